@@ -23,6 +23,7 @@ var (
 
 	upto = flag.Int("upto", 10*60, "upload timeout in Seconds")
 	dwto = flag.Int("dwto", 10*60, "download timeout in Seconds")
+	fetchPrivate = flag.Bool("fetchprivate", false, "allow import / pull url from loopback / private network")
 
 	addr = flag.String("l", ":4040", "bind addr & port")
 	crtFile = flag.String("crt", "", "https certificate file")
@@ -62,6 +63,17 @@ func main() {
 		return
 	}
 
+	err = webmap.MigrateAttachBlob(db)
+	if err != nil {
+		log.Println("[db]migrate attachment error", err)
+		return
+	}
+	err = webmap.MigrateGeoStats(db)
+	if err != nil {
+		log.Println("[db]migrate layer stats error", err)
+		return
+	}
+
 	if *ssusr != "" {
 		pwd := webmap.GenPWD(10)
 		db.AddShadowUser(*ssusr, pwd)
@@ -70,6 +82,7 @@ func main() {
 
 	webmap.GZIP_LV = *gzipLv
 	webmap.Verbosity = *verbosity
+	webmap.AttachFetchPrivate = *fetchPrivate
 	webmap.SetFileOutput(filepath.Join(*logDir, *syslogFile))
 	webmap.SetWebOutput(filepath.Join(*logDir, *logFile))
 
@@ -87,6 +100,10 @@ func main() {
 		IdleTimeout: 60 * time.Second,
 		MaxHeaderBytes: 1024*1024, // 1MB
 	}
+	srv.RegisterOnShutdown(web.CloseEvents) // Shutdown() not wait for event stream
+	if wto := srv.WriteTimeout * 9 / 10; wto > 0 && wto < webmap.EventStreamMax {
+		webmap.EventStreamMax = wto
+	}
 
 	idleConnsClosed := make(chan struct{})
 	go func() {
@@ -107,6 +124,7 @@ func main() {
 	<-idleConnsClosed
 
 	// flush & exit
+	web.Close()
 	db.Close()
 }
 
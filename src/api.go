@@ -9,6 +9,7 @@ var (
 	ErrItemExist = errors.New("item exist!")
 	ErrNotExist = errors.New("item not exist")
 	ErrTokenGen = errors.New("generate token fail")
+	ErrFileType = errors.New("file type not allow")
 )
 
 type API interface {
@@ -45,8 +46,14 @@ type API interface {
 	//GetAttachByAID(aid AttachID) *Attachment
 	DelAttachByAID(aid AttachID) error
 	UpdateAttach(attach *Attachment) error
+	ReplaceAttach(attach *Attachment) error // same as UpdateAttach, also bump VersionC for client cache
 	AddAttach(attach *Attachment) (AttachID, error) // auto set AID & token
+	UpdateAttachFetch(attach *Attachment) error // only update fetch status
+	UpdateAttachDerive(attach *Attachment) error // only update derived GeoJSON link & style
+	UpdateAttachCheck(aid AttachID, saveName string, st *FileCheck) error // only update verify state, skip if file changed
+	AttachRefs(saveName string) int // count of Attachment use the same blob
 	ListAttach() []*Attachment // return copy & clean up
+	ListAllAttach() []*Attachment // return copy, include hidden
 
 	// Hook
 	GetHookByToken(token string) *HookConfig // for download
@@ -56,6 +63,9 @@ type API interface {
 	AddHook(hk *HookConfig) (HookID, error) // auto set HID & token & AuthToken
 	UpdateHookConfig(hk *HookConfig) error // only update config
 	UpdateHook(hk *HookConfig) error
+	UpdateHookPullStatus(hk *HookConfig) error // only update pull status
+	SetHookStale(hid HookID, stale bool) error
+	UpdateHookCheck(hid HookID, saveName string, st *FileCheck) error // only update verify state, skip if file changed
 	ListHook() []*HookConfig // return copy & clean up
 
 	// Layer
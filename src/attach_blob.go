@@ -0,0 +1,240 @@
+package webmap
+
+/*
+* content-addressed storage for attachment
+* file saved as UploadFileDir/blob/{sha256}, shared by all Attachment with same content
+* ref count by AttachStore (SaveName), remove blob when last reference gone
+*/
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	AttachBlobDir = "blob"
+	AttachVersionMax = 5 // old versions keep for rollback
+
+	blobMx sync.Mutex // for add/remove blob & reference
+)
+
+func blobSaveName(hash string) string {
+	return AttachBlobDir + "/" + hash
+}
+
+func isBlobSaveName(saveName string) bool {
+	return strings.HasPrefix(saveName, AttachBlobDir + "/")
+}
+
+// file at UploadFileDir/attach.SaveName already hashed & verified
+// move into blob (or drop if same content exist) then add to db
+func addAttachFile(db API, attach *Attachment) (AttachID, error) {
+	blobMx.Lock()
+	defer blobMx.Unlock()
+
+	srcFp := filepath.Join(UploadFileDir, attach.SaveName)
+	err := moveToBlob(attach)
+	if err != nil {
+		os.Remove(srcFp)
+		return 0, err
+	}
+	attach.setStats()
+
+	aid, err := db.AddAttach(attach)
+	if err != nil {
+		attach.DelFromFS(UploadFileDir, db.AttachRefs(attach.SaveName))
+		return 0, err
+	}
+	return aid, nil
+}
+
+// remove from db, also blob if not used by other
+func delAttach(db API, attach *Attachment) error {
+	blobMx.Lock()
+	defer blobMx.Unlock()
+
+	err := db.DelAttachByAID(attach.ID)
+	if err != nil {
+		return err
+	}
+	for _, v := range attach.Versions {
+		releaseBlob(db, v.SaveName)
+	}
+	return attach.DelFromFS(UploadFileDir, db.AttachRefs(attach.SaveName))
+}
+
+// new content for exist token, current one move to Versions
+// newAttach same as addAttachFile(), return updated Attachment
+func replaceAttachFile(db API, token string, newAttach *Attachment) (*Attachment, error) {
+	blobMx.Lock()
+	defer blobMx.Unlock()
+
+	srcFp := filepath.Join(UploadFileDir, newAttach.SaveName)
+	attach0 := db.GetAttachByToken(token)
+	if attach0 == nil {
+		os.Remove(srcFp)
+		return nil, ErrNotExist
+	}
+	err := moveToBlob(newAttach)
+	if err != nil {
+		os.Remove(srcFp)
+		return nil, err
+	}
+	newAttach.setStats()
+
+	attach := attach0.Clone()
+	attach.Versions = append([]*AttachVersion{attach0.version()}, attach.Versions...)
+	attach.setVersion(newAttach.version())
+	return attach, updateVersions(db, attach0, attach)
+}
+
+// swap current with Versions[idx], can rollback again to undo
+func rollbackAttach(db API, token string, idx int) (*Attachment, error) {
+	blobMx.Lock()
+	defer blobMx.Unlock()
+
+	attach0 := db.GetAttachByToken(token)
+	if attach0 == nil {
+		return nil, ErrNotExist
+	}
+	if idx < 0 || idx >= len(attach0.Versions) {
+		return nil, ErrNotExist
+	}
+
+	attach := attach0.Clone()
+	v := attach.Versions[idx]
+	attach.Versions = append(attach.Versions[:idx], attach.Versions[idx+1:]...)
+	attach.Versions = append([]*AttachVersion{attach0.version()}, attach.Versions...)
+	attach.setVersion(v)
+	return attach, updateVersions(db, attach0, attach)
+}
+
+// save & remove blob no longer used, call with blobMx
+func updateVersions(db API, attach0 *Attachment, attach *Attachment) error {
+	drop := make([]*AttachVersion, 0, 1)
+	if len(attach.Versions) > AttachVersionMax {
+		drop = attach.Versions[AttachVersionMax:]
+		attach.Versions = attach.Versions[:AttachVersionMax]
+	}
+
+	err := db.ReplaceAttach(attach)
+	if err != nil {
+		releaseBlob(db, attach.SaveName)
+		return err
+	}
+	for _, v := range drop {
+		releaseBlob(db, v.SaveName)
+	}
+	if attach0.SaveName != attach.SaveName {
+		memCache.Del(attach0.cacheKey())
+	}
+	return nil
+}
+
+// remove blob if not used by any Attachment, call with blobMx
+func releaseBlob(db API, saveName string) {
+	if saveName == "" || db.AttachRefs(saveName) > 0 {
+		return
+	}
+	memCache.Del("dl/" + saveName)
+	err := os.Remove(filepath.Join(UploadFileDir, filepath.Clean("/" + saveName)[1:]))
+	if err != nil {
+		Vln(3, "[attach]remove blob error", saveName, err)
+	}
+}
+
+// call with blobMx
+func moveToBlob(attach *Attachment) error {
+	if attach.Checksum == "" {
+		return ErrFileHash
+	}
+	err := os.MkdirAll(filepath.Join(UploadFileDir, AttachBlobDir), 0755)
+	if err != nil {
+		return err
+	}
+
+	srcFp := filepath.Join(UploadFileDir, attach.SaveName)
+	saveName := blobSaveName(attach.Checksum)
+	saveFp := filepath.Join(UploadFileDir, saveName)
+
+	fi, err := os.Stat(saveFp)
+	switch {
+	case err == nil && fi.Size() == attach.Size && blobIntact(saveFp, attach.Checksum): // dedup
+		err = os.Remove(srcFp)
+		if err != nil {
+			return err
+		}
+		attach.FileMTime = fi.ModTime()
+
+	case err == nil: // broken blob, replace it
+		Vln(3, "[attach]replace broken blob", saveName, fi.Size(), attach.Size)
+		fallthrough
+	default:
+		err = os.Rename(srcFp, saveFp)
+		if err != nil {
+			return err
+		}
+	}
+	attach.SaveName = saveName
+	return nil
+}
+
+// blob content still match its name, new upload replace it if not
+func blobIntact(fp string, hash string) bool {
+	fd, err := os.Open(fp)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	h, ok := sha256fd(fd)
+	return ok && h == hash
+}
+
+// move old random named file into blob, run once before serve
+func MigrateAttachBlob(db API) error {
+	blobMx.Lock()
+	defer blobMx.Unlock()
+
+	var count, dedup int
+	for _, a := range db.ListAllAttach() {
+		if a.SaveName == "" || isBlobSaveName(a.SaveName) {
+			continue
+		}
+		srcFp := filepath.Join(UploadFileDir, filepath.Clean("/" + a.SaveName)[1:])
+		if a.Checksum == "" {
+			fd, err := os.Open(srcFp)
+			if err != nil {
+				Vln(3, "[attach]migrate open error", a.ID, a.SaveName, err)
+				continue
+			}
+			hash, ok := sha256fd(fd)
+			fd.Close()
+			if !ok {
+				Vln(3, "[attach]migrate hash error", a.ID, a.SaveName, hash)
+				continue
+			}
+			a.Checksum = hash
+		}
+
+		if _, err := os.Stat(filepath.Join(UploadFileDir, blobSaveName(a.Checksum))); err == nil {
+			dedup += 1
+		}
+		err := moveToBlob(a)
+		if err != nil {
+			Vln(3, "[attach]migrate move error", a.ID, a.SaveName, err)
+			continue
+		}
+		err = db.UpdateAttach(a)
+		if err != nil {
+			Vln(3, "[attach]migrate update error", a.ID, a.SaveName, err)
+			return err
+		}
+		count += 1
+	}
+	if count > 0 {
+		Vln(2, "[attach]migrate to blob storage", count, "dedup", dedup)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package webmap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAttachBlob(t *testing.T) {
+	dir, done := tempStorage(t, "attach-blob")
+	defer done()
+
+	db := NewDataStore()
+	data := []byte("same shapefile")
+	hash, _ := sha256fd(bytes.NewReader(data))
+
+	add := func(name string) *Attachment {
+		a := NewAttachment(name, int64(len(data)))
+		a.Checksum = hash
+		ioutil.WriteFile(filepath.Join(dir, a.SaveName), data, 0644)
+		if _, err := addAttachFile(db, a); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	a1 := add("a.zip")
+	a2 := add("b.zip")
+
+	blobFp := filepath.Join(dir, blobSaveName(hash))
+	if a1.SaveName != a2.SaveName || db.AttachRefs(a1.SaveName) != 2 {
+		t.Fatal("same content should share blob", a1.SaveName, a2.SaveName, db.AttachRefs(a1.SaveName))
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 { // only blob dir
+		t.Fatal("temp file should be removed", len(files))
+	}
+
+	// corrupted blob with same size, replaced by new upload
+	ioutil.WriteFile(blobFp, []byte("same shapefilX"), 0644)
+	a3 := add("c.zip")
+	if buf, _ := ioutil.ReadFile(blobFp); !bytes.Equal(buf, data) {
+		t.Fatal("corrupted blob should be replaced", string(buf))
+	}
+	delAttach(db, a3)
+
+	delAttach(db, a1)
+	if _, err := os.Stat(blobFp); err != nil {
+		t.Fatal("blob still used", err)
+	}
+	delAttach(db, a2)
+	if _, err := os.Stat(blobFp); !os.IsNotExist(err) {
+		t.Fatal("last reference gone, blob should be removed", err)
+	}
+
+	// old random named file
+	old := NewAttachment("old.json", int64(len(data)))
+	ioutil.WriteFile(filepath.Join(dir, old.SaveName), data, 0644)
+	db.AddAttach(old)
+	if err := MigrateAttachBlob(db); err != nil {
+		t.Fatal(err)
+	}
+	old = db.GetAttachByToken(old.Token)
+	if old.SaveName != blobSaveName(hash) || old.Checksum != hash || db.AttachRefs(old.SaveName) != 1 {
+		t.Fatal("migrate fail", old.SaveName, old.Checksum)
+	}
+	if _, err := os.Stat(blobFp); err != nil {
+		t.Fatal("blob not exist after migrate", err)
+	}
+}
+
+func TestAttachReplace(t *testing.T) {
+	dir, done := tempStorage(t, "attach-replace")
+	defer done()
+	AttachVersionMax0 := AttachVersionMax
+	AttachVersionMax = 2
+	defer func() { AttachVersionMax = AttachVersionMax0 }()
+
+	db := NewDataStore()
+	newFile := func(data string) *Attachment {
+		a := NewAttachment("data.geojson", int64(len(data)))
+		a.Checksum, _ = sha256fd(bytes.NewReader([]byte(data)))
+		ioutil.WriteFile(filepath.Join(dir, a.SaveName), []byte(data), 0644)
+		return a
+	}
+	exist := func(a *AttachVersion) bool {
+		_, err := os.Stat(filepath.Join(dir, a.SaveName))
+		return err == nil
+	}
+
+	a := newFile("v1")
+	addAttachFile(db, a)
+	token := a.Token
+	verC := db.GetConfig().VersionC
+
+	for _, data := range []string{"v2", "v3", "v4"} {
+		if _, err := replaceAttachFile(db, token, newFile(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a = db.GetAttachByToken(token)
+	v4, _ := sha256fd(bytes.NewReader([]byte("v4")))
+	if a.Checksum != v4 || len(a.Versions) != 2 {
+		t.Fatal("should keep token with new content", a.Checksum, len(a.Versions))
+	}
+	if db.GetConfig().VersionC == verC {
+		t.Fatal("cache version should change")
+	}
+	v1, _ := sha256fd(bytes.NewReader([]byte("v1")))
+	if _, err := os.Stat(filepath.Join(dir, blobSaveName(v1))); !os.IsNotExist(err) {
+		t.Fatal("version over limit should be removed", err)
+	}
+
+	// rollback to v2, v4 become old version
+	v2 := a.Versions[1]
+	a, err := rollbackAttach(db, token, 1)
+	if err != nil || a.Checksum != v2.Checksum || a.Versions[0].Checksum != v4 {
+		t.Fatal("rollback", err, a)
+	}
+	for _, v := range append(a.Versions, a.version()) {
+		if !exist(v) {
+			t.Fatal("blob should exist", v.SaveName)
+		}
+	}
+
+	all := a.blobs()
+	delAttach(db, a)
+	for _, sn := range all {
+		if _, err := os.Stat(filepath.Join(dir, sn)); !os.IsNotExist(err) {
+			t.Fatal("all versions should be removed", sn)
+		}
+	}
+}
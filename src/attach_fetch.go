@@ -0,0 +1,372 @@
+package webmap
+
+/*
+* import attachment from remote URL, server download instead of re-upload by user
+* optional re-fetch by Attachment.FetchCron, new content saved by replaceAttachFile (keep versions)
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	AttachFetchInterval = 60 * time.Second // check schedule period
+	AttachFetchTimeout = 5 * time.Minute // whole download
+	AttachFetchUA = "Mozilla/5.0 (dynmap attach fetcher)"
+	AttachFetchPrivate = false // allow loopback / private / link-local address, for intranet only
+
+	ErrFetchURL = errors.New("invalid url, only http/https")
+	ErrFetchAddr = errors.New("address not allowed")
+	ErrFetchRunning = errors.New("fetch already running")
+)
+
+type AttachFetcher struct {
+	db API
+	die chan struct{}
+	wg sync.WaitGroup // loop & running fetch
+
+	mx sync.Mutex
+	running map[string]bool // by URL for import, by Token for re-fetch
+}
+
+// downloaded file in UploadFileDir, not checked yet
+type fetchResult struct {
+	file *os.File
+	name string
+	size int64
+	hash string
+	etag string
+	lastMod string
+}
+
+func NewAttachFetcher(db API) *AttachFetcher {
+	return &AttachFetcher{
+		db: db,
+		die: make(chan struct{}),
+		running: make(map[string]bool),
+	}
+}
+
+func (f *AttachFetcher) Start() {
+	f.wg.Add(1)
+	go f.loop()
+}
+
+// stop schedule & wait running fetch
+func (f *AttachFetcher) Close() {
+	select {
+	case <-f.die:
+	default:
+		close(f.die)
+	}
+	f.wg.Wait()
+}
+
+func (f *AttachFetcher) loop() {
+	defer f.wg.Done()
+	ticker := time.NewTicker(AttachFetchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.die:
+			return
+		case <-ticker.C:
+		}
+		f.checkAll(time.Now())
+	}
+}
+
+func (f *AttachFetcher) checkAll(now time.Time) {
+	for _, a := range f.db.ListAllAttach() {
+		if !isFetchDue(a, now) {
+			continue
+		}
+		f.wg.Add(1)
+		go func(token string) {
+			defer f.wg.Done()
+			_, err := f.Fetch(token)
+			if err != nil && err != ErrFetchRunning {
+				Vln(3, "[attach][fetch]err", token, err)
+			}
+		}(a.Token)
+	}
+}
+
+func isFetchDue(a *Attachment, now time.Time) bool {
+	if a.Hide || a.SourceURL == "" || a.FetchCron == "" {
+		return false
+	}
+	spec, err := ParseCron(a.FetchCron)
+	if err != nil {
+		return false
+	}
+	next := spec.Next(a.FetchTime)
+	return !next.IsZero() && !now.Before(next)
+}
+
+func (f *AttachFetcher) lock(key string) bool {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.running[key] {
+		return false
+	}
+	f.running[key] = true
+	return true
+}
+
+func (f *AttachFetcher) unlock(key string) {
+	f.mx.Lock()
+	delete(f.running, key)
+	f.mx.Unlock()
+}
+
+// download & add new Attachment, cron: re-fetch schedule, empty for once
+func (f *AttachFetcher) Import(rawURL string, cron string, u *User) (*Attachment, error) {
+	if !f.lock(rawURL) {
+		return nil, ErrFetchRunning
+	}
+	defer f.unlock(rawURL)
+
+	res, err := f.get(rawURL, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(res.file.Name()) // not used if moved
+	defer res.file.Close()
+
+	err = checkUpload(f.db, StorageAttach, u.ID, res.size, 0)
+	if err != nil {
+		return nil, err
+	}
+	attach, err := moveAttachFile(res.file, res.name, res.size, res.hash, f.db.GetConfig().attachAllow())
+	if err != nil {
+		return nil, err
+	}
+	attach.UploadUID = u.ID
+	attach.UploaderName = u.Name
+	attach.SourceURL = rawURL
+	attach.FetchCron = cron
+	attach.FetchTime = time.Now()
+	attach.FetchETag = res.etag
+	attach.FetchLastMod = res.lastMod
+	_, err = addAttachFile(f.db, attach)
+	if err != nil {
+		return nil, err
+	}
+	deriveAsync(f.db, attach.Token)
+	return attach, nil
+}
+
+// download SourceURL again, replace content if changed
+// return true if content changed
+func (f *AttachFetcher) Fetch(token string) (bool, error) {
+	if !f.lock(token) {
+		return false, ErrFetchRunning
+	}
+	defer f.unlock(token)
+
+	attach0 := f.db.GetAttachByToken(token)
+	if attach0 == nil || attach0.SourceURL == "" {
+		return false, ErrNotExist
+	}
+
+	changed, etag, lastMod, err := f.refetch(attach0)
+
+	st := f.db.GetAttachByToken(token)
+	if st == nil { // deleted when fetching
+		return false, ErrNotExist
+	}
+	st = st.Clone()
+	st.FetchTime = time.Now()
+	st.FetchErr = ""
+	if err != nil {
+		st.FetchErr = err.Error()
+	}
+	if err == nil && (etag != "" || lastMod != "") {
+		st.FetchETag = etag
+		st.FetchLastMod = lastMod
+	}
+	if err2 := f.db.UpdateAttachFetch(st); err2 != nil {
+		return false, err2
+	}
+	if changed {
+		Vln(4, "[attach][fetch]updated", token, attach0.SourceURL)
+	}
+	return changed, err
+}
+
+func (f *AttachFetcher) refetch(attach0 *Attachment) (changed bool, etag string, lastMod string, err error) {
+	res, err := f.get(attach0.SourceURL, attach0.FetchETag, attach0.FetchLastMod)
+	if err != nil || res == nil { // nil for not modified
+		return false, "", "", err
+	}
+	defer os.Remove(res.file.Name())
+	defer res.file.Close()
+
+	if res.hash == attach0.Checksum {
+		return false, res.etag, res.lastMod, nil
+	}
+
+	err = checkUpload(f.db, StorageAttach, attach0.UploadUID, res.size, 0)
+	if err != nil {
+		return false, "", "", err
+	}
+	newAttach, err := moveAttachFile(res.file, res.name, res.size, res.hash, f.db.GetConfig().attachAllow())
+	if err != nil {
+		return false, "", "", err
+	}
+	newAttach.UploadUID = attach0.UploadUID
+	newAttach.UploaderName = attach0.UploaderName
+	_, err = replaceAttachFile(f.db, attach0.Token, newAttach)
+	if err != nil {
+		return false, "", "", err
+	}
+	deriveAsync(f.db, attach0.Token)
+	return true, res.etag, res.lastMod, nil
+}
+
+// conditional GET if etag / lastMod set, nil result for 304
+func (f *AttachFetcher) get(rawURL string, etag string, lastMod string) (*fetchResult, error) {
+	if !isFetchURL(rawURL) {
+		return nil, ErrFetchURL
+	}
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", AttachFetchUA)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastMod != "" {
+		req.Header.Set("If-Modified-Since", lastMod)
+	}
+
+	client := &http.Client{
+		Timeout: AttachFetchTimeout,
+		Transport: fetchTransport,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		return nil, fmt.Errorf("http status %v", resp.Status)
+	}
+
+	limit := f.db.GetConfig().attachSizeLimit()
+	if resp.ContentLength > limit {
+		return nil, ErrFileTooLarge
+	}
+
+	err = os.MkdirAll(UploadFileDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(UploadFileDir, "fetch-")
+	if err != nil {
+		return nil, err
+	}
+	hash, err := cpAndHashFd(tmp, io.LimitReader(resp.Body, limit+1))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = tmp.Stat()
+	}
+	if err == nil && fi.Size() > limit {
+		err = ErrFileTooLarge
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, 0)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return &fetchResult{
+		file: tmp,
+		name: pullFileName(resp),
+		size: fi.Size(),
+		hash: hash,
+		etag: resp.Header.Get("ETag"),
+		lastMod: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+func isFetchURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+// check address after DNS resolve, also for redirect
+var fetchTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout: 30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !AttachFetchPrivate && !isPublicIP(net.ParseIP(host)) {
+				return ErrFetchAddr
+			}
+			return nil
+		},
+	}).DialContext,
+	MaxIdleConns: 10,
+	IdleConnTimeout: 90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+var privateNets = func() []*net.IPNet {
+	list := []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	}
+	out := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		_, n, _ := net.ParseCIDR(s)
+		out = append(out, n)
+	}
+	return out
+}()
+
+func isPublicIP(ip net.IP) bool {
+	if ip == nil || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
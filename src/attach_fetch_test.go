@@ -0,0 +1,108 @@
+package webmap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAttachFetch(t *testing.T) {
+	dir, done := tempStorage(t, "attach-fetch")
+	defer done()
+
+	var mx sync.Mutex
+	etag := `"v1"`
+	payload := []byte(`{"type":"FeatureCollection","features":[]}`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		switch r.URL.Path {
+		case "/exe":
+			w.Write(append([]byte("MZ"), make([]byte, 62)...))
+			return
+		case "/big":
+			w.Write(bytes.Repeat([]byte(" "), 2 * 1024 * 1024))
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Disposition", `attachment; filename="river.geojson"`)
+		w.Write(payload)
+	}))
+	defer srv.Close()
+
+	if _, err := NewAttachFetcher(NewDataStore()).get(srv.URL, "", ""); err == nil || !strings.Contains(err.Error(), ErrFetchAddr.Error()) {
+		t.Fatal("loopback should not allowed", err)
+	}
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "169.254.169.254", "192.168.0.1", "::1", "fe80::1", "::ffff:172.16.0.1", "0.0.0.0"} {
+		if isPublicIP(net.ParseIP(ip)) {
+			t.Fatal("should be private", ip)
+		}
+	}
+	if !isPublicIP(net.ParseIP("8.8.8.8")) || !isPublicIP(net.ParseIP("2001:4860::8888")) {
+		t.Fatal("should be public")
+	}
+	AttachFetchPrivate = true
+	defer func() { AttachFetchPrivate = false }()
+
+	db := NewDataStore()
+	conf := db.GetConfig().Clone()
+	conf.AttachSizeLimit = 1
+	db.SetConfig(conf)
+	u := &User{ID: 1, Name: "editor"}
+	f := NewAttachFetcher(db)
+
+	a, err := f.Import(srv.URL + "/data", "@every 1h", u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = db.GetAttachByToken(a.Token)
+	hash, _ := sha256fd(bytes.NewReader(payload))
+	if a.OriginalName != "river.geojson" || a.Checksum != hash || a.SourceURL != srv.URL + "/data" || a.FetchETag != `"v1"` || a.UploaderName != "editor" {
+		t.Fatal("import record", a)
+	}
+	if isFetchDue(a, time.Now()) || !isFetchDue(a, time.Now().Add(2 * time.Hour)) {
+		t.Fatal("schedule")
+	}
+
+	changed, err := f.Fetch(a.Token)
+	if err != nil || changed {
+		t.Fatal("not modified", changed, err)
+	}
+
+	mx.Lock()
+	etag = `"v2"`
+	payload = []byte(`{"type":"FeatureCollection","features":[{}]}`)
+	mx.Unlock()
+	changed, err = f.Fetch(a.Token)
+	if err != nil || !changed {
+		t.Fatal("should replace content", changed, err)
+	}
+	a = db.GetAttachByToken(a.Token)
+	if len(a.Versions) != 1 || a.Checksum == hash || a.FetchETag != `"v2"` || a.SourceURL == "" {
+		t.Fatal("replace keep source & old version", a)
+	}
+
+	if _, err := f.Import(srv.URL + "/exe", "", u); err != ErrFileType {
+		t.Fatal("exe should reject", err)
+	}
+	if _, err := f.Import(srv.URL + "/big", "", u); err != ErrFileTooLarge {
+		t.Fatal("size limit", err)
+	}
+	if _, err := f.Import("file:///etc/passwd", "", u); err != ErrFetchURL {
+		t.Fatal("scheme", err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 { // only blob dir, no temp file left
+		t.Fatal("temp file should be removed", len(files))
+	}
+}
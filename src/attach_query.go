@@ -0,0 +1,218 @@
+package webmap
+
+/*
+* search, filter, sort & cursor pagination for attachment list
+*/
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	AttachPageSize = 50
+	AttachPageMax = 500
+	AttachTagMax = 20
+)
+
+type AttachQuery struct {
+	Q string // keyword in name, description, tag, token
+	Tag string // exact tag
+	Kind string // FileType.Kind
+	UID UserID
+	Hide bool // include hidden
+	Sort string // 'time', 'name', 'size'
+	Asc bool
+	Limit int
+	Cursor *attachCursor
+}
+
+// last item of previous page
+type attachCursor struct {
+	ID AttachID `json:"i"`
+	Time time.Time `json:"t,omitempty"`
+	Name string `json:"n,omitempty"`
+	Size int64 `json:"s,omitempty"`
+}
+
+type AttachPage struct {
+	Data []*AttachItem `json:"data"`
+	Next string `json:"next,omitempty"` // cursor for next page, empty for end
+	Total int `json:"total"` // match count
+}
+
+// ?q=&tag=&kind=&uid=&hide=1&sort=name&asc=1&limit=50&cursor=
+func parseAttachQuery(v url.Values) *AttachQuery {
+	q := &AttachQuery{
+		Q: strings.TrimSpace(v.Get("q")),
+		Tag: strings.TrimSpace(v.Get("tag")),
+		Kind: v.Get("kind"),
+		Hide: v.Get("hide") == "1",
+		Sort: v.Get("sort"),
+		Asc: v.Get("asc") == "1",
+		Limit: AttachPageSize,
+	}
+	if uid, err := strconv.ParseUint(v.Get("uid"), 10, 64); err == nil {
+		q.UID = UserID(uid)
+	}
+	switch q.Sort {
+	case "name", "size", "time":
+	default:
+		q.Sort = "time"
+	}
+	if n, err := strconv.Atoi(v.Get("limit")); err == nil && n > 0 {
+		q.Limit = n
+	}
+	if q.Limit > AttachPageMax {
+		q.Limit = AttachPageMax
+	}
+	if c := v.Get("cursor"); c != "" {
+		buf, err := base64.RawURLEncoding.DecodeString(c)
+		if err == nil {
+			cur := &attachCursor{}
+			if json.Unmarshal(buf, cur) == nil {
+				q.Cursor = cur
+			}
+		}
+	}
+	return q
+}
+
+func (q *AttachQuery) match(a *Attachment) bool {
+	if a.Hide && !q.Hide {
+		return false
+	}
+	if q.Kind != "" && a.Kind != q.Kind {
+		return false
+	}
+	if q.UID != 0 && a.UploadUID != q.UID {
+		return false
+	}
+	if q.Tag != "" && !a.HasTag(q.Tag) {
+		return false
+	}
+	if q.Q == "" {
+		return true
+	}
+	if a.Token == q.Q { // token is case sensitive
+		return true
+	}
+	kw := strings.ToLower(q.Q)
+	if strings.Contains(strings.ToLower(a.OriginalName), kw) || strings.Contains(strings.ToLower(a.Desc), kw) {
+		return true
+	}
+	for _, t := range a.Tags {
+		if strings.Contains(strings.ToLower(t), kw) {
+			return true
+		}
+	}
+	return false
+}
+
+// a before b in result order, tie break by ID
+func (q *AttachQuery) less(a *attachCursor, b *attachCursor) bool {
+	cmp := 0
+	switch q.Sort {
+	case "name":
+		cmp = strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	case "size":
+		switch {
+		case a.Size < b.Size:
+			cmp = -1
+		case a.Size > b.Size:
+			cmp = 1
+		}
+	default:
+		switch {
+		case a.Time.Before(b.Time):
+			cmp = -1
+		case a.Time.After(b.Time):
+			cmp = 1
+		}
+	}
+	if cmp == 0 {
+		switch {
+		case a.ID < b.ID:
+			cmp = -1
+		case a.ID > b.ID:
+			cmp = 1
+		}
+	}
+	if q.Asc {
+		return cmp < 0
+	}
+	return cmp > 0
+}
+
+func (q *AttachQuery) key(a *Attachment) *attachCursor {
+	c := &attachCursor{ID: a.ID}
+	switch q.Sort {
+	case "name":
+		c.Name = a.OriginalName
+	case "size":
+		c.Size = a.Size
+	default:
+		c.Time = a.UploadTime
+	}
+	return c
+}
+
+// list should be copy, SaveName will not clean up here
+func (q *AttachQuery) Apply(list []*Attachment) *AttachPage {
+	out := make([]*Attachment, 0, len(list))
+	for _, a := range list {
+		if q.match(a) {
+			out = append(out, a)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return q.less(q.key(out[i]), q.key(out[j]))
+	})
+
+	page := &AttachPage{
+		Total: len(out),
+	}
+	if q.Cursor != nil {
+		i := sort.Search(len(out), func(i int) bool {
+			return q.less(q.Cursor, q.key(out[i]))
+		})
+		out = out[i:]
+	}
+	if len(out) > q.Limit {
+		out = out[:q.Limit]
+		buf, _ := json.Marshal(q.key(out[len(out) - 1]))
+		page.Next = base64.RawURLEncoding.EncodeToString(buf)
+	}
+	page.Data = make([]*AttachItem, 0, len(out))
+	for _, a := range out {
+		page.Data = append(page.Data, &AttachItem{Attachment: a})
+	}
+	return page
+}
+
+// "a, b,,a" -> [a b]
+func parseTags(s string) []string {
+	out := make([]string, 0, 4)
+	seen := make(map[string]bool)
+	s = strings.Replace(s, "，", ",", -1)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+		if len(out) >= AttachTagMax {
+			break
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
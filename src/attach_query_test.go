@@ -0,0 +1,92 @@
+package webmap
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAttachQuery(t *testing.T) {
+	t0 := time.Now()
+	list := make([]*Attachment, 0, 10)
+	for i := 1; i <= 10; i++ {
+		a := &Attachment{
+			ID: AttachID(i),
+			Token: "tk" + strconv.Itoa(i),
+			OriginalName: "file" + strconv.Itoa(i) + ".zip",
+			Size: int64(i % 3),
+			UploadTime: t0.Add(time.Duration(i) * time.Minute),
+		}
+		if i % 2 == 0 {
+			a.Tags = []string{"河川", "2020"}
+			a.Desc = "水位站"
+		}
+		list = append(list, a)
+	}
+	list[9].Hide = true
+
+	// page by cursor until end
+	v := url.Values{"limit": {"3"}}
+	seen := make([]AttachID, 0, 10)
+	for i := 0; i < 10; i++ {
+		p := parseAttachQuery(v).Apply(list)
+		if p.Total != 9 {
+			t.Fatal("hidden should not count", p.Total)
+		}
+		for _, a := range p.Data {
+			seen = append(seen, a.ID)
+		}
+		if p.Next == "" {
+			break
+		}
+		v.Set("cursor", p.Next)
+	}
+	if len(seen) != 9 || seen[0] != 9 || seen[8] != 1 {
+		t.Fatal("newest first & no duplicate", seen)
+	}
+
+	// sort by size with many equal keys
+	v = url.Values{"limit": {"2"}, "sort": {"size"}, "asc": {"1"}, "hide": {"1"}}
+	seen = seen[:0]
+	for i := 0; i < 10; i++ {
+		p := parseAttachQuery(v).Apply(list)
+		for _, a := range p.Data {
+			seen = append(seen, a.ID)
+		}
+		if p.Next == "" {
+			break
+		}
+		v.Set("cursor", p.Next)
+	}
+	if len(seen) != 10 || seen[0] != 3 {
+		t.Fatal("sort by size", seen)
+	}
+
+	p := parseAttachQuery(url.Values{"q": {"水位"}}).Apply(list)
+	if p.Total != 4 { // 10 is hidden
+		t.Fatal("search description", p.Total)
+	}
+	list[2].Token = "Tk3X" // token is mixed case
+	p = parseAttachQuery(url.Values{"q": {"Tk3X"}}).Apply(list)
+	if p.Total != 1 || p.Data[0].Token != "Tk3X" {
+		t.Fatal("search token", p.Total)
+	}
+	p = parseAttachQuery(url.Values{"q": {"tk3x"}}).Apply(list)
+	if p.Total != 0 {
+		t.Fatal("token should match exactly", p.Total)
+	}
+	p = parseAttachQuery(url.Values{"q": {"FILE3."}}).Apply(list)
+	if p.Total != 1 {
+		t.Fatal("search name ignore case", p.Total)
+	}
+	p = parseAttachQuery(url.Values{"tag": {"河川"}, "hide": {"1"}}).Apply(list)
+	if p.Total != 5 {
+		t.Fatal("filter tag", p.Total)
+	}
+
+	tags := parseTags(" a，b,,a , c")
+	if len(tags) != 3 || tags[1] != "b" {
+		t.Fatal("parse tags", tags)
+	}
+}
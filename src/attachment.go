@@ -20,64 +20,207 @@ type Attachment struct {
 	Token string `json:"token"` // unique
 
 	UploadUID UserID `json:"uid,omitempty"`
+	UploaderName string `json:"uname,omitempty"` // display name when upload
 
 	OriginalName string `json:"on"`
 	Size int64 `json:"sz"`
 	UploadTime time.Time `json:"time"` // also for Last-Modified
 	Checksum string `json:"hash"` // also for ETag
 
-	SaveName string `json:"sn,omitempty"` // time + random + hash
+	SaveName string `json:"sn,omitempty"` // "blob/" + sha256, shared by same content
+
+	Kind string `json:"kind,omitempty"` // sniffed when upload, see FileType
+	MIME string `json:"mime,omitempty"`
+
+	// set by edit
+	Desc string `json:"desc,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+
+	// set by import, re-fetch by FetchCron if not empty
+	SourceURL string `json:"surl,omitempty"`
+	FetchCron string `json:"fcron,omitempty"`
+	FetchTime time.Time `json:"ftime,omitempty"` // last try
+	FetchErr string `json:"ferr,omitempty"`
+	FetchETag string `json:"fetag,omitempty"`
+	FetchLastMod string `json:"flm,omitempty"`
+
+	// GeoJSON converted from this, or source of this one
+	Derived string `json:"derived,omitempty"` // Token
+	DerivedFrom string `json:"from,omitempty"` // Token
+	ConvErr string `json:"converr,omitempty"`
+	Style *AttachStyle `json:"style,omitempty"` // default for new layer, from KML style
+	Table *TableConf `json:"table,omitempty"` // how to read point table, set by convert
+	SrcCRS string `json:"srccrs,omitempty"` // EPSG code, override .prj / crs member / guess
+	Report *ConvReport `json:"report,omitempty"` // failed row of point table
+	Stats *GeoStats `json:"stats,omitempty"` // GeoJSON only, set when saved
+	NoStats bool `json:"nostats,omitempty"` // JSON but not GeoJSON, not retry by MigrateGeoStats
+
+	// set by replace, newest first
+	Versions []*AttachVersion `json:"vers,omitempty"`
 
 	Hide bool `json:"hide,omitempty"` // mark as delete
 
+	FileCheck
+
 //	Gzipped bool `json:"gzip,omitempty"` // gzipped on disk
 //	GzSize int64 `json:"gzsz,omitempty"`
 //	GzChecksum string `json:"gzhash,omitempty"`
 }
 
+// layer color in LayerGroup format
+type AttachStyle struct {
+	Color string `json:"color,omitempty"`
+	FillColor string `json:"fillcolor,omitempty"`
+	Opacity float32 `json:"opacity,omitempty"`
+}
+
+// previous content of Attachment, for rollback
+type AttachVersion struct {
+	OriginalName string `json:"on"`
+	Size int64 `json:"sz"`
+	UploadTime time.Time `json:"time"`
+	Checksum string `json:"hash"`
+	SaveName string `json:"sn,omitempty"`
+	Kind string `json:"kind,omitempty"`
+	MIME string `json:"mime,omitempty"`
+	UploadUID UserID `json:"uid,omitempty"`
+	UploaderName string `json:"uname,omitempty"`
+	Stats *GeoStats `json:"stats,omitempty"`
+	NoStats bool `json:"nostats,omitempty"`
+	FileCheck
+}
+
 func (s *Attachment) Clone() *Attachment {
 	s2 := *s
+	if s.Versions != nil {
+		s2.Versions = make([]*AttachVersion, 0, len(s.Versions))
+		for _, v := range s.Versions {
+			v2 := *v
+			s2.Versions = append(s2.Versions, &v2)
+		}
+	}
 	return &s2
 }
 
-func (a *Attachment) DelFromFS(baseDir string) error {
+// remove not necessary info for api output, should be copy
+func (a *Attachment) cleanUp() {
+	a.SaveName = ""
+	for _, v := range a.Versions {
+		v.SaveName = ""
+	}
+}
+
+func (a *Attachment) version() *AttachVersion {
+	return &AttachVersion{
+		OriginalName: a.OriginalName,
+		Size: a.Size,
+		UploadTime: a.UploadTime,
+		Checksum: a.Checksum,
+		SaveName: a.SaveName,
+		Kind: a.Kind,
+		MIME: a.MIME,
+		UploadUID: a.UploadUID,
+		UploaderName: a.UploaderName,
+		Stats: a.Stats,
+		NoStats: a.NoStats,
+		FileCheck: a.FileCheck,
+	}
+}
+
+func (a *Attachment) setVersion(v *AttachVersion) {
+	a.OriginalName = v.OriginalName
+	a.Size = v.Size
+	a.UploadTime = v.UploadTime
+	a.Checksum = v.Checksum
+	a.SaveName = v.SaveName
+	a.Kind = v.Kind
+	a.MIME = v.MIME
+	a.UploadUID = v.UploadUID
+	a.UploaderName = v.UploaderName
+	a.Stats = v.Stats
+	a.NoStats = v.NoStats
+	a.FileCheck = v.FileCheck
+}
+
+// SaveName of current & old versions
+func (a *Attachment) blobs() []string {
+	out := make([]string, 0, len(a.Versions) + 1)
+	out = append(out, a.SaveName)
+	for _, v := range a.Versions {
+		out = append(out, v.SaveName)
+	}
+	return out
+}
+
+// refs: other Attachment still use the same blob, only remove when 0
+func (a *Attachment) DelFromFS(baseDir string, refs int) error {
+	if refs > 0 {
+		return nil
+	}
+	memCache.Del(a.cacheKey())
 	saveFp := filepath.Join(baseDir, a.SaveName)
 	return os.Remove(saveFp)
 }
 
-func (a *Attachment) ServeContent(w http.ResponseWriter, r *http.Request, baseDir string) {
+func (a *Attachment) HasTag(tag string) bool {
+	for _, t := range a.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Attachment) cacheKey() string {
+	return "dl/" + a.SaveName
+}
+
+func (a *Attachment) fileType() *FileType {
+	if a.MIME == "" { // upload before sniffing
+		return fileTypeByName(a.OriginalName)
+	}
+	return &FileType{a.Kind, a.MIME}
+}
+
+func (a *Attachment) setFileType(ft *FileType) {
+	a.Kind = ft.Kind
+	a.MIME = ft.MIME
+}
+
+// return true if file need check by scrubber
+func (a *Attachment) ServeContent(w http.ResponseWriter, r *http.Request, baseDir string) bool {
 	saveName := filepath.Clean("/" + a.SaveName)[1:] // clean again for SaveName in db tamper by other program
 	saveFp := filepath.Join(baseDir, saveName)
 
 	fi, err := os.Stat(saveFp)
 	if err != nil {
 		http.Error(w, "404 not found", http.StatusNotFound)
-		return
+		return !a.Corrupt
+	}
+	// full checksum by scrubber, only check size & mtime here
+	ok, suspect := a.quickCheck(fi, a.Size)
+	if !ok { // report to admin, not visitor
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return suspect
 	}
-	szCk := a.Size
-//	if a.Gzipped {
-//		szCk = a.GzSize
-//	}
-	if fi.Size() != szCk {
-		http.Error(w, "419 Checksum failed", 419)
-		return
+
+	ft := a.fileType()
+	setSafeHeader(w, ft, a.OriginalName)
+
+	if memCache.ServeFile(w, r, a.cacheKey(), saveFp, ft.MIME, a.Size, a.UploadTime, a.Checksum) { // small file
+		return suspect
 	}
 
 	fd, err := os.OpenFile(saveFp, os.O_RDONLY, 0400)
 	if err != nil {
 		http.Error(w, "404 not found", http.StatusNotFound)
-		return
+		return suspect
 	}
 	defer fd.Close()
 
-	// checksum check
-	sha256, ok := sha256fd(fd)
-	if !ok || sha256 != a.Checksum {
-		http.Error(w, "419 Checksum failed", 419)
-		return
-	}
 	w.Header().Set("Etag", `"` + a.Checksum + `"`)
 	http.ServeContent(w, r, a.OriginalName, a.UploadTime, fd)
+	return suspect
 }
 
 // Token & ID fill by ADD() api
@@ -107,6 +250,7 @@ type AttachStore struct {
 	mx sync.RWMutex
 	list map[AttachID]*Attachment
 	lut  map[string]*Attachment // for download
+	refs map[string]int // SaveName => count
 	nextID uint64
 
 	slist atomic.Value //[]*Attachment // cache for api output
@@ -116,6 +260,7 @@ func NewAttachStore() *AttachStore {
 	s := &AttachStore {
 		list: make(map[AttachID]*Attachment),
 		lut: make(map[string]*Attachment),
+		refs: make(map[string]int),
 		nextID: 1,
 	}
 	return s
@@ -157,6 +302,7 @@ func (ls *AttachStore) UnmarshalJSON(in []byte) error {
 	ls.nextID = data.Next
 	ls.list = make(map[AttachID]*Attachment, len(data.Data))
 	ls.lut = make(map[string]*Attachment, len(data.Data))
+	ls.refs = make(map[string]int, len(data.Data))
 	for _, obj := range data.Data {
 		id := obj.ID
 		if ls.list[id] != nil {
@@ -168,6 +314,7 @@ func (ls *AttachStore) UnmarshalJSON(in []byte) error {
 		}
 		ls.list[id] = obj
 		ls.lut[token] = obj
+		ls.ref(obj, 1)
 	}
 
 	ls.updateSortList()
@@ -206,6 +353,7 @@ func (ls *AttachStore) Add(obj *Attachment) (AttachID, error) {
 	obj.ID = id
 	ls.list[id] = obj
 	ls.lut[obj.Token] = obj
+	ls.ref(obj, 1)
 	ls.nextID += 1
 
 	ls.updateSortList()
@@ -227,6 +375,8 @@ func (s *AttachStore) Set(obj *Attachment) error { // replace by AID & Token, AI
 		return ErrNotExist
 	}
 
+	s.ref(s.list[id], -1)
+	s.ref(obj, 1)
 	s.list[id] = obj
 	s.lut[token] = obj
 
@@ -235,6 +385,66 @@ func (s *AttachStore) Set(obj *Attachment) error { // replace by AID & Token, AI
 	return nil
 }
 
+func (s *AttachStore) SetFetch(obj *Attachment) error { // replace by AID, only change fetch status
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	obj0, ok := s.list[obj.ID]
+	if !ok {
+		return ErrNotExist
+	}
+
+	obj0.FetchTime = obj.FetchTime
+	obj0.FetchErr = obj.FetchErr
+	obj0.FetchETag = obj.FetchETag
+	obj0.FetchLastMod = obj.FetchLastMod
+
+	s.updateSortList()
+
+	return nil
+}
+
+func (s *AttachStore) SetDerive(obj *Attachment) error { // replace by AID, only change derived link
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	obj0, ok := s.list[obj.ID]
+	if !ok {
+		return ErrNotExist
+	}
+	obj0.Derived = obj.Derived
+	obj0.Style = obj.Style
+	obj0.Table = obj.Table
+	obj0.SrcCRS = obj.SrcCRS
+	obj0.Report = obj.Report
+	obj0.ConvErr = obj.ConvErr
+
+	s.updateSortList()
+
+	return nil
+}
+
+func (s *AttachStore) SetCheck(id AttachID, saveName string, st *FileCheck) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	obj0, ok := s.list[id]
+	if !ok {
+		return ErrNotExist
+	}
+	if obj0.SaveName != saveName { // file changed when checking
+		return ErrNotExist
+	}
+	for _, obj := range s.list { // same blob
+		if obj.SaveName == saveName {
+			obj.FileCheck = *st
+		}
+	}
+
+	s.updateSortList()
+
+	return nil
+}
 
 func (s *AttachStore) Del(id AttachID) error {
 	s.mx.Lock()
@@ -246,12 +456,32 @@ func (s *AttachStore) Del(id AttachID) error {
 	}
 	delete(s.list, id)
 	delete(s.lut, obj.Token)
+	s.ref(obj, -1)
 
 	s.updateSortList()
 
 	return nil
 }
 
+// count current & old versions, call with lock
+func (s *AttachStore) ref(obj *Attachment, n int) {
+	for _, saveName := range obj.blobs() {
+		if saveName == "" {
+			continue
+		}
+		s.refs[saveName] += n
+		if s.refs[saveName] <= 0 {
+			delete(s.refs, saveName)
+		}
+	}
+}
+
+func (s *AttachStore) Refs(saveName string) int {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.refs[saveName]
+}
+
 func (s *AttachStore) GetByID(id AttachID) *Attachment {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
@@ -298,6 +528,7 @@ func (s *AttachStore) updateSortList() { // sort by AID
 		obj2 := obj.Clone()
 		//obj2.ID = 0
 		obj2.SaveName = ""
+		obj2.Versions = nil
 		out = append(out, obj2)
 	}
 
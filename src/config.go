@@ -30,6 +30,25 @@ type TmplIndex struct {
 
 	//Tabs []*TabData `json:"tabs,omitempty"`
 
+	// notification channel for system event (eg: stale hook data)
+	NotifyType string `json:"ntype,omitempty"` // '' for log only, 'json', 'slack'
+	NotifyURL string `json:"nurl,omitempty"`
+
+	// allowed file kind for upload, comma separated, empty for default
+	AttachTypes string `json:"atypes,omitempty"` // eg: "image,pdf,zip"
+	HookTypes string `json:"htypes,omitempty"`
+
+	// disk quota in MB, 0 for no limit
+	AttachQuota int64 `json:"aquota,omitempty"`
+	HookQuota int64 `json:"hquota,omitempty"`
+	UserQuota int64 `json:"uquota,omitempty"` // default for each user
+
+	ConvertSimplify float64 `json:"simplify,omitempty"` // tolerance in meter for converted GeoJSON, 0 for off
+
+	// per-file size limit in MB, 0 for default
+	AttachSizeLimit int64 `json:"asize,omitempty"`
+	HookSizeLimit int64 `json:"hsize,omitempty"`
+
 	// for sw/Etag cache control
 	VersionD string `json:"verD,omitempty"` // Layer's res token change
 	VersionC string `json:"verC,omitempty"` // config of Layer, Map, Link, Anno
@@ -41,6 +60,35 @@ func (s *TmplIndex) Clone() *TmplIndex {
 	return &s2
 }
 
+func (s *TmplIndex) attachAllow() string {
+	if s.AttachTypes == "" {
+		return AttachAllowDefault
+	}
+	return s.AttachTypes
+}
+
+func (s *TmplIndex) hookAllow() string {
+	if s.HookTypes == "" {
+		return HookAllowDefault
+	}
+	return s.HookTypes
+}
+
+// Bytes
+func (s *TmplIndex) attachSizeLimit() int64 {
+	if s.AttachSizeLimit <= 0 {
+		return AttachSizeDefault * 1024 * 1024
+	}
+	return s.AttachSizeLimit * 1024 * 1024
+}
+
+func (s *TmplIndex) hookSizeLimit() int64 {
+	if s.HookSizeLimit <= 0 {
+		return HookSizeDefault * 1024 * 1024
+	}
+	return s.HookSizeLimit * 1024 * 1024
+}
+
 func genVersion() string {
 	return formatTimestamp(time.Now()) + "-" + genRng8()
 }
@@ -0,0 +1,337 @@
+package webmap
+
+/*
+* derive GeoJSON from uploaded vector data (shapefile zip, KML/KMZ, GPX, CSV/XLSX point table, projected GeoJSON)
+* derived file is a normal Attachment with DerivedFrom set, keep the same token when source replaced
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ConvertDigits = 7 // coordinate precision after decimal point, ~1cm
+
+	ErrConvertType = errors.New("not convertible")
+	ErrConvertCRS = errors.New("unsupported coordinate system")
+
+	convMx sync.Mutex // one conversion at a time, also protect Derived link
+)
+
+// converter for one kind of file, ErrConvertType if not match
+type convertFn func(fp string, a *Attachment) (*FeatureCollection, error)
+
+var converters = []convertFn{
+	convertShapefile,
+	convertKMZ,
+	convertKML,
+	convertGPX,
+	convertTable,
+	convertGeoJSON,
+}
+
+var (
+	reGeoJSONCRS = regexp.MustCompile(`"crs"\s*:\s*\{[^{}]*\{[^{}]*"name"\s*:\s*"([^"]+)"`)
+	reGeoJSONCoord = regexp.MustCompile(`"coordinates"\s*:\s*[\[\s]*(-?[0-9.eE+-]+)\s*,\s*(-?[0-9.eE+-]+)`)
+)
+
+func convertShapefile(fp string, a *Attachment) (*FeatureCollection, error) {
+	if a.Kind != "zip" {
+		return nil, ErrConvertType
+	}
+	fc, prj, err := readShapefileZip(fp)
+	if err != nil {
+		return nil, err
+	}
+	crs, err := prjCRS(prj)
+	if err != nil && a.SrcCRS == "" {
+		return nil, err
+	}
+	return fc, fc.toWGS84(a.SrcCRS, crs)
+}
+
+// GeoJSON not in WGS84: named crs, projected coordinate, or SrcCRS set
+func convertGeoJSON(fp string, a *Attachment) (*FeatureCollection, error) {
+	if a.Kind != "json" {
+		return nil, ErrConvertType
+	}
+	if a.SrcCRS == "" && !geojsonProjected(fp) {
+		return nil, ErrConvertType
+	}
+	buf, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := ParseFeatureCollection(buf)
+	if err != nil {
+		return nil, err
+	}
+	crs := ""
+	if fc.CRS != nil {
+		crs, err = parseCRS(fc.CRS.Properties.Name)
+		if err != nil && a.SrcCRS == "" {
+			return nil, err
+		}
+	}
+	return fc, fc.toWGS84(a.SrcCRS, crs)
+}
+
+// pushed GeoJSON of hook with HookConfig.SrcCRS
+func reprojectHookGeoJSON(crs string, file io.Reader) ([]byte, error) {
+	buf, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := ParseFeatureCollection(buf)
+	if err != nil {
+		return nil, ErrGeoJSON
+	}
+	if err := fc.toWGS84(crs, ""); err != nil {
+		return nil, err
+	}
+	fc.Round(ConvertDigits)
+	return json.Marshal(fc)
+}
+
+// by head of file only, not parse whole file
+func geojsonProjected(fp string) bool {
+	f, err := os.Open(fp)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 64 * 1024)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+
+	if m := reGeoJSONCRS.FindSubmatch(head); m != nil {
+		crs, err := parseCRS(string(m[1]))
+		return err != nil || crs != "4326"
+	}
+	if m := reGeoJSONCoord.FindSubmatch(head); m != nil {
+		x, err1 := strconv.ParseFloat(string(m[1]), 64)
+		y, err2 := strconv.ParseFloat(string(m[2]), 64)
+		return err1 == nil && err2 == nil && guessCRS(x, y) != "4326"
+	}
+	return false
+}
+
+func convertFile(fp string, a *Attachment) (*FeatureCollection, error) {
+	for _, fn := range converters {
+		fc, err := fn(fp, a)
+		if err == ErrConvertType {
+			continue
+		}
+		return fc, err
+	}
+	return nil, ErrConvertType
+}
+
+// convert content of token and save/replace its derived GeoJSON
+// ErrConvertType if not a convertible file
+func deriveAttach(db API, token string) error {
+	convMx.Lock()
+	defer convMx.Unlock()
+
+	a := db.GetAttachByToken(token)
+	if a == nil {
+		return ErrNotExist
+	}
+	if a.DerivedFrom != "" { // already derived
+		return ErrConvertType
+	}
+
+	fail := func(err error) error {
+		st := a.Clone()
+		st.ConvErr = err.Error()
+		st.Report = nil
+		db.UpdateAttachDerive(st)
+		return err
+	}
+
+	fc, err := convertFile(filepath.Join(UploadFileDir, a.SaveName), a)
+	if err == ErrConvertType {
+		return err
+	}
+	if err != nil {
+		return fail(err)
+	}
+	style := fc.styleDefault()
+
+	conf := db.GetConfig()
+	if conf.ConvertSimplify > 0 {
+		tol := conf.ConvertSimplify / 111320 // meter to degree, roughly
+		for _, f := range fc.Features {
+			f.Geometry.Simplify(tol)
+		}
+	}
+	fc.Round(ConvertDigits)
+	buf, err := json.Marshal(fc)
+	if err != nil {
+		return err
+	}
+
+	d, err := saveDerived(a, buf)
+	if err != nil {
+		return fail(err)
+	}
+
+	derived := a.Derived
+	if old := db.GetAttachByToken(derived); old != nil {
+		if old.Checksum == d.Checksum {
+			os.Remove(filepath.Join(UploadFileDir, d.SaveName))
+		} else {
+			_, err = replaceAttachFile(db, derived, d)
+		}
+	} else {
+		_, err = addAttachFile(db, d)
+		derived = d.Token
+	}
+	if err != nil {
+		return fail(err)
+	}
+	st := a.Clone()
+	st.Derived = derived
+	st.Style = style
+	st.Report = fc.report
+	st.ConvErr = ""
+	return db.UpdateAttachDerive(st)
+}
+
+// write GeoJSON as new file in UploadFileDir, ready for addAttachFile
+func saveDerived(src *Attachment, buf []byte) (*Attachment, error) {
+	name := strings.TrimSuffix(src.OriginalName, filepath.Ext(src.OriginalName)) + ".geojson"
+	d := NewAttachment(name, int64(len(buf)))
+	d.Kind = "json"
+	d.MIME = "application/json"
+	d.UploadUID = src.UploadUID
+	d.UploaderName = src.UploaderName
+	d.DerivedFrom = src.Token
+	d.Checksum, _ = sha256fd(bytes.NewReader(buf))
+
+	saveFp := filepath.Join(UploadFileDir, d.SaveName)
+	err := ioutil.WriteFile(saveFp, buf, 0644)
+	if err != nil {
+		os.Remove(saveFp)
+		return nil, err
+	}
+	st := verifyFile(saveFp, d.Size, d.Checksum, 0)
+	if st.Corrupt {
+		os.Remove(saveFp)
+		return nil, errors.New(st.CheckErr)
+	}
+	d.FileCheck = *st
+	return d, nil
+}
+
+// running deriveAsync, wait before exit or change UploadFileDir
+var deriveWg sync.WaitGroup
+
+// run after content of token changed, not block the request
+func deriveAsync(db API, token string) {
+	deriveWg.Add(1)
+	go func() {
+		defer deriveWg.Done()
+		err := deriveAttach(db, token)
+		if err != nil && err != ErrConvertType {
+			Vln(3, "[attach][convert]err", token, err)
+		}
+	}()
+}
+
+// public layer list with Token point to converted GeoJSON & stats of data, copy if changed
+func resolveLayers(db API, layers []*LayerGroup) []*LayerGroup {
+	out := make([]*LayerGroup, 0, len(layers))
+	for _, ly := range layers {
+		token, ok := layerDataToken(db, ly)
+		st := layerStats(db, ly, token)
+		if ok || st != nil {
+			ly = ly.Clone()
+			ly.Stats = st
+		}
+		if ok {
+			ly.Token = token
+			if ly.Type == "shp" {
+				ly.Type = ""
+			}
+		}
+		out = append(out, ly)
+	}
+	return out
+}
+
+// token used by layer: derived one if LayerGroup.Derived set and exist
+func layerDataToken(db API, ly *LayerGroup) (string, bool) {
+	if !ly.Derived || ly.Dynamic {
+		return ly.Token, false
+	}
+	a := db.GetAttachByToken(ly.Token)
+	if a == nil || a.Derived == "" {
+		return ly.Token, false
+	}
+	d := db.GetAttachByToken(a.Derived)
+	if d == nil || d.Hide {
+		return ly.Token, false
+	}
+	return d.Token, true
+}
+
+// most used simplestyle color of features, nil if none
+func (fc *FeatureCollection) styleDefault() *AttachStyle {
+	top := func(key string) string {
+		cnt := make(map[string]int)
+		out := ""
+		for _, f := range fc.Features {
+			s, ok := f.Properties[key].(string)
+			if !ok || s == "" {
+				continue
+			}
+			cnt[s]++
+			if cnt[s] > cnt[out] || (cnt[s] == cnt[out] && s < out) {
+				out = s
+			}
+		}
+		return out
+	}
+	st := &AttachStyle{
+		Color: top("stroke"),
+		FillColor: top("fill"),
+	}
+	if st.Color == "" && st.FillColor == "" {
+		return nil
+	}
+	if st.FillColor != "" {
+		for _, f := range fc.Features {
+			if f.Properties["fill"] != st.FillColor {
+				continue
+			}
+			if v, ok := f.Properties["fill-opacity"].(float64); ok {
+				st.Opacity = float32(v)
+				break
+			}
+		}
+	}
+	return st
+}
+
+// style from converted source of token, nil if none
+func attachStyle(db API, token string) *AttachStyle {
+	a := db.GetAttachByToken(token)
+	if a != nil && a.DerivedFrom != "" {
+		a = db.GetAttachByToken(a.DerivedFrom)
+	}
+	if a == nil {
+		return nil
+	}
+	return a.Style
+}
@@ -0,0 +1,232 @@
+package webmap
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// polygon records, each one as rings
+func testShp(polys [][][][]float64) []byte {
+	be, le := binary.BigEndian, binary.LittleEndian
+	body := &bytes.Buffer{}
+	for i, rings := range polys {
+		n := 0
+		for _, r := range rings {
+			n += len(r)
+		}
+		rec := make([]byte, 44 + 4 * len(rings) + 16 * n)
+		le.PutUint32(rec[0:], 5)
+		le.PutUint32(rec[36:], uint32(len(rings)))
+		le.PutUint32(rec[40:], uint32(n))
+		off, p := 44 + 4 * len(rings), 0
+		for j, r := range rings {
+			le.PutUint32(rec[44+j*4:], uint32(p))
+			for _, pt := range r {
+				le.PutUint64(rec[off:], math.Float64bits(pt[0]))
+				le.PutUint64(rec[off+8:], math.Float64bits(pt[1]))
+				off += 16
+				p++
+			}
+		}
+		hdr := make([]byte, 8)
+		be.PutUint32(hdr[0:], uint32(i + 1))
+		be.PutUint32(hdr[4:], uint32(len(rec) / 2))
+		body.Write(hdr)
+		body.Write(rec)
+	}
+	head := make([]byte, 100)
+	be.PutUint32(head[0:], 9994)
+	be.PutUint32(head[24:], uint32((100 + body.Len()) / 2))
+	le.PutUint32(head[28:], 1000)
+	le.PutUint32(head[32:], 5)
+	return append(head, body.Bytes()...)
+}
+
+// NAME C(20), POP N(8), text in Big5
+func testDbf(t *testing.T, names []string, pops []string) []byte {
+	le := binary.LittleEndian
+	enc := traditionalchinese.Big5.NewEncoder()
+	recLen := 1 + 20 + 8
+	hdrLen := 32 + 32 * 2 + 1
+	buf := make([]byte, hdrLen, hdrLen + recLen * len(names) + 1)
+	buf[0] = 3
+	le.PutUint32(buf[4:], uint32(len(names)))
+	le.PutUint16(buf[8:], uint16(hdrLen))
+	le.PutUint16(buf[10:], uint16(recLen))
+	copy(buf[32:], "NAME")
+	buf[32+11] = 'C'
+	buf[32+16] = 20
+	copy(buf[64:], "POP")
+	buf[64+11] = 'N'
+	buf[64+16] = 8
+	buf[96] = 0x0D
+	for i, name := range names {
+		b, err := enc.Bytes([]byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := bytes.Repeat([]byte(" "), recLen)
+		copy(rec[1:], b)
+		copy(rec[21+8-len(pops[i]):], pops[i])
+		buf = append(buf, rec...)
+	}
+	return append(buf, 0x1A)
+}
+
+func testZip(t *testing.T, fp string, files map[string][]byte) {
+	fd, err := os.Create(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	zw := zip.NewWriter(fd)
+	for name, b := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(b)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAddZip(t *testing.T, name string, files map[string][]byte) *Attachment {
+	a := NewAttachment(name, 0)
+	fp := filepath.Join(UploadFileDir, a.SaveName)
+	testZip(t, fp, files)
+	fi, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Size = fi.Size()
+	a.Kind = "zip"
+	a.Checksum = sha256File(fp)
+	return a
+}
+
+func sha256File(fp string) string {
+	fd, err := os.Open(fp)
+	if err != nil {
+		return ""
+	}
+	defer fd.Close()
+	hash, _ := sha256fd(fd)
+	return hash
+}
+
+func TestConvertShapefile(t *testing.T) {
+	_, done := tempStorage(t, "convert")
+	defer done()
+
+	// shapefile winding: outer clockwise, hole counter-clockwise
+	outer := [][]float64{{120, 23}, {120, 24}, {121, 24}, {121, 23}, {120, 23}}
+	hole := [][]float64{{120.2, 23.2}, {120.4, 23.2}, {120.4, 23.4}, {120.2, 23.4}, {120.2, 23.2}}
+	other := [][]float64{{122, 25}, {122, 25.5}, {122.5, 25.5}, {122, 25}}
+
+	db := NewDataStore()
+	a := testAddZip(t, "town.zip", map[string][]byte{
+		"town/town.shp": testShp([][][][]float64{{outer, hole}, {other}}),
+		"town/town.dbf": testDbf(t, []string{"臺北市", "基隆市"}, []string{"2602418", "367577"}),
+	})
+	if _, err := addAttachFile(db, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deriveAttach(db, a.Token); err != nil {
+		t.Fatal(err)
+	}
+	a = db.GetAttachByToken(a.Token)
+	d := db.GetAttachByToken(a.Derived)
+	if d == nil || d.DerivedFrom != a.Token || a.ConvErr != "" {
+		t.Fatal("derived link", a, d)
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(UploadFileDir, d.SaveName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, err := ParseFeatureCollection(buf)
+	if err != nil || len(fc.Features) != 2 {
+		t.Fatal("parse derived", err, string(buf))
+	}
+	f0 := fc.Features[0]
+	if f0.Properties["NAME"] != "臺北市" || f0.Properties["POP"] != float64(2602418) {
+		t.Fatal("properties", f0.Properties)
+	}
+	if f0.Geometry.Type != "Polygon" || len(f0.Geometry.Poly) != 2 {
+		t.Fatal("polygon with hole", f0.Geometry)
+	}
+	if ringArea2(f0.Geometry.Poly[0]) <= 0 || ringArea2(f0.Geometry.Poly[1]) >= 0 {
+		t.Fatal("RFC 7946 winding")
+	}
+
+	// same content keep file, new content replace with same token
+	if err := deriveAttach(db, a.Token); err != nil {
+		t.Fatal(err)
+	}
+	if d2 := db.GetAttachByToken(a.Token); d2.Derived != d.Token {
+		t.Fatal("derived token changed", d2.Derived, d.Token)
+	}
+	b := testAddZip(t, "town.zip", map[string][]byte{
+		"town.shp": testShp([][][][]float64{{outer}}),
+		"town.dbf": testDbf(t, []string{"新北市"}, []string{"4030954"}),
+	})
+	if _, err := replaceAttachFile(db, a.Token, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := deriveAttach(db, a.Token); err != nil {
+		t.Fatal(err)
+	}
+	d2 := db.GetAttachByToken(d.Token)
+	if d2 == nil || d2.Checksum == d.Checksum || len(d2.Versions) != 1 {
+		t.Fatal("derived not replaced", d2)
+	}
+
+	// layer use derived GeoJSON only if asked
+	ly := &LayerGroup{Name: "town", Token: a.Token, Type: "shp"}
+	if out := resolveLayers(db, []*LayerGroup{ly}); out[0].Token != a.Token {
+		t.Fatal("not derived layer")
+	}
+	ly.Derived = true
+	out := resolveLayers(db, []*LayerGroup{ly})
+	if out[0].Token != d.Token || out[0].Type != "" || ly.Token != a.Token {
+		t.Fatal("derived layer", out[0], ly)
+	}
+
+	// unknown projection reject
+	p := testAddZip(t, "utm.zip", map[string][]byte{
+		"a.shp": testShp([][][][]float64{{outer}}),
+		"a.prj": []byte(`PROJCS["WGS 84 / UTM zone 51N",GEOGCS["WGS 84"],PROJECTION["Transverse_Mercator"],PARAMETER["central_meridian",123]]`),
+	})
+	if _, err := addAttachFile(db, p); err != nil {
+		t.Fatal(err)
+	}
+	if err := deriveAttach(db, p.Token); err != ErrConvertCRS {
+		t.Fatal("projected", err)
+	}
+	if p = db.GetAttachByToken(p.Token); p.ConvErr == "" || p.Derived != "" {
+		t.Fatal("convert error record", p)
+	}
+
+	// not convertible
+	j := NewAttachment("x.json", 2)
+	j.Kind = "json"
+	ioutil.WriteFile(filepath.Join(UploadFileDir, j.SaveName), []byte("{}"), 0644)
+	j.Checksum = sha256File(filepath.Join(UploadFileDir, j.SaveName))
+	if _, err := addAttachFile(db, j); err != nil {
+		t.Fatal(err)
+	}
+	if err := deriveAttach(db, j.Token); err != ErrConvertType {
+		t.Fatal("json", err)
+	}
+}
@@ -0,0 +1,171 @@
+package webmap
+
+// minimal cron-like schedule for server side jobs
+// "min hour dom month dow", support '*', '*/n', 'a-b', 'a-b/n', 'a,b,c'
+// or "@every 10m" / "@hourly" / "@daily"
+// as standard cron, when both dom & dow restricted (not start with '*') either one matched is enough
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrCronSpec = errors.New("invalid schedule")
+)
+
+type CronSpec struct {
+	min   uint64
+	hour  uint64
+	dom   uint64
+	month uint64
+	dow   uint64
+	dayOr bool // both dom & dow restricted
+
+	every time.Duration // for '@every'
+}
+
+func ParseCron(spec string) (*CronSpec, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "":
+		return nil, ErrCronSpec
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily":
+		spec = "0 0 * * *"
+	}
+
+	if strings.HasPrefix(spec, "@every ") {
+		dt, err := time.ParseDuration(strings.TrimSpace(spec[7:]))
+		if err != nil || dt < time.Minute {
+			return nil, ErrCronSpec
+		}
+		return &CronSpec{every: dt}, nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, ErrCronSpec
+	}
+
+	c := &CronSpec{}
+	var err error
+	if c.min, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.dow&(1<<7) != 0 { // 7 == Sunday
+		c.dow |= 1
+	}
+	c.dayOr = !strings.HasPrefix(fields[2], "*") && !strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+func parseCronField(field string, lo int, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, ErrCronSpec
+			}
+			step = n
+			part = part[:i]
+		}
+
+		a, b := lo, hi
+		switch {
+		case part == "*":
+		case strings.IndexByte(part, '-') > 0:
+			v := strings.SplitN(part, "-", 2)
+			n0, err0 := strconv.Atoi(v[0])
+			n1, err1 := strconv.Atoi(v[1])
+			if err0 != nil || err1 != nil {
+				return 0, ErrCronSpec
+			}
+			a, b = n0, n1
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, ErrCronSpec
+			}
+			a, b = n, n
+			if step != 1 { // 'n/step' same as 'n-hi/step'
+				b = hi
+			}
+		}
+		if a < lo || b > hi || a > b {
+			return 0, ErrCronSpec
+		}
+		for i := a; i <= b; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func (c *CronSpec) match(t time.Time) bool {
+	if c.min&(1<<uint(t.Minute())) == 0 {
+		return false
+	}
+	if c.hour&(1<<uint(t.Hour())) == 0 {
+		return false
+	}
+	if c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	return c.matchDay(t)
+}
+
+func (c *CronSpec) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.dayOr {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next trigger time after t, zero time if not found in 5 years
+func (c *CronSpec) Next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every)
+	}
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if c.match(t) {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
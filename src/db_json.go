@@ -277,13 +277,37 @@ func (s *DataStore) UpdateAttach(attach *Attachment) error { // need exist, AID
 	defer s.FlagDirty()
 	return s.Attach.Set(attach)
 }
+func (s *DataStore) ReplaceAttach(attach *Attachment) error { // content changed, also invalidate client cache
+	defer s.FlagDirty()
+	defer s.updateVerC()
+	return s.Attach.Set(attach)
+}
 func (s *DataStore) AddAttach(attach *Attachment) (AttachID, error) { // auto set AID & token
 	defer s.FlagDirty()
 	return s.Attach.Add(attach)
 }
+func (s *DataStore) UpdateAttachFetch(attach *Attachment) error { // only update fetch status
+	defer s.FlagDirty()
+	return s.Attach.SetFetch(attach)
+}
+func (s *DataStore) UpdateAttachDerive(attach *Attachment) error { // layer may point to new one
+	defer s.FlagDirty()
+	defer s.updateVerC()
+	return s.Attach.SetDerive(attach)
+}
+func (s *DataStore) UpdateAttachCheck(aid AttachID, saveName string, st *FileCheck) error {
+	defer s.FlagDirty()
+	return s.Attach.SetCheck(aid, saveName, st)
+}
+func (s *DataStore) AttachRefs(saveName string) int {
+	return s.Attach.Refs(saveName)
+}
 func (s *DataStore) ListAttach() []*Attachment {
 	return s.Attach.GetWeb()
 }
+func (s *DataStore) ListAllAttach() []*Attachment {
+	return s.Attach.GetAll()
+}
 
 // Hook
 func (s *DataStore) GetHookByToken(token string) *HookConfig { // for download
@@ -311,6 +335,18 @@ func (s *DataStore) UpdateHook(hk *HookConfig) error {
 	defer s.FlagDirty()
 	return s.Hook.Set(hk)
 }
+func (s *DataStore) UpdateHookPullStatus(hk *HookConfig) error { // only update pull status
+	defer s.FlagDirty()
+	return s.Hook.SetPullStatus(hk)
+}
+func (s *DataStore) SetHookStale(hid HookID, stale bool) error {
+	defer s.FlagDirty()
+	return s.Hook.SetStale(hid, stale)
+}
+func (s *DataStore) UpdateHookCheck(hid HookID, saveName string, st *FileCheck) error {
+	defer s.FlagDirty()
+	return s.Hook.SetCheck(hid, saveName, st)
+}
 func (s *DataStore) ListHook() []*HookConfig { // return copy & clean up
 	return s.Hook.GetWeb()
 }
@@ -0,0 +1,246 @@
+package webmap
+
+/*
+* live update event for map client (Server-Sent Events)
+* watch public data & hook data, broadcast what changed
+*/
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	EventPollInterval = 1 * time.Second
+	EventMaxClient = 1000
+	EventHeartbeat = 25 * time.Second
+	EventStreamMax = 5 * time.Minute // end stream before cut by server WriteTimeout, client reconnect by itself
+)
+
+type Event struct {
+	Type string `json:"type"` // 'hook', 'layer', 'map', 'link', 'tab', 'site'
+	Ver string `json:"ver,omitempty"` // VersionC for 'layer', 'map', 'link', 'tab', VersionA for 'site', FeatureVer for 'hook'
+	Token string `json:"token,omitempty"` // for 'hook'
+	Hash string `json:"hash,omitempty"` // for 'hook'
+	IDs []uint64 `json:"ids,omitempty"` // changed or new
+	Del []uint64 `json:"del,omitempty"` // removed or hidden
+}
+
+type EventHub struct {
+	db API
+	die chan struct{}
+	closeOnce sync.Once // by shutdown hook & web close
+
+	mx sync.Mutex
+	subs map[chan *Event]struct{}
+
+	// last seen, only access by watch goroutine
+	verA string
+	verC string
+	hooks map[string]time.Time // token -> UpdateTime
+	layers *eventSnap
+	maps *eventSnap
+	tabs *eventSnap
+	links string
+}
+
+func NewEventHub(db API) *EventHub {
+	return &EventHub{
+		db: db,
+		die: make(chan struct{}),
+		subs: make(map[chan *Event]struct{}),
+	}
+}
+
+func (h *EventHub) Start() {
+	h.scan() // init state, no event
+	go h.watch()
+}
+
+func (h *EventHub) Close() {
+	h.closeOnce.Do(func() {
+		close(h.die)
+	})
+}
+
+// nil if too many client
+func (h *EventHub) Subscribe() chan *Event {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if len(h.subs) >= EventMaxClient {
+		return nil
+	}
+	ch := make(chan *Event, 16)
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *EventHub) Unsubscribe(ch chan *Event) {
+	h.mx.Lock()
+	delete(h.subs, ch)
+	h.mx.Unlock()
+}
+
+func (h *EventHub) Publish(ev *Event) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default: // slow client, drop
+		}
+	}
+}
+
+func (h *EventHub) watch() {
+	ticker := time.NewTicker(EventPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.die:
+			return
+		case <-ticker.C:
+		}
+		for _, ev := range h.scan() {
+			h.Publish(ev)
+		}
+	}
+}
+
+// compare with last seen, return events
+func (h *EventHub) scan() []*Event {
+	out := make([]*Event, 0, 2)
+	init := h.hooks == nil
+
+	// hook data
+	hooks := make(map[string]time.Time)
+	for _, hook := range h.db.ListHook() {
+		if hook.Disable {
+			continue
+		}
+		hooks[hook.Token] = hook.UpdateTime
+		t0, ok := h.hooks[hook.Token]
+		if !init && (!ok || !t0.Equal(hook.UpdateTime)) {
+			out = append(out, &Event{
+				Type: "hook",
+				Ver: strconv.FormatUint(hook.FeatureVer, 10),
+				Token: hook.Token,
+				Hash: hook.Checksum,
+			})
+		}
+	}
+	h.hooks = hooks
+
+	conf := h.db.GetConfig()
+	if conf.VersionC != h.verC || init {
+		h.verC = conf.VersionC
+
+		layers := newEventSnap()
+		for _, obj := range resolveLayers(h.db, h.db.GetPubLayer()) {
+			if obj.Dynamic && obj.Stats != nil { // data change sent as 'hook'
+				obj = obj.Clone()
+				obj.Stats = nil
+			}
+			layers.add(obj.ID, obj)
+		}
+		if ev := layers.diff("layer", h.layers); ev != nil && !init {
+			ev.Ver = conf.VersionC
+			out = append(out, ev)
+		}
+		h.layers = layers
+
+		maps := newEventSnap()
+		for _, obj := range h.db.GetPubMap() {
+			maps.add(obj.ID, obj)
+		}
+		if ev := maps.diff("map", h.maps); ev != nil && !init {
+			ev.Ver = conf.VersionC
+			out = append(out, ev)
+		}
+		h.maps = maps
+
+		tabs := newEventSnap()
+		for _, obj := range h.db.GetPubTab() {
+			tabs.add(obj.ID, obj)
+		}
+		if ev := tabs.diff("tab", h.tabs); ev != nil && !init {
+			ev.Ver = conf.VersionC
+			out = append(out, ev)
+		}
+		h.tabs = tabs
+
+		links := jsonStr(h.db.GetPubLink())
+		if links != h.links && !init {
+			out = append(out, &Event{
+				Type: "link",
+				Ver: conf.VersionC,
+			})
+		}
+		h.links = links
+	}
+
+	if conf.VersionA != h.verA {
+		if !init {
+			out = append(out, &Event{
+				Type: "site",
+				Ver: conf.VersionA,
+			})
+		}
+		h.verA = conf.VersionA
+	}
+
+	return out
+}
+
+// public list at some time
+type eventSnap struct {
+	list map[uint64]string // ID -> json
+	order string
+}
+
+func newEventSnap() *eventSnap {
+	return &eventSnap{
+		list: make(map[uint64]string),
+	}
+}
+
+func (s *eventSnap) add(id uint64, obj interface{}) {
+	s.list[id] = jsonStr(obj)
+	s.order += strconv.FormatUint(id, 10) + ","
+}
+
+// nil for no change, order change only give empty IDs & Del
+func (s *eventSnap) diff(typ string, s0 *eventSnap) *Event {
+	if s0 == nil {
+		s0 = newEventSnap()
+	}
+	ev := &Event{
+		Type: typ,
+	}
+	for id, v1 := range s.list {
+		v0, ok := s0.list[id]
+		if !ok || v0 != v1 {
+			ev.IDs = append(ev.IDs, id)
+		}
+	}
+	for id := range s0.list {
+		if _, ok := s.list[id]; !ok {
+			ev.Del = append(ev.Del, id)
+		}
+	}
+	if len(ev.IDs) == 0 && len(ev.Del) == 0 && s.order == s0.order {
+		return nil
+	}
+	return ev
+}
+
+func jsonStr(v interface{}) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(buf)
+}
@@ -0,0 +1,234 @@
+package webmap
+
+/*
+* integrity check for saved file (attachment & hook data)
+* verify once at write time, then re-hash in background by FileScrubber
+* serve only do cheap size & mtime check
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ScrubInterval = 1 * time.Hour // check all file period
+	ScrubMaxAge = 7 * 24 * time.Hour // re-hash even size & mtime not change
+	ScrubRate = int64(8 * 1024 * 1024) // Bytes per second for background re-hash, 0 for no limit
+
+	ErrFileSize = errors.New("file size not match")
+	ErrFileHash = errors.New("checksum not match")
+)
+
+// verify state of saved file, embed in Attachment & HookConfig
+type FileCheck struct {
+	VerifyTime time.Time `json:"vtime,omitempty"` // last full re-hash
+	FileMTime time.Time `json:"mtime,omitempty"` // mtime when verify
+	Corrupt bool `json:"bad,omitempty"`
+	CheckErr string `json:"cerr,omitempty"`
+}
+
+// cheap check before serve, (can serve, need re-hash)
+func (c *FileCheck) quickCheck(fi os.FileInfo, size int64) (bool, bool) {
+	if c.Corrupt || fi.Size() != size {
+		return false, !c.Corrupt
+	}
+	if c.FileMTime.IsZero() || !fi.ModTime().Equal(c.FileMTime) {
+		return true, true
+	}
+	return true, false
+}
+
+// full re-hash, rate in Bytes per second, 0 for no limit
+func verifyFile(fp string, size int64, checksum string, rate int64) *FileCheck {
+	c := &FileCheck{
+		VerifyTime: time.Now(),
+	}
+	setErr := func(err error) *FileCheck {
+		c.Corrupt = true
+		c.CheckErr = err.Error()
+		return c
+	}
+
+	fd, err := os.Open(fp)
+	if err != nil {
+		return setErr(err)
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return setErr(err)
+	}
+	c.FileMTime = fi.ModTime()
+	if fi.Size() != size {
+		return setErr(ErrFileSize)
+	}
+
+	var rd io.Reader = fd
+	if rate > 0 {
+		rd = &rateReader{rd: fd, rate: rate, t0: time.Now()}
+	}
+	hash, ok := sha256fd(rd)
+	if !ok {
+		return setErr(errors.New(hash))
+	}
+	if hash != checksum {
+		return setErr(ErrFileHash)
+	}
+	return c
+}
+
+type rateReader struct {
+	rd io.Reader
+	rate int64
+	t0 time.Time
+	n int64
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n += int64(n)
+	expect := time.Duration(r.n * int64(time.Second) / r.rate)
+	if dt := expect - time.Since(r.t0); dt > 0 {
+		time.Sleep(dt)
+	}
+	return n, err
+}
+
+type FileScrubber struct {
+	db API
+	die chan struct{}
+	kick chan struct{}
+}
+
+func NewFileScrubber(db API) *FileScrubber {
+	return &FileScrubber{
+		db: db,
+		die: make(chan struct{}),
+		kick: make(chan struct{}, 1),
+	}
+}
+
+func (s *FileScrubber) Start() {
+	go s.loop()
+}
+
+func (s *FileScrubber) Close() {
+	select {
+	case <-s.die:
+	default:
+		close(s.die)
+	}
+}
+
+// ask for check soon, eg: size or mtime changed when serve
+func (s *FileScrubber) Kick() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (s *FileScrubber) loop() {
+	ticker := time.NewTicker(ScrubInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.die:
+			return
+		case <-ticker.C:
+		case <-s.kick:
+		}
+		s.checkAll(time.Now())
+	}
+}
+
+func (s *FileScrubber) checkAll(now time.Time) {
+	for _, a := range s.db.ListAllAttach() {
+		select {
+		case <-s.die:
+			return
+		default:
+		}
+		if a.SaveName == "" || !needVerify(&a.FileCheck, filepath.Join(UploadFileDir, a.SaveName), a.Size, now) {
+			continue
+		}
+		s.VerifyAttach(a, ScrubRate)
+	}
+
+	for _, hook := range s.db.ListHook() {
+		select {
+		case <-s.die:
+			return
+		default:
+		}
+		hook0 := s.db.GetHookByID(hook.ID) // ListHook() clean up SaveName
+		if hook0 == nil {
+			continue
+		}
+		hook = hook0.Clone()
+		if hook.SaveName == "" || !needVerify(&hook.FileCheck, filepath.Join(CacheFileDir, hook.SaveName), hook.Size, now) {
+			continue
+		}
+		s.VerifyHook(hook, ScrubRate)
+	}
+}
+
+func needVerify(c *FileCheck, fp string, size int64, now time.Time) bool {
+	fi, err := os.Stat(fp)
+	if err != nil {
+		return !c.Corrupt
+	}
+	_, changed := c.quickCheck(fi, size)
+	return changed || now.Sub(c.VerifyTime) > ScrubMaxAge
+}
+
+func (s *FileScrubber) VerifyAttach(a *Attachment, rate int64) *FileCheck {
+	saveName := filepath.Clean("/" + a.SaveName)[1:]
+	st := verifyFile(filepath.Join(UploadFileDir, saveName), a.Size, a.Checksum, rate)
+	err := s.db.UpdateAttachCheck(a.ID, a.SaveName, st)
+	if err != nil {
+		return st
+	}
+	if st.Corrupt {
+		memCache.Del(a.cacheKey())
+	}
+	s.report("檔案", a.OriginalName + " (" + a.Token + ")", &a.FileCheck, st)
+	return st
+}
+
+func (s *FileScrubber) VerifyHook(hook *HookConfig, rate int64) *FileCheck {
+	saveName := filepath.Clean("/" + hook.SaveName)[1:]
+	st := verifyFile(filepath.Join(CacheFileDir, saveName), hook.Size, hook.Checksum, rate)
+	err := s.db.UpdateHookCheck(hook.ID, hook.SaveName, st)
+	if err != nil {
+		return st
+	}
+	if st.Corrupt {
+		memCache.Del(hook.cacheKey())
+	}
+	s.report("動態資源", hook.Name + " (" + hook.Token + ")", &hook.FileCheck, st)
+	return st
+}
+
+// log & notify when state change
+func (s *FileScrubber) report(kind string, name string, c0 *FileCheck, c *FileCheck) {
+	if c0.Corrupt == c.Corrupt {
+		return
+	}
+	title := "[" + kind + "損毀] " + name
+	msg := fmt.Sprintf("%v 檢查失敗: %v", name, c.CheckErr)
+	if !c.Corrupt {
+		title = "[" + kind + "恢復] " + name
+		msg = fmt.Sprintf("%v 檢查通過", name)
+	}
+	err := sendNotify(s.db.GetConfig(), title, msg)
+	if err != nil {
+		Vln(3, "[scrub]notify error", err)
+	}
+}
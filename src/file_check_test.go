@@ -0,0 +1,59 @@
+package webmap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("some attachment data")
+	fp := filepath.Join(dir, "data")
+	ioutil.WriteFile(fp, data, 0644)
+	hash, _ := sha256fd(bytes.NewReader(data))
+
+	st := verifyFile(fp, int64(len(data)), hash, 1024)
+	if st.Corrupt || st.VerifyTime.IsZero() || st.FileMTime.IsZero() {
+		t.Fatal("verify should pass", st)
+	}
+	fi, _ := os.Stat(fp)
+	if ok, suspect := st.quickCheck(fi, int64(len(data))); !ok || suspect {
+		t.Fatal("quick check should pass", ok, suspect)
+	}
+	if needVerify(st, fp, int64(len(data)), time.Now()) {
+		t.Fatal("should not re-hash verified file")
+	}
+	if !needVerify(st, fp, int64(len(data)), time.Now().Add(ScrubMaxAge + time.Hour)) {
+		t.Fatal("should re-hash after ScrubMaxAge")
+	}
+
+	// same size, different content & mtime
+	ioutil.WriteFile(fp, []byte("SOME attachment data"), 0644)
+	os.Chtimes(fp, time.Now(), st.FileMTime.Add(time.Second))
+	fi, _ = os.Stat(fp)
+	if ok, suspect := st.quickCheck(fi, int64(len(data))); !ok || !suspect {
+		t.Fatal("mtime change should serve & ask for re-hash", ok, suspect)
+	}
+	st2 := verifyFile(fp, int64(len(data)), hash, 0)
+	if !st2.Corrupt || st2.CheckErr != ErrFileHash.Error() {
+		t.Fatal("should detect content change", st2)
+	}
+	if ok, suspect := st2.quickCheck(fi, int64(len(data))); ok || suspect {
+		t.Fatal("corrupt file should not serve & not ask again", ok, suspect)
+	}
+
+	ioutil.WriteFile(fp, data[:4], 0644)
+	fi, _ = os.Stat(fp)
+	if ok, suspect := st.quickCheck(fi, int64(len(data))); ok || !suspect {
+		t.Fatal("size change should not serve", ok, suspect)
+	}
+}
@@ -0,0 +1,272 @@
+package webmap
+
+/*
+* content sniffing by magic bytes, allowlist per endpoint
+* archive (zip/gz) decompression limit
+* safe header for serving user file from our origin
+*/
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// comma separated kind, used when config is empty
+	AttachAllowDefault = "image,svg,pdf,zip,gzip,archive,json,xml,text,shp,bin"
+	HookAllowDefault = "image,json,xml,text,zip,gzip,bin"
+
+	ArchiveMaxRatio = int64(100) // uncompressed / compressed
+	ArchiveMaxSize = int64(512 * 1024 * 1024) // Bytes (512 MB), uncompressed
+	ArchiveMaxFiles = 10000
+	SvgScanMax = int64(1024 * 1024) // Bytes (1 MB), larger SVG not scanned & force download
+
+	ErrArchiveBomb = errors.New("archive decompression limit exceeded")
+)
+
+// kind: image, svg, html, pdf, zip, gzip, archive, json, xml, text, shp, bin, exe
+type FileType struct {
+	Kind string
+	MIME string
+}
+
+// allowlist "a,b,c", 'exe' never allow
+func fileTypeAllow(list string, kind string) bool {
+	if kind == "exe" {
+		return false
+	}
+	for _, v := range strings.Split(list, ",") {
+		if strings.TrimSpace(v) == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// sniff, check allowlist & archive limit, fd will seek back to 0
+func checkFileType(fd io.ReadSeeker, name string, size int64, allow string) (*FileType, error) {
+	ft := sniffFile(fd, name)
+	if !fileTypeAllow(allow, ft.Kind) {
+		return ft, ErrFileType
+	}
+
+	var err error
+	switch ft.Kind {
+	case "zip":
+		if ra, ok := fd.(io.ReaderAt); ok {
+			err = checkZip(ra, size)
+		}
+	case "gzip":
+		err = checkGzip(fd, size)
+	}
+	fd.Seek(0, 0)
+	switch err {
+	case nil:
+	case ErrArchiveBomb:
+		return ft, err
+	default: // broken archive, can not check
+		return ft, ErrFileType
+	}
+	return ft, nil
+}
+
+var (
+	reSvgActive = regexp.MustCompile(`(?i)<script|<foreignobject|<iframe|<embed|<object|\son[a-z]+\s*=|javascript:|data:text/html`)
+	reHtml = regexp.MustCompile(`(?i)^\s*(<\?xml[^>]*>\s*)?(<!--.*?-->\s*)*<(!doctype\s+html|html|head|body|script|iframe|h1|div|table|a\s|title|style|br|p[\s>])`)
+)
+
+func sniffFile(fd io.ReadSeeker, name string) *FileType {
+	defer fd.Seek(0, 0)
+
+	ext := strings.ToLower(filepath.Ext(name))
+	mimeExt := mime.TypeByExtension(ext)
+
+	if isExeFile(fd) {
+		return &FileType{"exe", "application/octet-stream"}
+	}
+	fd.Seek(0, 0)
+
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(fd, head)
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return &FileType{"image", "image/png"}
+	case bytes.HasPrefix(head, []byte("\xff\xd8\xff")):
+		return &FileType{"image", "image/jpeg"}
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return &FileType{"image", "image/gif"}
+	case len(head) >= 12 && bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")):
+		return &FileType{"image", "image/webp"}
+	case bytes.HasPrefix(head, []byte("BM")) && ext == ".bmp":
+		return &FileType{"image", "image/bmp"}
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return &FileType{"image", "image/tiff"}
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return &FileType{"pdf", "application/pdf"}
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		if mimeExt == "" || strings.HasPrefix(mimeExt, "text/") {
+			mimeExt = "application/zip"
+		}
+		return &FileType{"zip", mimeExt} // also docx, xlsx, kmz
+	case bytes.HasPrefix(head, []byte("\x1f\x8b")):
+		return &FileType{"gzip", "application/gzip"}
+	case bytes.HasPrefix(head, []byte("7z\xbc\xaf\x27\x1c")), bytes.HasPrefix(head, []byte("Rar!\x1a\x07")):
+		return &FileType{"archive", "application/octet-stream"}
+	case len(head) >= 4 && bytes.Equal(head[:4], []byte("\x00\x00\x27\x0a")): // shp, shx file code 9994
+		return &FileType{"shp", "application/octet-stream"}
+	}
+
+	// text based
+	text := bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")) // UTF-8 BOM
+	ctype := http.DetectContentType(text)
+	if !strings.HasPrefix(ctype, "text/") && !bytes.HasPrefix(bytes.TrimSpace(text), []byte("<")) {
+		if ext == ".dbf" || ext == ".shx" || ext == ".shp" {
+			return &FileType{"shp", "application/octet-stream"}
+		}
+		return &FileType{"bin", "application/octet-stream"}
+	}
+
+	trim := bytes.TrimSpace(text)
+	lower := bytes.ToLower(trim)
+	switch {
+	case bytes.Contains(lower, []byte("<svg")):
+		// active content, force download instead of render
+		buf, _ := ioutil.ReadAll(io.LimitReader(io.MultiReader(bytes.NewReader(head), fd), SvgScanMax + 1))
+		if int64(len(buf)) > SvgScanMax || reSvgActive.Match(buf) {
+			return &FileType{"svg", "application/octet-stream"}
+		}
+		return &FileType{"svg", "image/svg+xml"}
+	case reHtml.Match(trim):
+		return &FileType{"html", "application/octet-stream"}
+	case bytes.HasPrefix(trim, []byte("{")) || bytes.HasPrefix(trim, []byte("[")):
+		return &FileType{"json", "application/json"}
+	case bytes.HasPrefix(trim, []byte("<")):
+		return &FileType{"xml", "text/xml; charset=utf-8"}
+	}
+
+	switch ext {
+	case ".csv":
+		return &FileType{"text", "text/csv; charset=utf-8"}
+	case ".prj", ".cpg", ".txt":
+		return &FileType{"text", "text/plain; charset=utf-8"}
+	}
+	return &FileType{"text", "text/plain; charset=utf-8"}
+}
+
+func checkZip(ra io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	if len(zr.File) > ArchiveMaxFiles {
+		return ErrArchiveBomb
+	}
+	limit := archiveLimit(size)
+	var total int64
+	for _, f := range zr.File {
+		total += int64(f.UncompressedSize64)
+		if total > limit {
+			return ErrArchiveBomb
+		}
+	}
+
+	// size in header can be fake, count real data
+	total = 0
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(ioutil.Discard, io.LimitReader(rc, limit - total + 1))
+		rc.Close()
+		total += n
+		if total > limit {
+			return ErrArchiveBomb
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkGzip(rd io.Reader, size int64) error {
+	gr, err := gzip.NewReader(rd)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	limit := archiveLimit(size)
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(gr, limit + 1))
+	if n > limit {
+		return ErrArchiveBomb
+	}
+	return err
+}
+
+func archiveLimit(size int64) int64 {
+	limit := size * ArchiveMaxRatio
+	if limit > ArchiveMaxSize || limit < 0 {
+		limit = ArchiveMaxSize
+	}
+	return limit
+}
+
+// kind & MIME for old data without sniff result
+func fileTypeByName(name string) *FileType {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch ext {
+	case ".svg", ".svgz":
+		return &FileType{"svg", "application/octet-stream"} // not checked, download only
+	case ".html", ".htm", ".xhtml", ".shtml", ".xht", ".mht", ".mhtml":
+		return &FileType{"html", "application/octet-stream"}
+	case ".xml", ".kml", ".gpx":
+		return &FileType{"xml", "text/xml; charset=utf-8"}
+	case ".json", ".geojson":
+		return &FileType{"json", "application/json"}
+	}
+	ctype := mime.TypeByExtension(ext)
+	if ctype == "" || strings.Contains(ctype, "html") || strings.Contains(ctype, "xml") || strings.Contains(ctype, "javascript") {
+		ctype = "application/octet-stream"
+	}
+	return &FileType{"", ctype}
+}
+
+// header for serving user file from our origin
+func setSafeHeader(w http.ResponseWriter, ft *FileType, name string) {
+	h := w.Header()
+	h.Set("Content-Type", ft.MIME)
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	disp := "attachment"
+	switch ft.Kind {
+	case "image", "pdf", "json", "text":
+		disp = "inline"
+	case "svg":
+		if ft.MIME == "image/svg+xml" {
+			disp = "inline"
+		}
+	}
+	if ft.MIME == "application/octet-stream" {
+		disp = "attachment"
+	}
+	if ft.Kind != "pdf" { // chrome pdf viewer not work in sandbox
+		h.Set("Content-Security-Policy", "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; sandbox")
+	}
+	if name != "" {
+		disp += "; filename*=UTF-8''" + url.PathEscape(name)
+	}
+	h.Set("Content-Disposition", disp)
+}
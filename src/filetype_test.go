@@ -0,0 +1,102 @@
+package webmap
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSniffFile(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		kind string
+		mime string
+	}{
+		{"a.png", "\x89PNG\r\n\x1a\n0000", "image", "image/png"},
+		{"a.pdf", "%PDF-1.4\n", "pdf", "application/pdf"},
+		{"a.exe", "MZ" + string(make([]byte, 62)), "exe", "application/octet-stream"},
+		{"a.geojson", "\xef\xbb\xbf {\"type\": \"FeatureCollection\"}", "json", "application/json"},
+		{"a.csv", "x,y\n121,23\n", "text", "text/csv; charset=utf-8"},
+		{"a.svg", `<svg xmlns="http://www.w3.org/2000/svg"><rect/></svg>`, "svg", "image/svg+xml"},
+		{"a.svg", `<svg><script>alert(1)</script></svg>`, "svg", "application/octet-stream"},
+		{"a.svg", `<svg><rect onload="x()"/></svg>`, "svg", "application/octet-stream"},
+		{"a.svg", "<svg>" + strings.Repeat("<rect/>", 200 * 1024) + "</svg>", "svg", "application/octet-stream"}, // too large to scan
+		{"a.txt", "<!DOCTYPE html><html></html>", "html", "application/octet-stream"},
+		{"a.kml", `<?xml version="1.0"?><kml></kml>`, "xml", "text/xml; charset=utf-8"},
+	}
+	for _, c := range cases {
+		ft := sniffFile(bytes.NewReader([]byte(c.data)), c.name)
+		if ft.Kind != c.kind || ft.MIME != c.mime {
+			t.Error("sniff", c.name, c.data, "got", ft.Kind, ft.MIME)
+		}
+	}
+}
+
+func TestCheckFileType(t *testing.T) {
+	check := func(name string, data []byte, allow string) error {
+		_, err := checkFileType(bytes.NewReader(data), name, int64(len(data)), allow)
+		return err
+	}
+
+	if check("a.exe", append([]byte("MZ"), make([]byte, 62)...), "exe,bin") != ErrFileType {
+		t.Fatal("exe should never allow")
+	}
+	if check("a.pdf", []byte("%PDF-1.4\n"), "image") != ErrFileType {
+		t.Fatal("pdf not in allowlist")
+	}
+	if check("a.7z", []byte("7z\xbc\xaf\x27\x1c\x00\x04"), AttachAllowDefault) != nil {
+		t.Fatal("7z should allow by default")
+	}
+
+	// small archive ok, high ratio rejected
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	f, _ := zw.Create("a.txt")
+	f.Write([]byte("hello"))
+	zw.Close()
+	if err := check("a.zip", zb.Bytes(), "zip"); err != nil {
+		t.Fatal("small zip should pass", err)
+	}
+	if check("a.zip", []byte("PK\x03\x04broken"), "zip") != ErrFileType {
+		t.Fatal("broken zip should reject")
+	}
+
+	var gb bytes.Buffer
+	gw, _ := gzip.NewWriterLevel(&gb, gzip.BestCompression)
+	gw.Write(make([]byte, 4 * 1024 * 1024))
+	gw.Close()
+	if check("a.gz", gb.Bytes(), "gzip") != ErrArchiveBomb {
+		t.Fatal("high ratio gzip should reject")
+	}
+
+	zb.Reset()
+	zw = zip.NewWriter(&zb)
+	f, _ = zw.Create("zero.bin")
+	f.Write(make([]byte, 4 * 1024 * 1024))
+	zw.Close()
+	if check("a.zip", zb.Bytes(), "zip") != ErrArchiveBomb {
+		t.Fatal("high ratio zip should reject")
+	}
+}
+
+func TestSetSafeHeader(t *testing.T) {
+	w := httptest.NewRecorder()
+	setSafeHeader(w, fileTypeByName("x.html"), "x.html")
+	h := w.Header()
+	if h.Get("Content-Type") != "application/octet-stream" || h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatal("html should not render", h)
+	}
+	if h.Get("Content-Disposition") != "attachment; filename*=UTF-8''x.html" {
+		t.Fatal("html should force download", h.Get("Content-Disposition"))
+	}
+
+	w = httptest.NewRecorder()
+	setSafeHeader(w, &FileType{"image", "image/png"}, "圖.png")
+	if w.Header().Get("Content-Disposition") != "inline; filename*=UTF-8''%E5%9C%96.png" {
+		t.Fatal("image should inline", w.Header().Get("Content-Disposition"))
+	}
+}
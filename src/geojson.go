@@ -0,0 +1,378 @@
+package webmap
+
+/*
+* minimal GeoJSON model for server side convert / process
+* coordinate kept as []float64, [lng, lat(, z)]
+*/
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"sync"
+)
+
+var (
+	ErrGeoJSON = errors.New("bad geojson")
+)
+
+type FeatureCollection struct {
+	Type string `json:"type"` // "FeatureCollection"
+	Features []*Feature `json:"features"`
+	CRS *NamedCRS `json:"crs,omitempty"` // old GeoJSON (2008) only, removed after reproject
+
+	report *ConvReport // by table converter
+}
+
+// {"type": "name", "properties": {"name": "urn:ogc:def:crs:EPSG::3826"}}
+type NamedCRS struct {
+	Type string `json:"type"`
+	Properties struct {
+		Name string `json:"name"`
+	} `json:"properties"`
+}
+
+type Feature struct {
+	Type string `json:"type"` // "Feature"
+	ID interface{} `json:"id,omitempty"`
+	Geometry *Geometry `json:"geometry"` // nil for null geometry
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// only one of coordinate field used by Type
+type Geometry struct {
+	Type string
+	Point []float64 // Point
+	Line [][]float64 // LineString, MultiPoint
+	Poly [][][]float64 // Polygon, MultiLineString
+	Multi [][][][]float64 // MultiPolygon
+	Geoms []*Geometry // GeometryCollection
+}
+
+func NewFeatureCollection() *FeatureCollection {
+	return &FeatureCollection{
+		Type: "FeatureCollection",
+		Features: make([]*Feature, 0, 16),
+	}
+}
+
+func NewFeature(g *Geometry, props map[string]interface{}) *Feature {
+	if props == nil {
+		props = make(map[string]interface{})
+	}
+	return &Feature{
+		Type: "Feature",
+		Geometry: g,
+		Properties: props,
+	}
+}
+
+func ParseFeatureCollection(buf []byte) (*FeatureCollection, error) {
+	fc := &FeatureCollection{}
+	err := json.Unmarshal(buf, fc)
+	if err != nil {
+		return nil, err
+	}
+	switch fc.Type {
+	case "FeatureCollection":
+	case "Feature": // single feature
+		f := &Feature{}
+		err = json.Unmarshal(buf, f)
+		if err != nil {
+			return nil, err
+		}
+		fc = NewFeatureCollection()
+		fc.Features = append(fc.Features, f)
+	default:
+		return nil, ErrGeoJSON
+	}
+	return fc, nil
+}
+
+func (g *Geometry) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Type string `json:"type"`
+		Coordinates interface{} `json:"coordinates,omitempty"`
+		Geometries []*Geometry `json:"geometries,omitempty"`
+	}{Type: g.Type}
+	switch g.Type {
+	case "Point":
+		out.Coordinates = g.Point
+	case "LineString", "MultiPoint":
+		out.Coordinates = g.Line
+	case "Polygon", "MultiLineString":
+		out.Coordinates = g.Poly
+	case "MultiPolygon":
+		out.Coordinates = g.Multi
+	case "GeometryCollection":
+		out.Geometries = g.Geoms
+		if out.Geometries == nil {
+			out.Geometries = []*Geometry{}
+		}
+	default:
+		return nil, ErrGeoJSON
+	}
+	return json.Marshal(out)
+}
+
+func (g *Geometry) UnmarshalJSON(in []byte) error {
+	raw := struct {
+		Type string `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+		Geometries []*Geometry `json:"geometries"`
+	}{}
+	err := json.Unmarshal(in, &raw)
+	if err != nil {
+		return err
+	}
+	g.Type = raw.Type
+	switch g.Type {
+	case "Point":
+		err = json.Unmarshal(raw.Coordinates, &g.Point)
+	case "LineString", "MultiPoint":
+		err = json.Unmarshal(raw.Coordinates, &g.Line)
+	case "Polygon", "MultiLineString":
+		err = json.Unmarshal(raw.Coordinates, &g.Poly)
+	case "MultiPolygon":
+		err = json.Unmarshal(raw.Coordinates, &g.Multi)
+	case "GeometryCollection":
+		g.Geoms = raw.Geometries
+	default:
+		return ErrGeoJSON
+	}
+	return err
+}
+
+// call fn for every position, can modify in place
+func (g *Geometry) EachCoord(fn func(pt []float64)) {
+	if g == nil {
+		return
+	}
+	switch g.Type {
+	case "Point":
+		if len(g.Point) >= 2 {
+			fn(g.Point)
+		}
+	case "GeometryCollection":
+		for _, c := range g.Geoms {
+			c.EachCoord(fn)
+		}
+	}
+	for _, pt := range g.Line {
+		fn(pt)
+	}
+	for _, l := range g.Poly {
+		for _, pt := range l {
+			fn(pt)
+		}
+	}
+	for _, p := range g.Multi {
+		for _, l := range p {
+			for _, pt := range l {
+				fn(pt)
+			}
+		}
+	}
+}
+
+// round to 'digits' after decimal point, 7 for ~1cm in degree
+func (fc *FeatureCollection) Round(digits int) {
+	p := math.Pow(10, float64(digits))
+	for _, f := range fc.Features {
+		f.Geometry.EachCoord(func(pt []float64) {
+			for i := range pt {
+				pt[i] = math.Round(pt[i] * p) / p
+			}
+		})
+	}
+}
+
+// twice the signed area, > 0 for counter-clockwise (x right, y up)
+func ringArea2(ring [][]float64) float64 {
+	var a float64
+	for i := 0; i + 1 < len(ring); i++ {
+		a += ring[i][0] * ring[i+1][1] - ring[i+1][0] * ring[i][1]
+	}
+	return a
+}
+
+func reverseRing(ring [][]float64) {
+	for i, j := 0, len(ring) - 1; i < j; i, j = i + 1, j - 1 {
+		ring[i], ring[j] = ring[j], ring[i]
+	}
+}
+
+// ray casting, ring should be closed
+func ringContains(ring [][]float64, x float64, y float64) bool {
+	in := false
+	for i, j := 0, len(ring) - 1; i < len(ring); j, i = i, i + 1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > y) != (yj > y) && x < (xj - xi) * (y - yi) / (yj - yi) + xi {
+			in = !in
+		}
+	}
+	return in
+}
+
+// Douglas-Peucker, keep first & last
+func simplifyLine(pts [][]float64, tol float64) [][]float64 {
+	if tol <= 0 || len(pts) <= 2 {
+		return pts
+	}
+	keep := make([]bool, len(pts))
+	keep[0], keep[len(pts) - 1] = true, true
+	var dp func(a int, b int)
+	dp = func(a int, b int) {
+		if b <= a + 1 {
+			return
+		}
+		idx, max := -1, tol
+		for i := a + 1; i < b; i++ {
+			d := segDist(pts[i], pts[a], pts[b])
+			if d > max {
+				idx, max = i, d
+			}
+		}
+		if idx < 0 {
+			return
+		}
+		keep[idx] = true
+		dp(a, idx)
+		dp(idx, b)
+	}
+	dp(0, len(pts) - 1)
+
+	out := make([][]float64, 0, len(pts))
+	for i, pt := range pts {
+		if keep[i] {
+			out = append(out, pt)
+		}
+	}
+	return out
+}
+
+// distance from p to segment a-b
+func segDist(p []float64, a []float64, b []float64) float64 {
+	dx, dy := b[0] - a[0], b[1] - a[1]
+	if dx == 0 && dy == 0 {
+		return math.Hypot(p[0] - a[0], p[1] - a[1])
+	}
+	t := ((p[0] - a[0]) * dx + (p[1] - a[1]) * dy) / (dx * dx + dy * dy)
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(p[0] - a[0] - t * dx, p[1] - a[1] - t * dy)
+}
+
+// simplify line & ring, ring keep at least 4 point or unchanged
+func (g *Geometry) Simplify(tol float64) {
+	if g == nil || tol <= 0 {
+		return
+	}
+	ring := func(r [][]float64) [][]float64 {
+		s := simplifyLine(r, tol)
+		if len(s) < 4 {
+			return r
+		}
+		return s
+	}
+	switch g.Type {
+	case "LineString":
+		g.Line = simplifyLine(g.Line, tol)
+	case "MultiLineString":
+		for i, l := range g.Poly {
+			g.Poly[i] = simplifyLine(l, tol)
+		}
+	case "Polygon":
+		for i, r := range g.Poly {
+			g.Poly[i] = ring(r)
+		}
+	case "MultiPolygon":
+		for _, p := range g.Multi {
+			for i, r := range p {
+				p[i] = ring(r)
+			}
+		}
+	case "GeometryCollection":
+		for _, c := range g.Geoms {
+			c.Simplify(tol)
+		}
+	}
+}
+
+// parsed GeoJSON file by content version, built into tile source / query index
+type geoCache struct {
+	mx sync.Mutex
+	max int
+	lru *list.List
+	idx map[string]*list.Element
+	loading map[string]*geoCacheLoad // parsing without lock, same key wait for it
+	build func(key string, fc *FeatureCollection) interface{}
+}
+
+type geoCacheEntry struct {
+	key string
+	v interface{}
+}
+
+type geoCacheLoad struct {
+	done chan struct{}
+	v interface{}
+	err error
+}
+
+func newGeoCache(max int, build func(key string, fc *FeatureCollection) interface{}) *geoCache {
+	return &geoCache{
+		max: max,
+		lru: list.New(),
+		idx: make(map[string]*list.Element),
+		loading: make(map[string]*geoCacheLoad),
+		build: build,
+	}
+}
+
+func (c *geoCache) get(key string, fp string) (interface{}, error) {
+	c.mx.Lock()
+	if el, ok := c.idx[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mx.Unlock()
+		return el.Value.(*geoCacheEntry).v, nil
+	}
+	if ld, ok := c.loading[key]; ok {
+		c.mx.Unlock()
+		<-ld.done
+		return ld.v, ld.err
+	}
+	ld := &geoCacheLoad{done: make(chan struct{})}
+	c.loading[key] = ld
+	c.mx.Unlock()
+
+	ld.v, ld.err = c.load(key, fp)
+
+	c.mx.Lock()
+	delete(c.loading, key)
+	if ld.err == nil {
+		c.idx[key] = c.lru.PushFront(&geoCacheEntry{key, ld.v})
+		for c.lru.Len() > c.max {
+			el := c.lru.Back()
+			c.lru.Remove(el)
+			delete(c.idx, el.Value.(*geoCacheEntry).key)
+		}
+	}
+	c.mx.Unlock()
+	close(ld.done)
+	return ld.v, ld.err
+}
+
+func (c *geoCache) load(key string, fp string) (interface{}, error) {
+	buf, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := ParseFeatureCollection(buf)
+	if err != nil {
+		return nil, err
+	}
+	return c.build(key, fc), nil
+}
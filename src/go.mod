@@ -2,4 +2,7 @@ module webmap
 
 go 1.13
 
-require golang.org/x/crypto v0.0.0-20200128174031-69ecbb4d6d5d
+require (
+	golang.org/x/crypto v0.0.0-20200128174031-69ecbb4d6d5d
+	golang.org/x/text v0.3.2
+)
@@ -0,0 +1,153 @@
+package webmap
+
+/*
+* read GPX (GPS unit) into GeoJSON
+* waypoint as Point, route as LineString, track as (Multi)LineString by segment
+*/
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type gpxPoint struct {
+	Lat float64 `xml:"lat,attr"`
+	Lon float64 `xml:"lon,attr"`
+	Ele *float64 `xml:"ele"`
+	Time string `xml:"time"`
+	Name string `xml:"name"`
+	Desc string `xml:"desc"`
+	Cmt string `xml:"cmt"`
+	Sym string `xml:"sym"`
+	Type string `xml:"type"`
+}
+
+type gpxRoute struct {
+	Name string `xml:"name"`
+	Desc string `xml:"desc"`
+	Type string `xml:"type"`
+	Points []gpxPoint `xml:"rtept"`
+}
+
+type gpxTrack struct {
+	Name string `xml:"name"`
+	Desc string `xml:"desc"`
+	Type string `xml:"type"`
+	Segs []struct {
+		Points []gpxPoint `xml:"trkpt"`
+	} `xml:"trkseg"`
+}
+
+type gpxFile struct {
+	Waypoints []gpxPoint `xml:"wpt"`
+	Routes []gpxRoute `xml:"rte"`
+	Tracks []gpxTrack `xml:"trk"`
+}
+
+func convertGPX(fp string, a *Attachment) (*FeatureCollection, error) {
+	if a.Kind != "xml" {
+		return nil, ErrConvertType
+	}
+	fd, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	dec := newXMLDecoder(fd)
+	root, err := xmlRoot(dec)
+	if err != nil || root != "gpx" {
+		return nil, ErrConvertType
+	}
+	fd.Seek(0, 0)
+	gpx := &gpxFile{}
+	err = newXMLDecoder(fd).Decode(gpx)
+	if err != nil {
+		return nil, fmt.Errorf("bad gpx: %v", err)
+	}
+
+	fc := NewFeatureCollection()
+	for _, p := range gpx.Waypoints {
+		props := gpxProps(p.Name, p.Desc, p.Type)
+		if p.Cmt != "" {
+			props["cmt"] = strings.TrimSpace(p.Cmt)
+		}
+		if p.Sym != "" {
+			props["sym"] = strings.TrimSpace(p.Sym)
+		}
+		if p.Ele != nil {
+			props["ele"] = *p.Ele
+		}
+		if p.Time != "" {
+			props["time"] = strings.TrimSpace(p.Time)
+		}
+		fc.Features = append(fc.Features, NewFeature(&Geometry{Type: "Point", Point: p.coord()}, props))
+	}
+	for _, r := range gpx.Routes {
+		line := gpxLine(r.Points)
+		if len(line) < 2 {
+			continue
+		}
+		props := gpxProps(r.Name, r.Desc, r.Type)
+		fc.Features = append(fc.Features, NewFeature(&Geometry{Type: "LineString", Line: line}, props))
+	}
+	for _, t := range gpx.Tracks {
+		lines := make([][][]float64, 0, len(t.Segs))
+		var start, end string
+		for _, s := range t.Segs {
+			if line := gpxLine(s.Points); len(line) >= 2 {
+				lines = append(lines, line)
+			}
+			for _, p := range s.Points {
+				if p.Time == "" {
+					continue
+				}
+				if start == "" {
+					start = strings.TrimSpace(p.Time)
+				}
+				end = strings.TrimSpace(p.Time)
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		props := gpxProps(t.Name, t.Desc, t.Type)
+		if start != "" {
+			props["start"] = start
+			props["end"] = end
+		}
+		g := &Geometry{Type: "MultiLineString", Poly: lines}
+		if len(lines) == 1 {
+			g = &Geometry{Type: "LineString", Line: lines[0]}
+		}
+		fc.Features = append(fc.Features, NewFeature(g, props))
+	}
+	return fc, nil
+}
+
+func gpxProps(name string, desc string, typ string) map[string]interface{} {
+	props := make(map[string]interface{})
+	if name != "" {
+		props["name"] = strings.TrimSpace(name)
+	}
+	if desc != "" {
+		props["description"] = strings.TrimSpace(desc)
+	}
+	if typ != "" {
+		props["type"] = strings.TrimSpace(typ)
+	}
+	return props
+}
+
+func (p *gpxPoint) coord() []float64 {
+	return []float64{p.Lon, p.Lat}
+}
+
+func gpxLine(pts []gpxPoint) [][]float64 {
+	out := make([][]float64, 0, len(pts))
+	for i := range pts {
+		out = append(out, pts[i].coord())
+	}
+	return out
+}
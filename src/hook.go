@@ -8,7 +8,6 @@ package webmap
 */
 
 import (
-	"bytes"
 	"encoding/json"
 	"net/http"
 	"os"
@@ -21,7 +20,6 @@ import (
 
 var (
 	CacheInMemorySizeLimit = int64(16 * 1024 * 1024) // Bytes (16 MB)
-	CacheFileSizeLimit = int64(128 * 1024 * 1024) // Bytes (128 MB)
 	CacheFileDir = "./cache/"
 )
 
@@ -33,6 +31,7 @@ type HookConfig struct {
 	ID HookID `json:"hid,omitempty"` // unique
 	Token string `json:"token"` // unique, for guest download
 	AuthToken string `json:"auth"` // unique, for data pipeline input
+	OwnerUID UserID `json:"ouid,omitempty"` // who create it, data input count to this user's quota
 
 	// set when data input
 	Size int64 `json:"sz"`
@@ -40,14 +39,44 @@ type HookConfig struct {
 	Checksum string `json:"hash"` // also for ETag
 	SaveName string `json:"sn,omitempty"` // time + random + hash
 	ExtName string `json:"ext,omitempty"`
-	cache atomic.Value //[]byte // in-memory cache for small file
+	Kind string `json:"kind,omitempty"` // sniffed, see FileType
+	MIME string `json:"mime,omitempty"`
+	FeatureVer uint64 `json:"fver,omitempty"` // +1 for each data input, for 'geojson' diff
+	TableReport *ConvReport `json:"trep,omitempty"` // failed row when Table set
+	Stats *GeoStats `json:"stats,omitempty"` // GeoJSON only
+	NoStats bool `json:"nostats,omitempty"` // JSON but not GeoJSON, not retry by MigrateGeoStats
 
 	// set by config
 	Name string `json:"name"`
 	Note string `json:"note,omitempty"`
 	Disable bool `json:"disable,omitempty"`
 	RenderType string `json:"type,omitempty"` // geojson, UV json, UV png, UV bin
+	Table *TableConf `json:"table,omitempty"` // convert pushed CSV / XLSX into GeoJSON
+	SrcCRS string `json:"srccrs,omitempty"` // EPSG code of pushed table / GeoJSON, reproject to WGS84
 	// TODO: limit source IP? only set by another https server bind on different IP/port?
+
+	// set by config, server side pull mode
+	PullURL string `json:"purl,omitempty"` // empty for push only
+	PullCron string `json:"pcron,omitempty"` // "*/10 * * * *", "@every 30m"
+	PullHeader string `json:"phdr,omitempty"` // "Key: Value" per line
+	PullTimeout int `json:"pto,omitempty"` // Seconds
+	PullRetry int `json:"pretry,omitempty"`
+
+	// set by config, staleness monitor
+	Interval int `json:"intv,omitempty"` // expected update interval in Minutes, 0 for no check
+
+	// set by monitor
+	Stale bool `json:"stale,omitempty"` // last state for notification
+
+	// set by puller
+	PullETag string `json:"petag,omitempty"`
+	PullLastMod string `json:"plm,omitempty"`
+	PullTime time.Time `json:"ptime,omitempty"` // last try
+	PullCode int `json:"pcode,omitempty"` // last http status code
+	PullErr string `json:"perr,omitempty"` // last error, empty for ok
+
+	// set by scrubber
+	FileCheck
 }
 
 func (s *HookConfig) Clone() *HookConfig {
@@ -56,51 +85,89 @@ func (s *HookConfig) Clone() *HookConfig {
 }
 
 func (a *HookConfig) DelFromFS(baseDir string) error {
+	memCache.Del(a.cacheKey())
 	saveFp := filepath.Join(baseDir, a.SaveName)
 	return os.Remove(saveFp)
 }
 
-func (a *HookConfig) ServeContent(w http.ResponseWriter, r *http.Request, baseDir string) {
-	szCk := a.Size
-	if szCk < CacheInMemorySizeLimit { // check in-memory cache first
-		buf, ok := a.cache.Load().([]byte)
-		if ok && len(buf) == int(szCk) { // cache valid
-			w.Header().Set("Etag", `"` + a.Checksum + `"`)
-			http.ServeContent(w, r, a.ExtName, a.UpdateTime, bytes.NewReader(buf))
-			return
-		}
+func (a *HookConfig) cacheKey() string {
+	return "hook/" + a.SaveName
+}
+
+func (a *HookConfig) fileType() *FileType {
+	if a.MIME == "" { // data input before sniffing
+		return fileTypeByName(a.ExtName)
 	}
+	return &FileType{a.Kind, a.MIME}
+}
 
+// return true if file need check by scrubber
+func (a *HookConfig) ServeContent(w http.ResponseWriter, r *http.Request, baseDir string) bool {
+	if a.SaveName == "" { // no data yet
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return false
+	}
 	saveName := filepath.Clean("/" + a.SaveName)[1:] // clean again for SaveName in db tamper by other program
 	saveFp := filepath.Join(baseDir, saveName)
 
 	fi, err := os.Stat(saveFp)
 	if err != nil {
 		http.Error(w, "404 not found", http.StatusNotFound)
-		return
+		return !a.Corrupt
 	}
-	if fi.Size() != szCk {
-		http.Error(w, "419 Checksum failed", 419)
-		return
+	// full checksum by scrubber, only check size & mtime here
+	ok, suspect := a.quickCheck(fi, a.Size)
+	if !ok { // report to admin, not visitor
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return suspect
+	}
+
+	ft := a.fileType()
+	setSafeHeader(w, ft, "")
+
+	if memCache.ServeFile(w, r, a.cacheKey(), saveFp, ft.MIME, a.Size, a.UpdateTime, a.Checksum) { // small file
+		return suspect
 	}
 
 	fd, err := os.OpenFile(saveFp, os.O_RDONLY, 0400)
 	if err != nil {
 		http.Error(w, "404 not found", http.StatusNotFound)
-		return
+		return suspect
 	}
 	defer fd.Close()
 
-	// TODO: if size < in-memory size limit, cache it
-
-	// checksum check
-	sha256, ok := sha256fd(fd)
-	if !ok || sha256 != a.Checksum {
-		http.Error(w, "419 Checksum failed", 419)
-		return
-	}
 	w.Header().Set("Etag", `"` + a.Checksum + `"`)
 	http.ServeContent(w, r, a.ExtName, a.UpdateTime, fd)
+	return suspect
+}
+
+// no data input within expected interval
+func (a *HookConfig) IsStale(now time.Time) bool {
+	if a.Interval <= 0 {
+		return false
+	}
+	if a.UpdateTime.IsZero() {
+		return true
+	}
+	return now.Sub(a.UpdateTime) > time.Duration(a.Interval) * time.Minute
+}
+
+// freshness info for map client
+type HookFresh struct {
+	UpdateTime time.Time `json:"time"`
+	Age int64 `json:"age"` // Seconds
+	Stale bool `json:"stale,omitempty"`
+}
+
+func (a *HookConfig) Fresh(now time.Time) *HookFresh {
+	f := &HookFresh{
+		UpdateTime: a.UpdateTime,
+		Stale: a.IsStale(now),
+	}
+	if !a.UpdateTime.IsZero() {
+		f.Age = int64(now.Sub(a.UpdateTime) / time.Second)
+	}
+	return f
 }
 
 // only update info about data
@@ -260,6 +327,69 @@ func (s *HookStore) SetConfig(obj *HookConfig) error { // replace by HID, should
 	obj0.Note = obj.Note
 	obj0.Disable = obj.Disable
 	obj0.RenderType = obj.RenderType
+	obj0.Table = obj.Table
+	obj0.SrcCRS = obj.SrcCRS
+
+	obj0.PullURL = obj.PullURL
+	obj0.PullCron = obj.PullCron
+	obj0.PullHeader = obj.PullHeader
+	obj0.PullTimeout = obj.PullTimeout
+	obj0.PullRetry = obj.PullRetry
+	obj0.Interval = obj.Interval
+
+	s.updateSortList()
+
+	return nil
+}
+
+func (s *HookStore) SetPullStatus(obj *HookConfig) error { // replace by HID, only change pull status
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	id := obj.ID
+	obj0, ok := s.list[id]
+	if !ok {
+		return ErrNotExist
+	}
+
+	obj0.PullETag = obj.PullETag
+	obj0.PullLastMod = obj.PullLastMod
+	obj0.PullTime = obj.PullTime
+	obj0.PullCode = obj.PullCode
+	obj0.PullErr = obj.PullErr
+
+	s.updateSortList()
+
+	return nil
+}
+
+func (s *HookStore) SetStale(id HookID, stale bool) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	obj0, ok := s.list[id]
+	if !ok {
+		return ErrNotExist
+	}
+	obj0.Stale = stale
+
+	s.updateSortList()
+
+	return nil
+}
+
+func (s *HookStore) SetCheck(id HookID, saveName string, st *FileCheck) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	obj0, ok := s.list[id]
+	if !ok {
+		return ErrNotExist
+	}
+	if obj0.SaveName != saveName { // data changed when checking
+		return ErrNotExist
+	}
+	obj0.FileCheck = *st
 
 	s.updateSortList()
 
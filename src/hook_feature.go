@@ -0,0 +1,495 @@
+package webmap
+
+/*
+* incremental feature update for 'geojson' hook
+* keep canonical FeatureCollection in RAM, upsert / patch / delete by feature ID
+* every batch write back by updateHookData (new checksum & version)
+* keep a change log for client to fetch diff since their version
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	HookFeatureLogSize = 4096 // changes keep for diff
+
+	ErrNotGeoJSON = errors.New("not geojson hook")
+	ErrFeatureID = errors.New("feature without id")
+	ErrFeatureFmt = errors.New("feature format error")
+)
+
+const HookTypeGeoJSON = "geojson"
+
+// batch input for /api/feature/{auth token}
+type FeatureOps struct {
+	Upsert []json.RawMessage `json:"upsert,omitempty"` // full Feature
+	Patch []*FeaturePatch `json:"patch,omitempty"`
+	Delete []json.RawMessage `json:"delete,omitempty"` // feature ID
+}
+
+type FeaturePatch struct {
+	ID json.RawMessage `json:"id"`
+	Properties map[string]json.RawMessage `json:"properties"` // null for remove key
+}
+
+// output for '/hook/{token}?since={ver}'
+type FeatureDiff struct {
+	Type string `json:"type"` // always 'FeatureDiff'
+	Ver uint64 `json:"ver"`
+	Since uint64 `json:"since"`
+	Upsert []json.RawMessage `json:"upsert"`
+	Delete []json.RawMessage `json:"delete"`
+}
+
+type featureChange struct {
+	ver uint64
+	id string
+}
+
+type featureDoc struct {
+	mx sync.Mutex
+	hash string // Checksum of loaded data, reload when not match
+	ver uint64
+
+	ids []string // keep order
+	list map[string]json.RawMessage // id -> Feature
+	rawID map[string]json.RawMessage // id -> original id for output
+	noid []json.RawMessage // Feature without id, keep as is
+	head map[string]json.RawMessage // other member of FeatureCollection
+
+	base uint64 // log only cover version > base
+	log []featureChange
+}
+
+type HookFeatureStore struct {
+	db API
+
+	mx sync.Mutex
+	docs map[HookID]*featureDoc
+}
+
+func NewHookFeatureStore(db API) *HookFeatureStore {
+	return &HookFeatureStore{
+		db: db,
+		docs: make(map[HookID]*featureDoc),
+	}
+}
+
+func (fs *HookFeatureStore) getDoc(hid HookID) *featureDoc {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+	doc, ok := fs.docs[hid]
+	if !ok {
+		doc = &featureDoc{}
+		fs.docs[hid] = doc
+	}
+	return doc
+}
+
+func (fs *HookFeatureStore) Forget(hid HookID) {
+	fs.mx.Lock()
+	delete(fs.docs, hid)
+	fs.mx.Unlock()
+}
+
+// apply a batch, all or nothing
+func (fs *HookFeatureStore) Apply(hid HookID, ops *FeatureOps) (uint64, error) {
+	hook0 := fs.db.GetHookByID(hid)
+	if hook0 == nil {
+		return 0, ErrNotExist
+	}
+	if hook0.RenderType != HookTypeGeoJSON {
+		return 0, ErrNotGeoJSON
+	}
+
+	doc := fs.getDoc(hid)
+	doc.mx.Lock()
+	defer doc.mx.Unlock()
+
+	err := doc.sync(hook0)
+	if err != nil {
+		return 0, err
+	}
+
+	// check all before change anything
+	upsert := make(map[string]json.RawMessage, len(ops.Upsert))
+	upsertID := make([]string, 0, len(ops.Upsert))
+	upsertRaw := make(map[string]json.RawMessage, len(ops.Upsert))
+	for _, f := range ops.Upsert {
+		id, raw, err := parseFeature(f)
+		if err != nil {
+			return 0, err
+		}
+		if hook0.SrcCRS != "" { // stored data already in WGS84, only new geometry
+			f, err = reprojectFeature(hook0.SrcCRS, f)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if _, ok := upsert[id]; !ok {
+			upsertID = append(upsertID, id)
+		}
+		upsert[id] = f
+		upsertRaw[id] = raw
+	}
+	for _, p := range ops.Patch {
+		id, ok := featureKey(p.ID)
+		if !ok {
+			return 0, ErrFeatureID
+		}
+		if _, ok := upsert[id]; ok {
+			continue
+		}
+		if _, ok := doc.list[id]; !ok {
+			return 0, ErrNotExist
+		}
+	}
+	dels := make([]string, 0, len(ops.Delete))
+	for _, raw := range ops.Delete {
+		id, ok := featureKey(raw)
+		if !ok {
+			return 0, ErrFeatureID
+		}
+		dels = append(dels, id)
+	}
+
+	// apply on copy, keep doc unchanged if save failed
+	list := make(map[string]json.RawMessage, len(doc.list) + len(upsert))
+	for id, f := range doc.list {
+		list[id] = f
+	}
+	rawID := make(map[string]json.RawMessage, len(doc.rawID) + len(upsert))
+	for id, raw := range doc.rawID {
+		rawID[id] = raw
+	}
+	ids := append([]string{}, doc.ids...)
+	changed := make([]string, 0, len(upsertID) + len(ops.Patch) + len(dels))
+
+	for _, id := range upsertID {
+		if _, ok := list[id]; !ok {
+			ids = append(ids, id)
+		}
+		list[id] = upsert[id]
+		rawID[id] = upsertRaw[id]
+		changed = append(changed, id)
+	}
+	for _, p := range ops.Patch {
+		id, _ := featureKey(p.ID)
+		f, err := patchFeature(list[id], p.Properties)
+		if err != nil {
+			return 0, err
+		}
+		list[id] = f
+		changed = append(changed, id)
+	}
+	delMap := make(map[string]bool, len(dels))
+	for _, id := range dels {
+		if _, ok := list[id]; !ok {
+			continue
+		}
+		delete(list, id)
+		delMap[id] = true
+		changed = append(changed, id)
+	}
+	if len(delMap) > 0 {
+		ids2 := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if !delMap[id] {
+				ids2 = append(ids2, id)
+			}
+		}
+		ids = ids2
+	}
+
+	if len(changed) == 0 { // nothing to do
+		return doc.ver, nil
+	}
+
+	buf, err := encodeFeatureDoc(doc.head, ids, list, doc.noid)
+	if err != nil {
+		return 0, err
+	}
+	name := hook0.ExtName
+	if name == "" {
+		name = "data.geojson"
+	}
+	// already GeoJSON in WGS84, no table convert or reproject
+	err = saveHookData(fs.db, hook0, name, int64(len(buf)), bytes.NewReader(buf), &FileType{"json", "application/json"}, hook0.TableReport)
+	if err != nil {
+		return 0, err
+	}
+	hook := fs.db.GetHookByID(hid)
+	if hook == nil {
+		return 0, ErrNotExist
+	}
+
+	doc.ids = ids
+	doc.list = list
+	doc.rawID = rawID
+	if hook.FeatureVer != doc.ver + 1 { // something else also write, log not valid
+		doc.base = hook.FeatureVer
+		doc.log = nil
+	}
+	doc.ver = hook.FeatureVer
+	doc.hash = hook.Checksum
+	for _, id := range changed {
+		doc.log = append(doc.log, featureChange{ver: doc.ver, id: id})
+	}
+	if n := len(doc.log) - HookFeatureLogSize; n > 0 {
+		doc.base = doc.log[n-1].ver
+		doc.log = append([]featureChange{}, doc.log[n:]...)
+	}
+
+	return doc.ver, nil
+}
+
+// nil for client need full data
+func (fs *HookFeatureStore) Diff(hid HookID, since uint64) *FeatureDiff {
+	hook := fs.db.GetHookByID(hid)
+	if hook == nil || hook.RenderType != HookTypeGeoJSON {
+		return nil
+	}
+	if since > hook.FeatureVer {
+		return nil
+	}
+	if since == hook.FeatureVer { // up to date, no need load
+		return &FeatureDiff{
+			Type: "FeatureDiff",
+			Ver: since,
+			Since: since,
+			Upsert: []json.RawMessage{},
+			Delete: []json.RawMessage{},
+		}
+	}
+
+	doc := fs.getDoc(hid)
+	doc.mx.Lock()
+	defer doc.mx.Unlock()
+
+	err := doc.sync(hook)
+	if err != nil {
+		Vln(3, "[hook][feature]load data error", hid, err)
+		return nil
+	}
+	if since < doc.base {
+		return nil
+	}
+
+	out := &FeatureDiff{
+		Type: "FeatureDiff",
+		Ver: doc.ver,
+		Since: since,
+		Upsert: []json.RawMessage{},
+		Delete: []json.RawMessage{},
+	}
+	seen := make(map[string]bool)
+	for i := len(doc.log) - 1; i >= 0; i-- { // newest first
+		c := doc.log[i]
+		if c.ver <= since {
+			break
+		}
+		if seen[c.id] {
+			continue
+		}
+		seen[c.id] = true
+		if f, ok := doc.list[c.id]; ok {
+			out.Upsert = append(out.Upsert, f)
+		} else {
+			id, err := json.Marshal(c.id)
+			if err != nil {
+				continue
+			}
+			if raw, ok := doc.rawID[c.id]; ok {
+				id = raw
+			}
+			out.Delete = append(out.Delete, id)
+		}
+	}
+	return out
+}
+
+// (re)load from saved data if changed by full push / pull
+func (doc *featureDoc) sync(hook *HookConfig) error {
+	if doc.list != nil && doc.hash == hook.Checksum {
+		return nil
+	}
+
+	doc.head = nil
+	doc.ids = nil
+	doc.list = make(map[string]json.RawMessage)
+	doc.rawID = make(map[string]json.RawMessage)
+	doc.noid = nil
+	doc.log = nil
+	doc.ver = hook.FeatureVer
+	doc.base = hook.FeatureVer
+	doc.hash = hook.Checksum
+
+	if hook.SaveName == "" { // no data yet
+		return nil
+	}
+
+	saveName := filepath.Clean("/" + hook.SaveName)[1:]
+	buf, err := ioutil.ReadFile(filepath.Join(CacheFileDir, saveName))
+	if err != nil {
+		doc.list = nil
+		return err
+	}
+
+	head := make(map[string]json.RawMessage)
+	err = json.Unmarshal(buf, &head)
+	if err != nil {
+		doc.list = nil
+		return ErrFeatureFmt
+	}
+	var features []json.RawMessage
+	if raw, ok := head["features"]; ok {
+		err = json.Unmarshal(raw, &features)
+		if err != nil {
+			doc.list = nil
+			return ErrFeatureFmt
+		}
+	}
+	delete(head, "features")
+	doc.head = head
+
+	for _, f := range features {
+		id, raw, err := parseFeature(f)
+		if err == ErrFeatureID {
+			doc.noid = append(doc.noid, f)
+			continue
+		}
+		if err != nil {
+			doc.list = nil
+			return err
+		}
+		if _, ok := doc.list[id]; !ok {
+			doc.ids = append(doc.ids, id)
+		}
+		doc.list[id] = f
+		doc.rawID[id] = raw
+	}
+	return nil
+}
+
+func parseFeature(f json.RawMessage) (string, json.RawMessage, error) {
+	obj := struct {
+		Type string `json:"type"`
+		ID json.RawMessage `json:"id"`
+	}{}
+	err := json.Unmarshal(f, &obj)
+	if err != nil || obj.Type != "Feature" {
+		return "", nil, ErrFeatureFmt
+	}
+	id, ok := featureKey(obj.ID)
+	if !ok {
+		return "", nil, ErrFeatureID
+	}
+	return id, obj.ID, nil
+}
+
+// geometry from SrcCRS to WGS84, other member kept as is
+func reprojectFeature(crs string, f json.RawMessage) (json.RawMessage, error) {
+	obj := make(map[string]json.RawMessage)
+	err := json.Unmarshal(f, &obj)
+	if err != nil {
+		return nil, ErrFeatureFmt
+	}
+	g := bytes.TrimSpace(obj["geometry"])
+	if len(g) == 0 || string(g) == "null" {
+		return f, nil
+	}
+	ft := &Feature{Type: "Feature"}
+	err = json.Unmarshal(g, &ft.Geometry)
+	if err != nil || ft.Geometry == nil {
+		return nil, ErrFeatureFmt
+	}
+	fc := &FeatureCollection{Type: "FeatureCollection", Features: []*Feature{ft}}
+	err = fc.toWGS84(crs, "")
+	if err != nil {
+		return nil, err
+	}
+	fc.Round(ConvertDigits)
+	obj["geometry"], err = json.Marshal(ft.Geometry)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
+
+// feature ID can be string or number, "1" and 1 are the same
+func featureKey(raw json.RawMessage) (string, bool) {
+	s := strings.TrimSpace(string(raw))
+	if s == "" || s == "null" {
+		return "", false
+	}
+	if s[0] == '"' {
+		var str string
+		err := json.Unmarshal(raw, &str)
+		if err != nil || str == "" {
+			return "", false
+		}
+		return str, true
+	}
+	var num json.Number
+	err := json.Unmarshal(raw, &num)
+	if err != nil {
+		return "", false
+	}
+	return num.String(), true
+}
+
+// merge properties, null value for remove key
+func patchFeature(f json.RawMessage, props map[string]json.RawMessage) (json.RawMessage, error) {
+	obj := make(map[string]json.RawMessage)
+	err := json.Unmarshal(f, &obj)
+	if err != nil {
+		return nil, ErrFeatureFmt
+	}
+	p := make(map[string]json.RawMessage)
+	if raw, ok := obj["properties"]; ok && string(raw) != "null" {
+		err = json.Unmarshal(raw, &p)
+		if err != nil {
+			return nil, ErrFeatureFmt
+		}
+	}
+	for k, v := range props {
+		if v == nil || string(v) == "null" {
+			delete(p, k)
+			continue
+		}
+		p[k] = v
+	}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	obj["properties"] = raw
+	return json.Marshal(obj)
+}
+
+func encodeFeatureDoc(head map[string]json.RawMessage, ids []string, list map[string]json.RawMessage, noid []json.RawMessage) ([]byte, error) {
+	features := make([]json.RawMessage, 0, len(ids) + len(noid))
+	for _, id := range ids {
+		features = append(features, list[id])
+	}
+	features = append(features, noid...)
+
+	raw, err := json.Marshal(features)
+	if err != nil {
+		return nil, err
+	}
+	obj := make(map[string]json.RawMessage, len(head) + 2)
+	for k, v := range head {
+		obj[k] = v
+	}
+	obj["type"] = json.RawMessage(`"FeatureCollection"`)
+	obj["features"] = raw
+	return json.Marshal(obj)
+}
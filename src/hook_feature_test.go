@@ -0,0 +1,109 @@
+package webmap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestHookFeature(t *testing.T) {
+	dir, done := tempStorage(t, "hook-feature")
+	defer done()
+
+	db := NewDataStore()
+	hid, err := db.AddHook(&HookConfig{
+		Name: "test",
+		RenderType: HookTypeGeoJSON,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewHookFeatureStore(db)
+
+	ops := func(s string) *FeatureOps {
+		o := &FeatureOps{}
+		if err := json.Unmarshal([]byte(s), o); err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	load := func() map[string]map[string]interface{} {
+		hook := db.GetHookByID(hid)
+		buf, err := ioutil.ReadFile(filepath.Join(dir, hook.SaveName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := struct {
+			Type string `json:"type"`
+			Features []struct {
+				ID interface{} `json:"id"`
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"features"`
+		}{}
+		if err := json.Unmarshal(buf, &doc); err != nil || doc.Type != "FeatureCollection" {
+			t.Fatal("saved data not FeatureCollection", err, string(buf))
+		}
+		out := make(map[string]map[string]interface{})
+		for _, f := range doc.Features {
+			k, _ := json.Marshal(f.ID)
+			id, _ := featureKey(k)
+			out[id] = f.Properties
+		}
+		return out
+	}
+
+	ver1, err := fs.Apply(hid, ops(`{"upsert":[
+		{"type":"Feature","id":1,"geometry":{"type":"Point","coordinates":[121,25]},"properties":{"name":"a","spd":3}},
+		{"type":"Feature","id":"b","geometry":{"type":"Point","coordinates":[120,23]},"properties":{"name":"b"}}
+	]}`))
+	if err != nil || ver1 != 1 {
+		t.Fatal("upsert error", err, ver1)
+	}
+	hash1 := db.GetHookByID(hid).Checksum
+
+	ver2, err := fs.Apply(hid, ops(`{"patch":[{"id":"1","properties":{"spd":null,"hdg":90}}],"delete":["b"]}`))
+	if err != nil || ver2 != 2 {
+		t.Fatal("patch error", err, ver2)
+	}
+	if db.GetHookByID(hid).Checksum == hash1 {
+		t.Fatal("checksum should change")
+	}
+	doc := load()
+	if len(doc) != 1 || doc["1"]["name"] != "a" || doc["1"]["hdg"] != float64(90) || doc["1"]["spd"] != nil {
+		t.Fatal("patch not applied", doc)
+	}
+
+	// batch should be all or nothing
+	if _, err := fs.Apply(hid, ops(`{"upsert":[{"type":"Feature","id":3}],"patch":[{"id":"x","properties":{}}]}`)); err != ErrNotExist {
+		t.Fatal("patch missing feature should fail", err)
+	}
+	if _, err := fs.Apply(hid, ops(`{"upsert":[{"type":"Feature","properties":{}}]}`)); err != ErrFeatureID {
+		t.Fatal("feature without id should fail", err)
+	}
+	if db.GetHookByID(hid).FeatureVer != 2 || len(load()) != 1 {
+		t.Fatal("failed batch should not change data")
+	}
+
+	diff := fs.Diff(hid, 1)
+	if diff == nil || diff.Ver != 2 || len(diff.Upsert) != 1 || len(diff.Delete) != 1 || string(diff.Delete[0]) != `"b"` {
+		t.Fatal("diff not match", diff)
+	}
+	if diff := fs.Diff(hid, 2); diff == nil || len(diff.Upsert) + len(diff.Delete) != 0 {
+		t.Fatal("diff should be empty", diff)
+	}
+	if fs.Diff(hid, 3) != nil {
+		t.Fatal("unknown version should get full data")
+	}
+
+	// full push, reload from file & old diff not valid
+	hook := db.GetHookByID(hid).Clone()
+	fs2 := NewHookFeatureStore(db)
+	if fs2.Diff(hid, 1) != nil {
+		t.Fatal("diff not available after restart")
+	}
+	ver3, err := fs2.Apply(hid, ops(`{"delete":[1]}`))
+	if err != nil || ver3 != hook.FeatureVer + 1 || len(load()) != 0 {
+		t.Fatal("delete after reload error", err, ver3)
+	}
+}
@@ -0,0 +1,99 @@
+package webmap
+
+/*
+* staleness monitor for hook
+* mark hook as stale when no data input within HookConfig.Interval
+* and send notification when state change
+*/
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	HookStaleCheckInterval = 60 * time.Second
+)
+
+type HookMonitor struct {
+	db API
+	die chan struct{}
+}
+
+func NewHookMonitor(db API) *HookMonitor {
+	return &HookMonitor{
+		db: db,
+		die: make(chan struct{}),
+	}
+}
+
+func (m *HookMonitor) Start() {
+	go m.loop()
+}
+
+func (m *HookMonitor) Close() {
+	select {
+	case <-m.die:
+	default:
+		close(m.die)
+	}
+}
+
+func (m *HookMonitor) loop() {
+	ticker := time.NewTicker(HookStaleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		m.check(time.Now())
+		select {
+		case <-m.die:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *HookMonitor) check(now time.Time) {
+	for _, obj := range m.db.ListHook() {
+		hook := m.db.GetHookByID(obj.ID)
+		if hook == nil {
+			continue
+		}
+
+		stale := !hook.Disable && hook.IsStale(now)
+		if stale == hook.Stale {
+			continue
+		}
+		err := m.db.SetHookStale(hook.ID, stale)
+		if err != nil {
+			Vln(3, "[hook][stale]set state err", hook.ID, err)
+			continue
+		}
+		if hook.Disable { // reset only, no notify
+			continue
+		}
+
+		title, msg := "", ""
+		if stale {
+			title = "動態資源資料過期: " + hook.Name
+			msg = fmt.Sprintf("超過 %v 分鐘未更新, 最後更新時間: %v", hook.Interval, formatUpdateTime(hook.UpdateTime))
+		} else {
+			title = "動態資源資料恢復更新: " + hook.Name
+			msg = fmt.Sprintf("最後更新時間: %v", formatUpdateTime(hook.UpdateTime))
+		}
+		if hook.PullErr != "" {
+			msg += "\n拉取錯誤: " + hook.PullErr
+		}
+		err = sendNotify(m.db.GetConfig(), title, msg)
+		if err != nil {
+			Vln(3, "[hook][stale]notify err", hook.ID, err)
+		}
+	}
+}
+
+func formatUpdateTime(t time.Time) string {
+	if t.IsZero() {
+		return "無資料"
+	}
+	return t.Format("2006-01-02 15:04:05 -0700")
+}
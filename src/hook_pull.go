@@ -0,0 +1,270 @@
+package webmap
+
+/*
+* server side pull mode for hook
+* fetch HookConfig.PullURL by HookConfig.PullCron, with conditional GET (ETag/Last-Modified)
+* then save by the same path as push (updateHookData)
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	HookPullInterval = 30 * time.Second // check schedule period
+	HookPullTimeout = 60 * time.Second // default timeout for each try
+	HookPullMaxRetry = 5
+	HookPullUA = "Mozilla/5.0 (dynmap hook puller)"
+
+	ErrPullTooLarge = errors.New("remote file too large")
+	ErrPullRunning = errors.New("pull already running")
+)
+
+type HookPuller struct {
+	db API
+	die chan struct{}
+
+	mx sync.Mutex
+	running map[HookID]bool
+}
+
+func NewHookPuller(db API) *HookPuller {
+	return &HookPuller{
+		db: db,
+		die: make(chan struct{}),
+		running: make(map[HookID]bool),
+	}
+}
+
+func (p *HookPuller) Start() {
+	go p.loop()
+}
+
+func (p *HookPuller) Close() {
+	select {
+	case <-p.die:
+	default:
+		close(p.die)
+	}
+}
+
+func (p *HookPuller) loop() {
+	ticker := time.NewTicker(HookPullInterval)
+	defer ticker.Stop()
+
+	for {
+		p.checkAll(time.Now())
+		select {
+		case <-p.die:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *HookPuller) checkAll(now time.Time) {
+	for _, obj := range p.db.ListHook() {
+		hook := p.db.GetHookByID(obj.ID)
+		if hook == nil || !isPullDue(hook, now) {
+			continue
+		}
+		go func(hid HookID) {
+			err := p.Pull(hid)
+			if err != nil && err != ErrPullRunning {
+				Vln(3, "[hook][pull]err", hid, err)
+			}
+		}(hook.ID)
+	}
+}
+
+func isPullDue(hook *HookConfig, now time.Time) bool {
+	if hook.Disable || hook.PullURL == "" {
+		return false
+	}
+	spec, err := ParseCron(hook.PullCron)
+	if err != nil {
+		return false
+	}
+	if hook.PullTime.IsZero() { // never pulled
+		return true
+	}
+	next := spec.Next(hook.PullTime)
+	return !next.IsZero() && !now.Before(next)
+}
+
+// fetch once (with retry) and record status, no schedule check
+func (p *HookPuller) Pull(hid HookID) error {
+	p.mx.Lock()
+	if p.running[hid] {
+		p.mx.Unlock()
+		return ErrPullRunning
+	}
+	p.running[hid] = true
+	p.mx.Unlock()
+
+	defer func() {
+		p.mx.Lock()
+		delete(p.running, hid)
+		p.mx.Unlock()
+	}()
+
+	hook := p.db.GetHookByID(hid)
+	if hook == nil {
+		return ErrNotExist
+	}
+
+	retry := hook.PullRetry
+	if retry < 0 {
+		retry = 0
+	}
+	if retry > HookPullMaxRetry {
+		retry = HookPullMaxRetry
+	}
+
+	var code int
+	var etag, lastMod string
+	var err error
+	for i := 0; i <= retry; i++ {
+		if i > 0 {
+			select {
+			case <-p.die:
+				return err
+			case <-time.After(time.Duration(1<<uint(i-1)) * time.Second): // 1s, 2s, 4s...
+			}
+		}
+		code, etag, lastMod, err = p.fetch(hid)
+		if err == nil || err == ErrFileType || err == ErrArchiveBomb || isQuotaErr(err) || err == ErrPullTooLarge || err == ErrTableColumn || err == ErrConvertCRS || err == ErrGeoJSON {
+			break
+		}
+	}
+
+	hook = p.db.GetHookByID(hid)
+	if hook == nil { // deleted when pulling
+		return ErrNotExist
+	}
+	st := hook.Clone()
+	st.PullTime = time.Now()
+	st.PullCode = code
+	st.PullErr = ""
+	if err != nil {
+		st.PullErr = err.Error()
+	}
+	if err == nil && code == http.StatusOK {
+		st.PullETag = etag
+		st.PullLastMod = lastMod
+	}
+	if err2 := p.db.UpdateHookPullStatus(st); err2 != nil {
+		return err2
+	}
+	return err
+}
+
+func (p *HookPuller) fetch(hid HookID) (code int, etag string, lastMod string, err error) {
+	hook0 := p.db.GetHookByID(hid)
+	if hook0 == nil {
+		return 0, "", "", ErrNotExist
+	}
+
+	req, err := http.NewRequest("GET", hook0.PullURL, nil)
+	if err != nil {
+		return 0, "", "", err
+	}
+	req.Header.Set("User-Agent", HookPullUA)
+	for _, line := range strings.Split(hook0.PullHeader, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		k := strings.TrimSpace(kv[0])
+		if k == "" {
+			continue
+		}
+		req.Header.Set(k, strings.TrimSpace(kv[1]))
+	}
+	if hook0.SaveName != "" { // only conditional GET when we have data
+		if hook0.PullETag != "" {
+			req.Header.Set("If-None-Match", hook0.PullETag)
+		}
+		if hook0.PullLastMod != "" {
+			req.Header.Set("If-Modified-Since", hook0.PullLastMod)
+		}
+	}
+
+	timeout := HookPullTimeout
+	if hook0.PullTimeout > 0 {
+		timeout = time.Duration(hook0.PullTimeout) * time.Second
+	}
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: fetchTransport,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer resp.Body.Close()
+
+	code = resp.StatusCode
+	switch code {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return code, "", "", nil
+	default:
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		return code, "", "", fmt.Errorf("http status %v", resp.Status)
+	}
+
+	// spool to temp file first, for file magic check & size
+	tmp, err := ioutil.TempFile(CacheFileDir, "pull-")
+	if err != nil {
+		return code, "", "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	limit := p.db.GetConfig().hookSizeLimit()
+	n, err := io.Copy(tmp, io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return code, "", "", err
+	}
+	if n > limit {
+		return code, "", "", ErrPullTooLarge
+	}
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return code, "", "", err
+	}
+
+	// hook may be edited while downloading, save onto the current one
+	hook := p.db.GetHookByID(hid)
+	if hook == nil {
+		return code, "", "", ErrNotExist
+	}
+	err = updateHookData(p.db, hook, pullFileName(resp), n, tmp)
+	if err != nil {
+		return code, "", "", err
+	}
+	return code, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
+
+func pullFileName(resp *http.Response) string {
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	name := path.Base(resp.Request.URL.Path)
+	if name == "/" || name == "." {
+		return "data"
+	}
+	return name
+}
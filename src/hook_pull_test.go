@@ -0,0 +1,177 @@
+package webmap
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCronSpec(t *testing.T) {
+	bad := []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "@every 10s", "a * * * *"}
+	for _, s := range bad {
+		if _, err := ParseCron(s); err == nil {
+			t.Fatal("should be invalid spec", s)
+		}
+	}
+
+	t0 := time.Date(2020, 6, 1, 10, 7, 30, 0, time.UTC) // Monday
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2020, 6, 1, 10, 8, 0, 0, time.UTC)},
+		{"*/10 * * * *", time.Date(2020, 6, 1, 10, 10, 0, 0, time.UTC)},
+		{"5 * * * *", time.Date(2020, 6, 1, 11, 5, 0, 0, time.UTC)},
+		{"0 0 * * *", time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC)},
+		{"30 8 * * 0", time.Date(2020, 6, 7, 8, 30, 0, 0, time.UTC)},
+		{"30 8 * * 7", time.Date(2020, 6, 7, 8, 30, 0, 0, time.UTC)},
+		{"0 12 15 1,7 *", time.Date(2020, 7, 15, 12, 0, 0, 0, time.UTC)},
+		{"0 0 5 * 1", time.Date(2020, 6, 5, 0, 0, 0, 0, time.UTC)}, // dom or dow
+		{"0 0 9 * 1", time.Date(2020, 6, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 */2 * 1", time.Date(2020, 6, 15, 0, 0, 0, 0, time.UTC)}, // '*' in dom: dom and dow
+		{"@hourly", time.Date(2020, 6, 1, 11, 0, 0, 0, time.UTC)},
+		{"@every 30m", t0.Add(30 * time.Minute)},
+	}
+	for _, tc := range tests {
+		c, err := ParseCron(tc.spec)
+		if err != nil {
+			t.Fatal("parse spec error", tc.spec, err)
+		}
+		next := c.Next(t0)
+		if !next.Equal(tc.next) {
+			t.Fatal("next time not match", tc.spec, next, tc.next)
+		}
+	}
+}
+
+func TestHookPull(t *testing.T) {
+	dir, done := tempStorage(t, "hook-pull")
+	defer done()
+
+	var hit, fail int32
+	var edit atomic.Value // edit hook while serving
+	payload := []byte(`{"type":"FeatureCollection","features":[]}`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hit, 1)
+		if r.Header.Get("X-Token") != "abc" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if atomic.LoadInt32(&fail) > 0 {
+			atomic.AddInt32(&fail, -1)
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		if f, ok := edit.Load().(func()); ok {
+			f()
+		} else if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(payload)
+	}))
+	defer srv.Close()
+
+	AttachFetchPrivate = true // test server on loopback
+	defer func() { AttachFetchPrivate = false }()
+
+	db := NewDataStore()
+	hid, err := db.AddHook(&HookConfig{
+		Name: "test",
+		PullURL: srv.URL + "/data.json",
+		PullCron: "*/5 * * * *",
+		PullHeader: "X-Token: abc\n",
+		PullRetry: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewHookPuller(db)
+	defer p.Close()
+
+	if !isPullDue(db.GetHookByID(hid), time.Now()) {
+		t.Fatal("never pulled hook should be due")
+	}
+
+	// first pull, save data
+	if err := p.Pull(hid); err != nil {
+		t.Fatal("pull error", err)
+	}
+	hook := db.GetHookByID(hid)
+	if hook.Size != int64(len(payload)) || hook.ExtName != "data.json" || hook.Checksum == "" {
+		t.Fatal("hook data not update", hook)
+	}
+	if hook.PullETag != `"v1"` || hook.PullCode != http.StatusOK || hook.PullErr != "" {
+		t.Fatal("pull status not update", hook)
+	}
+	buf, err := ioutil.ReadFile(dir + "/" + hook.SaveName)
+	if err != nil || string(buf) != string(payload) {
+		t.Fatal("saved data not match", err, string(buf))
+	}
+	if isPullDue(hook, hook.PullTime) {
+		t.Fatal("should not due right after pull", hook.PullTime)
+	}
+
+	// conditional GET, data not change
+	saveName := hook.SaveName
+	if err := p.Pull(hid); err != nil {
+		t.Fatal("pull error", err)
+	}
+	hook = db.GetHookByID(hid)
+	if hook.SaveName != saveName || hook.PullCode != http.StatusNotModified {
+		t.Fatal("data should not change on 304", hook)
+	}
+
+	// retry
+	atomic.StoreInt32(&fail, 1)
+	atomic.StoreInt32(&hit, 0)
+	if err := p.Pull(hid); err != nil {
+		t.Fatal("pull should success after retry", err)
+	}
+	if atomic.LoadInt32(&hit) != 2 {
+		t.Fatal("should retry once", hit)
+	}
+
+	// edit during download kept
+	edit.Store(func() {
+		hk := db.GetHookByID(hid).Clone()
+		hk.Name = "edited"
+		db.UpdateHookConfig(hk)
+	})
+	if err := p.Pull(hid); err != nil {
+		t.Fatal("pull error", err)
+	}
+	hook = db.GetHookByID(hid)
+	if hook.Name != "edited" || hook.SaveName == saveName {
+		t.Fatal("edit during pull reverted", hook)
+	}
+	saveName = hook.SaveName
+
+	// error recorded
+	hook = db.GetHookByID(hid).Clone()
+	hook.PullHeader = ""
+	hook.PullRetry = 0
+	db.UpdateHookConfig(hook)
+	if err := p.Pull(hid); err == nil {
+		t.Fatal("pull should fail without header")
+	}
+	hook = db.GetHookByID(hid)
+	if hook.PullCode != http.StatusForbidden || hook.PullErr == "" || hook.SaveName != saveName {
+		t.Fatal("pull error not record", hook)
+	}
+
+	// loopback not allowed by default
+	hook = db.GetHookByID(hid).Clone()
+	hook.PullHeader = "X-Token: abc\n"
+	db.UpdateHookConfig(hook)
+	atomic.StoreInt32(&hit, 0)
+	AttachFetchPrivate = false
+	fetchTransport.CloseIdleConnections() // guard on dial only
+	if err := p.Pull(hid); err == nil || atomic.LoadInt32(&hit) != 0 {
+		t.Fatal("pull from loopback should fail", err, hit)
+	}
+}
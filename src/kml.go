@@ -0,0 +1,398 @@
+package webmap
+
+/*
+* read KML / KMZ (Google Earth) into GeoJSON
+* Placemark name, description, ExtendedData and folder path kept as properties
+* style color kept as simplestyle properties (stroke, fill ...)
+*/
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+type kmlStyle struct {
+	ID string `xml:"id,attr"`
+	LineColor string `xml:"LineStyle>color"`
+	LineWidth string `xml:"LineStyle>width"`
+	PolyColor string `xml:"PolyStyle>color"`
+	PolyFill string `xml:"PolyStyle>fill"`
+	IconColor string `xml:"IconStyle>color"`
+}
+
+type kmlStyleMap struct {
+	ID string `xml:"id,attr"`
+	Pairs []struct {
+		Key string `xml:"key"`
+		StyleURL string `xml:"styleUrl"`
+	} `xml:"Pair"`
+}
+
+type kmlPoly struct {
+	Outer string `xml:"outerBoundaryIs>LinearRing>coordinates"`
+	Inner []string `xml:"innerBoundaryIs>LinearRing>coordinates"`
+}
+
+type kmlGeom struct {
+	Points []string `xml:"Point>coordinates"`
+	Lines []string `xml:"LineString>coordinates"`
+	Rings []string `xml:"LinearRing>coordinates"`
+	Polys []kmlPoly `xml:"Polygon"`
+	Multi []kmlGeom `xml:"MultiGeometry"`
+}
+
+type kmlPlacemark struct {
+	ID string `xml:"id,attr"`
+	Name string `xml:"name"`
+	Desc string `xml:"description"`
+	StyleURL string `xml:"styleUrl"`
+	Style *kmlStyle `xml:"Style"`
+	Data []struct {
+		Name string `xml:"name,attr"`
+		Value string `xml:"value"`
+	} `xml:"ExtendedData>Data"`
+	SimpleData []struct {
+		Name string `xml:"name,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"ExtendedData>SchemaData>SimpleData"`
+	kmlGeom
+
+	folder string
+}
+
+func convertKML(fp string, a *Attachment) (*FeatureCollection, error) {
+	if a.Kind != "xml" {
+		return nil, ErrConvertType
+	}
+	fd, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return readKML(fd)
+}
+
+// zip with .kml inside, doc.kml first
+func convertKMZ(fp string, a *Attachment) (*FeatureCollection, error) {
+	if a.Kind != "zip" {
+		return nil, ErrConvertType
+	}
+	zr, err := zip.OpenReader(fp)
+	if err != nil {
+		return nil, ErrConvertType
+	}
+	defer zr.Close()
+
+	var kml *zip.File
+	for _, f := range zr.File {
+		if strings.ToLower(path.Ext(f.Name)) != ".kml" || strings.HasPrefix(path.Base(f.Name), "._") {
+			continue
+		}
+		if kml == nil || strings.ToLower(path.Base(f.Name)) == "doc.kml" {
+			kml = f
+		}
+	}
+	if kml == nil {
+		return nil, ErrConvertType
+	}
+	fd, err := kml.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return readKML(fd)
+}
+
+func newXMLDecoder(rd io.Reader) *xml.Decoder {
+	dec := xml.NewDecoder(rd)
+	dec.Strict = false
+	dec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(label)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}
+	return dec
+}
+
+// name of root element, ErrConvertType if not xml
+func xmlRoot(dec *xml.Decoder) (string, error) {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", ErrConvertType
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			return se.Name.Local, nil
+		}
+	}
+}
+
+func readKML(rd io.Reader) (*FeatureCollection, error) {
+	dec := newXMLDecoder(rd)
+	root, err := xmlRoot(dec)
+	if err != nil || root != "kml" {
+		return nil, ErrConvertType
+	}
+
+	styles := make(map[string]*kmlStyle)
+	styleMaps := make(map[string]string) // id -> normal styleUrl
+	marks := make([]*kmlPlacemark, 0, 64)
+	folders := make([]string, 0, 4) // name of Document / Folder, "" if not named yet
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad kml: %v", err)
+		}
+		switch se := tok.(type) {
+		case xml.StartElement:
+			switch se.Name.Local {
+			case "Document", "Folder":
+				folders = append(folders, "")
+			case "name":
+				var name string
+				if err := dec.DecodeElement(&name, &se); err != nil {
+					return nil, err
+				}
+				if n := len(folders); n > 0 && folders[n-1] == "" { // first one, not from overlay
+					folders[n-1] = strings.TrimSpace(name)
+				}
+			case "Style":
+				st := &kmlStyle{}
+				if err := dec.DecodeElement(st, &se); err != nil {
+					return nil, err
+				}
+				styles["#" + st.ID] = st
+			case "StyleMap":
+				sm := &kmlStyleMap{}
+				if err := dec.DecodeElement(sm, &se); err != nil {
+					return nil, err
+				}
+				for _, p := range sm.Pairs {
+					if p.Key == "normal" {
+						styleMaps["#" + sm.ID] = strings.TrimSpace(p.StyleURL)
+					}
+				}
+			case "Placemark":
+				pm := &kmlPlacemark{}
+				if err := dec.DecodeElement(pm, &se); err != nil {
+					return nil, err
+				}
+				pm.folder = kmlFolder(folders)
+				marks = append(marks, pm)
+			}
+		case xml.EndElement:
+			switch se.Name.Local {
+			case "Document", "Folder":
+				if len(folders) > 0 {
+					folders = folders[:len(folders)-1]
+				}
+			}
+		}
+	}
+
+	fc := NewFeatureCollection()
+	for _, pm := range marks {
+		props := make(map[string]interface{})
+		if pm.Name != "" {
+			props["name"] = strings.TrimSpace(pm.Name)
+		}
+		if pm.Desc != "" {
+			props["description"] = strings.TrimSpace(pm.Desc)
+		}
+		if pm.folder != "" {
+			props["folder"] = pm.folder
+		}
+		for _, d := range pm.Data {
+			props[d.Name] = strings.TrimSpace(d.Value)
+		}
+		for _, d := range pm.SimpleData {
+			props[d.Name] = strings.TrimSpace(d.Value)
+		}
+
+		st := pm.Style
+		if st == nil {
+			url := strings.TrimSpace(pm.StyleURL)
+			if v, ok := styleMaps[url]; ok {
+				url = v
+			}
+			st = styles[url]
+		}
+		st.setProps(props)
+
+		f := NewFeature(pm.kmlGeom.geometry(), props)
+		if pm.ID != "" {
+			f.ID = pm.ID
+		}
+		fc.Features = append(fc.Features, f)
+	}
+	return fc, nil
+}
+
+// "Document/Folder/Sub", skip unnamed & root Document
+func kmlFolder(folders []string) string {
+	out := make([]string, 0, len(folders))
+	for i, v := range folders {
+		if v == "" || i == 0 {
+			continue
+		}
+		out = append(out, v)
+	}
+	return strings.Join(out, "/")
+}
+
+func (st *kmlStyle) setProps(props map[string]interface{}) {
+	if st == nil {
+		return
+	}
+	if c, op, ok := kmlColor(st.LineColor); ok {
+		props["stroke"] = c
+		props["stroke-opacity"] = op
+	}
+	if w, err := strconv.ParseFloat(strings.TrimSpace(st.LineWidth), 64); err == nil {
+		props["stroke-width"] = w
+	}
+	if c, op, ok := kmlColor(st.PolyColor); ok {
+		if strings.TrimSpace(st.PolyFill) == "0" {
+			op = 0
+		}
+		props["fill"] = c
+		props["fill-opacity"] = op
+	}
+	if c, _, ok := kmlColor(st.IconColor); ok {
+		props["marker-color"] = c
+	}
+}
+
+// KML color is aabbggrr
+func kmlColor(s string) (string, float64, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(s) != 8 {
+		return "", 0, false
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return "", 0, false
+	}
+	a, b, g, r := v >> 24, (v >> 16) & 0xff, (v >> 8) & 0xff, v & 0xff
+	op := float64(int(float64(a) / 255 * 100 + 0.5)) / 100
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b), op, true
+}
+
+// "lng,lat[,alt] lng,lat[,alt] ..."
+func kmlCoords(s string) [][]float64 {
+	out := make([][]float64, 0, 16)
+	for _, t := range strings.Fields(s) {
+		p := strings.Split(t, ",")
+		if len(p) < 2 {
+			continue
+		}
+		x, err1 := strconv.ParseFloat(p[0], 64)
+		y, err2 := strconv.ParseFloat(p[1], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		out = append(out, []float64{x, y})
+	}
+	return out
+}
+
+// RFC 7946 winding, outer counter-clockwise
+func kmlPolygon(p kmlPoly) [][][]float64 {
+	outer := kmlCoords(p.Outer)
+	if len(outer) < 4 {
+		return nil
+	}
+	if ringArea2(outer) < 0 {
+		reverseRing(outer)
+	}
+	rings := [][][]float64{outer}
+	for _, s := range p.Inner {
+		r := kmlCoords(s)
+		if len(r) < 4 {
+			continue
+		}
+		if ringArea2(r) > 0 {
+			reverseRing(r)
+		}
+		rings = append(rings, r)
+	}
+	return rings
+}
+
+// single one as is, same type as Multi*, mixed as GeometryCollection
+func (g *kmlGeom) geometry() *Geometry {
+	geoms := g.flatten(nil)
+	if len(geoms) == 0 {
+		return nil
+	}
+	if len(geoms) == 1 {
+		return geoms[0]
+	}
+	typ := geoms[0].Type
+	for _, c := range geoms[1:] {
+		if c.Type != typ {
+			return &Geometry{Type: "GeometryCollection", Geoms: geoms}
+		}
+	}
+	switch typ {
+	case "Point":
+		out := &Geometry{Type: "MultiPoint"}
+		for _, c := range geoms {
+			out.Line = append(out.Line, c.Point)
+		}
+		return out
+	case "LineString":
+		out := &Geometry{Type: "MultiLineString"}
+		for _, c := range geoms {
+			out.Poly = append(out.Poly, c.Line)
+		}
+		return out
+	case "Polygon":
+		out := &Geometry{Type: "MultiPolygon"}
+		for _, c := range geoms {
+			out.Multi = append(out.Multi, c.Poly)
+		}
+		return out
+	}
+	return &Geometry{Type: "GeometryCollection", Geoms: geoms}
+}
+
+func (g *kmlGeom) flatten(out []*Geometry) []*Geometry {
+	for _, s := range g.Points {
+		if pts := kmlCoords(s); len(pts) > 0 {
+			out = append(out, &Geometry{Type: "Point", Point: pts[0]})
+		}
+	}
+	for _, s := range g.Lines {
+		if pts := kmlCoords(s); len(pts) >= 2 {
+			out = append(out, &Geometry{Type: "LineString", Line: pts})
+		}
+	}
+	for _, s := range g.Rings {
+		if rings := kmlPolygon(kmlPoly{Outer: s}); rings != nil {
+			out = append(out, &Geometry{Type: "Polygon", Poly: rings})
+		}
+	}
+	for _, p := range g.Polys {
+		if rings := kmlPolygon(p); rings != nil {
+			out = append(out, &Geometry{Type: "Polygon", Poly: rings})
+		}
+	}
+	for i := range g.Multi {
+		out = g.Multi[i].flatten(out)
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+package webmap
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKML = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2">
+<Document>
+	<name>巡查</name>
+	<Style id="red"><LineStyle><color>ff0000ff</color><width>3</width></LineStyle><PolyStyle><color>7f00ff00</color></PolyStyle></Style>
+	<StyleMap id="redMap"><Pair><key>normal</key><styleUrl>#red</styleUrl></Pair><Pair><key>highlight</key><styleUrl>#none</styleUrl></Pair></StyleMap>
+	<Folder>
+		<name>區域</name>
+		<Placemark id="p1">
+			<name>保護區</name>
+			<description><![CDATA[<b>禁止</b>進入]]></description>
+			<styleUrl>#redMap</styleUrl>
+			<ExtendedData><Data name="level"><value>A</value></Data></ExtendedData>
+			<Polygon>
+				<outerBoundaryIs><LinearRing><coordinates>120,23,0 121,23,0 121,24,0 120,24,0 120,23,0</coordinates></LinearRing></outerBoundaryIs>
+				<innerBoundaryIs><LinearRing><coordinates>120.2,23.2 120.2,23.4 120.4,23.4 120.4,23.2 120.2,23.2</coordinates></LinearRing></innerBoundaryIs>
+			</Polygon>
+		</Placemark>
+	</Folder>
+	<Placemark>
+		<name>站點</name>
+		<styleUrl>#red</styleUrl>
+		<MultiGeometry>
+			<Point><coordinates>121.5,25.0</coordinates></Point>
+			<Point><coordinates>121.6,25.1</coordinates></Point>
+		</MultiGeometry>
+	</Placemark>
+</Document>
+</kml>`
+
+const testGPX = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1">
+	<wpt lat="24.1" lon="120.6"><ele>35.5</ele><name>起點</name><sym>Flag</sym></wpt>
+	<trk><name>路線</name>
+		<trkseg>
+			<trkpt lat="24.1" lon="120.6"><time>2020-01-01T00:00:00Z</time></trkpt>
+			<trkpt lat="24.2" lon="120.7"><time>2020-01-01T00:10:00Z</time></trkpt>
+		</trkseg>
+		<trkseg>
+			<trkpt lat="24.3" lon="120.8"><time>2020-01-01T00:20:00Z</time></trkpt>
+			<trkpt lat="24.4" lon="120.9"><time>2020-01-01T00:30:00Z</time></trkpt>
+		</trkseg>
+	</trk>
+</gpx>`
+
+func TestConvertKML(t *testing.T) {
+	_, done := tempStorage(t, "convert-kml")
+	defer done()
+
+	fc, err := readKML(strings.NewReader(testKML))
+	if err != nil || len(fc.Features) != 2 {
+		t.Fatal("parse", err, fc)
+	}
+	f0, f1 := fc.Features[0], fc.Features[1]
+	if f0.ID != "p1" || f0.Properties["name"] != "保護區" || f0.Properties["description"] != "<b>禁止</b>進入" || f0.Properties["folder"] != "區域" || f0.Properties["level"] != "A" {
+		t.Fatal("properties", f0.Properties)
+	}
+	if f0.Properties["stroke"] != "#ff0000" || f0.Properties["fill"] != "#00ff00" || f0.Properties["fill-opacity"] != 0.5 || f0.Properties["stroke-width"] != float64(3) {
+		t.Fatal("style", f0.Properties)
+	}
+	if f0.Geometry.Type != "Polygon" || len(f0.Geometry.Poly) != 2 || ringArea2(f0.Geometry.Poly[0]) <= 0 || ringArea2(f0.Geometry.Poly[1]) >= 0 {
+		t.Fatal("polygon", f0.Geometry)
+	}
+	if f1.Geometry.Type != "MultiPoint" || len(f1.Geometry.Line) != 2 || f1.Properties["folder"] != nil {
+		t.Fatal("multi geometry", f1.Geometry, f1.Properties)
+	}
+
+	db := NewDataStore()
+	add := func(name string, kind string, buf []byte) *Attachment {
+		a := NewAttachment(name, int64(len(buf)))
+		a.Kind = kind
+		fp := filepath.Join(UploadFileDir, a.SaveName)
+		ioutil.WriteFile(fp, buf, 0644)
+		a.Checksum = sha256File(fp)
+		if _, err := addAttachFile(db, a); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	// KMZ, style as default of new layer
+	a := NewAttachment("area.kmz", 0)
+	fp := filepath.Join(UploadFileDir, a.SaveName)
+	testZip(t, fp, map[string][]byte{
+		"doc.kml": []byte(testKML),
+		"files/icon.png": []byte("\x89PNG\r\n\x1a\n"),
+	})
+	a.Kind = "zip"
+	a.Checksum = sha256File(fp)
+	if _, err := addAttachFile(db, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := deriveAttach(db, a.Token); err != nil {
+		t.Fatal(err)
+	}
+	a = db.GetAttachByToken(a.Token)
+	st := a.Style
+	if st == nil || st.Color != "#ff0000" || st.FillColor != "#00ff00" || st.Opacity != 0.5 {
+		t.Fatal("style default", st)
+	}
+	if attachStyle(db, a.Derived) != st || attachStyle(db, a.Token) != st {
+		t.Fatal("style lookup")
+	}
+
+	// GPX
+	g := add("trip.gpx", "xml", []byte(testGPX))
+	if err := deriveAttach(db, g.Token); err != nil {
+		t.Fatal(err)
+	}
+	g = db.GetAttachByToken(g.Token)
+	d := db.GetAttachByToken(g.Derived)
+	if d == nil || g.Style != nil {
+		t.Fatal("gpx derived", g)
+	}
+	buf, _ := ioutil.ReadFile(filepath.Join(UploadFileDir, d.SaveName))
+	fc, err = ParseFeatureCollection(buf)
+	if err != nil || len(fc.Features) != 2 {
+		t.Fatal("gpx", err, string(buf))
+	}
+	wpt, trk := fc.Features[0], fc.Features[1]
+	if wpt.Geometry.Type != "Point" || wpt.Geometry.Point[0] != 120.6 || wpt.Properties["name"] != "起點" || wpt.Properties["ele"] != 35.5 || wpt.Properties["sym"] != "Flag" {
+		t.Fatal("waypoint", wpt.Geometry, wpt.Properties)
+	}
+	if trk.Geometry.Type != "MultiLineString" || len(trk.Geometry.Poly) != 2 || trk.Properties["start"] != "2020-01-01T00:00:00Z" || trk.Properties["end"] != "2020-01-01T00:30:00Z" {
+		t.Fatal("track", trk.Geometry, trk.Properties)
+	}
+
+	// other xml not convertible
+	x := add("note.xml", "xml", []byte(`<?xml version="1.0"?><note>hi</note>`))
+	if err := deriveAttach(db, x.Token); err != ErrConvertType {
+		t.Fatal("plain xml", err)
+	}
+}
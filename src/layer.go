@@ -20,11 +20,16 @@ type LayerGroup struct {
 	FillColor string `json:"fillcolor,omitempty"` // color '#3388FF'
 	Opacity float32 `json:"opacity,omitempty"` // opacity
 
-	Type string `json:"type,omitempty"` // '' for geoJson, 'uv' for wind map, 'heat' for heatmap
+	Type string `json:"type,omitempty"` // '' for geoJson, 'uv' for wind map, 'heat' for heatmap, 'mvt' for vector tile '/tiles/'
 	VelScale float32 `json:"velocityScale,omitempty"` // velocityScale
 	ColorScale string `json:"colorScale,omitempty"` // colorScale
 
 	Dynamic bool `json:"dyn,omitempty"` // for dynamic data
+	Derived bool `json:"derived,omitempty"` // use GeoJSON converted from Token if exist
+	Style *StyleRule `json:"style,omitempty"` // data-driven style, Color / FillColor / Opacity for not set
+	Popup *PopupConfig `json:"popup,omitempty"` // nil for default popup
+
+	Stats *GeoStats `json:"stats,omitempty"` // of data, set by resolveLayers for output, not saved
 
 	//Objs map[ObjID]*LayerObj // for objs
 }
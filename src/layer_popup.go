@@ -0,0 +1,129 @@
+package webmap
+
+/*
+* popup of feature: properties shown, display label, order, value format
+* set by '/api/layer/' as JSON, cleaned here, rendered by map client
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	PopupFieldMax = 50
+	PopupTextMax = 64 // rune, for prop, label, unit, link text
+
+	ErrPopup = errors.New("bad popup")
+)
+
+type PopupConfig struct {
+	Title string `json:"title,omitempty"` // property as popup title
+	Fields []*PopupField `json:"fields,omitempty"` // shown in order
+	Rest bool `json:"rest,omitempty"` // also show properties not in Fields
+}
+
+type PopupField struct {
+	Prop string `json:"prop"`
+	Label string `json:"label,omitempty"` // Prop if empty
+	Format string `json:"format,omitempty"` // '' for text, 'number', 'date', 'datetime', 'link', 'image'
+	Digits *int `json:"digits,omitempty"` // 'number': digits after point, nil for as is
+	Unit string `json:"unit,omitempty"` // 'number': suffix
+	Text string `json:"text,omitempty"` // 'link': text instead of url
+}
+
+// nil for empty input
+func ParsePopupConfig(s string) (*PopupConfig, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.DisallowUnknownFields()
+	cfg := &PopupConfig{}
+	err := dec.Decode(cfg)
+	if err != nil {
+		return nil, ErrPopup
+	}
+	err = cfg.check()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Title == "" && len(cfg.Fields) == 0 && !cfg.Rest {
+		return nil, nil
+	}
+	return cfg, nil
+}
+
+// drop control & markup char, rendered as text by client anyway
+func popupText(s string) (string, error) {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '<' || r == '>' {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) > PopupTextMax {
+		return "", ErrPopup
+	}
+	return s, nil
+}
+
+func (cfg *PopupConfig) check() error {
+	var err error
+	if cfg.Title, err = popupText(cfg.Title); err != nil {
+		return err
+	}
+	if len(cfg.Fields) > PopupFieldMax {
+		return ErrPopup
+	}
+
+	seen := make(map[string]bool, len(cfg.Fields))
+	fields := make([]*PopupField, 0, len(cfg.Fields))
+	for _, f := range cfg.Fields {
+		if f == nil {
+			return ErrPopup
+		}
+		if f.Prop, err = popupText(f.Prop); err != nil {
+			return err
+		}
+		if f.Prop == "" || seen[f.Prop] {
+			continue
+		}
+		seen[f.Prop] = true
+		if f.Label, err = popupText(f.Label); err != nil {
+			return err
+		}
+		if f.Unit, err = popupText(f.Unit); err != nil {
+			return err
+		}
+		if f.Text, err = popupText(f.Text); err != nil {
+			return err
+		}
+
+		switch f.Format {
+		case "number":
+			if f.Digits != nil && (*f.Digits < 0 || *f.Digits > 10) {
+				return ErrPopup
+			}
+		case "", "date", "datetime", "link", "image":
+			f.Digits = nil
+			f.Unit = ""
+		default:
+			return ErrPopup
+		}
+		if f.Format != "link" {
+			f.Text = ""
+		}
+		fields = append(fields, f)
+	}
+	cfg.Fields = fields
+	if len(cfg.Fields) == 0 {
+		cfg.Fields = nil
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package webmap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePopupConfig(t *testing.T) {
+	cfg, err := ParsePopupConfig(`{"title":" 名稱 ","fields":[
+		{"prop":"pop","label":"<b>人口</b>","format":"number","digits":0,"unit":"人"},
+		{"prop":"day","label":"日期\n","format":"date","unit":"x","digits":2},
+		{"prop":"url","format":"link","text":"網站"},
+		{"prop":"img","format":"image","text":"x"},
+		{"prop":"pop","label":"dup"},
+		{"prop":"  "}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Title != "名稱" || len(cfg.Fields) != 4 {
+		t.Fatal("fields", cfg.Title, len(cfg.Fields))
+	}
+	f := cfg.Fields
+	if f[0].Label != "b人口/b" || *f[0].Digits != 0 || f[0].Unit != "人" {
+		t.Fatal("number", f[0])
+	}
+	if f[1].Label != "日期" || f[1].Digits != nil || f[1].Unit != "" {
+		t.Fatal("date", f[1])
+	}
+	if f[2].Text != "網站" || f[3].Text != "" {
+		t.Fatal("link", f[2], f[3])
+	}
+
+	cfg, err = ParsePopupConfig(`{"rest":true}`)
+	if err != nil || cfg == nil || !cfg.Rest {
+		t.Fatal("rest only", cfg, err)
+	}
+	for _, s := range []string{"", " ", `{}`, `{"fields":[]}`, `{"fields":[{"prop":""}]}`} {
+		cfg, err = ParsePopupConfig(s)
+		if cfg != nil || err != nil {
+			t.Fatal("empty", s, cfg, err)
+		}
+	}
+
+	bad := []string{
+		`[]`,
+		`{"fields":[null]}`,
+		`{"fields":[{"prop":"a","format":"html"}]}`,
+		`{"fields":[{"prop":"a","format":"number","digits":11}]}`,
+		`{"fields":[{"prop":"a","onclick":"x"}]}`,
+		`{"title":"` + strings.Repeat("字", 65) + `"}`,
+	}
+	for _, s := range bad {
+		if _, err := ParsePopupConfig(s); err != ErrPopup {
+			t.Fatal("bad", s, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package webmap
+
+/*
+* reference between LayerGroup and Attachment / HookConfig by Token
+* build from layer list when need, always match current data
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+)
+
+var (
+	ErrRefToken = errors.New("token not found")
+	ErrRefInUse = errors.New("in use by layer")
+)
+
+type LayerRef struct {
+	ID LayerID `json:"lyid"`
+	Name string `json:"name"`
+}
+
+type RefIndex struct {
+	attach map[string][]*LayerRef // Token => layers
+	hook map[string][]*LayerRef
+}
+
+func NewRefIndex(layers []*LayerGroup) *RefIndex {
+	x := &RefIndex{
+		attach: make(map[string][]*LayerRef),
+		hook: make(map[string][]*LayerRef),
+	}
+	for _, ly := range layers {
+		if ly.Token == "" {
+			continue
+		}
+		ref := &LayerRef{ID: ly.ID, Name: ly.Name}
+		if ly.Dynamic {
+			x.hook[ly.Token] = append(x.hook[ly.Token], ref)
+		} else {
+			x.attach[ly.Token] = append(x.attach[ly.Token], ref)
+		}
+	}
+	return x
+}
+
+func (x *RefIndex) Attach(token string) []*LayerRef {
+	return x.attach[token]
+}
+
+func (x *RefIndex) Hook(token string) []*LayerRef {
+	return x.hook[token]
+}
+
+// check Token of layer point to exist data
+func checkLayerToken(db API, ly *LayerGroup) error {
+	if ly.Token == "" {
+		return nil
+	}
+	if ly.Dynamic {
+		if db.GetHookByToken(ly.Token) == nil {
+			return ErrRefToken
+		}
+		return nil
+	}
+	if db.GetAttachByToken(ly.Token) == nil {
+		return ErrRefToken
+	}
+	return nil
+}
+
+// listing with layers use it
+type AttachItem struct {
+	*Attachment
+	Used []*LayerRef `json:"used,omitempty"`
+}
+
+type HookItem struct {
+	*HookConfig
+	Used []*LayerRef `json:"used,omitempty"`
+}
+
+// reply for delete in-use item without 'force'
+func writeUsed(w http.ResponseWriter, used []*LayerRef) {
+	out := struct {
+		Ok bool `json:"ok"`
+		Msg string `json:"msg"`
+		Used []*LayerRef `json:"used"`
+	}{false, ErrRefInUse.Error(), used}
+	json.NewEncoder(w).Encode(out)
+}
+
+type DanglingRef struct {
+	Layer *LayerRef `json:"layer"`
+	Token string `json:"token"`
+	Dynamic bool `json:"dyn,omitempty"`
+	Reason string `json:"reason"` // 'missing', 'hidden', 'disable', 'nodata', 'corrupt'
+}
+
+// layers point to missing or not servable data
+func danglingRefs(db API) []*DanglingRef {
+	out := make([]*DanglingRef, 0)
+	for _, ly := range db.GetAllLayer() {
+		if ly.Token == "" {
+			continue
+		}
+		reason := ""
+		if ly.Dynamic {
+			hook := db.GetHookByToken(ly.Token)
+			switch {
+			case hook == nil:
+				reason = "missing"
+			case hook.Disable:
+				reason = "disable"
+			case hook.SaveName == "":
+				reason = "nodata"
+			case hook.Corrupt:
+				reason = "corrupt"
+			}
+		} else {
+			attach := db.GetAttachByToken(ly.Token)
+			switch {
+			case attach == nil:
+				reason = "missing"
+			case attach.Hide:
+				reason = "hidden"
+			case attach.Corrupt:
+				reason = "corrupt"
+			}
+		}
+		if reason == "" {
+			continue
+		}
+		out = append(out, &DanglingRef{
+			Layer: &LayerRef{ID: ly.ID, Name: ly.Name},
+			Token: ly.Token,
+			Dynamic: ly.Dynamic,
+			Reason: reason,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Layer.ID < out[j].Layer.ID
+	})
+	return out
+}
@@ -0,0 +1,45 @@
+package webmap
+
+import (
+	"testing"
+)
+
+func TestLayerRef(t *testing.T) {
+	db := NewDataStore()
+	db.AddAttach(&Attachment{OriginalName: "a.geojson"})
+	db.AddAttach(&Attachment{OriginalName: "b.geojson", Hide: true})
+	hid, _ := db.AddHook(&HookConfig{Name: "wind"})
+
+	list := db.ListAllAttach()
+	a1, a2 := list[0], list[1]
+	if a1.OriginalName != "a.geojson" {
+		a1, a2 = a2, a1
+	}
+	hook := db.GetHookByID(hid)
+
+	if checkLayerToken(db, &LayerGroup{Token: a1.Token}) != nil || checkLayerToken(db, &LayerGroup{Token: hook.Token, Dynamic: true}) != nil {
+		t.Fatal("exist token should pass")
+	}
+	if checkLayerToken(db, &LayerGroup{Token: hook.Token}) != ErrRefToken || checkLayerToken(db, &LayerGroup{Token: "nope"}) != ErrRefToken {
+		t.Fatal("wrong token should fail")
+	}
+
+	db.AddLayer(&LayerGroup{Name: "L1", Token: a1.Token})
+	db.AddLayer(&LayerGroup{Name: "L2", Token: a1.Token})
+	db.AddLayer(&LayerGroup{Name: "L3", Token: a2.Token})
+	db.AddLayer(&LayerGroup{Name: "L4", Token: hook.Token, Dynamic: true})
+	db.AddLayer(&LayerGroup{Name: "L5", Token: "gone"})
+
+	refs := NewRefIndex(db.GetAllLayer())
+	if len(refs.Attach(a1.Token)) != 2 || len(refs.Hook(hook.Token)) != 1 || len(refs.Attach(hook.Token)) != 0 {
+		t.Fatal("used by", refs.Attach(a1.Token), refs.Hook(hook.Token))
+	}
+
+	reasons := make(map[string]string)
+	for _, d := range danglingRefs(db) {
+		reasons[d.Layer.Name] = d.Reason
+	}
+	if len(reasons) != 3 || reasons["L3"] != "hidden" || reasons["L4"] != "nodata" || reasons["L5"] != "missing" {
+		t.Fatal("dangling", reasons)
+	}
+}
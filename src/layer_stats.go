@@ -0,0 +1,193 @@
+package webmap
+
+/*
+* summary of GeoJSON content: extent, count, geometry type, property schema
+* computed once when attachment / hook data saved, published with LayerGroup
+*/
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	GeoStatsPropMax = 100 // property keys kept in schema
+)
+
+type GeoStats struct {
+	BBox *BBox `json:"bbox,omitempty"` // minLng, minLat, maxLng, maxLat; nil if no coordinate
+	Count int `json:"n"` // feature
+	Types map[string]int `json:"types,omitempty"` // geometry type -> count, 'null' for no geometry
+	Props []*PropSchema `json:"props,omitempty"` // most used first
+}
+
+type PropSchema struct {
+	Key string `json:"key"`
+	Type string `json:"type"` // 'string', 'number', 'bool', 'array', 'object', 'mixed'
+	Count int `json:"n"` // feature has non-null value
+}
+
+func (fc *FeatureCollection) Stats() *GeoStats {
+	st := &GeoStats{
+		Count: len(fc.Features),
+		Types: make(map[string]int),
+	}
+	box := emptyBBox()
+	props := make(map[string]*PropSchema)
+	for _, f := range fc.Features {
+		if f.Geometry == nil {
+			st.Types["null"]++
+		} else {
+			st.Types[f.Geometry.Type]++
+			box.Extend(f.Geometry.BBox())
+		}
+		for k, v := range f.Properties {
+			typ := jsonType(v)
+			if typ == "" {
+				continue
+			}
+			p, ok := props[k]
+			if !ok {
+				p = &PropSchema{Key: k, Type: typ}
+				props[k] = p
+			}
+			if p.Type != typ {
+				p.Type = "mixed"
+			}
+			p.Count++
+		}
+	}
+	if !box.Empty() {
+		st.BBox = &box
+	}
+	if len(st.Types) == 0 {
+		st.Types = nil
+	}
+
+	for _, p := range props {
+		st.Props = append(st.Props, p)
+	}
+	sort.Slice(st.Props, func(i, j int) bool {
+		if st.Props[i].Count != st.Props[j].Count {
+			return st.Props[i].Count > st.Props[j].Count
+		}
+		return st.Props[i].Key < st.Props[j].Key
+	})
+	if len(st.Props) > GeoStatsPropMax {
+		st.Props = st.Props[:GeoStatsPropMax]
+	}
+	return st
+}
+
+// '' for null
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return ""
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// nil if not GeoJSON
+func geoStatsFile(fp string) *GeoStats {
+	buf, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil
+	}
+	fc, err := ParseFeatureCollection(buf)
+	if err != nil {
+		return nil
+	}
+	return fc.Stats()
+}
+
+// for GeoJSON in blob
+func (a *Attachment) setStats() {
+	a.Stats = nil
+	if a.Kind == "json" {
+		a.Stats = geoStatsFile(filepath.Join(UploadFileDir, a.SaveName))
+	}
+	a.NoStats = a.Kind == "json" && a.Stats == nil
+}
+
+// stats of data used by layer, derived one if used
+func layerStats(db API, ly *LayerGroup, token string) *GeoStats {
+	if ly.Dynamic {
+		if h := db.GetHookByToken(token); h != nil {
+			return h.Stats
+		}
+		return nil
+	}
+	if a := db.GetAttachByToken(token); a != nil {
+		return a.Stats
+	}
+	return nil
+}
+
+// cheap check for migrate, skip other JSON (eg: UV array) without full parse
+func looksGeoJSON(fp string) bool {
+	f, err := os.Open(fp)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 4 * 1024)
+	n, _ := io.ReadFull(f, head)
+	head = bytes.TrimSpace(head[:n])
+	return bytes.HasPrefix(head, []byte("{")) && bytes.Contains(head, []byte(`"Feature`))
+}
+
+// fill stats for data saved before stats exist, run once before serve
+func MigrateGeoStats(db API) error {
+	var count int
+	for _, a := range db.ListAllAttach() {
+		if a.Kind != "json" || a.Stats != nil || a.NoStats || a.SaveName == "" {
+			continue
+		}
+		fp := filepath.Join(UploadFileDir, filepath.Clean("/" + a.SaveName)[1:])
+		if !looksGeoJSON(fp) {
+			continue
+		}
+		a.Stats = geoStatsFile(fp)
+		a.NoStats = a.Stats == nil // parse once only
+		err := db.UpdateAttach(a)
+		if err != nil {
+			return err
+		}
+		count += 1
+	}
+	for _, hook := range db.ListHook() {
+		hook0 := db.GetHookByID(hook.ID) // ListHook() clean up SaveName
+		if hook0 == nil || hook0.Kind != "json" || hook0.Stats != nil || hook0.NoStats || hook0.SaveName == "" {
+			continue
+		}
+		fp := filepath.Join(CacheFileDir, filepath.Clean("/" + hook0.SaveName)[1:])
+		if !looksGeoJSON(fp) {
+			continue
+		}
+		hook = hook0.Clone()
+		hook.Stats = geoStatsFile(fp)
+		hook.NoStats = hook.Stats == nil
+		err := db.UpdateHook(hook)
+		if err != nil {
+			return err
+		}
+		count += 1
+	}
+	if count > 0 {
+		Vln(2, "[layer]migrate stats", count)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package webmap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestGeoStats(t *testing.T) {
+	fc, err := ParseFeatureCollection([]byte(`{"type":"FeatureCollection","features":[
+		{"type":"Feature","properties":{"name":"a","n":1,"v":null},"geometry":{"type":"Point","coordinates":[121,23]}},
+		{"type":"Feature","properties":{"name":"b","n":"x","tag":[1]},"geometry":{"type":"LineString","coordinates":[[120,22],[122,25]]}},
+		{"type":"Feature","properties":{"name":"c"},"geometry":null}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := fc.Stats()
+	if st.Count != 3 || st.BBox == nil || *st.BBox != (BBox{120, 22, 122, 25}) {
+		t.Fatal("count & bbox", st.Count, st.BBox)
+	}
+	if len(st.Types) != 3 || st.Types["Point"] != 1 || st.Types["LineString"] != 1 || st.Types["null"] != 1 {
+		t.Fatal("types", st.Types)
+	}
+	if len(st.Props) != 3 {
+		t.Fatal("props", st.Props)
+	}
+	want := []PropSchema{{"name", "string", 3}, {"n", "mixed", 2}, {"tag", "array", 1}}
+	for i, p := range want {
+		if *st.Props[i] != p {
+			t.Fatal("prop", i, st.Props[i])
+		}
+	}
+
+	empty := NewFeatureCollection().Stats()
+	if empty.Count != 0 || empty.BBox != nil || empty.Types != nil {
+		t.Fatal("empty", empty)
+	}
+}
+
+func TestGeoStatsIngest(t *testing.T) {
+	_, done := tempStorage(t, "stats")
+	defer done()
+
+	db := NewDataStore()
+	save := func(name string, buf string) *Attachment {
+		a := NewAttachment(name, int64(len(buf)))
+		a.Kind = "json"
+		ioutil.WriteFile(filepath.Join(UploadFileDir, a.SaveName), []byte(buf), 0644)
+		a.Checksum = sha256File(filepath.Join(UploadFileDir, a.SaveName))
+		return a
+	}
+	a := save("p.geojson", `{"type":"Feature","properties":{"k":1},"geometry":{"type":"Point","coordinates":[121,23]}}`)
+	if _, err := addAttachFile(db, a); err != nil {
+		t.Fatal(err)
+	}
+	if st := db.GetAttachByToken(a.Token).Stats; st == nil || st.Count != 1 || st.Types["Point"] != 1 {
+		t.Fatal("add", st)
+	}
+
+	// replace, then rollback
+	b := save("q.geojson", `{"type":"FeatureCollection","features":[]}`)
+	if _, err := replaceAttachFile(db, a.Token, b); err != nil {
+		t.Fatal(err)
+	}
+	if st := db.GetAttachByToken(a.Token).Stats; st == nil || st.Count != 0 {
+		t.Fatal("replace", st)
+	}
+	if _, err := rollbackAttach(db, a.Token, 0); err != nil {
+		t.Fatal(err)
+	}
+	if st := db.GetAttachByToken(a.Token).Stats; st == nil || st.Count != 1 {
+		t.Fatal("rollback", st)
+	}
+
+	// not GeoJSON
+	uv := save("uv.json", `[{"header":{}}]`)
+	if _, err := addAttachFile(db, uv); err != nil {
+		t.Fatal(err)
+	}
+	if st := db.GetAttachByToken(uv.Token).Stats; st != nil {
+		t.Fatal("uv", st)
+	}
+
+	// hook data
+	hid, _ := db.AddHook(&HookConfig{Name: "h"})
+	push := []byte(`{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}}`)
+	if err := updateHookData(db, db.GetHookByID(hid), "p.json", int64(len(push)), bytes.NewReader(push)); err != nil {
+		t.Fatal(err)
+	}
+	hook := db.GetHookByID(hid)
+	if hook.Stats == nil || hook.Stats.Types["Polygon"] != 1 {
+		t.Fatal("hook", hook.Stats)
+	}
+
+	// published with layer
+	db.AddLayer(&LayerGroup{Name: "a", Token: a.Token})
+	db.AddLayer(&LayerGroup{Name: "h", Token: hook.Token, Dynamic: true})
+	db.AddLayer(&LayerGroup{Name: "uv", Token: uv.Token, Type: "uv"})
+	out := resolveLayers(db, db.GetPubLayer())
+	if out[0].Stats == nil || out[0].Stats.Count != 1 || out[1].Stats == nil || out[1].Stats.BBox == nil || out[2].Stats != nil {
+		t.Fatal("layer", out[0].Stats, out[1].Stats, out[2].Stats)
+	}
+	if db.GetLayerByID(out[0].ID).Stats != nil {
+		t.Fatal("stored layer changed")
+	}
+
+	// fill old data
+	old := db.GetAttachByToken(a.Token).Clone()
+	old.Stats = nil
+	db.UpdateAttach(old)
+	h := hook.Clone()
+	h.Stats = nil
+	db.UpdateHook(h)
+	broken := NewAttachment("broken.geojson", 0)
+	broken.Kind = "json"
+	ioutil.WriteFile(filepath.Join(UploadFileDir, broken.SaveName), []byte(`{"type":"Feature","geometry":`), 0644)
+	db.AddAttach(broken)
+	if err := MigrateGeoStats(db); err != nil {
+		t.Fatal(err)
+	}
+	if db.GetAttachByToken(a.Token).Stats == nil || db.GetHookByID(hid).Stats == nil || db.GetAttachByToken(uv.Token).Stats != nil {
+		t.Fatal("migrate")
+	}
+	if b := db.GetAttachByToken(broken.Token); b.Stats != nil || !b.NoStats || !db.GetAttachByToken(uv.Token).NoStats {
+		t.Fatal("not GeoJSON should marked, not parse again", b.NoStats)
+	}
+}
@@ -0,0 +1,196 @@
+package webmap
+
+/*
+* data-driven style of layer: categorized by property value / graduated by numeric range
+* set by '/api/layer/' as JSON, checked here, applied by map client
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	StyleClassMax = 64
+	StyleTextMax = 64 // rune, for title & value
+
+	ErrStyle = errors.New("bad style")
+
+	reStyleDash = regexp.MustCompile(`^[0-9]{1,3}([ ,][0-9]{1,3}){0,7}$`)
+	reStyleIcon = regexp.MustCompile(`^(/|https?://)[^\s"'<>()\\]{1,500}$`)
+)
+
+type StyleRule struct {
+	Mode string `json:"mode,omitempty"` // '' for all feature, 'category', 'graduated'
+	Prop string `json:"prop,omitempty"` // property for 'category', 'graduated'
+	Classes []*StyleClass `json:"classes,omitempty"` // first matched one used
+	Default *StyleSym `json:"default,omitempty"` // for not matched, or all if Mode == ''
+	Label *StyleLabel `json:"label,omitempty"`
+}
+
+type StyleClass struct {
+	Value string `json:"value,omitempty"` // 'category': equal to property as text
+	Min *float64 `json:"min,omitempty"` // 'graduated': min <= value < max, nil for no limit
+	Max *float64 `json:"max,omitempty"`
+	Title string `json:"title,omitempty"` // for legend, auto if empty
+	StyleSym
+}
+
+// empty for layer setting
+type StyleSym struct {
+	Color string `json:"color,omitempty"` // stroke
+	FillColor string `json:"fillcolor,omitempty"`
+	Opacity *float64 `json:"opacity,omitempty"` // fill
+	Weight float64 `json:"weight,omitempty"` // stroke width in px
+	Dash string `json:"dash,omitempty"` // SVG dasharray, eg: '4 4'
+	Icon string `json:"icon,omitempty"` // marker image url
+	IconSize int `json:"isize,omitempty"` // px
+}
+
+type StyleLabel struct {
+	Prop string `json:"prop"` // text from property
+	Color string `json:"color,omitempty"`
+	Size int `json:"size,omitempty"` // font size in px
+	MinZoom int `json:"minzoom,omitempty"` // hide when zoom out
+}
+
+// only #000~#fff & #000000~#ffffff
+func parseColor(s string) (string, bool) {
+	if len(s) != 4 && len(s) != 7 {
+		return "", false
+	}
+	if s[0] != '#' {
+		return "", false
+	}
+	for _, r := range s[1:] {
+		if (r < 'a' || r > 'f') && (r < 'A' || r > 'F') && (r < '0' || r > '9') {
+			return "", false
+		}
+	}
+	return s, true
+}
+
+// nil for empty input
+func ParseStyleRule(s string) (*StyleRule, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.DisallowUnknownFields()
+	rule := &StyleRule{}
+	err := dec.Decode(rule)
+	if err != nil {
+		return nil, ErrStyle
+	}
+	err = rule.check()
+	if err != nil {
+		return nil, err
+	}
+	if rule.Mode == "" && rule.Default == nil && rule.Label == nil {
+		return nil, nil
+	}
+	return rule, nil
+}
+
+func styleText(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) > StyleTextMax {
+		return "", ErrStyle
+	}
+	return s, nil
+}
+
+func (rule *StyleRule) check() error {
+	var err error
+	rule.Prop, err = styleText(rule.Prop)
+	if err != nil {
+		return err
+	}
+	switch rule.Mode {
+	case "":
+		rule.Prop = ""
+		rule.Classes = nil
+	case "category", "graduated":
+		if rule.Prop == "" || len(rule.Classes) == 0 || len(rule.Classes) > StyleClassMax {
+			return ErrStyle
+		}
+	default:
+		return ErrStyle
+	}
+
+	for _, c := range rule.Classes {
+		if c == nil {
+			return ErrStyle
+		}
+		if c.Title, err = styleText(c.Title); err != nil {
+			return err
+		}
+		if c.Value, err = styleText(c.Value); err != nil {
+			return err
+		}
+		if rule.Mode == "category" {
+			c.Min, c.Max = nil, nil
+		} else {
+			c.Value = ""
+			if c.Min == nil && c.Max == nil {
+				return ErrStyle
+			}
+			if c.Min != nil && c.Max != nil && *c.Min >= *c.Max {
+				return ErrStyle
+			}
+		}
+		if err = c.StyleSym.check(); err != nil {
+			return err
+		}
+	}
+	if rule.Default != nil {
+		if err = rule.Default.check(); err != nil {
+			return err
+		}
+	}
+
+	if lb := rule.Label; lb != nil {
+		if lb.Prop, err = styleText(lb.Prop); err != nil || lb.Prop == "" {
+			return ErrStyle
+		}
+		if _, ok := parseColor(lb.Color); lb.Color != "" && !ok {
+			return ErrStyle
+		}
+		if lb.Size != 0 && (lb.Size < 8 || lb.Size > 48) {
+			return ErrStyle
+		}
+		if lb.MinZoom < 0 || lb.MinZoom > TileMaxZoom {
+			return ErrStyle
+		}
+	}
+	return nil
+}
+
+func (sym *StyleSym) check() error {
+	if _, ok := parseColor(sym.Color); sym.Color != "" && !ok {
+		return ErrStyle
+	}
+	if _, ok := parseColor(sym.FillColor); sym.FillColor != "" && !ok {
+		return ErrStyle
+	}
+	if sym.Opacity != nil && (*sym.Opacity < 0 || *sym.Opacity > 1) {
+		return ErrStyle
+	}
+	if sym.Weight < 0 || sym.Weight > 50 {
+		return ErrStyle
+	}
+	if sym.Dash != "" && !reStyleDash.MatchString(sym.Dash) {
+		return ErrStyle
+	}
+	if sym.Icon != "" && !reStyleIcon.MatchString(sym.Icon) {
+		return ErrStyle
+	}
+	if sym.IconSize < 0 || sym.IconSize > 128 {
+		return ErrStyle
+	}
+	return nil
+}
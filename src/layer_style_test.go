@@ -0,0 +1,74 @@
+package webmap
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseStyleRule(t *testing.T) {
+	rule, err := ParseStyleRule(` {"mode":"graduated","prop":" 人口 ","classes":[
+		{"max":1000,"fillcolor":"#fee"},
+		{"min":1000,"max":5000,"value":"x","fillcolor":"#fc8d59","opacity":0.8},
+		{"min":5000,"title":"多","fillcolor":"#D7301F","dash":"4 2","weight":2}
+	],"default":{"color":"#999"},"label":{"prop":"名稱","size":14,"minzoom":12}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Prop != "人口" || len(rule.Classes) != 3 || rule.Classes[1].Value != "" || *rule.Classes[1].Opacity != 0.8 {
+		t.Fatal("graduated", rule)
+	}
+	if rule.Classes[2].FillColor != "#D7301F" || rule.Default.Color != "#999" || rule.Label.MinZoom != 12 {
+		t.Fatal("sym", rule.Classes[2], rule.Default, rule.Label)
+	}
+
+	rule, err = ParseStyleRule(`{"mode":"category","prop":"type","classes":[{"value":"A","min":1,"icon":"/res/a.png","isize":32}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Classes[0].Min != nil || rule.Classes[0].Icon != "/res/a.png" {
+		t.Fatal("category", rule.Classes[0])
+	}
+
+	for _, s := range []string{"", "  ", `{}`, `{"classes":[{"value":"A"}]}`} {
+		rule, err = ParseStyleRule(s)
+		if rule != nil || err != nil {
+			t.Fatal("empty", s, rule, err)
+		}
+	}
+
+	bad := []string{
+		`[]`,
+		`{"mode":"pie","prop":"a","classes":[{"value":"A"}]}`,
+		`{"mode":"category","classes":[{"value":"A"}]}`,
+		`{"mode":"category","prop":"a"}`,
+		`{"mode":"category","prop":"a","classes":[null]}`,
+		`{"mode":"graduated","prop":"a","classes":[{"value":"A"}]}`,
+		`{"mode":"graduated","prop":"a","classes":[{"min":5,"max":1}]}`,
+		`{"default":{"color":"red"}}`,
+		`{"default":{"fillcolor":"#12345"}}`,
+		`{"default":{"opacity":1.5}}`,
+		`{"default":{"dash":"4;stroke:red"}}`,
+		`{"default":{"icon":"javascript:alert(1)"}}`,
+		`{"default":{"icon":"/a.png\" onerror=\"x"}}`,
+		`{"default":{"weight":-1}}`,
+		`{"label":{"prop":""}}`,
+		`{"label":{"prop":"a","size":100}}`,
+		`{"default":{},"script":"x"}`,
+	}
+	for _, s := range bad {
+		if _, err := ParseStyleRule(s); err != ErrStyle {
+			t.Fatal("bad", s, err)
+		}
+	}
+
+	// saved as JSON with layer
+	rule, _ = ParseStyleRule(`{"mode":"category","prop":"t","classes":[{"value":"0","opacity":0}]}`)
+	buf, _ := json.Marshal(&LayerGroup{Name: "a", Style: rule})
+	ly := &LayerGroup{}
+	if err := json.Unmarshal(buf, ly); err != nil {
+		t.Fatal(err)
+	}
+	if ly.Style == nil || ly.Style.Classes[0].Opacity == nil || *ly.Style.Classes[0].Opacity != 0 {
+		t.Fatal("json", string(buf))
+	}
+}
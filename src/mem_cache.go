@@ -0,0 +1,194 @@
+package webmap
+
+/*
+* in-memory cache for small hook data & attachment
+* global LRU with memory budget, keep gzipped variant together
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	CacheMemoryLimit = int64(64 * 1024 * 1024) // Bytes (64 MB), for all hook & attachment
+
+	memCache = NewMemCache()
+)
+
+type memEntry struct {
+	key string
+	buf []byte
+	gz []byte // nil if not worth to compress
+	ctype string
+}
+
+func (e *memEntry) size() int64 {
+	return int64(len(e.buf) + len(e.gz))
+}
+
+type MemCache struct {
+	mx sync.Mutex
+	lru *list.List // front is newest
+	idx map[string]*list.Element
+	used int64
+
+	hit uint64
+	miss uint64
+	gzHit uint64
+	evict uint64
+}
+
+type MemCacheStats struct {
+	Hit uint64 `json:"mch"`
+	Miss uint64 `json:"mcm"`
+	GzHit uint64 `json:"mcg"`
+	Evict uint64 `json:"mce"`
+	Count int `json:"mcn"`
+	Used int64 `json:"mcb"`
+	Limit int64 `json:"mcl"`
+}
+
+func NewMemCache() *MemCache {
+	return &MemCache{
+		lru: list.New(),
+		idx: make(map[string]*list.Element),
+	}
+}
+
+func (c *MemCache) get(key string) *memEntry {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	el, ok := c.idx[key]
+	if !ok {
+		atomic.AddUint64(&c.miss, 1)
+		return nil
+	}
+	atomic.AddUint64(&c.hit, 1)
+	c.lru.MoveToFront(el)
+	return el.Value.(*memEntry)
+}
+
+func (c *MemCache) fit(size int64) bool {
+	return size <= CacheInMemorySizeLimit && size <= CacheMemoryLimit
+}
+
+// compress & put, return nil if too large
+func (c *MemCache) put(key string, ctype string, buf []byte) *memEntry {
+	if !c.fit(int64(len(buf))) {
+		return nil
+	}
+	e := &memEntry{
+		key: key,
+		buf: buf,
+		ctype: ctype,
+	}
+	if e.ctype == "" {
+		e.ctype = http.DetectContentType(buf)
+	}
+	if GZIP_LV != 0 && len(buf) > 1024 {
+		var b bytes.Buffer
+		gw, err := gzip.NewWriterLevel(&b, GZIP_LV)
+		if err == nil {
+			gw.Write(buf)
+			gw.Close()
+			if b.Len() < len(buf) * 9 / 10 { // only keep if save > 10%
+				e.gz = b.Bytes()
+			}
+		}
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if el, ok := c.idx[key]; ok { // put by other request
+		c.lru.MoveToFront(el)
+		return el.Value.(*memEntry)
+	}
+	for c.used + e.size() > CacheMemoryLimit && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+		c.evict += 1
+	}
+	c.idx[key] = c.lru.PushFront(e)
+	c.used += e.size()
+	return e
+}
+
+func (c *MemCache) Del(key string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if el, ok := c.idx[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *MemCache) removeElement(el *list.Element) {
+	e := el.Value.(*memEntry)
+	c.lru.Remove(el)
+	delete(c.idx, e.key)
+	c.used -= e.size()
+}
+
+func (c *MemCache) Stats() *MemCacheStats {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return &MemCacheStats{
+		Hit: atomic.LoadUint64(&c.hit),
+		Miss: atomic.LoadUint64(&c.miss),
+		GzHit: atomic.LoadUint64(&c.gzHit),
+		Evict: c.evict,
+		Count: c.lru.Len(),
+		Used: c.used,
+		Limit: CacheMemoryLimit,
+	}
+}
+
+// serve small file from RAM, load on first read
+// false for file too large, should serve from disk by caller
+func (c *MemCache) ServeFile(w http.ResponseWriter, r *http.Request, key string, fp string, ctype string, size int64, modtime time.Time, checksum string) bool {
+	if !c.fit(size) {
+		return false
+	}
+
+	e := c.get(key)
+	if e == nil {
+		buf, err := ioutil.ReadFile(fp)
+		if err != nil || int64(len(buf)) != size {
+			http.Error(w, "404 not found", http.StatusNotFound)
+			return true
+		}
+		e = c.put(key, ctype, buf)
+	}
+	c.serve(w, r, e, modtime, checksum)
+	return true
+}
+
+// serve from RAM, use gzipped variant directly if client accept
+func (c *MemCache) serve(w http.ResponseWriter, r *http.Request, e *memEntry, modtime time.Time, etag string) {
+	gzw, isGz := w.(*GzipResponseWriter)
+	if isGz { // skip on-the-fly gzip
+		gzw.Skip()
+		w = gzw.ResponseWriter
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", e.ctype)
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if e.gz != nil && (isGz || CanAcceptsGzip(r)) {
+		atomic.AddUint64(&c.gzHit, 1)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Etag", `"` + etag + `-gz"`)
+		http.ServeContent(w, r, "", modtime, bytes.NewReader(e.gz))
+		return
+	}
+
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Etag", `"` + etag + `"`)
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(e.buf))
+}
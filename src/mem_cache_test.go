@@ -0,0 +1,91 @@
+package webmap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemCache(t *testing.T) {
+	limit0 := CacheMemoryLimit
+	CacheMemoryLimit = 3000
+	defer func() { CacheMemoryLimit = limit0 }()
+
+	c := NewMemCache()
+	rnd := func(n int) []byte {
+		buf, _ := genRandomBytes(n)
+		return buf
+	}
+	c.put("a", "a.bin", rnd(1000))
+	c.put("b", "b.bin", rnd(1000))
+	c.get("a") // 'b' is oldest now
+	c.put("c", "c.bin", rnd(1500))
+	if c.get("b") != nil || c.get("a") == nil || c.get("c") == nil {
+		t.Fatal("lru evict not match")
+	}
+	if c.put("d", "d.bin", rnd(4000)) != nil {
+		t.Fatal("should not cache data over budget")
+	}
+	st := c.Stats()
+	if st.Used != 2500 || st.Count != 2 || st.Evict != 1 || st.Hit != 3 || st.Miss != 1 {
+		t.Fatal("stats not match", st)
+	}
+}
+
+func TestMemCacheServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mem-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte(strings.Repeat(`{"type":"Feature","properties":{}},`, 200))
+	fp := filepath.Join(dir, "data")
+	ioutil.WriteFile(fp, data, 0644)
+	hash, _ := sha256fd(bytes.NewReader(data))
+
+	c := NewMemCache()
+	serve := func(gz bool) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/hook/x", nil)
+		if gz {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		fn := ReqGzFn(func(w http.ResponseWriter, r *http.Request) {
+			if !c.ServeFile(w, r, "hook/x", fp, "application/json", int64(len(data)), time.Now(), hash) {
+				t.Fatal("small file should serve from RAM")
+			}
+		})
+		fn(w, r)
+		return w
+	}
+
+	w := serve(true)
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal("response not gzipped", err)
+	}
+	buf, err := ioutil.ReadAll(gr)
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Fatal("gzipped data not match", err)
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Fatal("content type not match", w.Header())
+	}
+
+	os.Remove(fp) // should not touch disk again
+	w = serve(false)
+	if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatal("plain data not match", w.Header())
+	}
+	if st := c.Stats(); st.Hit != 1 || st.Miss != 1 || st.GzHit != 1 {
+		t.Fatal("stats not match", st)
+	}
+}
@@ -0,0 +1,581 @@
+package webmap
+
+/*
+* Mapbox Vector Tile (v2) from GeoJSON of attachment / hook, generated on request
+* parsed GeoJSON kept in small LRU by content version, encoded tile cached in memCache
+* simplify in tile coordinate, so less point for low zoom
+*/
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+)
+
+var (
+	TileExtent = 4096 // tile coordinate resolution
+	TileBuffer = 64 // in tile coordinate, for line & polygon across tile
+	TileSimplify = 4.0 // in tile coordinate, 256px tile: 1px = 16
+	TileMaxZoom = 22
+	TileSourceMax = 4 // parsed GeoJSON in RAM
+
+	ErrTileRange = errors.New("tile out of range")
+
+	tileSources = newGeoCache(TileSourceMax, func(key string, fc *FeatureCollection) interface{} {
+		return newTileSource(key, fc)
+	})
+)
+
+const (
+	mvtLayerName = "data"
+	mvtPoint = 1
+	mvtLine = 2
+	mvtPolygon = 3
+)
+
+// one GeoJSON in Web Mercator world coordinate [0, 1]
+type tileSource struct {
+	key string // path + checksum
+	feats []*tileFeature
+}
+
+type tileFeature struct {
+	f *Feature // properties & id
+	g *Geometry // world coordinate, not GeometryCollection
+	bbox BBox
+}
+
+func newTileSource(key string, fc *FeatureCollection) *tileSource {
+	s := &tileSource{
+		key: key,
+		feats: make([]*tileFeature, 0, len(fc.Features)),
+	}
+	var add func(f *Feature, g *Geometry)
+	add = func(f *Feature, g *Geometry) {
+		if g == nil {
+			return
+		}
+		if g.Type == "GeometryCollection" { // one tile feature for each
+			for _, c := range g.Geoms {
+				add(f, c)
+			}
+			return
+		}
+		tf := &tileFeature{f: f, g: g, bbox: emptyBBox()}
+		g.EachCoord(func(pt []float64) {
+			if len(pt) < 2 {
+				return
+			}
+			pt[0], pt[1] = lngLat2World(pt[0], pt[1])
+			tf.bbox.ExtendPt(pt)
+		})
+		if tf.bbox.Empty() { // no coordinate
+			return
+		}
+		s.feats = append(s.feats, tf)
+	}
+	for _, f := range fc.Features {
+		add(f, f.Geometry)
+	}
+	return s
+}
+
+// Web Mercator in [0, 1], y from north
+func lngLat2World(lng float64, lat float64) (float64, float64) {
+	lat = math.Max(-85.0511287798, math.Min(85.0511287798, lat))
+	sin := math.Sin(lat * math.Pi / 180)
+	x := lng / 360 + 0.5
+	y := 0.5 - math.Log((1 + sin) / (1 - sin)) / (4 * math.Pi)
+	return x, y
+}
+
+// encoded tile, empty for no feature
+func (s *tileSource) Tile(z int, x int, y int) ([]byte, error) {
+	if z < 0 || z > TileMaxZoom {
+		return nil, ErrTileRange
+	}
+	n := 1 << uint(z)
+	if x < 0 || y < 0 || x >= n || y >= n {
+		return nil, ErrTileRange
+	}
+
+	ext := float64(TileExtent)
+	buf := float64(TileBuffer) / ext
+	fn := float64(n)
+	minX, minY := (float64(x) - buf) / fn, (float64(y) - buf) / fn
+	maxX, maxY := (float64(x) + 1 + buf) / fn, (float64(y) + 1 + buf) / fn
+	tc := &tileClip{
+		fn: fn,
+		x: float64(x),
+		y: float64(y),
+		min: -float64(TileBuffer),
+		max: ext + float64(TileBuffer),
+	}
+
+	ly := newMvtLayer(mvtLayerName)
+	for _, tf := range s.feats {
+		if !tf.bbox.Intersects(BBox{minX, minY, maxX, maxY}) {
+			continue
+		}
+		typ, geom := tc.encode(tf.g)
+		if len(geom) == 0 {
+			continue
+		}
+		ly.add(tf.f, typ, geom)
+	}
+	if len(ly.feats) == 0 {
+		return []byte{}, nil
+	}
+	var p pbuf
+	p.bytes(3, ly.marshal())
+	return p.b, nil
+}
+
+// world coordinate into one tile
+type tileClip struct {
+	fn float64 // 2^z
+	x float64
+	y float64
+	min float64 // buffered tile edge, tile coordinate
+	max float64
+}
+
+func (tc *tileClip) tileXY(pt []float64) []float64 {
+	ext := float64(TileExtent)
+	return []float64{(pt[0] * tc.fn - tc.x) * ext, (pt[1] * tc.fn - tc.y) * ext}
+}
+
+func (tc *tileClip) line(pts [][]float64) [][]float64 {
+	out := make([][]float64, len(pts))
+	for i, pt := range pts {
+		out[i] = tc.tileXY(pt)
+	}
+	return out
+}
+
+func (tc *tileClip) inside(pt []float64) bool {
+	return pt[0] >= tc.min && pt[0] <= tc.max && pt[1] >= tc.min && pt[1] <= tc.max
+}
+
+// MVT type & geometry command
+func (tc *tileClip) encode(g *Geometry) (int, []uint32) {
+	var ge mvtGeom
+	switch g.Type {
+	case "Point", "MultiPoint":
+		pts := g.Line
+		if g.Type == "Point" {
+			pts = [][]float64{g.Point}
+		}
+		list := make([][]float64, 0, len(pts))
+		for _, pt := range pts {
+			if len(pt) < 2 {
+				continue
+			}
+			if t := tc.tileXY(pt); tc.inside(t) {
+				list = append(list, t)
+			}
+		}
+		ge.points(list)
+		return mvtPoint, ge.cmds
+
+	case "LineString", "MultiLineString":
+		lines := g.Poly
+		if g.Type == "LineString" {
+			lines = [][][]float64{g.Line}
+		}
+		for _, l := range lines {
+			l = simplifyLine(tc.line(l), TileSimplify)
+			for _, part := range clipLine(l, tc.min, tc.max) {
+				ge.line(part)
+			}
+		}
+		return mvtLine, ge.cmds
+
+	case "Polygon", "MultiPolygon":
+		polys := g.Multi
+		if g.Type == "Polygon" {
+			polys = [][][][]float64{g.Poly}
+		}
+		for _, poly := range polys {
+			for i, ring := range poly {
+				ring = clipRing(simplifyLine(tc.line(ring), TileSimplify), tc.min, tc.max)
+				if !ge.ring(ring, i == 0) && i == 0 { // outer ring gone, skip holes
+					break
+				}
+			}
+		}
+		return mvtPolygon, ge.cmds
+	}
+	return 0, nil
+}
+
+// split by clip rectangle, Liang-Barsky for each segment
+func clipLine(pts [][]float64, min float64, max float64) [][][]float64 {
+	var out [][][]float64
+	var cur [][]float64
+	for i := 0; i + 1 < len(pts); i++ {
+		a, b, ok := clipSegment(pts[i], pts[i+1], BBox{min, min, max, max})
+		if !ok {
+			if len(cur) > 1 {
+				out = append(out, cur)
+			}
+			cur = nil
+			continue
+		}
+		if len(cur) == 0 {
+			cur = append(cur, a)
+		} else if last := cur[len(cur) - 1]; last[0] != a[0] || last[1] != a[1] { // enter again
+			if len(cur) > 1 {
+				out = append(out, cur)
+			}
+			cur = [][]float64{a}
+		}
+		cur = append(cur, b)
+		if b[0] != pts[i+1][0] || b[1] != pts[i+1][1] { // leave
+			out = append(out, cur)
+			cur = nil
+		}
+	}
+	if len(cur) > 1 {
+		out = append(out, cur)
+	}
+	return out
+}
+
+func clipSegment(a []float64, b []float64, box BBox) ([]float64, []float64, bool) {
+	t0, t1 := 0.0, 1.0
+	dx, dy := b[0] - a[0], b[1] - a[1]
+	for _, e := range [4][2]float64{{-dx, a[0] - box[0]}, {dx, box[2] - a[0]}, {-dy, a[1] - box[1]}, {dy, box[3] - a[1]}} {
+		p, q := e[0], e[1]
+		if p == 0 {
+			if q < 0 {
+				return nil, nil, false
+			}
+			continue
+		}
+		r := q / p
+		if p < 0 {
+			if r > t1 {
+				return nil, nil, false
+			}
+			if r > t0 {
+				t0 = r
+			}
+		} else {
+			if r < t0 {
+				return nil, nil, false
+			}
+			if r < t1 {
+				t1 = r
+			}
+		}
+	}
+	a2, b2 := a, b
+	if t0 > 0 {
+		a2 = []float64{a[0] + t0 * dx, a[1] + t0 * dy}
+	}
+	if t1 < 1 {
+		b2 = []float64{a[0] + t1 * dx, a[1] + t1 * dy}
+	}
+	return a2, b2, true
+}
+
+// Sutherland-Hodgman, ring closed or not, output not closed
+func clipRing(ring [][]float64, min float64, max float64) [][]float64 {
+	edges := []func(pt []float64) bool{
+		func(pt []float64) bool { return pt[0] >= min },
+		func(pt []float64) bool { return pt[0] <= max },
+		func(pt []float64) bool { return pt[1] >= min },
+		func(pt []float64) bool { return pt[1] <= max },
+	}
+	cross := func(a []float64, b []float64, i int) []float64 {
+		v := min
+		if i == 1 || i == 3 {
+			v = max
+		}
+		if i < 2 { // vertical edge
+			t := (v - a[0]) / (b[0] - a[0])
+			return []float64{v, a[1] + t * (b[1] - a[1])}
+		}
+		t := (v - a[1]) / (b[1] - a[1])
+		return []float64{a[0] + t * (b[0] - a[0]), v}
+	}
+
+	out := ring
+	if n := len(out); n > 1 && out[0][0] == out[n-1][0] && out[0][1] == out[n-1][1] {
+		out = out[:n-1]
+	}
+	for i, in := range edges {
+		if len(out) == 0 {
+			break
+		}
+		src := out
+		out = make([][]float64, 0, len(src) + 4)
+		prev := src[len(src) - 1]
+		for _, pt := range src {
+			if in(pt) {
+				if !in(prev) {
+					out = append(out, cross(prev, pt, i))
+				}
+				out = append(out, pt)
+			} else if in(prev) {
+				out = append(out, cross(prev, pt, i))
+			}
+			prev = pt
+		}
+	}
+	return out
+}
+
+// geometry command, delta from cursor
+type mvtGeom struct {
+	cmds []uint32
+	cx int64
+	cy int64
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (ge *mvtGeom) cmd(id uint32, count int) {
+	ge.cmds = append(ge.cmds, id & 7 | uint32(count) << 3)
+}
+
+func (ge *mvtGeom) param(x int64, y int64) {
+	ge.cmds = append(ge.cmds, uint32(zigzag(x - ge.cx)), uint32(zigzag(y - ge.cy)))
+	ge.cx, ge.cy = x, y
+}
+
+// round & remove repeated point
+func mvtRound(pts [][]float64) [][2]int64 {
+	out := make([][2]int64, 0, len(pts))
+	for _, pt := range pts {
+		p := [2]int64{int64(math.Round(pt[0])), int64(math.Round(pt[1]))}
+		if len(out) > 0 && out[len(out) - 1] == p {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+func (ge *mvtGeom) points(pts [][]float64) {
+	if len(pts) == 0 {
+		return
+	}
+	ge.cmd(1, len(pts))
+	for _, pt := range pts {
+		p := [2]int64{int64(math.Round(pt[0])), int64(math.Round(pt[1]))}
+		ge.param(p[0], p[1])
+	}
+}
+
+func (ge *mvtGeom) line(pts [][]float64) {
+	list := mvtRound(pts)
+	if len(list) < 2 {
+		return
+	}
+	ge.cmd(1, 1)
+	ge.param(list[0][0], list[0][1])
+	ge.cmd(2, len(list) - 1)
+	for _, p := range list[1:] {
+		ge.param(p[0], p[1])
+	}
+}
+
+// exterior ring positive area in tile coordinate (clockwise, y down), false if degenerate
+func (ge *mvtGeom) ring(pts [][]float64, outer bool) bool {
+	list := mvtRound(pts)
+	if n := len(list); n > 1 && list[0] == list[n-1] {
+		list = list[:n-1]
+	}
+	if len(list) < 3 {
+		return false
+	}
+	var area int64
+	for i := range list {
+		j := (i + 1) % len(list)
+		area += list[i][0] * list[j][1] - list[j][0] * list[i][1]
+	}
+	if area == 0 {
+		return false
+	}
+	if (area > 0) != outer {
+		for i, j := 0, len(list) - 1; i < j; i, j = i + 1, j - 1 {
+			list[i], list[j] = list[j], list[i]
+		}
+	}
+	ge.cmd(1, 1)
+	ge.param(list[0][0], list[0][1])
+	ge.cmd(2, len(list) - 1)
+	for _, p := range list[1:] {
+		ge.param(p[0], p[1])
+	}
+	ge.cmd(7, 1)
+	return true
+}
+
+// one MVT layer, keys & values shared by feature
+type mvtLayer struct {
+	name string
+	keys []string
+	keyIdx map[string]uint32
+	vals [][]byte // encoded Value
+	valIdx map[string]uint32
+	feats [][]byte
+}
+
+func newMvtLayer(name string) *mvtLayer {
+	return &mvtLayer{
+		name: name,
+		keyIdx: make(map[string]uint32),
+		valIdx: make(map[string]uint32),
+	}
+}
+
+func (ly *mvtLayer) add(f *Feature, typ int, geom []uint32) {
+	var p pbuf
+	if id, ok := mvtID(f.ID); ok {
+		p.uint(1, id)
+	}
+	tags := make([]uint32, 0, len(f.Properties) * 2)
+	for k, v := range f.Properties {
+		val := mvtValue(v)
+		if val == nil {
+			continue
+		}
+		ki, ok := ly.keyIdx[k]
+		if !ok {
+			ki = uint32(len(ly.keys))
+			ly.keyIdx[k] = ki
+			ly.keys = append(ly.keys, k)
+		}
+		vi, ok := ly.valIdx[string(val)]
+		if !ok {
+			vi = uint32(len(ly.vals))
+			ly.valIdx[string(val)] = vi
+			ly.vals = append(ly.vals, val)
+		}
+		tags = append(tags, ki, vi)
+	}
+	p.packed(2, tags)
+	p.uint(3, uint64(typ))
+	p.packed(4, geom)
+	ly.feats = append(ly.feats, p.b)
+}
+
+func (ly *mvtLayer) marshal() []byte {
+	var p pbuf
+	p.str(1, ly.name)
+	for _, f := range ly.feats {
+		p.bytes(2, f)
+	}
+	for _, k := range ly.keys {
+		p.str(3, k)
+	}
+	for _, v := range ly.vals {
+		p.bytes(4, v)
+	}
+	p.uint(5, uint64(TileExtent))
+	p.uint(15, 2) // version
+	return p.b
+}
+
+// integer id only
+func mvtID(id interface{}) (uint64, bool) {
+	switch v := id.(type) {
+	case float64:
+		if v >= 0 && v == math.Trunc(v) && v < 1 << 53 {
+			return uint64(v), true
+		}
+	case string:
+		n, err := strconv.ParseUint(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// encoded Value, nil for null
+func mvtValue(v interface{}) []byte {
+	var p pbuf
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		p.str(1, v)
+	case bool:
+		n := uint64(0)
+		if v {
+			n = 1
+		}
+		p.uint(7, n)
+	case float64:
+		switch {
+		case v == math.Trunc(v) && v >= 0 && v < 1 << 53:
+			p.uint(5, uint64(v))
+		case v == math.Trunc(v) && v > -(1 << 53) && v < 0:
+			p.uint(6, zigzag(int64(v)))
+		default:
+			p.double(3, v)
+		}
+	default: // object & array as JSON text
+		buf, _ := json.Marshal(v)
+		p.str(1, string(buf))
+	}
+	return p.b
+}
+
+// protobuf writer, only what MVT need
+type pbuf struct {
+	b []byte
+}
+
+func (p *pbuf) varint(v uint64) {
+	for v >= 0x80 {
+		p.b = append(p.b, byte(v) | 0x80)
+		v >>= 7
+	}
+	p.b = append(p.b, byte(v))
+}
+
+func (p *pbuf) key(field int, wire int) {
+	p.varint(uint64(field << 3 | wire))
+}
+
+func (p *pbuf) uint(field int, v uint64) {
+	p.key(field, 0)
+	p.varint(v)
+}
+
+func (p *pbuf) double(field int, v float64) {
+	p.key(field, 1)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	p.b = append(p.b, b[:]...)
+}
+
+func (p *pbuf) bytes(field int, b []byte) {
+	p.key(field, 2)
+	p.varint(uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *pbuf) str(field int, s string) {
+	p.key(field, 2)
+	p.varint(uint64(len(s)))
+	p.b = append(p.b, s...)
+}
+
+func (p *pbuf) packed(field int, vs []uint32) {
+	if len(vs) == 0 {
+		return
+	}
+	var q pbuf
+	for _, v := range vs {
+		q.varint(uint64(v))
+	}
+	p.bytes(field, q.b)
+}
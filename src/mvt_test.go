@@ -0,0 +1,300 @@
+package webmap
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// decoded MVT feature for test
+type testMvtFeature struct {
+	id uint64
+	typ uint64
+	props map[string]interface{}
+	parts [][][2]int64 // MoveTo start new part, ClosePath not added
+	closed int
+}
+
+func testPbf(b []byte, fn func(field int, wire int, v uint64, sub []byte)) {
+	varint := func() uint64 {
+		var v uint64
+		for s := uint(0); ; s += 7 {
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c & 0x7f) << s
+			if c < 0x80 {
+				return v
+			}
+		}
+	}
+	for len(b) > 0 {
+		key := varint()
+		switch key & 7 {
+		case 0:
+			fn(int(key >> 3), 0, varint(), nil)
+		case 1:
+			fn(int(key >> 3), 1, binary.LittleEndian.Uint64(b), nil)
+			b = b[8:]
+		case 2:
+			n := varint()
+			fn(int(key >> 3), 2, 0, b[:n])
+			b = b[n:]
+		}
+	}
+}
+
+func testPacked(b []byte) []uint64 {
+	var out []uint64
+	for len(b) > 0 {
+		var v uint64
+		for s := uint(0); ; s += 7 {
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c & 0x7f) << s
+			if c < 0x80 {
+				break
+			}
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+func testDecodeTile(t *testing.T, buf []byte) (string, uint64, []*testMvtFeature) {
+	var name string
+	var extent uint64
+	var out []*testMvtFeature
+	testPbf(buf, func(f int, w int, v uint64, ly []byte) {
+		if f != 3 {
+			t.Fatal("tile field", f)
+		}
+		var keys []string
+		var vals []interface{}
+		var feats [][]byte
+		testPbf(ly, func(f int, w int, v uint64, sub []byte) {
+			switch f {
+			case 1:
+				name = string(sub)
+			case 2:
+				feats = append(feats, sub)
+			case 3:
+				keys = append(keys, string(sub))
+			case 4:
+				testPbf(sub, func(f int, w int, v uint64, s []byte) {
+					switch f {
+					case 1:
+						vals = append(vals, string(s))
+					case 3:
+						vals = append(vals, math.Float64frombits(v))
+					case 5:
+						vals = append(vals, v)
+					case 6:
+						vals = append(vals, int64(v >> 1) ^ -int64(v & 1))
+					case 7:
+						vals = append(vals, v == 1)
+					}
+				})
+			case 5:
+				extent = v
+			}
+		})
+		for _, fb := range feats {
+			ft := &testMvtFeature{props: map[string]interface{}{}}
+			testPbf(fb, func(f int, w int, v uint64, sub []byte) {
+				switch f {
+				case 1:
+					ft.id = v
+				case 2:
+					tags := testPacked(sub)
+					for i := 0; i + 1 < len(tags); i += 2 {
+						ft.props[keys[tags[i]]] = vals[tags[i+1]]
+					}
+				case 3:
+					ft.typ = v
+				case 4:
+					cmds := testPacked(sub)
+					var x, y int64
+					for i := 0; i < len(cmds); {
+						id, n := cmds[i] & 7, int(cmds[i] >> 3)
+						i++
+						if id == 7 {
+							ft.closed++
+							continue
+						}
+						for j := 0; j < n; j++ {
+							x += int64(cmds[i] >> 1) ^ -int64(cmds[i] & 1)
+							y += int64(cmds[i+1] >> 1) ^ -int64(cmds[i+1] & 1)
+							i += 2
+							if id == 1 {
+								ft.parts = append(ft.parts, nil)
+							}
+							ft.parts[len(ft.parts) - 1] = append(ft.parts[len(ft.parts) - 1], [2]int64{x, y})
+						}
+					}
+				}
+			})
+			out = append(out, ft)
+		}
+	})
+	return name, extent, out
+}
+
+func TestMVT(t *testing.T) {
+	buf := []byte(`{"type":"FeatureCollection","features":[
+		{"type":"Feature","id":7,"properties":{"name":"站","n":-3,"ok":true,"v":1.5,"tag":["a"]},"geometry":{"type":"Point","coordinates":[121.5,25.0]}},
+		{"type":"Feature","properties":{"name":"線"},"geometry":{"type":"LineString","coordinates":[[-10,0],[10,0]]}},
+		{"type":"Feature","properties":{"name":"面"},"geometry":{"type":"Polygon","coordinates":[[[-10,-10],[10,-10],[10,10],[-10,10],[-10,-10]],[[-1,-1],[-1,1],[1,1],[1,-1],[-1,-1]]]}}
+	]}`)
+	fc, err := ParseFeatureCollection(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := newTileSource("test", fc)
+
+	// whole world
+	tile, err := src.Tile(0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, extent, feats := testDecodeTile(t, tile)
+	if name != mvtLayerName || extent != uint64(TileExtent) || len(feats) != 3 {
+		t.Fatal("layer", name, extent, len(feats))
+	}
+	pt := feats[0]
+	if pt.id != 7 || pt.typ != mvtPoint || pt.props["name"] != "站" || pt.props["n"] != int64(-3) || pt.props["ok"] != true || pt.props["v"] != 1.5 || pt.props["tag"] != `["a"]` {
+		t.Fatal("point feature", pt)
+	}
+	wx, wy := lngLat2World(121.5, 25.0)
+	if p := pt.parts[0][0]; p[0] != int64(math.Round(wx * 4096)) || p[1] != int64(math.Round(wy * 4096)) {
+		t.Fatal("point coordinate", p)
+	}
+	poly := feats[2]
+	if poly.typ != mvtPolygon || len(poly.parts) != 2 || poly.closed != 2 {
+		t.Fatal("polygon", poly)
+	}
+	area := func(ring [][2]int64) int64 {
+		var a int64
+		for i := range ring {
+			j := (i + 1) % len(ring)
+			a += ring[i][0] * ring[j][1] - ring[j][0] * ring[i][1]
+		}
+		return a
+	}
+	if area(poly.parts[0]) <= 0 || area(poly.parts[1]) >= 0 {
+		t.Fatal("winding", poly.parts)
+	}
+
+	// north-west quarter at z1: line & polygon clipped to buffer, point not in
+	tile, _ = src.Tile(1, 0, 0)
+	_, _, feats = testDecodeTile(t, tile)
+	if len(feats) != 2 || feats[0].typ != mvtLine {
+		t.Fatal("z1 features", feats)
+	}
+	line := feats[0].parts[0]
+	if len(line) != 2 || line[1][0] != 4096 + int64(TileBuffer) || line[1][1] != 4096 {
+		t.Fatal("clipped line", line)
+	}
+	for _, p := range feats[1].parts[0] {
+		if p[0] > 4096 + int64(TileBuffer) || p[1] > 4096 + int64(TileBuffer) {
+			t.Fatal("clipped polygon", feats[1].parts)
+		}
+	}
+
+	// nothing there
+	if tile, err = src.Tile(3, 0, 0); err != nil || len(tile) != 0 {
+		t.Fatal("empty tile", tile, err)
+	}
+	if _, err = src.Tile(1, 2, 0); err != ErrTileRange {
+		t.Fatal("range", err)
+	}
+}
+
+func TestGeoCache(t *testing.T) {
+	dir, done := tempStorage(t, "geo-cache")
+	defer done()
+	fp := filepath.Join(dir, "a.geojson")
+	ioutil.WriteFile(fp, []byte(`{"type":"FeatureCollection","features":[]}`), 0644)
+
+	var builds int32
+	slow := make(chan struct{})
+	c := newGeoCache(2, func(key string, fc *FeatureCollection) interface{} {
+		atomic.AddInt32(&builds, 1)
+		if key == "slow" {
+			<-slow
+		}
+		return key
+	})
+
+	// same key parse once, other key not blocked
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.get("slow", fp); err != nil || v != "slow" {
+				t.Error("slow", v, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if v, err := c.get("fast", fp); err != nil || v != "fast" {
+		t.Fatal("fast", v, err)
+	}
+	close(slow)
+	wg.Wait()
+	if n := atomic.LoadInt32(&builds); n != 2 {
+		t.Fatal("build count", n)
+	}
+
+	// error not cached
+	if _, err := c.get("missing", filepath.Join(dir, "none")); err == nil {
+		t.Fatal("missing file")
+	}
+	if _, ok := c.idx["missing"]; ok || len(c.loading) != 0 {
+		t.Fatal("error cached")
+	}
+}
+
+func TestMVTServe(t *testing.T) {
+	_, done := tempStorage(t, "tiles")
+	defer done()
+
+	db := NewDataStore()
+	buf := []byte(`{"type":"Feature","properties":{},"geometry":{"type":"Point","coordinates":[121,23]}}`)
+	a := NewAttachment("p.geojson", int64(len(buf)))
+	a.Kind = "json"
+	ioutil.WriteFile(filepath.Join(UploadFileDir, a.SaveName), buf, 0644)
+	a.Checksum = sha256File(filepath.Join(UploadFileDir, a.SaveName))
+	if _, err := addAttachFile(db, a); err != nil {
+		t.Fatal(err)
+	}
+	wb := NewWebAPI(db)
+	defer wb.Close()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		wb.tiles("/tiles/", nil, w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	w := get("/tiles/" + a.Token + "/0/0/0.pbf")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/vnd.mapbox-vector-tile" || w.Body.Len() == 0 {
+		t.Fatal("tile", w.Code, w.Header(), w.Body.Len())
+	}
+	if _, _, feats := testDecodeTile(t, w.Body.Bytes()); len(feats) != 1 {
+		t.Fatal("served tile", feats)
+	}
+	if w = get("/tiles/" + a.Token + "/0/0/0.pbf"); w.Code != 200 || w.Header().Get("Etag") == "" { // from memCache
+		t.Fatal("cached tile", w.Code, w.Header())
+	}
+	for _, p := range []string{"/tiles/" + a.Token + "/1/5/0.pbf", "/tiles/nope/0/0/0.pbf", "/tiles/" + a.Token + "/0/0.pbf"} {
+		if w = get(p); w.Code != 404 {
+			t.Fatal("not found", p, w.Code)
+		}
+	}
+}
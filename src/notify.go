@@ -0,0 +1,61 @@
+package webmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var (
+	NotifyTimeout = 20 * time.Second
+)
+
+// send system event by TmplIndex.NotifyType & TmplIndex.NotifyURL, always log it
+func sendNotify(conf *TmplIndex, title string, msg string) error {
+	Vln(2, "[notify]", title, msg)
+
+	if conf == nil || conf.NotifyURL == "" {
+		return nil
+	}
+
+	var body interface{}
+	switch conf.NotifyType {
+	case "json":
+		body = map[string]interface{}{
+			"title": title,
+			"msg": msg,
+			"site": conf.SiteTitle,
+			"time": time.Now(),
+		}
+	case "slack": // also for Mattermost, Discord ('/slack' endpoint)
+		body = map[string]interface{}{
+			"text": "[" + conf.SiteTitle + "] " + title + "\n" + msg,
+		}
+	default:
+		return nil
+	}
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Timeout: NotifyTimeout,
+	}
+	resp, err := client.Post(conf.NotifyURL, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notify http status %v", resp.Status)
+	}
+	return nil
+}
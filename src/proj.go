@@ -0,0 +1,320 @@
+package webmap
+
+/*
+* coordinate reprojection for import, no external library
+* EPSG:4326 WGS84, 3857 Web Mercator, 3826/3825 TWD97 TM2 121/119, 3828 TWD67 TM2 121, 3821 TWD67
+* TWD97 treat as WGS84, TWD67 by 3 parameter datum shift (error within several meters)
+*/
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type ellipsoid struct {
+	a float64
+	f float64
+}
+
+var (
+	ellWGS84 = ellipsoid{6378137, 1 / 298.257223563}
+	ellGRS80 = ellipsoid{6378137, 1 / 298.257222101}
+	ellAustSA = ellipsoid{6378160, 1 / 298.25} // TWD67
+
+	twd67Shift = [3]float64{-752, -358, -179} // to WGS84 geocentric, meter
+)
+
+type crsDef struct {
+	code string
+	geo bool // lng/lat in degree
+	merc bool // spherical Web Mercator
+	ell ellipsoid
+	shift *[3]float64 // datum to WGS84, nil for same
+
+	// Transverse Mercator
+	lon0 float64
+	k0 float64
+	fe float64
+	fn float64
+}
+
+var crsList = map[string]*crsDef{
+	"4326": {code: "4326", geo: true, ell: ellWGS84},
+	"3857": {code: "3857", merc: true, ell: ellWGS84},
+	"3826": {code: "3826", ell: ellGRS80, lon0: 121, k0: 0.9999, fe: 250000},
+	"3825": {code: "3825", ell: ellGRS80, lon0: 119, k0: 0.9999, fe: 250000},
+	"3828": {code: "3828", ell: ellAustSA, shift: &twd67Shift, lon0: 121, k0: 0.9999, fe: 250000},
+	"3821": {code: "3821", geo: true, ell: ellAustSA, shift: &twd67Shift},
+}
+
+// other name of same CRS
+var crsAlias = map[string]string{
+	"CRS84": "4326",
+	"WGS84": "4326",
+	"900913": "3857",
+	"3785": "3857",
+	"102100": "3857",
+	"102113": "3857",
+	"TWD97": "3826",
+	"TWD67": "3828",
+}
+
+// "3826", "EPSG:3826", "urn:ogc:def:crs:EPSG::3826", "CRS84" -> "3826"
+// empty for empty, ErrConvertCRS for not supported
+func parseCRS(s string) (string, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return "", nil
+	}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		s = s[i+1:]
+	}
+	if v, ok := crsAlias[s]; ok {
+		s = v
+	}
+	if crsList[s] == nil {
+		return "", ErrConvertCRS
+	}
+	return s, nil
+}
+
+var (
+	reWktAuth = regexp.MustCompile(`AUTHORITY\s*\[\s*"EPSG"\s*,\s*"?(\d+)"?\s*\]\s*\]\s*$`)
+	reWktCM = regexp.MustCompile(`PARAMETER\s*\[\s*"CENTRAL_MERIDIAN"\s*,\s*([-0-9.]+)`)
+)
+
+// CRS from .prj (WKT), empty if no prj
+func prjCRS(wkt string) (string, error) {
+	u := strings.ToUpper(strings.TrimSpace(wkt))
+	if u == "" {
+		return "", nil
+	}
+	if m := reWktAuth.FindStringSubmatch(u); m != nil { // authority of whole CRS
+		if code, err := parseCRS(m[1]); err == nil {
+			return code, nil
+		}
+	}
+
+	has := func(list ...string) bool {
+		for _, v := range list {
+			if strings.Contains(u, v) {
+				return true
+			}
+		}
+		return false
+	}
+	twd97 := has("TWD97", "TWD_1997", "TWD 1997", "TAIWAN_DATUM_1997")
+	twd67 := has("TWD67", "TWD_1967", "TWD 1967", "TAIWAN_DATUM_1967", "HU_TZU_SHAN", "HU TZU SHAN")
+	cm := 0.0
+	if m := reWktCM.FindStringSubmatch(u); m != nil {
+		cm, _ = strconv.ParseFloat(m[1], 64)
+	} else if has("ZONE 121", "ZONE_121") { // name only, e.g. "TWD97 / TM2 zone 121"
+		cm = 121
+	} else if has("ZONE 119", "ZONE_119") {
+		cm = 119
+	}
+
+	switch {
+	case !strings.HasPrefix(u, "PROJCS"):
+		if twd67 {
+			return "3821", nil
+		}
+		return "4326", nil
+	case has("MERCATOR_AUXILIARY_SPHERE", "WEB_MERCATOR", "POPULAR VISUALISATION", "PSEUDO-MERCATOR", "PSEUDO_MERCATOR"):
+		return "3857", nil
+	case twd97 && cm == 121:
+		return "3826", nil
+	case twd97 && cm == 119:
+		return "3825", nil
+	case twd67 && cm == 121:
+		return "3828", nil
+	}
+	return "", ErrConvertCRS
+}
+
+// by one coordinate: lng/lat, or TWD97 TM2 121
+func guessCRS(x float64, y float64) string {
+	switch {
+	case math.Abs(x) <= 180 && math.Abs(y) <= 90:
+		return "4326"
+	case x > 100000 && x < 400000 && y > 2400000 && y < 2800000:
+		return "3826"
+	}
+	return ""
+}
+
+// guessCRS by first coordinate, "4326" if no coordinate
+func (fc *FeatureCollection) guessCRS() string {
+	for _, f := range fc.Features {
+		var pt0 []float64
+		f.Geometry.EachCoord(func(pt []float64) {
+			if pt0 == nil && len(pt) >= 2 {
+				pt0 = pt
+			}
+		})
+		if pt0 != nil {
+			return guessCRS(pt0[0], pt0[1])
+		}
+	}
+	return "4326"
+}
+
+// reproject all coordinate in place, z kept
+func (fc *FeatureCollection) Reproject(from string, to string) error {
+	src, dst := crsList[from], crsList[to]
+	if src == nil || dst == nil {
+		return ErrConvertCRS
+	}
+	if src == dst {
+		return nil
+	}
+	for _, f := range fc.Features {
+		f.Geometry.EachCoord(func(pt []float64) {
+			if len(pt) < 2 {
+				return
+			}
+			lng, lat := src.toWGS84(pt[0], pt[1])
+			pt[0], pt[1] = dst.fromWGS84(lng, lat)
+		})
+	}
+	return nil
+}
+
+// to WGS84 from override CRS, or detected one if no override
+func (fc *FeatureCollection) toWGS84(override string, detected string) error {
+	from := detected
+	if override != "" {
+		from = override
+	}
+	if from == "" {
+		from = fc.guessCRS()
+	}
+	if from == "" {
+		return ErrConvertCRS
+	}
+	fc.CRS = nil
+	return fc.Reproject(from, "4326")
+}
+
+func (c *crsDef) toWGS84(x float64, y float64) (float64, float64) {
+	var lng, lat float64
+	switch {
+	case c.geo:
+		lng, lat = x, y
+	case c.merc:
+		lng = x / c.ell.a * 180 / math.Pi
+		lat = (2 * math.Atan(math.Exp(y / c.ell.a)) - math.Pi / 2) * 180 / math.Pi
+	default:
+		lng, lat = c.ell.tmInverse(x - c.fe, y - c.fn, c.lon0, c.k0)
+	}
+	if c.shift != nil {
+		lng, lat = datumShift(lng, lat, c.ell, ellWGS84, c.shift, 1)
+	}
+	return lng, lat
+}
+
+func (c *crsDef) fromWGS84(lng float64, lat float64) (float64, float64) {
+	if c.shift != nil {
+		lng, lat = datumShift(lng, lat, ellWGS84, c.ell, c.shift, -1)
+	}
+	switch {
+	case c.geo:
+		return lng, lat
+	case c.merc:
+		lat = math.Max(-85.0511287798, math.Min(85.0511287798, lat))
+		x := c.ell.a * lng * math.Pi / 180
+		y := c.ell.a * math.Log(math.Tan(math.Pi / 4 + lat * math.Pi / 360))
+		return x, y
+	}
+	x, y := c.ell.tmForward(lng, lat, c.lon0, c.k0)
+	return x + c.fe, y + c.fn
+}
+
+// meridian arc length from equator
+func (e ellipsoid) arc(phi float64) float64 {
+	e2 := e.f * (2 - e.f)
+	e4, e6 := e2 * e2, e2 * e2 * e2
+	return e.a * ((1 - e2 / 4 - 3 * e4 / 64 - 5 * e6 / 256) * phi -
+		(3 * e2 / 8 + 3 * e4 / 32 + 45 * e6 / 1024) * math.Sin(2 * phi) +
+		(15 * e4 / 256 + 45 * e6 / 1024) * math.Sin(4 * phi) -
+		(35 * e6 / 3072) * math.Sin(6 * phi))
+}
+
+// Snyder, Map Projections - A Working Manual, p.61
+func (e ellipsoid) tmForward(lng float64, lat float64, lon0 float64, k0 float64) (float64, float64) {
+	e2 := e.f * (2 - e.f)
+	ep2 := e2 / (1 - e2)
+	phi := lat * math.Pi / 180
+	sin, cos, tan := math.Sin(phi), math.Cos(phi), math.Tan(phi)
+	n := e.a / math.Sqrt(1 - e2 * sin * sin)
+	t := tan * tan
+	c := ep2 * cos * cos
+	a := (lng - lon0) * math.Pi / 180 * cos
+
+	x := k0 * n * (a + (1 - t + c) * math.Pow(a, 3) / 6 +
+		(5 - 18 * t + t * t + 72 * c - 58 * ep2) * math.Pow(a, 5) / 120)
+	y := k0 * (e.arc(phi) + n * tan * (a * a / 2 +
+		(5 - t + 9 * c + 4 * c * c) * math.Pow(a, 4) / 24 +
+		(61 - 58 * t + t * t + 600 * c - 330 * ep2) * math.Pow(a, 6) / 720))
+	return x, y
+}
+
+func (e ellipsoid) tmInverse(x float64, y float64, lon0 float64, k0 float64) (float64, float64) {
+	e2 := e.f * (2 - e.f)
+	e4, e6 := e2 * e2, e2 * e2 * e2
+	ep2 := e2 / (1 - e2)
+	mu := y / k0 / (e.a * (1 - e2 / 4 - 3 * e4 / 64 - 5 * e6 / 256))
+	e1 := (1 - math.Sqrt(1 - e2)) / (1 + math.Sqrt(1 - e2))
+	phi1 := mu + (3 * e1 / 2 - 27 * math.Pow(e1, 3) / 32) * math.Sin(2 * mu) +
+		(21 * e1 * e1 / 16 - 55 * math.Pow(e1, 4) / 32) * math.Sin(4 * mu) +
+		(151 * math.Pow(e1, 3) / 96) * math.Sin(6 * mu) +
+		(1097 * math.Pow(e1, 4) / 512) * math.Sin(8 * mu)
+
+	sin, cos, tan := math.Sin(phi1), math.Cos(phi1), math.Tan(phi1)
+	c1 := ep2 * cos * cos
+	t1 := tan * tan
+	n1 := e.a / math.Sqrt(1 - e2 * sin * sin)
+	r1 := e.a * (1 - e2) / math.Pow(1 - e2 * sin * sin, 1.5)
+	d := x / (n1 * k0)
+
+	phi := phi1 - (n1 * tan / r1) * (d * d / 2 -
+		(5 + 3 * t1 + 10 * c1 - 4 * c1 * c1 - 9 * ep2) * math.Pow(d, 4) / 24 +
+		(61 + 90 * t1 + 298 * c1 + 45 * t1 * t1 - 252 * ep2 - 3 * c1 * c1) * math.Pow(d, 6) / 720)
+	lam := (d - (1 + 2 * t1 + c1) * math.Pow(d, 3) / 6 +
+		(5 - 2 * c1 + 28 * t1 - 3 * c1 * c1 + 8 * ep2 + 24 * t1 * t1) * math.Pow(d, 5) / 120) / cos
+	return lon0 + lam * 180 / math.Pi, phi * 180 / math.Pi
+}
+
+// geographic on 'from' -> geocentric + sign * shift -> geographic on 'to'
+func datumShift(lng float64, lat float64, from ellipsoid, to ellipsoid, shift *[3]float64, sign float64) (float64, float64) {
+	x, y, z := from.geocentric(lng, lat)
+	return to.geographic(x + sign * shift[0], y + sign * shift[1], z + sign * shift[2])
+}
+
+func (e ellipsoid) geocentric(lng float64, lat float64) (float64, float64, float64) {
+	e2 := e.f * (2 - e.f)
+	phi, lam := lat * math.Pi / 180, lng * math.Pi / 180
+	n := e.a / math.Sqrt(1 - e2 * math.Sin(phi) * math.Sin(phi))
+	return n * math.Cos(phi) * math.Cos(lam), n * math.Cos(phi) * math.Sin(lam), n * (1 - e2) * math.Sin(phi)
+}
+
+// iterative, height dropped
+func (e ellipsoid) geographic(x float64, y float64, z float64) (float64, float64) {
+	e2 := e.f * (2 - e.f)
+	p := math.Hypot(x, y)
+	phi := math.Atan2(z, p * (1 - e2))
+	for i := 0; i < 10; i++ {
+		sin := math.Sin(phi)
+		n := e.a / math.Sqrt(1 - e2 * sin * sin)
+		h := p / math.Cos(phi) - n
+		next := math.Atan2(z, p * (1 - e2 * n / (n + h)))
+		if math.Abs(next - phi) < 1e-12 {
+			phi = next
+			break
+		}
+		phi = next
+	}
+	return math.Atan2(y, x) * 180 / math.Pi, phi * 180 / math.Pi
+}
@@ -0,0 +1,162 @@
+package webmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestProjRoundTrip(t *testing.T) {
+	for code, c := range crsList {
+		for _, ll := range [][2]float64{{121.5645, 25.034}, {120.2, 22.6}, {118.3, 24.4}} {
+			x, y := c.fromWGS84(ll[0], ll[1])
+			lng, lat := c.toWGS84(x, y)
+			if math.Abs(lng - ll[0]) > 1e-7 || math.Abs(lat - ll[1]) > 1e-7 { // ~1cm, height dropped by datum shift
+				t.Fatal("round trip", code, ll, lng, lat)
+			}
+		}
+	}
+
+	// central meridian and false easting
+	x, y := crsList["3826"].fromWGS84(121, 23)
+	if math.Abs(x - 250000) > 1e-6 || math.Abs(y - 2544283.12) > 0.01 {
+		t.Fatal("tm2 121", x, y)
+	}
+	if x, _ := crsList["3825"].fromWGS84(119, 24); math.Abs(x - 250000) > 1e-6 {
+		t.Fatal("tm2 119", x)
+	}
+	if x, y := crsList["3857"].fromWGS84(180, 0); math.Abs(x - 20037508.3428) > 1e-3 || math.Abs(y) > 1e-6 {
+		t.Fatal("web mercator", x, y)
+	}
+
+	// TWD67 TM2 about 828m west & 207m north of TWD97
+	x97, y97 := crsList["3826"].fromWGS84(121.5645, 25.034)
+	x67, y67 := crsList["3828"].fromWGS84(121.5645, 25.034)
+	if math.Abs(x97 - x67 - 828) > 5 || math.Abs(y97 - y67 + 207) > 5 {
+		t.Fatal("twd67 shift", x97 - x67, y97 - y67)
+	}
+}
+
+func TestParseCRS(t *testing.T) {
+	for in, out := range map[string]string{
+		"": "",
+		"4326": "4326",
+		"EPSG:3826": "3826",
+		"urn:ogc:def:crs:EPSG::3828": "3828",
+		"urn:ogc:def:crs:OGC:1.3:CRS84": "4326",
+		"epsg:900913": "3857",
+	} {
+		if crs, err := parseCRS(in); err != nil || crs != out {
+			t.Fatal("parse", in, crs, err)
+		}
+	}
+	if _, err := parseCRS("32651"); err != ErrConvertCRS {
+		t.Fatal("not supported", err)
+	}
+
+	for prj, out := range map[string]string{
+		`GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984"]]`: "4326",
+		`PROJCS["TWD_1997_TM_Taiwan",GEOGCS["GCS_TWD_1997"],PROJECTION["Transverse_Mercator"],PARAMETER["False_Easting",250000.0],PARAMETER["Central_Meridian",121.0]]`: "3826",
+		`PROJCS["TWD97 / TM2 zone 119",GEOGCS["TWD97"]]`: "3825",
+		`PROJCS["TWD67 / TM2 zone 121",GEOGCS["TWD67",DATUM["Taiwan_Datum_1967"]],AUTHORITY["EPSG","3828"]]`: "3828",
+		`GEOGCS["GCS_TWD_1967",DATUM["D_TWD_1967"]]`: "3821",
+		`PROJCS["WGS_1984_Web_Mercator_Auxiliary_Sphere",GEOGCS["GCS_WGS_1984"]]`: "3857",
+	} {
+		if crs, err := prjCRS(prj); err != nil || crs != out {
+			t.Fatal("prj", prj, crs, err)
+		}
+	}
+}
+
+func TestConvertProjected(t *testing.T) {
+	_, done := tempStorage(t, "proj")
+	defer done()
+
+	db := NewDataStore()
+	derived := func(a *Attachment) *FeatureCollection {
+		if _, err := addAttachFile(db, a); err != nil {
+			t.Fatal(err)
+		}
+		if err := deriveAttach(db, a.Token); err != nil {
+			t.Fatal(err)
+		}
+		d := db.GetAttachByToken(db.GetAttachByToken(a.Token).Derived)
+		buf, _ := ioutil.ReadFile(filepath.Join(UploadFileDir, d.SaveName))
+		fc, err := ParseFeatureCollection(buf)
+		if err != nil || len(fc.Features) != 1 || fc.CRS != nil {
+			t.Fatal("derived", err, string(buf))
+		}
+		return fc
+	}
+	near := func(pt []float64, lng float64, lat float64) bool {
+		return math.Abs(pt[0] - lng) < 1e-6 && math.Abs(pt[1] - lat) < 1e-6
+	}
+
+	// shapefile with .prj
+	x0, y0 := crsList["3826"].fromWGS84(121, 23)
+	x1, y1 := crsList["3826"].fromWGS84(121.1, 23.1)
+	ring := [][]float64{{x0, y0}, {x0, y1}, {x1, y1}, {x1, y0}, {x0, y0}}
+	s := testAddZip(t, "twd97.zip", map[string][]byte{
+		"a.shp": testShp([][][][]float64{{ring}}),
+		"a.prj": []byte(`PROJCS["TWD97 / TM2 zone 121",GEOGCS["TWD97"]]`),
+	})
+	fc := derived(s)
+	if g := fc.Features[0].Geometry; !near(g.Poly[0][0], 121, 23) || !near(g.Poly[0][2], 121.1, 23.1) {
+		t.Fatal("shapefile", g.Poly)
+	}
+
+	// GeoJSON with named crs
+	gj := []byte(`{"type":"FeatureCollection","crs":{"type":"name","properties":{"name":"urn:ogc:def:crs:EPSG::3857"}},` +
+		`"features":[{"type":"Feature","properties":{"n":1},"geometry":{"type":"Point","coordinates":[13467021.6,2632018.6]}}]}`)
+	g := NewAttachment("m.geojson", int64(len(gj)))
+	g.Kind = "json"
+	ioutil.WriteFile(filepath.Join(UploadFileDir, g.SaveName), gj, 0644)
+	g.Checksum = sha256File(filepath.Join(UploadFileDir, g.SaveName))
+	fc = derived(g)
+	if pt := fc.Features[0].Geometry.Point; math.Abs(pt[0] - 120.976) > 1e-3 || math.Abs(pt[1] - 23.0) > 1e-3 {
+		t.Fatal("geojson 3857", pt)
+	}
+
+	// hook push with source CRS
+	hid, err := db.AddHook(&HookConfig{Name: "twd67", SrcCRS: "3828"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := crsList["3828"].fromWGS84(121.5, 25)
+	push := []byte(`{"type":"Feature","properties":{},"geometry":{"type":"Point","coordinates":[` + strconv.FormatFloat(x, 'f', -1, 64) + `,` + strconv.FormatFloat(y, 'f', -1, 64) + `]}}`)
+	err = updateHookData(db, db.GetHookByID(hid), "p.json", int64(len(push)), bytes.NewReader(push))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadFile(filepath.Join(CacheFileDir, db.GetHookByID(hid).SaveName))
+	if fc, err = ParseFeatureCollection(buf); err != nil || !near(fc.Features[0].Geometry.Point, 121.5, 25) {
+		t.Fatal("hook", err, string(buf))
+	}
+
+	// feature edit, only new geometry reprojected
+	hid, err = db.AddHook(&HookConfig{Name: "twd97", SrcCRS: "3826", RenderType: HookTypeGeoJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewHookFeatureStore(db)
+	pt := func(id string, lng float64, lat float64) json.RawMessage {
+		x, y := crsList["3826"].fromWGS84(lng, lat)
+		return json.RawMessage(`{"type":"Feature","id":"` + id + `","properties":{},"geometry":{"type":"Point","coordinates":[` + strconv.FormatFloat(x, 'f', -1, 64) + `,` + strconv.FormatFloat(y, 'f', -1, 64) + `]}}`)
+	}
+	for _, f := range []json.RawMessage{pt("a", 121.5, 25), pt("b", 120.5, 23)} {
+		if _, err := fs.Apply(hid, &FeatureOps{Upsert: []json.RawMessage{f}}); err != nil {
+			t.Fatal("hook edit", err)
+		}
+	}
+	buf, _ = ioutil.ReadFile(filepath.Join(CacheFileDir, db.GetHookByID(hid).SaveName))
+	if fc, err = ParseFeatureCollection(buf); err != nil || len(fc.Features) != 2 {
+		t.Fatal("hook edit data", err, string(buf))
+	}
+	if !near(fc.Features[0].Geometry.Point, 121.5, 25) || !near(fc.Features[1].Geometry.Point, 120.5, 23) {
+		t.Fatal("hook edit reproject", string(buf))
+	}
+}
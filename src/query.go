@@ -0,0 +1,413 @@
+package webmap
+
+/*
+* spatial & property query over features of GeoJSON attachment / hook
+* R-tree by bbox of feature, exact test after, distance in meter by local plane (approximate)
+*/
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	QueryIndexMax = 4 // indexed GeoJSON in RAM
+	QueryLimit = 100 // default page size
+	QueryLimitMax = 1000
+
+	ErrQuery = errors.New("bad query")
+
+	queryIndexes = newGeoCache(QueryIndexMax, func(key string, fc *FeatureCollection) interface{} {
+		return newQueryIndex(fc)
+	})
+
+	queryOps = []string{">=", "<=", "!=", "=", ">", "<", "~"} // longer first
+)
+
+const earthRadius = 6371008.8 // meter
+
+type queryIndex struct {
+	feats []*Feature
+	tree *RTree
+}
+
+func newQueryIndex(fc *FeatureCollection) *queryIndex {
+	boxes := make([]BBox, len(fc.Features))
+	for i, f := range fc.Features {
+		boxes[i] = f.Geometry.BBox()
+	}
+	return &queryIndex{
+		feats: fc.Features,
+		tree: NewRTree(boxes),
+	}
+}
+
+type FeatureQuery struct {
+	BBox *BBox
+	Point []float64 // contained by polygon, or within Radius
+	Radius float64 // meter
+	Where []*propFilter
+	Offset int
+	Limit int
+}
+
+type propFilter struct {
+	key string
+	op string
+	val string
+	num float64
+	isNum bool
+}
+
+// GeoJSON FeatureCollection with paging info
+type QueryResult struct {
+	Type string `json:"type"` // "FeatureCollection"
+	Features []*Feature `json:"features"`
+	Total int `json:"total"`
+	Offset int `json:"offset"`
+	Limit int `json:"limit"`
+}
+
+// bbox=minLng,minLat,maxLng,maxLat & point=lng,lat & radius=meter & where=key>=value & offset & limit
+func parseFeatureQuery(v url.Values) (*FeatureQuery, error) {
+	q := &FeatureQuery{Limit: QueryLimit}
+	floats := func(s string, n int) ([]float64, error) {
+		parts := strings.Split(s, ",")
+		if len(parts) != n {
+			return nil, ErrQuery
+		}
+		out := make([]float64, n)
+		for i, p := range parts {
+			f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, ErrQuery
+			}
+			out[i] = f
+		}
+		return out, nil
+	}
+
+	if s := v.Get("bbox"); s != "" {
+		b, err := floats(s, 4)
+		if err != nil || b[0] > b[2] || b[1] > b[3] {
+			return nil, ErrQuery
+		}
+		q.BBox = &BBox{b[0], b[1], b[2], b[3]}
+	}
+	if s := v.Get("point"); s != "" {
+		pt, err := floats(s, 2)
+		if err != nil || math.Abs(pt[1]) > 90 {
+			return nil, ErrQuery
+		}
+		q.Point = pt
+	}
+	if s := v.Get("radius"); s != "" {
+		r, err := strconv.ParseFloat(s, 64)
+		if err != nil || r <= 0 || q.Point == nil {
+			return nil, ErrQuery
+		}
+		q.Radius = r
+	}
+	for _, s := range v["where"] {
+		f, err := parsePropFilter(s)
+		if err != nil {
+			return nil, err
+		}
+		q.Where = append(q.Where, f)
+	}
+	if s := v.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, ErrQuery
+		}
+		q.Offset = n
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, ErrQuery
+		}
+		q.Limit = n
+	}
+	if q.Limit > QueryLimitMax {
+		q.Limit = QueryLimitMax
+	}
+	return q, nil
+}
+
+// "pop>=1000", "name~公園", "type!=A"
+func parsePropFilter(s string) (*propFilter, error) {
+	i := strings.IndexAny(s, "=!<>~")
+	if i <= 0 {
+		return nil, ErrQuery
+	}
+	f := &propFilter{key: strings.TrimSpace(s[:i])}
+	for _, op := range queryOps {
+		if strings.HasPrefix(s[i:], op) {
+			f.op = op
+			break
+		}
+	}
+	if f.op == "" || f.key == "" {
+		return nil, ErrQuery
+	}
+	f.val = strings.TrimSpace(s[i + len(f.op):])
+	n, err := strconv.ParseFloat(f.val, 64)
+	f.num, f.isNum = n, err == nil
+	return f, nil
+}
+
+func (f *propFilter) match(props map[string]interface{}) bool {
+	v, ok := props[f.key]
+	if !ok || v == nil {
+		return f.op == "!="
+	}
+	if f.op == "~" {
+		return strings.Contains(strings.ToLower(fmt.Sprint(v)), strings.ToLower(f.val))
+	}
+
+	cmp := 0
+	switch n := v.(type) {
+	case float64:
+		if !f.isNum {
+			return f.op == "!="
+		}
+		switch {
+		case n < f.num:
+			cmp = -1
+		case n > f.num:
+			cmp = 1
+		}
+	default:
+		cmp = strings.Compare(fmt.Sprint(v), f.val)
+	}
+	switch f.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+func (idx *queryIndex) Query(q *FeatureQuery) *QueryResult {
+	var ids []int
+	search := emptyBBox()
+	switch {
+	case q.BBox != nil:
+		search = *q.BBox
+	case q.Point != nil:
+		dy := q.Radius / earthRadius * 180 / math.Pi
+		dx := dy / math.Max(math.Cos(q.Point[1] * math.Pi / 180), 1e-6)
+		search = BBox{q.Point[0] - dx, q.Point[1] - dy, q.Point[0] + dx, q.Point[1] + dy}
+	}
+	if search.Empty() {
+		ids = make([]int, len(idx.feats))
+		for i := range ids {
+			ids[i] = i
+		}
+	} else {
+		idx.tree.Search(search, func(id int) bool {
+			ids = append(ids, id)
+			return true
+		})
+		sort.Ints(ids) // same order as file
+	}
+
+	type hit struct {
+		f *Feature
+		dist float64
+	}
+	hits := make([]hit, 0, len(ids))
+	for _, id := range ids {
+		f := idx.feats[id]
+		if q.BBox != nil && !geomIntersectsBox(f.Geometry, *q.BBox) {
+			continue
+		}
+		dist := 0.0
+		if q.Point != nil {
+			if q.Radius == 0 {
+				if !geomContains(f.Geometry, q.Point) {
+					continue
+				}
+			} else {
+				dist = geomDist(f.Geometry, q.Point)
+				if dist > q.Radius {
+					continue
+				}
+			}
+		}
+		ok := true
+		for _, w := range q.Where {
+			if !w.match(f.Properties) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			hits = append(hits, hit{f, dist})
+		}
+	}
+	if q.Radius > 0 { // nearest first
+		sort.SliceStable(hits, func(i, j int) bool { return hits[i].dist < hits[j].dist })
+	}
+
+	out := &QueryResult{
+		Type: "FeatureCollection",
+		Features: make([]*Feature, 0, q.Limit),
+		Total: len(hits),
+		Offset: q.Offset,
+		Limit: q.Limit,
+	}
+	for i := q.Offset; i < len(hits) && i < q.Offset + q.Limit; i++ {
+		out.Features = append(out.Features, hits[i].f)
+	}
+	return out
+}
+
+// each part as point list: Point, line, ring
+func geomParts(g *Geometry, fn func(pts [][]float64, poly [][][]float64)) {
+	if g == nil {
+		return
+	}
+	switch g.Type {
+	case "Point":
+		fn([][]float64{g.Point}, nil)
+	case "MultiPoint":
+		for _, pt := range g.Line {
+			fn([][]float64{pt}, nil)
+		}
+	case "LineString":
+		fn(g.Line, nil)
+	case "MultiLineString":
+		for _, l := range g.Poly {
+			fn(l, nil)
+		}
+	case "Polygon":
+		fn(nil, g.Poly)
+	case "MultiPolygon":
+		for _, p := range g.Multi {
+			fn(nil, p)
+		}
+	case "GeometryCollection":
+		for _, c := range g.Geoms {
+			geomParts(c, fn)
+		}
+	}
+}
+
+// inside outer ring & not in hole
+func polyContains(poly [][][]float64, x float64, y float64) bool {
+	if len(poly) == 0 || !ringContains(poly[0], x, y) {
+		return false
+	}
+	for _, hole := range poly[1:] {
+		if ringContains(hole, x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// polygon only
+func geomContains(g *Geometry, pt []float64) bool {
+	in := false
+	geomParts(g, func(pts [][]float64, poly [][][]float64) {
+		if poly != nil && !in {
+			in = polyContains(poly, pt[0], pt[1])
+		}
+	})
+	return in
+}
+
+func geomIntersectsBox(g *Geometry, b BBox) bool {
+	hit := false
+	inBox := func(pt []float64) bool {
+		return len(pt) >= 2 && pt[0] >= b[0] && pt[0] <= b[2] && pt[1] >= b[1] && pt[1] <= b[3]
+	}
+	line := func(pts [][]float64) bool {
+		if len(pts) == 1 {
+			return inBox(pts[0])
+		}
+		for i := 0; i + 1 < len(pts); i++ {
+			if _, _, ok := clipSegment(pts[i], pts[i+1], b); ok {
+				return true
+			}
+		}
+		return false
+	}
+	geomParts(g, func(pts [][]float64, poly [][][]float64) {
+		if hit {
+			return
+		}
+		if poly == nil {
+			hit = line(pts)
+			return
+		}
+		for _, ring := range poly {
+			if line(ring) {
+				hit = true
+				return
+			}
+		}
+		hit = polyContains(poly, b[0], b[1]) // box inside polygon
+	})
+	return hit
+}
+
+// meter, 0 if inside polygon
+func geomDist(g *Geometry, pt []float64) float64 {
+	k := math.Pi / 180 * earthRadius
+	cos := math.Cos(pt[1] * math.Pi / 180)
+	local := func(p []float64) []float64 {
+		dx := p[0] - pt[0]
+		if dx > 180 {
+			dx -= 360
+		} else if dx < -180 {
+			dx += 360
+		}
+		return []float64{dx * cos * k, (p[1] - pt[1]) * k}
+	}
+	origin := []float64{0, 0}
+	min := math.Inf(1)
+	line := func(pts [][]float64) {
+		for i := range pts {
+			if len(pts[i]) < 2 {
+				continue
+			}
+			a := local(pts[i])
+			b := a
+			if i + 1 < len(pts) {
+				b = local(pts[i+1])
+			}
+			min = math.Min(min, segDist(origin, a, b))
+		}
+	}
+	geomParts(g, func(pts [][]float64, poly [][][]float64) {
+		if poly == nil {
+			line(pts)
+			return
+		}
+		if polyContains(poly, pt[0], pt[1]) {
+			min = 0
+			return
+		}
+		for _, ring := range poly {
+			line(ring)
+		}
+	})
+	return min
+}
@@ -0,0 +1,170 @@
+package webmap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestRTree(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	boxes := make([]BBox, 1000)
+	for i := range boxes {
+		x, y := rnd.Float64() * 100, rnd.Float64() * 100
+		boxes[i] = BBox{x, y, x + rnd.Float64(), y + rnd.Float64()}
+	}
+	boxes[5] = emptyBBox() // skipped
+	tree := NewRTree(boxes)
+
+	for n := 0; n < 50; n++ {
+		x, y := rnd.Float64() * 100, rnd.Float64() * 100
+		q := BBox{x, y, x + 10, y + 10}
+		want := map[int]bool{}
+		for i, b := range boxes {
+			if !b.Empty() && b.Intersects(q) {
+				want[i] = true
+			}
+		}
+		got := map[int]bool{}
+		tree.Search(q, func(id int) bool {
+			got[id] = true
+			return true
+		})
+		if len(got) != len(want) {
+			t.Fatal("search", q, len(got), len(want))
+		}
+		for id := range want {
+			if !got[id] {
+				t.Fatal("missing", id)
+			}
+		}
+	}
+
+	count := 0
+	tree.Search(BBox{0, 0, 200, 200}, func(id int) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Fatal("stop", count)
+	}
+	NewRTree(nil).Search(BBox{0, 0, 1, 1}, func(id int) bool {
+		t.Fatal("empty tree")
+		return true
+	})
+}
+
+func TestFeatureQuery(t *testing.T) {
+	buf := []byte(`{"type":"FeatureCollection","features":[
+		{"type":"Feature","properties":{"name":"北站","pop":1000},"geometry":{"type":"Point","coordinates":[121.5,25.05]}},
+		{"type":"Feature","properties":{"name":"南站","pop":50},"geometry":{"type":"Point","coordinates":[120.3,22.6]}},
+		{"type":"Feature","properties":{"name":"路"},"geometry":{"type":"LineString","coordinates":[[121,24],[122,24]]}},
+		{"type":"Feature","properties":{"name":"區","pop":300},"geometry":{"type":"Polygon","coordinates":[[[121,25],[122,25],[122,26],[121,26],[121,25]],[[121.4,25.4],[121.6,25.4],[121.6,25.6],[121.4,25.6],[121.4,25.4]]]}}
+	]}`)
+	fc, err := ParseFeatureCollection(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := newQueryIndex(fc)
+
+	names := func(qs string) []string {
+		v, _ := url.ParseQuery(qs)
+		q, err := parseFeatureQuery(v)
+		if err != nil {
+			t.Fatal(qs, err)
+		}
+		out := []string{}
+		for _, f := range idx.Query(q).Features {
+			out = append(out, f.Properties["name"].(string))
+		}
+		return out
+	}
+	check := func(qs string, want ...string) {
+		got := names(qs)
+		if len(got) != len(want) {
+			t.Fatal(qs, got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatal(qs, got, want)
+			}
+		}
+	}
+
+	check("", "北站", "南站", "路", "區")
+	check("bbox=121.4,23.9,121.6,24.1", "路") // line cross, no vertex inside
+	check("bbox=121.7,25.7,121.8,25.8", "區") // box inside polygon
+	check("bbox=121.45,25.45,121.55,25.55") // box inside hole
+	check("point=121.8,25.2", "區")
+	check("point=121.5,25.5") // in hole
+	check("point=121.5,24.01&radius=2000", "路")
+	check("point=121.5,25.04&radius=5000", "區", "北站") // nearest first
+	check("where=pop>=300", "北站", "區")
+	check("where=pop<300", "南站")
+	check("where=pop!=50", "北站", "路", "區")
+	check("where=name~站&where=pop>100", "北站")
+	check("where=name=路", "路")
+	check("limit=2&offset=1", "南站", "路")
+
+	v, _ := url.ParseQuery("limit=1")
+	q, _ := parseFeatureQuery(v)
+	if res := idx.Query(q); res.Total != 4 || res.Limit != 1 || len(res.Features) != 1 {
+		t.Fatal("paging", res.Total, res.Limit)
+	}
+	for _, qs := range []string{"bbox=1,2,3", "bbox=3,0,1,1", "point=a,1", "radius=10", "point=1,1&radius=-1", "where=pop", "where==1", "limit=0", "offset=-1"} {
+		v, _ := url.ParseQuery(qs)
+		if _, err := parseFeatureQuery(v); err != ErrQuery {
+			t.Fatal("bad query", qs, err)
+		}
+	}
+}
+
+func TestQueryServe(t *testing.T) {
+	_, done := tempStorage(t, "query")
+	defer done()
+
+	db := NewDataStore()
+	buf := []byte(`{"type":"FeatureCollection","features":[{"type":"Feature","properties":{"n":1},"geometry":{"type":"Point","coordinates":[121,23]}},{"type":"Feature","properties":{"n":2},"geometry":{"type":"Point","coordinates":[10,10]}}]}`)
+	a := NewAttachment("p.geojson", int64(len(buf)))
+	a.Kind = "json"
+	ioutil.WriteFile(filepath.Join(UploadFileDir, a.SaveName), buf, 0644)
+	a.Checksum = sha256File(filepath.Join(UploadFileDir, a.SaveName))
+	if _, err := addAttachFile(db, a); err != nil {
+		t.Fatal(err)
+	}
+	wb := NewWebAPI(db)
+	defer wb.Close()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		wb.query("/api/query/", nil, w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	w := get("/api/query/" + a.Token + "?bbox=120,22,122,24")
+	if w.Code != 200 {
+		t.Fatal("query", w.Code, w.Body.String())
+	}
+	var res struct {
+		Type string `json:"type"`
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+		Total int `json:"total"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Type != "FeatureCollection" || res.Total != 1 || len(res.Features) != 1 || res.Features[0].Properties["n"] != 1.0 {
+		t.Fatal("result", w.Body.String())
+	}
+	if w = get("/api/query/" + a.Token + "?bbox=1"); w.Code != 400 {
+		t.Fatal("bad request", w.Code)
+	}
+	if w = get("/api/query/nope"); w.Code != 404 {
+		t.Fatal("not found", w.Code)
+	}
+}
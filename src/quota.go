@@ -0,0 +1,116 @@
+package webmap
+
+/*
+* per-file size limit, per-user quota by Attachment.UploadUID & HookConfig.OwnerUID
+* global quota see checkQuota() in storage_gc.go
+*/
+
+import (
+	"errors"
+)
+
+const (
+	AttachSizeDefault = 100 // MB
+	HookSizeDefault = 128 // MB
+)
+
+var (
+	ErrFileTooLarge = errors.New("file size limit exceeded")
+	ErrUserQuota = errors.New("user storage quota exceeded")
+)
+
+type UserUsage struct {
+	Attach int64 `json:"attach"` // Bytes, include old versions
+	AttachN int `json:"an"`
+	Hook int64 `json:"hook"`
+	HookN int `json:"hn"`
+	Quota int64 `json:"quota,omitempty"` // Bytes, 0 for no limit
+
+	AttachLimit int64 `json:"asize"` // per-file, Bytes
+	HookLimit int64 `json:"hsize"`
+}
+
+func (s *UserUsage) Total() int64 {
+	return s.Attach + s.Hook
+}
+
+func userUsage(db API, uid UserID) *UserUsage {
+	conf := db.GetConfig()
+	out := &UserUsage{
+		Quota: userQuota(db, uid),
+		AttachLimit: conf.attachSizeLimit(),
+		HookLimit: conf.hookSizeLimit(),
+	}
+
+	seen := make(map[string]bool)
+	for _, a := range db.ListAllAttach() {
+		if a.UploadUID == uid {
+			out.AttachN += 1
+			if !seen[a.SaveName] {
+				seen[a.SaveName] = true
+				out.Attach += a.Size
+			}
+		}
+		for _, v := range a.Versions { // charge to who upload that version
+			if v.UploadUID == uid && !seen[v.SaveName] {
+				seen[v.SaveName] = true
+				out.Attach += v.Size
+			}
+		}
+	}
+	for _, hook := range db.ListHook() {
+		if hook.OwnerUID == uid {
+			out.HookN += 1
+			out.Hook += hook.Size
+		}
+	}
+	return out
+}
+
+// Bytes, 0 for no limit
+func userQuota(db API, uid UserID) int64 {
+	u := db.GetUserByUID(uid)
+	if u == nil {
+		return 0
+	}
+	if u.Quota > 0 {
+		return u.Quota * 1024 * 1024
+	}
+	return db.GetConfig().UserQuota * 1024 * 1024
+}
+
+// size: new data, old: size of data replaced by this one
+func checkUpload(db API, cat string, uid UserID, size int64, old int64) error {
+	return checkUploadPending(db, cat, uid, size, old, 0)
+}
+
+// pending: Bytes of unfinished upload by the user, count as used
+func checkUploadPending(db API, cat string, uid UserID, size int64, old int64, pending int64) error {
+	conf := db.GetConfig()
+	limit := conf.attachSizeLimit()
+	if cat == StorageHook {
+		limit = conf.hookSizeLimit()
+	}
+	if size > limit {
+		return ErrFileTooLarge
+	}
+
+	err := checkQuota(db, cat, size - old)
+	if err != nil {
+		return err
+	}
+
+	if uid == 0 || size - old <= 0 { // no owner, eg: hook created before
+		return nil
+	}
+	quota := userQuota(db, uid)
+	if quota > 0 && userUsage(db, uid).Total() + pending + size - old > quota {
+		return ErrUserQuota
+	}
+	return nil
+}
+
+// error for upload response
+func isQuotaErr(err error) bool {
+	return err == ErrFileTooLarge || err == ErrQuota || err == ErrUserQuota
+}
@@ -0,0 +1,59 @@
+package webmap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserQuota(t *testing.T) {
+	dir, done := tempStorage(t, "user-quota")
+	defer done()
+
+	db := NewDataStore()
+	uid, _ := db.AddUser(&User{Acc: "a", Name: "a"})
+	uid2, _ := db.AddUser(&User{Acc: "b", Name: "b", Quota: 2})
+	conf := db.GetConfig().Clone()
+	conf.UserQuota = 1
+	conf.AttachSizeLimit = 3
+	db.SetConfig(conf)
+
+	const MB = 1024 * 1024
+	data := bytes.Repeat([]byte("x"), MB / 2)
+	a := NewAttachment("a.bin", int64(len(data)))
+	a.Checksum, _ = sha256fd(bytes.NewReader(data))
+	a.UploadUID = uid
+	ioutil.WriteFile(filepath.Join(dir, a.SaveName), data, 0644)
+	if _, err := addAttachFile(db, a); err != nil {
+		t.Fatal(err)
+	}
+
+	hid, _ := db.AddHook(&HookConfig{Name: "hook", OwnerUID: uid})
+	hook := db.GetHookByID(hid)
+	if err := updateHookData(db, hook, "a.json", MB / 4, bytes.NewReader(bytes.Repeat([]byte(" "), MB / 4))); err != nil {
+		t.Fatal(err)
+	}
+	usage := userUsage(db, uid)
+	if usage.Attach != MB / 2 || usage.Hook != MB / 4 || usage.AttachN != 1 || usage.HookN != 1 || usage.Quota != MB {
+		t.Fatal("usage", usage)
+	}
+
+	if err := checkUpload(db, StorageAttach, uid, MB / 2, 0); err != ErrUserQuota {
+		t.Fatal("should over user quota", err)
+	}
+	// replace hook data count the old one
+	hook = db.GetHookByID(hid)
+	if err := checkUpload(db, StorageHook, uid, MB / 2, hook.Size); err != nil {
+		t.Fatal("replace within quota", err)
+	}
+	if err := checkUpload(db, StorageAttach, uid2, MB + MB / 2, 0); err != nil {
+		t.Fatal("user quota override", err)
+	}
+	if err := checkUpload(db, StorageAttach, 0, 4 * MB, 0); err != ErrFileTooLarge {
+		t.Fatal("per-file limit", err)
+	}
+	if err := checkUpload(db, StorageHook, 0, 4 * MB, 0); err != nil {
+		t.Fatal("default hook limit", err)
+	}
+}
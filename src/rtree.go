@@ -0,0 +1,133 @@
+package webmap
+
+/*
+* static R-tree, bulk loaded by Sort-Tile-Recursive (STR)
+* data of one GeoJSON version never change, rebuild for new version
+*/
+
+import (
+	"math"
+	"sort"
+)
+
+var RTreeNodeSize = 16
+
+// minX, minY, maxX, maxY
+type BBox [4]float64
+
+func emptyBBox() BBox {
+	return BBox{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+}
+
+func (b BBox) Empty() bool {
+	return b[0] > b[2] || b[1] > b[3]
+}
+
+func (b BBox) Intersects(o BBox) bool {
+	return b[0] <= o[2] && o[0] <= b[2] && b[1] <= o[3] && o[1] <= b[3]
+}
+
+func (b *BBox) Extend(o BBox) {
+	b[0] = math.Min(b[0], o[0])
+	b[1] = math.Min(b[1], o[1])
+	b[2] = math.Max(b[2], o[2])
+	b[3] = math.Max(b[3], o[3])
+}
+
+func (b *BBox) ExtendPt(pt []float64) {
+	b.Extend(BBox{pt[0], pt[1], pt[0], pt[1]})
+}
+
+// bbox of all coordinate
+func (g *Geometry) BBox() BBox {
+	b := emptyBBox()
+	g.EachCoord(func(pt []float64) {
+		if len(pt) >= 2 {
+			b.ExtendPt(pt)
+		}
+	})
+	return b
+}
+
+type rtNode struct {
+	box BBox
+	child []*rtNode // nil for leaf
+	id int // item index, leaf only
+}
+
+type RTree struct {
+	root *rtNode
+}
+
+// id of item is index in boxes, empty box skipped
+func NewRTree(boxes []BBox) *RTree {
+	nodes := make([]*rtNode, 0, len(boxes))
+	for i, b := range boxes {
+		if b.Empty() {
+			continue
+		}
+		nodes = append(nodes, &rtNode{box: b, id: i})
+	}
+	if len(nodes) == 0 {
+		return &RTree{}
+	}
+	for len(nodes) > 1 {
+		nodes = strPack(nodes)
+	}
+	return &RTree{root: nodes[0]}
+}
+
+// one level up
+func strPack(nodes []*rtNode) []*rtNode {
+	m := RTreeNodeSize
+	cx := func(n *rtNode) float64 { return n.box[0] + n.box[2] }
+	cy := func(n *rtNode) float64 { return n.box[1] + n.box[3] }
+
+	sort.Slice(nodes, func(i, j int) bool { return cx(nodes[i]) < cx(nodes[j]) })
+	pages := int(math.Ceil(float64(len(nodes)) / float64(m)))
+	slab := int(math.Ceil(math.Sqrt(float64(pages)))) * m
+
+	out := make([]*rtNode, 0, pages)
+	for s := 0; s < len(nodes); s += slab {
+		part := nodes[s:minInt(s + slab, len(nodes))]
+		sort.Slice(part, func(i, j int) bool { return cy(part[i]) < cy(part[j]) })
+		for i := 0; i < len(part); i += m {
+			n := &rtNode{box: emptyBBox(), child: part[i:minInt(i + m, len(part))]}
+			for _, c := range n.child {
+				n.box.Extend(c.box)
+			}
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// fn for each item intersect b, stop if fn return false
+func (t *RTree) Search(b BBox, fn func(id int) bool) {
+	if t.root == nil {
+		return
+	}
+	var walk func(n *rtNode) bool
+	walk = func(n *rtNode) bool {
+		if !n.box.Intersects(b) {
+			return true
+		}
+		if n.child == nil {
+			return fn(n.id)
+		}
+		for _, c := range n.child {
+			if !walk(c) {
+				return false
+			}
+		}
+		return true
+	}
+	walk(t.root)
+}
@@ -0,0 +1,451 @@
+package webmap
+
+/*
+* full-text search over properties of all public layer
+* CJK run split into unigram & bigram, other word as whole (prefix match on query)
+* rebuild when public layer list or data version changed
+*/
+
+import (
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var (
+	SearchPollInterval = 3 * time.Second
+	SearchLimit = 20 // default result count
+	SearchLimitMax = 100
+	SearchValueMax = 200 // rune, longer property value cut
+	SearchPrefixMax = 64 // expanded term for one query word
+
+	SearchTitleKeys = []string{"name", "Name", "NAME", "名稱", "title", "Title", "標題"}
+)
+
+// simplestyle keys, not indexed
+var searchSkipKeys = map[string]bool{
+	"stroke": true, "stroke-width": true, "stroke-opacity": true,
+	"fill": true, "fill-opacity": true,
+	"marker-color": true, "marker-size": true, "marker-symbol": true,
+}
+
+type SearchResult struct {
+	LayerID LayerID `json:"lyid"`
+	Layer string `json:"layer"` // name
+	Token string `json:"token"` // data token, derived one if used
+	Index int `json:"idx"` // feature index in GeoJSON
+	Title string `json:"title"`
+	Center []float64 `json:"center"` // lng, lat
+	BBox BBox `json:"bbox"`
+	Properties map[string]interface{} `json:"properties"`
+
+	score int
+	order int32 // layer order, then feature order
+}
+
+type searchDoc struct {
+	idx int
+	title string
+	text string // lower case, for phrase match
+	center []float64
+	bbox BBox
+	props map[string]interface{}
+	terms []string
+}
+
+// docs of one layer
+type searchLayer struct {
+	ly *LayerGroup
+	token string
+	docs []*searchDoc
+}
+
+type SearchIndex struct {
+	db API
+	die chan struct{}
+	poke chan struct{}
+	wg sync.WaitGroup // loop
+
+	mx sync.RWMutex
+	sig string
+	layers []*searchLayer
+	docs []*searchResultRef // global doc id -> doc
+	post map[string][]int32 // term -> doc id, ascending
+	terms []string // sorted, for prefix
+
+	cache map[string][]*searchDoc // by geoData key, only access by Refresh
+	runMx sync.Mutex
+}
+
+type searchResultRef struct {
+	layer *searchLayer
+	doc *searchDoc
+}
+
+func NewSearchIndex(db API) *SearchIndex {
+	return &SearchIndex{
+		db: db,
+		die: make(chan struct{}),
+		poke: make(chan struct{}, 1),
+		post: make(map[string][]int32),
+		cache: make(map[string][]*searchDoc),
+	}
+}
+
+func (s *SearchIndex) Start() {
+	s.wg.Add(1)
+	go s.loop()
+}
+
+func (s *SearchIndex) Close() {
+	select {
+	case <-s.die:
+	default:
+		close(s.die)
+	}
+	s.wg.Wait()
+}
+
+// check for change soon, not block
+func (s *SearchIndex) Touch() {
+	select {
+	case s.poke <- struct{}{}:
+	default:
+	}
+}
+
+func (s *SearchIndex) loop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(SearchPollInterval)
+	defer ticker.Stop()
+
+	s.Refresh()
+	for {
+		select {
+		case <-s.die:
+			return
+		case <-ticker.C:
+		case <-s.poke:
+		}
+		s.Refresh()
+	}
+}
+
+// rebuild if public layer or data changed
+func (s *SearchIndex) Refresh() {
+	s.runMx.Lock()
+	defer s.runMx.Unlock()
+
+	type src struct {
+		ly *LayerGroup
+		token string
+		gd *geoData
+	}
+	var srcs []*src
+	var sig strings.Builder
+	for _, ly := range s.db.GetPubLayer() {
+		if ly.Type == "uv" { // wind field, no feature
+			continue
+		}
+		token, _ := layerDataToken(s.db, ly)
+		gd := findGeoData(s.db, token)
+		if gd == nil || gd.hide {
+			continue
+		}
+		srcs = append(srcs, &src{ly, token, gd})
+		sig.WriteString(strconv.FormatUint(uint64(ly.ID), 10) + "/" + ly.Name + "/" + token + "/" + gd.key + ",")
+	}
+
+	s.mx.RLock()
+	same := s.sig == sig.String() && s.layers != nil
+	s.mx.RUnlock()
+	if same {
+		return
+	}
+
+	cache := make(map[string][]*searchDoc, len(srcs))
+	layers := make([]*searchLayer, 0, len(srcs))
+	for _, sc := range srcs {
+		docs, ok := s.cache[sc.gd.key]
+		if !ok {
+			var err error
+			docs, err = loadSearchDocs(sc.gd.fp)
+			if err != nil {
+				Vln(3, "[search]load error", sc.ly.ID, sc.token, err)
+				continue
+			}
+		}
+		cache[sc.gd.key] = docs
+		layers = append(layers, &searchLayer{ly: sc.ly, token: sc.token, docs: docs})
+	}
+	s.cache = cache
+
+	var refs []*searchResultRef
+	post := make(map[string][]int32)
+	for _, sl := range layers {
+		for _, d := range sl.docs {
+			id := int32(len(refs))
+			refs = append(refs, &searchResultRef{sl, d})
+			for _, t := range d.terms {
+				post[t] = append(post[t], id)
+			}
+		}
+	}
+	terms := make([]string, 0, len(post))
+	for t := range post {
+		terms = append(terms, t)
+	}
+	sort.Strings(terms)
+
+	s.mx.Lock()
+	s.sig = sig.String()
+	s.layers = layers
+	s.docs = refs
+	s.post = post
+	s.terms = terms
+	s.mx.Unlock()
+	Vln(4, "[search]reindex", len(layers), "layers", len(refs), "features", len(terms), "terms")
+}
+
+func loadSearchDocs(fp string) ([]*searchDoc, error) {
+	buf, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := ParseFeatureCollection(buf)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]*searchDoc, 0, len(fc.Features))
+	for i, f := range fc.Features {
+		d := newSearchDoc(i, f)
+		if d != nil {
+			docs = append(docs, d)
+		}
+	}
+	return docs, nil
+}
+
+// nil if no text or no coordinate
+func newSearchDoc(idx int, f *Feature) *searchDoc {
+	box := f.Geometry.BBox()
+	if box.Empty() {
+		return nil
+	}
+	keys := make([]string, 0, len(f.Properties))
+	for k := range f.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	d := &searchDoc{
+		idx: idx,
+		bbox: box,
+		props: f.Properties,
+	}
+	if f.Geometry.Type == "Point" {
+		d.center = f.Geometry.Point[:2]
+	} else {
+		d.center = []float64{(box[0] + box[2]) / 2, (box[1] + box[3]) / 2}
+	}
+
+	seen := make(map[string]bool)
+	var text []string
+	for _, k := range keys {
+		if searchSkipKeys[k] {
+			continue
+		}
+		var v string
+		switch val := f.Properties[k].(type) {
+		case string:
+			v = val
+		case float64:
+			v = strconv.FormatFloat(val, 'f', -1, 64)
+		default:
+			continue
+		}
+		if rs := []rune(v); len(rs) > SearchValueMax {
+			v = string(rs[:SearchValueMax])
+		}
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		text = append(text, searchFold(v))
+		for _, t := range searchTokens(v, false) {
+			if !seen[t] {
+				seen[t] = true
+				d.terms = append(d.terms, t)
+			}
+		}
+	}
+	if len(d.terms) == 0 {
+		return nil
+	}
+	d.text = strings.Join(text, "\n")
+	d.title = searchTitle(f.Properties, keys)
+	return d
+}
+
+func searchTitle(props map[string]interface{}, keys []string) string {
+	for _, k := range SearchTitleKeys {
+		if v, ok := props[k].(string); ok && strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	for _, k := range keys { // first text value
+		if searchSkipKeys[k] {
+			continue
+		}
+		if v, ok := props[k].(string); ok && strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// lower case, full-width ASCII to half-width
+func searchFold(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFEE0
+		} else if r == 0x3000 {
+			r = ' '
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+// index: CJK unigram & bigram; query: CJK bigram (unigram if single)
+func searchTokens(s string, query bool) []string {
+	var out []string
+	var word []rune
+	var cjk []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			out = append(out, string(word))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		if query && len(cjk) == 1 {
+			out = append(out, string(cjk))
+		}
+		for i := range cjk {
+			if !query {
+				out = append(out, string(cjk[i:i+1]))
+			}
+			if i + 1 < len(cjk) {
+				out = append(out, string(cjk[i:i+2]))
+			}
+		}
+		cjk = cjk[:0]
+	}
+	for _, r := range searchFold(s) {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return out
+}
+
+// all query token must match, word token match by prefix
+func (s *SearchIndex) Search(q string, limit int) ([]*SearchResult, int) {
+	toks := searchTokens(q, true)
+	if len(toks) == 0 {
+		return nil, 0
+	}
+	phrase := strings.TrimSpace(searchFold(q))
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	score := make(map[int32]int)
+	for n, t := range toks {
+		hit := make(map[int32]int)
+		add := func(term string, w int) {
+			for _, id := range s.post[term] {
+				if n == 0 || score[id] > 0 {
+					if w > hit[id] {
+						hit[id] = w
+					}
+				}
+			}
+		}
+		if isCJK([]rune(t)[0]) {
+			add(t, 2)
+		} else {
+			i := sort.SearchStrings(s.terms, t)
+			for j := 0; i + j < len(s.terms) && j < SearchPrefixMax && strings.HasPrefix(s.terms[i+j], t); j++ {
+				w := 1
+				if s.terms[i+j] == t {
+					w = 2
+				}
+				add(s.terms[i+j], w)
+			}
+		}
+		next := make(map[int32]int, len(hit))
+		for id, w := range hit {
+			next[id] = score[id] + w
+		}
+		score = next
+		if len(score) == 0 {
+			return nil, 0
+		}
+	}
+
+	out := make([]*SearchResult, 0, len(score))
+	for id, sc := range score {
+		ref := s.docs[id]
+		d := ref.doc
+		title := searchFold(d.title)
+		switch {
+		case title == phrase:
+			sc += 20
+		case strings.Contains(title, phrase):
+			sc += 10
+		case strings.Contains(d.text, phrase):
+			sc += 5
+		}
+		out = append(out, &SearchResult{
+			LayerID: ref.layer.ly.ID,
+			Layer: ref.layer.ly.Name,
+			Token: ref.layer.token,
+			Index: d.idx,
+			Title: d.title,
+			Center: d.center,
+			BBox: d.bbox,
+			Properties: d.props,
+			score: sc,
+			order: id,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].score != out[j].score {
+			return out[i].score > out[j].score
+		}
+		return out[i].order < out[j].order
+	})
+	total := len(out)
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, total
+}
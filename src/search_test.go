@@ -0,0 +1,121 @@
+package webmap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestSearchTokens(t *testing.T) {
+	eq := func(got []string, want ...string) {
+		if len(got) != len(want) {
+			t.Fatal(got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatal(got, want)
+			}
+		}
+	}
+	eq(searchTokens("基隆港 Buoy-12", false), "基", "基隆", "隆", "隆港", "港", "buoy", "12")
+	eq(searchTokens("基隆港 Buoy-12", true), "基隆", "隆港", "buoy", "12")
+	eq(searchTokens("港", true), "港")
+	eq(searchTokens("ＡＢ１站", true), "ab1", "站")
+	eq(searchTokens(" - ", true))
+}
+
+func TestSearchIndex(t *testing.T) {
+	_, done := tempStorage(t, "search")
+	defer done()
+
+	db := NewDataStore()
+	add := func(name string, buf string) *Attachment {
+		a := NewAttachment(name, int64(len(buf)))
+		a.Kind = "json"
+		ioutil.WriteFile(filepath.Join(UploadFileDir, a.SaveName), []byte(buf), 0644)
+		a.Checksum = sha256File(filepath.Join(UploadFileDir, a.SaveName))
+		if _, err := addAttachFile(db, a); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	harbor := add("harbor.geojson", `{"type":"FeatureCollection","features":[
+		{"type":"Feature","properties":{"name":"基隆港","stroke":"#ff0000"},"geometry":{"type":"Point","coordinates":[121.74,25.15]}},
+		{"type":"Feature","properties":{"name":"高雄港","note":"Kaohsiung harbour"},"geometry":{"type":"Polygon","coordinates":[[[120,22],[121,22],[121,23],[120,23],[120,22]]]}},
+		{"type":"Feature","properties":{"name":"沒有座標"},"geometry":null}
+	]}`)
+	buoy := add("buoy.geojson", `{"type":"Feature","properties":{"id":"Buoy-46694A","名稱":"基隆浮標"},"geometry":{"type":"Point","coordinates":[121.8,25.2]}}`)
+	hidden := add("hidden.geojson", `{"type":"Feature","properties":{"name":"基隆秘密"},"geometry":{"type":"Point","coordinates":[121,25]}}`)
+
+	db.AddLayer(&LayerGroup{Name: "港口", Token: harbor.Token})
+	db.AddLayer(&LayerGroup{Name: "浮標", Token: buoy.Token})
+	db.AddLayer(&LayerGroup{Name: "隱藏", Token: hidden.Token, Hide: true})
+
+	s := NewSearchIndex(db)
+	s.Refresh()
+
+	titles := func(q string) []string {
+		res, _ := s.Search(q, 10)
+		out := []string{}
+		for _, r := range res {
+			out = append(out, r.Title)
+		}
+		return out
+	}
+	if got := titles("基隆"); len(got) != 2 || got[0] != "基隆港" || got[1] != "基隆浮標" {
+		t.Fatal("基隆", got)
+	}
+	if got := titles("高雄港"); len(got) != 1 {
+		t.Fatal("高雄港", got)
+	}
+	if got := titles("harb"); len(got) != 1 || got[0] != "高雄港" { // prefix
+		t.Fatal("harb", got)
+	}
+	if got := titles("buoy 46694"); len(got) != 1 || got[0] != "基隆浮標" {
+		t.Fatal("buoy", got)
+	}
+	for _, q := range []string{"秘密", "ff0000", "座標", "基隆 高雄"} { // hidden layer, style key, no geometry, AND
+		if got := titles(q); len(got) != 0 {
+			t.Fatal(q, got)
+		}
+	}
+	res, total := s.Search("港", 1)
+	if total != 2 || len(res) != 1 || res[0].Layer != "港口" || res[0].Token != harbor.Token || res[0].Index != 0 {
+		t.Fatal("limit", total, res)
+	}
+	if res, _ = s.Search("高雄", 1); res[0].Center[0] != 120.5 || res[0].BBox != (BBox{120, 22, 121, 23}) {
+		t.Fatal("extent", res[0])
+	}
+
+	// reindex after layer change
+	ly := db.GetLayerByID(1).Clone()
+	ly.Hide = true
+	db.UpdateLayer(ly)
+	s.Refresh()
+	if got := titles("基隆"); len(got) != 1 || got[0] != "基隆浮標" {
+		t.Fatal("after hide", got)
+	}
+
+	wb := NewWebAPI(db)
+	defer wb.Close()
+	wb.search.Refresh()
+	w := httptest.NewRecorder()
+	wb.searchFeature(w, httptest.NewRequest("GET", "/api/search?q=%E6%B5%AE%E6%A8%99", nil))
+	var out struct {
+		Total int `json:"total"`
+		Results []*SearchResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || w.Code != 200 {
+		t.Fatal(w.Code, w.Body.String(), err)
+	}
+	if out.Total != 1 || out.Results[0].Properties["id"] != "Buoy-46694A" {
+		t.Fatal("serve", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	wb.searchFeature(w, httptest.NewRequest("GET", "/api/search?q=", nil))
+	if w.Code != 400 {
+		t.Fatal("empty query", w.Code)
+	}
+}
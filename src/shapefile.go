@@ -0,0 +1,418 @@
+package webmap
+
+/*
+* read zipped shapefile (.shp + .dbf, optional .prj .cpg) into GeoJSON
+* DBF text in UTF-8 or Big5 (cp950), by .cpg, language driver ID or content
+*/
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+var (
+	ErrShpFormat = errors.New("bad shapefile")
+)
+
+// one .shp in zip, with sidecar files
+type shpSet struct {
+	shp *zip.File
+	dbf *zip.File
+	prj *zip.File
+	cpg *zip.File
+}
+
+// all layers in zip merge into one collection, prj of first layer returned
+func readShapefileZip(fp string) (*FeatureCollection, string, error) {
+	zr, err := zip.OpenReader(fp)
+	if err != nil {
+		return nil, "", ErrConvertType
+	}
+	defer zr.Close()
+
+	sets := make(map[string]*shpSet)
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || strings.HasPrefix(path.Base(f.Name), "._") { // skip macOS resource fork
+			continue
+		}
+		ext := strings.ToLower(path.Ext(f.Name))
+		base := strings.ToLower(strings.TrimSuffix(f.Name, path.Ext(f.Name)))
+		s := sets[base]
+		if s == nil {
+			s = &shpSet{}
+			sets[base] = s
+		}
+		switch ext {
+		case ".shp":
+			s.shp = f
+		case ".dbf":
+			s.dbf = f
+		case ".prj":
+			s.prj = f
+		case ".cpg":
+			s.cpg = f
+		}
+	}
+
+	names := make([]string, 0, len(sets))
+	for k, s := range sets {
+		if s.shp != nil {
+			names = append(names, k)
+		}
+	}
+	if len(names) == 0 {
+		return nil, "", ErrConvertType
+	}
+	sort.Strings(names)
+
+	fc := NewFeatureCollection()
+	prj := ""
+	for i, k := range names {
+		s := sets[k]
+		geoms, err := readShp(s.shp)
+		if err != nil {
+			return nil, "", err
+		}
+		var rows []map[string]interface{}
+		var deleted []bool
+		if s.dbf != nil {
+			rows, deleted, err = readDbf(s.dbf, readZipText(s.cpg))
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		if i == 0 {
+			prj = readZipText(s.prj)
+		}
+		for j, g := range geoms {
+			if j < len(deleted) && deleted[j] {
+				continue
+			}
+			var props map[string]interface{}
+			if j < len(rows) {
+				props = rows[j]
+			}
+			fc.Features = append(fc.Features, NewFeature(g, props))
+		}
+	}
+	return fc, prj, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	fd, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ioutil.ReadAll(fd)
+}
+
+func readZipText(f *zip.File) string {
+	if f == nil {
+		return ""
+	}
+	buf, err := readZipFile(f)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(buf))
+}
+
+func readShp(f *zip.File) ([]*Geometry, error) {
+	buf, err := readZipFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 100 || binary.BigEndian.Uint32(buf[0:4]) != 9994 {
+		return nil, ErrShpFormat
+	}
+
+	out := make([]*Geometry, 0, 64)
+	off := 100
+	for off + 8 <= len(buf) {
+		size := int(binary.BigEndian.Uint32(buf[off+4:off+8])) * 2 // 16-bit words
+		off += 8
+		if size < 4 || off + size > len(buf) {
+			return nil, ErrShpFormat
+		}
+		g, err := parseShpRecord(buf[off:off+size])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, g)
+		off += size
+	}
+	return out, nil
+}
+
+func parseShpRecord(rec []byte) (*Geometry, error) {
+	le := binary.LittleEndian
+	f64 := func(b []byte) float64 {
+		return math.Float64frombits(le.Uint64(b))
+	}
+	points := func(b []byte, n int) ([][]float64, error) {
+		if n < 0 || len(b) < n * 16 {
+			return nil, ErrShpFormat
+		}
+		pts := make([][]float64, 0, n)
+		for i := 0; i < n; i++ {
+			pts = append(pts, []float64{f64(b[i*16:]), f64(b[i*16+8:])})
+		}
+		return pts, nil
+	}
+
+	switch le.Uint32(rec[0:4]) {
+	case 0: // null shape
+		return nil, nil
+
+	case 1, 11, 21: // Point, PointZ, PointM
+		if len(rec) < 20 {
+			return nil, ErrShpFormat
+		}
+		return &Geometry{Type: "Point", Point: []float64{f64(rec[4:]), f64(rec[12:])}}, nil
+
+	case 8, 18, 28: // MultiPoint
+		if len(rec) < 40 {
+			return nil, ErrShpFormat
+		}
+		pts, err := points(rec[40:], int(int32(le.Uint32(rec[36:40]))))
+		if err != nil {
+			return nil, err
+		}
+		return &Geometry{Type: "MultiPoint", Line: pts}, nil
+
+	case 3, 13, 23, 5, 15, 25: // PolyLine, Polygon
+		if len(rec) < 44 {
+			return nil, ErrShpFormat
+		}
+		nParts := int(int32(le.Uint32(rec[36:40])))
+		nPts := int(int32(le.Uint32(rec[40:44])))
+		if nParts < 0 || len(rec) < 44 + nParts * 4 {
+			return nil, ErrShpFormat
+		}
+		pts, err := points(rec[44+nParts*4:], nPts)
+		if err != nil {
+			return nil, err
+		}
+		parts := make([][][]float64, 0, nParts)
+		for i := 0; i < nParts; i++ {
+			a := int(int32(le.Uint32(rec[44+i*4:])))
+			b := nPts
+			if i + 1 < nParts {
+				b = int(int32(le.Uint32(rec[48+i*4:])))
+			}
+			if a < 0 || a > b || b > nPts {
+				return nil, ErrShpFormat
+			}
+			if b > a {
+				parts = append(parts, pts[a:b])
+			}
+		}
+		if len(parts) == 0 {
+			return nil, nil
+		}
+
+		switch le.Uint32(rec[0:4]) {
+		case 3, 13, 23:
+			if len(parts) == 1 {
+				return &Geometry{Type: "LineString", Line: parts[0]}, nil
+			}
+			return &Geometry{Type: "MultiLineString", Poly: parts}, nil
+		}
+		return shpPolygon(parts), nil
+	}
+	return nil, nil // MultiPatch or unknown, keep attribute only
+}
+
+// outer ring clockwise & hole counter-clockwise in shapefile
+// output RFC 7946 winding: outer counter-clockwise
+func shpPolygon(rings [][][]float64) *Geometry {
+	polys := make([][][][]float64, 0, 1)
+	holes := make([][][]float64, 0)
+	for _, r := range rings {
+		if ringArea2(r) <= 0 {
+			reverseRing(r)
+			polys = append(polys, [][][]float64{r})
+		} else {
+			holes = append(holes, r)
+		}
+	}
+	if len(polys) == 0 { // wrong winding, all as outer
+		for _, r := range holes {
+			polys = append(polys, [][][]float64{r})
+		}
+		holes = nil
+	}
+	for _, h := range holes {
+		reverseRing(h)
+		idx := 0
+		for i, p := range polys {
+			if ringContains(p[0], h[0][0], h[0][1]) {
+				idx = i
+				break
+			}
+		}
+		polys[idx] = append(polys[idx], h)
+	}
+
+	if len(polys) == 1 {
+		return &Geometry{Type: "Polygon", Poly: polys[0]}
+	}
+	return &Geometry{Type: "MultiPolygon", Multi: polys}
+}
+
+type dbfField struct {
+	name string
+	typ byte
+	size int
+	dec int
+}
+
+func readDbf(f *zip.File, cpg string) ([]map[string]interface{}, []bool, error) {
+	buf, err := readZipFile(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(buf) < 32 {
+		return nil, nil, ErrShpFormat
+	}
+	le := binary.LittleEndian
+	nRec := int(le.Uint32(buf[4:8]))
+	hdrLen := int(le.Uint16(buf[8:10]))
+	recLen := int(le.Uint16(buf[10:12]))
+	if hdrLen > len(buf) || recLen <= 0 {
+		return nil, nil, ErrShpFormat
+	}
+	if max := (len(buf) - hdrLen) / recLen; nRec > max { // truncated file
+		nRec = max
+	}
+
+	rawNames := make([][]byte, 0, 16)
+	fields := make([]*dbfField, 0, 16)
+	for off := 32; off + 32 <= hdrLen && buf[off] != 0x0D; off += 32 {
+		fd := buf[off:off+32]
+		name := fd[0:11]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		rawNames = append(rawNames, name)
+		fields = append(fields, &dbfField{
+			typ: fd[11],
+			size: int(fd[16]),
+			dec: int(fd[17]),
+		})
+	}
+
+	// pick decoder by all text
+	sample := make([][]byte, 0, len(rawNames) + 1)
+	sample = append(sample, rawNames...)
+	sample = append(sample, buf[hdrLen:hdrLen+nRec*recLen])
+	decode := dbfDecoder(cpg, buf[29], sample)
+	for i, f := range fields {
+		f.name = decode(rawNames[i])
+	}
+
+	rows := make([]map[string]interface{}, 0, nRec)
+	deleted := make([]bool, 0, nRec)
+	for i := 0; i < nRec; i++ {
+		off := hdrLen + i * recLen
+		if off + recLen > len(buf) {
+			break
+		}
+		rec := buf[off:off+recLen]
+		deleted = append(deleted, rec[0] == '*')
+		props := make(map[string]interface{}, len(fields))
+		p := 1
+		for _, f := range fields {
+			if p + f.size > len(rec) {
+				break
+			}
+			props[f.name] = dbfValue(f, rec[p:p+f.size], decode)
+			p += f.size
+		}
+		rows = append(rows, props)
+	}
+	return rows, deleted, nil
+}
+
+func dbfValue(f *dbfField, raw []byte, decode func([]byte) string) interface{} {
+	switch f.typ {
+	case 'N', 'F':
+		s := strings.TrimSpace(string(raw))
+		if s == "" || strings.Trim(s, "*") == "" {
+			return nil
+		}
+		if f.dec == 0 {
+			if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return v
+			}
+		}
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			return v
+		}
+		return nil
+	case 'L':
+		switch strings.TrimSpace(string(raw)) {
+		case "T", "t", "Y", "y":
+			return true
+		case "F", "f", "N", "n":
+			return false
+		}
+		return nil
+	case 'D':
+		s := strings.TrimSpace(string(raw))
+		if len(s) == 8 {
+			return s[0:4] + "-" + s[4:6] + "-" + s[6:8]
+		}
+		return s
+	}
+	return decode(raw)
+}
+
+// ldid: language driver ID at DBF header byte 29
+func dbfDecoder(cpg string, ldid byte, sample [][]byte) func([]byte) string {
+	big5 := false
+	cpg = strings.ToUpper(cpg)
+	switch {
+	case strings.Contains(cpg, "UTF") || strings.Contains(cpg, "65001"):
+	case strings.Contains(cpg, "BIG5") || strings.Contains(cpg, "950"):
+		big5 = true
+	case ldid == 0x78 || ldid == 0x4F: // cp950
+		big5 = true
+	default:
+		for _, b := range sample {
+			if !utf8.Valid(b) {
+				big5 = true
+				break
+			}
+		}
+	}
+
+	trim := func(b []byte) []byte {
+		return bytes.TrimSpace(bytes.TrimRight(b, "\x00"))
+	}
+	if !big5 {
+		return func(b []byte) string {
+			return string(trim(b))
+		}
+	}
+	dec := traditionalchinese.Big5.NewDecoder()
+	return func(b []byte) string {
+		out, err := dec.Bytes(trim(b))
+		if err != nil {
+			return string(trim(b))
+		}
+		return string(out)
+	}
+}
@@ -0,0 +1,290 @@
+package webmap
+
+/*
+* reconcile ./upload & ./cache with AttachStore / HookStore
+* report orphan, missing & size mismatch file, disk usage per category
+* orphan older than StorageGCGrace removed by background job
+*/
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	StorageGCInterval = 6 * time.Hour
+	StorageGCGrace = 24 * time.Hour // keep orphan file for a while, eg: upload in progress
+
+	ErrQuota = errors.New("storage quota exceeded")
+)
+
+const (
+	StorageAttach = "attach"
+	StorageHook = "hook"
+)
+
+type StorageUsage struct {
+	Files int `json:"n"`
+	Size int64 `json:"sz"` // Bytes
+	Quota int64 `json:"quota,omitempty"` // Bytes, 0 for no limit
+}
+
+type OrphanFile struct {
+	Category string `json:"cat"` // 'attach', 'hook'
+	Name string `json:"name"` // relative path
+	Size int64 `json:"sz"`
+	MTime time.Time `json:"mtime"`
+	Removed bool `json:"rm,omitempty"`
+}
+
+type BrokenFile struct {
+	Category string `json:"cat"`
+	Token string `json:"token"`
+	Name string `json:"name"`
+	Size int64 `json:"sz"` // in db
+	DiskSize int64 `json:"dsz"` // -1 for missing
+}
+
+type StorageReport struct {
+	Time time.Time `json:"time"`
+	Attach *StorageUsage `json:"attach"` // on disk, include old versions
+	Hook *StorageUsage `json:"hook"`
+	Temp *StorageUsage `json:"tmp"` // unfinished resumable upload
+	Orphan *StorageUsage `json:"orphan"`
+
+	Orphans []*OrphanFile `json:"orphans"`
+	Missing []*BrokenFile `json:"missing"`
+	Mismatch []*BrokenFile `json:"mismatch"`
+}
+
+type StorageGC struct {
+	db API
+	die chan struct{}
+
+	mx sync.Mutex // one run at a time
+	last *StorageReport
+}
+
+func NewStorageGC(db API) *StorageGC {
+	return &StorageGC{
+		db: db,
+		die: make(chan struct{}),
+	}
+}
+
+func (g *StorageGC) Start() {
+	go g.loop()
+}
+
+func (g *StorageGC) Close() {
+	select {
+	case <-g.die:
+	default:
+		close(g.die)
+	}
+}
+
+func (g *StorageGC) loop() {
+	ticker := time.NewTicker(StorageGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.die:
+			return
+		case <-ticker.C:
+		}
+		rp := g.Run(time.Now(), true)
+		removed := 0
+		for _, f := range rp.Orphans {
+			if f.Removed {
+				removed += 1
+			}
+		}
+		if removed > 0 || len(rp.Missing) > 0 || len(rp.Mismatch) > 0 {
+			Vln(3, "[gc]orphan", len(rp.Orphans), "removed", removed, "missing", len(rp.Missing), "mismatch", len(rp.Mismatch))
+		}
+	}
+}
+
+// last report, nil if never run
+func (g *StorageGC) Last() *StorageReport {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	return g.last
+}
+
+// scan & remove orphan older than grace if 'remove'
+func (g *StorageGC) Run(now time.Time, remove bool) *StorageReport {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	conf := g.db.GetConfig()
+	rp := &StorageReport{
+		Time: now,
+		Attach: &StorageUsage{Quota: conf.AttachQuota * 1024 * 1024},
+		Hook: &StorageUsage{Quota: conf.HookQuota * 1024 * 1024},
+		Temp: &StorageUsage{},
+		Orphan: &StorageUsage{},
+		Orphans: make([]*OrphanFile, 0),
+		Missing: make([]*BrokenFile, 0),
+		Mismatch: make([]*BrokenFile, 0),
+	}
+
+	// upload blob may added while scanning, hold it
+	blobMx.Lock()
+	known := make(map[string]bool)
+	for _, a := range g.db.ListAllAttach() {
+		for _, sn := range a.blobs() {
+			known[filepath.Clean("/" + sn)[1:]] = true
+		}
+		g.checkFile(rp, StorageAttach, UploadFileDir, a.SaveName, a.Token, a.OriginalName, a.Size)
+	}
+	g.scanDir(rp, StorageAttach, UploadFileDir, known, rp.Attach, now, remove)
+	blobMx.Unlock()
+
+	known = make(map[string]bool)
+	for _, obj := range g.db.ListHook() {
+		hook := g.db.GetHookByID(obj.ID) // ListHook() clean up SaveName
+		if hook == nil || hook.SaveName == "" {
+			continue
+		}
+		known[filepath.Clean("/" + hook.SaveName)[1:]] = true
+		g.checkFile(rp, StorageHook, CacheFileDir, hook.SaveName, hook.Token, hook.Name, hook.Size)
+	}
+	g.scanDir(rp, StorageHook, CacheFileDir, known, rp.Hook, now, remove)
+
+	sort.Slice(rp.Orphans, func(i, j int) bool {
+		return rp.Orphans[i].Size > rp.Orphans[j].Size
+	})
+	g.last = rp
+	return rp
+}
+
+func (g *StorageGC) checkFile(rp *StorageReport, cat string, dir string, saveName string, token string, name string, size int64) {
+	if saveName == "" {
+		return
+	}
+	fi, err := os.Stat(filepath.Join(dir, filepath.Clean("/" + saveName)[1:]))
+	b := &BrokenFile{
+		Category: cat,
+		Token: token,
+		Name: name,
+		Size: size,
+		DiskSize: -1,
+	}
+	switch {
+	case err != nil:
+		rp.Missing = append(rp.Missing, b)
+	case fi.Size() != size:
+		b.DiskSize = fi.Size()
+		rp.Mismatch = append(rp.Mismatch, b)
+	}
+}
+
+func (g *StorageGC) scanDir(rp *StorageReport, cat string, dir string, known map[string]bool, usage *StorageUsage, now time.Time, remove bool) {
+	tmpDir := filepath.Clean(UploadTempDir)
+	filepath.Walk(dir, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi.IsDir() {
+			if filepath.Clean(fp) == tmpDir && cat == StorageAttach { // managed by UploadStore
+				rp.Temp.Files, rp.Temp.Size = dirUsage(fp)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fp)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if known[rel] {
+			usage.Files += 1
+			usage.Size += fi.Size()
+			return nil
+		}
+
+		of := &OrphanFile{
+			Category: cat,
+			Name: rel,
+			Size: fi.Size(),
+			MTime: fi.ModTime(),
+		}
+		if remove && now.Sub(fi.ModTime()) > StorageGCGrace && !strings.HasPrefix(fi.Name(), ".") {
+			if err := os.Remove(fp); err == nil {
+				of.Removed = true
+				Vln(4, "[gc]remove orphan", cat, rel, fi.Size())
+			} else {
+				Vln(3, "[gc]remove orphan error", cat, rel, err)
+			}
+		}
+		if !of.Removed {
+			rp.Orphan.Files += 1
+			rp.Orphan.Size += fi.Size()
+		}
+		rp.Orphans = append(rp.Orphans, of)
+		return nil
+	})
+}
+
+func dirUsage(dir string) (int, int64) {
+	var n int
+	var sz int64
+	filepath.Walk(dir, func(fp string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			n += 1
+			sz += fi.Size()
+		}
+		return nil
+	})
+	return n, sz
+}
+
+// usage by db, for quota check before write
+func storageUsed(db API, cat string) int64 {
+	var sz int64
+	switch cat {
+	case StorageAttach:
+		seen := make(map[string]bool)
+		for _, a := range db.ListAllAttach() {
+			if !seen[a.SaveName] {
+				seen[a.SaveName] = true
+				sz += a.Size
+			}
+			for _, v := range a.Versions {
+				if !seen[v.SaveName] {
+					seen[v.SaveName] = true
+					sz += v.Size
+				}
+			}
+		}
+	case StorageHook:
+		for _, hook := range db.ListHook() {
+			sz += hook.Size
+		}
+	}
+	return sz
+}
+
+// add: size of new data, minus size of replaced data if any
+func checkQuota(db API, cat string, add int64) error {
+	conf := db.GetConfig()
+	quota := conf.AttachQuota
+	if cat == StorageHook {
+		quota = conf.HookQuota
+	}
+	if quota <= 0 || add <= 0 {
+		return nil
+	}
+	if storageUsed(db, cat) + add > quota * 1024 * 1024 {
+		return ErrQuota
+	}
+	return nil
+}
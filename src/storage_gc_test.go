@@ -0,0 +1,86 @@
+package webmap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorageGC(t *testing.T) {
+	dir, done := tempStorage(t, "storage-gc")
+	defer done()
+	UploadFileDir, CacheFileDir, UploadTempDir = filepath.Join(dir, "upload"), filepath.Join(dir, "cache"), filepath.Join(dir, "upload", "tmp")
+	for _, d := range []string{UploadFileDir, CacheFileDir, UploadTempDir} {
+		os.MkdirAll(d, 0755)
+	}
+
+	db := NewDataStore()
+	data := []byte(`{"type":"FeatureCollection","features":[]}`)
+	a := NewAttachment("a.geojson", int64(len(data)))
+	a.Checksum, _ = sha256fd(bytes.NewReader(data))
+	ioutil.WriteFile(filepath.Join(UploadFileDir, a.SaveName), data, 0644)
+	if _, err := addAttachFile(db, a); err != nil {
+		t.Fatal(err)
+	}
+	lost := NewAttachment("lost.zip", 10)
+	db.AddAttach(lost)
+
+	hid, _ := db.AddHook(&HookConfig{Name: "hook"})
+	if err := updateHookData(db, db.GetHookByID(hid), "data.json", int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	old := now.Add(-StorageGCGrace * 2)
+	orphan := func(fp string, mtime time.Time) string {
+		ioutil.WriteFile(fp, []byte("orphan"), 0644)
+		os.Chtimes(fp, mtime, mtime)
+		return fp
+	}
+	oldFp := orphan(filepath.Join(CacheFileDir, "old.bin"), old)
+	newFp := orphan(filepath.Join(UploadFileDir, "new.bin"), now)
+	orphan(filepath.Join(UploadTempDir, "part"), old)
+
+	gc := NewStorageGC(db)
+	rp := gc.Run(now, false)
+	if len(rp.Orphans) != 2 || rp.Orphan.Files != 2 || rp.Temp.Files != 1 {
+		t.Fatal("orphan count", len(rp.Orphans), rp.Orphan.Files, rp.Temp.Files)
+	}
+	if rp.Attach.Files != 1 || rp.Hook.Files != 1 || rp.Attach.Size != int64(len(data)) {
+		t.Fatal("usage", rp.Attach, rp.Hook)
+	}
+	if len(rp.Missing) != 1 || rp.Missing[0].Token != lost.Token {
+		t.Fatal("missing file", rp.Missing)
+	}
+
+	ioutil.WriteFile(filepath.Join(UploadFileDir, a.SaveName), data[:5], 0644)
+	rp = gc.Run(now, true)
+	if len(rp.Mismatch) != 1 || rp.Mismatch[0].DiskSize != 5 {
+		t.Fatal("size mismatch", rp.Mismatch)
+	}
+	if _, err := os.Stat(oldFp); !os.IsNotExist(err) {
+		t.Fatal("old orphan should be removed", err)
+	}
+	if _, err := os.Stat(newFp); err != nil {
+		t.Fatal("orphan in grace period should keep", err)
+	}
+	if rp.Orphan.Files != 1 || gc.Last() != rp {
+		t.Fatal("report after remove", rp.Orphan.Files)
+	}
+
+	conf := db.GetConfig().Clone()
+	conf.AttachQuota = 1
+	db.SetConfig(conf)
+	if err := checkQuota(db, StorageAttach, 1024 * 1024); err != ErrQuota {
+		t.Fatal("should over quota", err)
+	}
+	if err := checkQuota(db, StorageAttach, 1024); err != nil {
+		t.Fatal("under quota", err)
+	}
+	if err := checkQuota(db, StorageHook, 1024 * 1024 * 1024); err != nil {
+		t.Fatal("no hook quota", err)
+	}
+}
@@ -0,0 +1,552 @@
+package webmap
+
+/*
+* point table (CSV / XLSX) into GeoJSON
+* coordinate column by TableConf or header name, other column as properties with type inference
+* bad row skipped and reported, not fail whole table
+*/
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+var (
+	TableFailedMax = 100 // failed row listed in report
+	TableColMax = 16384 // cell per row, xlsx limit 'XFD'
+
+	ErrTableColumn = errors.New("coordinate column not found")
+	ErrTableSize = errors.New("too many columns")
+
+	tableXNames = []string{"lng", "lon", "long", "longitude", "經度", "x", "x座標", "x坐標", "座標x", "坐標x", "twd97x", "twd97_x", "x_twd97", "橫座標", "東座標"}
+	tableYNames = []string{"lat", "latitude", "緯度", "y", "y座標", "y坐標", "座標y", "坐標y", "twd97y", "twd97_y", "y_twd97", "縱座標", "北座標"}
+)
+
+// how to read a point table, empty field for auto detect
+type TableConf struct {
+	X string `json:"x,omitempty"` // column name of longitude or TWD97 X
+	Y string `json:"y,omitempty"`
+	Delim string `json:"delim,omitempty"` // CSV only, "tab" for \t
+	Enc string `json:"enc,omitempty"` // CSV only, "utf-8" or "big5"
+}
+
+// result of table convert
+type ConvReport struct {
+	Rows int `json:"rows"` // data row, header not included
+	OK int `json:"ok"`
+	Failed []*RowErr `json:"failed,omitempty"`
+	More int `json:"more,omitempty"` // failed but not listed
+}
+
+type RowErr struct {
+	Row int `json:"row"` // record in CSV (blank line skipped) or row in sheet, header is 1
+	Err string `json:"err"`
+}
+
+func (r *ConvReport) fail(row int, msg string) {
+	if len(r.Failed) >= TableFailedMax {
+		r.More++
+		return
+	}
+	r.Failed = append(r.Failed, &RowErr{row, msg})
+}
+
+type tableRow struct {
+	n int
+	cells []string
+}
+
+func convertTable(fp string, a *Attachment) (*FeatureCollection, error) {
+	conf := a.Table
+	if conf == nil {
+		conf = &TableConf{}
+	}
+	var rows []*tableRow
+	switch a.Kind {
+	case "zip":
+		zr, err := zip.OpenReader(fp)
+		if err != nil {
+			return nil, ErrConvertType
+		}
+		defer zr.Close()
+		rows, err = readXlsx(&zr.Reader)
+		if err != nil {
+			return nil, err
+		}
+	case "text":
+		ext := strings.ToLower(filepath.Ext(a.OriginalName))
+		if a.Table == nil && ext != ".csv" && ext != ".tsv" {
+			return nil, ErrConvertType
+		}
+		buf, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return nil, err
+		}
+		rows, err = readCSV(buf, ext, conf)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrConvertType
+	}
+
+	fc, err := tableFeatures(rows, conf, a.SrcCRS)
+	if err == ErrTableColumn && a.Table == nil { // not a point table
+		return nil, ErrConvertType
+	}
+	return fc, err
+}
+
+// pushed CSV / XLSX data of hook into GeoJSON, for HookConfig.Table
+func convertHookTable(conf *TableConf, crs string, ft *FileType, name string, file io.Reader) ([]byte, *ConvReport, error) {
+	buf, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rows []*tableRow
+	switch ft.Kind {
+	case "zip":
+		var zr *zip.Reader
+		zr, err = zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+		if err != nil {
+			return nil, nil, err
+		}
+		rows, err = readXlsx(zr)
+	case "text":
+		rows, err = readCSV(buf, strings.ToLower(filepath.Ext(name)), conf)
+	default:
+		return nil, nil, ErrConvertType
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	fc, err := tableFeatures(rows, conf, crs)
+	if err != nil {
+		return nil, nil, err
+	}
+	fc.Round(ConvertDigits)
+	out, err := json.Marshal(fc)
+	return out, fc.report, err
+}
+
+func readCSV(buf []byte, ext string, conf *TableConf) ([]*tableRow, error) {
+	buf = bytes.TrimPrefix(buf, []byte("\xef\xbb\xbf"))
+	enc := strings.ToLower(conf.Enc)
+	if enc == "big5" || enc == "cp950" || (enc == "" && !utf8.Valid(buf)) {
+		out, err := traditionalchinese.Big5.NewDecoder().Bytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = out
+	}
+
+	delim := ','
+	switch conf.Delim {
+	case "":
+		delim = csvDelim(buf, ext)
+	case "tab", "\\t", "\t":
+		delim = '\t'
+	default:
+		delim, _ = utf8.DecodeRuneInString(conf.Delim)
+	}
+
+	rd := csv.NewReader(bytes.NewReader(buf))
+	rd.Comma = delim
+	rd.LazyQuotes = true
+	rd.FieldsPerRecord = -1
+	rows := make([]*tableRow, 0, 64)
+	for n := 1; ; n++ {
+		rec, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad csv: %v", err)
+		}
+		rows = append(rows, &tableRow{n, rec})
+	}
+	return rows, nil
+}
+
+// most used one in header line
+func csvDelim(buf []byte, ext string) rune {
+	if ext == ".tsv" {
+		return '\t'
+	}
+	line := buf
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		line = buf[:i]
+	}
+	out, max := ',', 0
+	for _, d := range []rune{',', '\t', ';', '|'} {
+		if c := bytes.Count(line, []byte(string(d))); c > max {
+			out, max = d, c
+		}
+	}
+	return out
+}
+
+type xlsxText struct {
+	T string `xml:"t"`
+	R []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t *xlsxText) String() string {
+	if len(t.R) == 0 {
+		return t.T
+	}
+	out := ""
+	for _, r := range t.R {
+		out += r.T
+	}
+	return out
+}
+
+type xlsxRow struct {
+	R int `xml:"r,attr"`
+	C []struct {
+		R string `xml:"r,attr"`
+		T string `xml:"t,attr"`
+		V string `xml:"v"`
+		Is xlsxText `xml:"is"`
+	} `xml:"c"`
+}
+
+// first sheet only, ErrConvertType if not xlsx
+func readXlsx(zr *zip.Reader) ([]*tableRow, error) {
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	if files["xl/workbook.xml"] == nil {
+		return nil, ErrConvertType
+	}
+
+	sheet := "xl/worksheets/sheet1.xml"
+	wb := struct {
+		Sheets []struct {
+			RID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}{}
+	rels := struct {
+		Rels []struct {
+			ID string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}{}
+	if xlsxDecode(files["xl/workbook.xml"], &wb) == nil && xlsxDecode(files["xl/_rels/workbook.xml.rels"], &rels) == nil && len(wb.Sheets) > 0 {
+		for _, r := range rels.Rels {
+			if r.ID != wb.Sheets[0].RID {
+				continue
+			}
+			if strings.HasPrefix(r.Target, "/") {
+				sheet = strings.TrimPrefix(r.Target, "/")
+			} else {
+				sheet = path.Join("xl", r.Target)
+			}
+		}
+	}
+	if files[sheet] == nil {
+		return nil, errors.New("bad xlsx: sheet not found")
+	}
+
+	sst := struct {
+		SI []xlsxText `xml:"si"`
+	}{}
+	xlsxDecode(files["xl/sharedStrings.xml"], &sst)
+
+	fd, err := files[sheet].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	dec := xml.NewDecoder(fd)
+	rows := make([]*tableRow, 0, 64)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad xlsx: %v", err)
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "row" {
+			continue
+		}
+		row := &xlsxRow{}
+		if err := dec.DecodeElement(row, &se); err != nil {
+			return nil, fmt.Errorf("bad xlsx: %v", err)
+		}
+		if row.R == 0 {
+			row.R = len(rows) + 1
+		}
+		if len(row.C) > TableColMax {
+			return nil, ErrTableSize
+		}
+		cells := make([]string, 0, len(row.C))
+		for i, c := range row.C {
+			idx := xlsxCol(c.R)
+			if idx < 0 {
+				idx = i
+			}
+			if idx >= TableColMax {
+				return nil, ErrTableSize
+			}
+			for len(cells) <= idx {
+				cells = append(cells, "")
+			}
+			switch c.T {
+			case "s":
+				if n, err := strconv.Atoi(c.V); err == nil && n >= 0 && n < len(sst.SI) {
+					cells[idx] = sst.SI[n].String()
+				}
+			case "inlineStr":
+				cells[idx] = c.Is.String()
+			case "b":
+				cells[idx] = map[string]string{"1": "true", "0": "false"}[c.V]
+			default:
+				cells[idx] = c.V
+			}
+		}
+		rows = append(rows, &tableRow{row.R, cells})
+	}
+	return rows, nil
+}
+
+func xlsxDecode(f *zip.File, v interface{}) error {
+	if f == nil {
+		return ErrNotExist
+	}
+	fd, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return xml.NewDecoder(fd).Decode(v)
+}
+
+// "AB12" -> 27, -1 if no column, TableColMax if out of range
+func xlsxCol(ref string) int {
+	n := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		n = n * 26 + int(r - 'A' + 1)
+		if n > TableColMax {
+			return TableColMax
+		}
+	}
+	return n - 1
+}
+
+func tableColumn(header []string, name string, names []string) int {
+	norm := func(s string) string {
+		return strings.ToLower(strings.Join(strings.Fields(s), ""))
+	}
+	if name != "" {
+		for i, h := range header {
+			if strings.TrimSpace(h) == strings.TrimSpace(name) {
+				return i
+			}
+		}
+		return -1
+	}
+	for _, n := range names {
+		for i, h := range header {
+			if norm(h) == n {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// crs: source EPSG code, empty for guess by first valid row
+func tableFeatures(rows []*tableRow, conf *TableConf, crs string) (*FeatureCollection, error) {
+	if len(rows) == 0 {
+		return nil, ErrTableColumn
+	}
+	header := make([]string, len(rows[0].cells))
+	for i, h := range rows[0].cells {
+		header[i] = strings.TrimSpace(h)
+		if header[i] == "" {
+			header[i] = "col" + strconv.Itoa(i + 1)
+		}
+	}
+	xi := tableColumn(header, conf.X, tableXNames)
+	yi := tableColumn(header, conf.Y, tableYNames)
+	if xi < 0 || yi < 0 || xi == yi {
+		return nil, ErrTableColumn
+	}
+	rows = rows[1:]
+	types := tableTypes(header, rows)
+
+	fc := NewFeatureCollection()
+	fc.report = &ConvReport{}
+	for _, row := range rows {
+		if tableEmpty(row.cells) {
+			continue
+		}
+		fc.report.Rows++
+		x, err1 := tableFloat(row.cells, xi)
+		y, err2 := tableFloat(row.cells, yi)
+		if err1 != nil || err2 != nil {
+			fc.report.fail(row.n, "bad coordinate")
+			continue
+		}
+		if crs == "" {
+			crs = guessCRS(x, y)
+		}
+		if !coordInCRS(crs, x, y) {
+			fc.report.fail(row.n, "coordinate out of range")
+			continue
+		}
+
+		props := make(map[string]interface{}, len(header))
+		for i, h := range header {
+			v := ""
+			if i < len(row.cells) {
+				v = strings.TrimSpace(row.cells[i])
+			}
+			props[h] = tableValue(types[i], v)
+		}
+		fc.Features = append(fc.Features, NewFeature(&Geometry{Type: "Point", Point: []float64{x, y}}, props))
+		fc.report.OK++
+	}
+	if crs != "" {
+		if err := fc.Reproject(crs, "4326"); err != nil {
+			return nil, err
+		}
+	}
+	return fc, nil
+}
+
+func tableEmpty(cells []string) bool {
+	for _, c := range cells {
+		if strings.TrimSpace(c) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func tableFloat(cells []string, i int) (float64, error) {
+	if i >= len(cells) {
+		return 0, ErrNotExist
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(cells[i]), 64)
+	if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		err = ErrNotExist
+	}
+	return v, err
+}
+
+func coordInCRS(crs string, x float64, y float64) bool {
+	switch crs {
+	case "4326", "3821":
+		return math.Abs(x) <= 180 && math.Abs(y) <= 90
+	case "":
+		return false
+	}
+	return true
+}
+
+// int, float, bool or string, by all value in column
+func tableTypes(header []string, rows []*tableRow) []string {
+	types := make([]string, len(header))
+	for i := range header {
+		typ := ""
+		for _, row := range rows {
+			if i >= len(row.cells) {
+				continue
+			}
+			v := strings.TrimSpace(row.cells[i])
+			if v == "" {
+				continue
+			}
+			typ = tableMerge(typ, tableKind(v))
+			if typ == "string" {
+				break
+			}
+		}
+		types[i] = typ
+	}
+	return types
+}
+
+func tableKind(v string) string {
+	switch strings.ToLower(v) {
+	case "true", "false":
+		return "bool"
+	}
+	if len(v) > 1 && v[0] == '0' && v[1] != '.' { // code like 007, keep as text
+		return "string"
+	}
+	if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return "int"
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return "float"
+	}
+	return "string"
+}
+
+func tableMerge(a string, b string) string {
+	switch {
+	case a == "" || a == b:
+		return b
+	case (a == "int" && b == "float") || (a == "float" && b == "int"):
+		return "float"
+	}
+	return "string"
+}
+
+func tableValue(typ string, v string) interface{} {
+	if v == "" {
+		return nil
+	}
+	switch typ {
+	case "int":
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	case "float":
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	case "bool":
+		return strings.ToLower(v) == "true"
+	}
+	return v
+}
+
+// table setting from form, nil if not set
+func parseTableConf(get func(string) string) *TableConf {
+	conf := &TableConf{
+		X: strings.TrimSpace(get("tx")),
+		Y: strings.TrimSpace(get("ty")),
+		Delim: get("tdelim"),
+		Enc: strings.TrimSpace(get("tenc")),
+	}
+	if *conf == (TableConf{}) && get("table") != "1" {
+		return nil
+	}
+	return conf
+}
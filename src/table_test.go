@@ -0,0 +1,177 @@
+package webmap
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+func TestTableCSV(t *testing.T) {
+	csv := "\xef\xbb\xbf名稱;經度;緯度;人數;代碼;開放;面積\n" +
+		"公園;121.5;25.0;10;007;TRUE;1.5\n" +
+		"\n" +
+		"廣場;121.6;25.1;20;008;false;2\n" +
+		"壞點;abc;25.1;1;009;true;\n" +
+		"太遠;221.6;25.1;1;010;true;3\n"
+	rows, err := readCSV([]byte(csv), ".csv", &TableConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, err := tableFeatures(rows, &TableConf{}, "")
+	if err != nil || len(fc.Features) != 2 {
+		t.Fatal("features", err, fc)
+	}
+	p := fc.Features[0].Properties
+	if p["名稱"] != "公園" || p["人數"] != int64(10) || p["代碼"] != "007" || p["開放"] != true || p["面積"] != 1.5 {
+		t.Fatal("type inference", p)
+	}
+	if v := fc.Features[1].Properties["面積"]; v != float64(2) {
+		t.Fatal("float column", v)
+	}
+	if pt := fc.Features[1].Geometry.Point; pt[0] != 121.6 || pt[1] != 25.1 {
+		t.Fatal("coordinate", pt)
+	}
+	rep := fc.report
+	if rep.Rows != 4 || rep.OK != 2 || len(rep.Failed) != 2 || rep.Failed[0].Row != 4 || rep.Failed[1].Row != 5 {
+		t.Fatal("report", rep, rep.Failed)
+	}
+
+	// Big5, named column, tab
+	big5, _ := traditionalchinese.Big5.NewEncoder().Bytes([]byte("站名\tE\tN\n測站\t120.1\t23.5\n"))
+	conf := &TableConf{X: "E", Y: "N"}
+	rows, err = readCSV(big5, ".txt", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, err = tableFeatures(rows, conf, "")
+	if err != nil || len(fc.Features) != 1 || fc.Features[0].Properties["站名"] != "測站" {
+		t.Fatal("big5", err, fc)
+	}
+	if _, err := tableFeatures(rows, &TableConf{}, ""); err != ErrTableColumn {
+		t.Fatal("no coordinate column", err)
+	}
+
+	// TWD97 guessed, TWD67 by override
+	rows, _ = readCSV([]byte("name,TWD97X,TWD97Y\na,250000,2544283.12\n"), ".csv", &TableConf{})
+	fc, err = tableFeatures(rows, &TableConf{}, "")
+	if err != nil || len(fc.Features) != 1 {
+		t.Fatal("twd97", err)
+	}
+	if pt := fc.Features[0].Geometry.Point; math.Abs(pt[0] - 121) > 1e-9 || math.Abs(pt[1] - 23) > 1e-6 {
+		t.Fatal("twd97 coordinate", pt)
+	}
+	fc, err = tableFeatures(rows, &TableConf{}, "3828")
+	if err != nil || len(fc.Features) != 1 || fc.Features[0].Geometry.Point[0] < 121.005 {
+		t.Fatal("twd67", err, fc.Features[0].Geometry.Point)
+	}
+}
+
+func TestTableXlsx(t *testing.T) {
+	_, done := tempStorage(t, "table")
+	defer done()
+
+	xlsx := map[string][]byte{
+		"[Content_Types].xml": []byte(`<?xml version="1.0"?><Types/>`),
+		"xl/workbook.xml": []byte(`<?xml version="1.0"?><workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="點位" sheetId="1" r:id="rId3"/></sheets></workbook>`),
+		"xl/_rels/workbook.xml.rels": []byte(`<?xml version="1.0"?><Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId3" Type="worksheet" Target="worksheets/data.xml"/></Relationships>`),
+		"xl/sharedStrings.xml": []byte(`<?xml version="1.0"?><sst><si><t>名稱</t></si><si><t>lng</t></si><si><t>lat</t></si><si><r><t>消防</t></r><r><t>隊</t></r></si></sst>`),
+		"xl/worksheets/data.xml": []byte(`<?xml version="1.0"?><worksheet><sheetData>` +
+			`<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c><c r="C1" t="s"><v>2</v></c><c r="D1" t="inlineStr"><is><t>啟用</t></is></c></row>` +
+			`<row r="2"><c r="A2" t="s"><v>3</v></c><c r="B2"><v>121.25</v></c><c r="C2"><v>24.5</v></c><c r="D2" t="b"><v>1</v></c></row>` +
+			`<row r="4"><c r="B4"><v>121.3</v></c></row>` +
+			`</sheetData></worksheet>`),
+	}
+
+	db := NewDataStore()
+	a := NewAttachment("point.xlsx", 0)
+	fp := filepath.Join(UploadFileDir, a.SaveName)
+	testZip(t, fp, xlsx)
+	a.Kind = "zip"
+	a.Checksum = sha256File(fp)
+	if _, err := addAttachFile(db, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := deriveAttach(db, a.Token); err != nil {
+		t.Fatal(err)
+	}
+	a = db.GetAttachByToken(a.Token)
+	d := db.GetAttachByToken(a.Derived)
+	if d == nil || a.Report == nil || a.Report.Rows != 2 || a.Report.OK != 1 || a.Report.Failed[0].Row != 4 {
+		t.Fatal("derived", a, a.Report)
+	}
+	buf, _ := ioutil.ReadFile(filepath.Join(UploadFileDir, d.SaveName))
+	fc, err := ParseFeatureCollection(buf)
+	if err != nil || len(fc.Features) != 1 {
+		t.Fatal(err, string(buf))
+	}
+	if p := fc.Features[0].Properties; p["名稱"] != "消防隊" || p["啟用"] != true || p["lng"] != 121.25 {
+		t.Fatal("xlsx properties", p)
+	}
+
+	// crafted cell ref far beyond 'XFD'
+	if xlsxCol("XFD1") != 16383 || xlsxCol("ZZZZZZZZZZZZZZZ1") != TableColMax || xlsxCol("12") != -1 {
+		t.Fatal("xlsx column", xlsxCol("XFD1"))
+	}
+	xlsx["xl/worksheets/data.xml"] = []byte(`<?xml version="1.0"?><worksheet><sheetData><row r="1"><c r="ZZZZZZZ1"><v>1</v></c></row></sheetData></worksheet>`)
+	fp = filepath.Join(UploadFileDir, "big.xlsx")
+	testZip(t, fp, xlsx)
+	zr, err := zip.OpenReader(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readXlsx(&zr.Reader); err != ErrTableSize {
+		t.Fatal("column out of range should reject", err)
+	}
+	zr.Close()
+
+	// hook push CSV, saved as GeoJSON
+	hid, err := db.AddHook(&HookConfig{Name: "station", Table: &TableConf{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv := []byte("name,lon,lat\nA,121,23\nB,x,23\n")
+	err = updateHookData(db, db.GetHookByID(hid), "station.csv", int64(len(csv)), bytes.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := db.GetHookByID(hid)
+	if hook.Kind != "json" || hook.ExtName != "station.geojson" || hook.TableReport == nil || hook.TableReport.OK != 1 || len(hook.TableReport.Failed) != 1 {
+		t.Fatal("hook table", hook, hook.TableReport)
+	}
+	buf, _ = ioutil.ReadFile(filepath.Join(CacheFileDir, hook.SaveName))
+	if fc, err = ParseFeatureCollection(buf); err != nil || len(fc.Features) != 1 {
+		t.Fatal("hook data", err, string(buf))
+	}
+	csv = []byte("a,b\n1,2\n")
+	if err := updateHookData(db, hook, "bad.csv", int64(len(csv)), bytes.NewReader(csv)); err != ErrTableColumn {
+		t.Fatal("hook bad table", err)
+	}
+
+	// feature edit write back converted data, not convert again
+	hook = hook.Clone()
+	hook.RenderType = HookTypeGeoJSON
+	db.UpdateHookConfig(hook)
+	fs := NewHookFeatureStore(db)
+	for i, f := range []string{
+		`{"type":"Feature","id":"c","geometry":{"type":"Point","coordinates":[121,24]},"properties":{"name":"C"}}`,
+		`{"type":"Feature","id":"d","geometry":{"type":"Point","coordinates":[121,25]},"properties":{"name":"D"}}`,
+	} {
+		if _, err := fs.Apply(hid, &FeatureOps{Upsert: []json.RawMessage{json.RawMessage(f)}}); err != nil {
+			t.Fatal("hook table edit", i, err)
+		}
+	}
+	hook = db.GetHookByID(hid)
+	if hook.ExtName != "station.geojson" || hook.TableReport == nil || hook.TableReport.OK != 1 {
+		t.Fatal("hook table after edit", hook, hook.TableReport)
+	}
+	buf, _ = ioutil.ReadFile(filepath.Join(CacheFileDir, hook.SaveName))
+	if fc, err = ParseFeatureCollection(buf); err != nil || len(fc.Features) != 3 {
+		t.Fatal("hook table data after edit", err, string(buf))
+	}
+}
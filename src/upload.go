@@ -0,0 +1,343 @@
+package webmap
+
+/*
+* resumable upload (tus-like)
+* create -> PATCH chunk with offset -> HEAD for offset -> finalize
+* partial data & hash state keep in UploadTempDir, can resume after restart
+*/
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	UploadTempDir = "./upload/tmp/"
+	UploadChunkLimit = int64(32 * 1024 * 1024) // Bytes (32 MB) per PATCH
+	UploadExpire = 24 * time.Hour // remove unfinished upload
+
+	ErrUploadOffset = errors.New("upload offset not match")
+	ErrUploadSize = errors.New("upload size not match")
+)
+
+const (
+	UploadToAttach = "attach"
+	UploadToHook = "hook"
+)
+
+type UploadInfo struct {
+	ID string `json:"id"`
+	Target string `json:"target"` // 'attach', 'hook'
+	UID UserID `json:"uid,omitempty"` // uploader for 'attach', owner for 'hook', for quota
+	Replace string `json:"replace,omitempty"` // for 'attach', token of exist Attachment to replace
+	HookID HookID `json:"hid,omitempty"` // for 'hook'
+	Name string `json:"name"`
+	Length int64 `json:"len"`
+	Offset int64 `json:"off"`
+	HashState []byte `json:"hs,omitempty"` // sha256 state at Offset
+	Create time.Time `json:"ct"`
+	Update time.Time `json:"ut"`
+}
+
+type uploadTask struct {
+	mx sync.Mutex
+	info UploadInfo
+	h hash.Hash
+	done bool // finalized or removed
+}
+
+type UploadStore struct {
+	mx sync.Mutex
+	list map[string]*uploadTask
+}
+
+func NewUploadStore() *UploadStore {
+	return &UploadStore{
+		list: make(map[string]*uploadTask),
+	}
+}
+
+func uploadPath(id string, ext string) string {
+	id = filepath.Clean("/" + id)[1:]
+	return filepath.Join(UploadTempDir, id + ext)
+}
+
+func (s *UploadStore) Create(info *UploadInfo) (*UploadInfo, error) {
+	err := os.MkdirAll(UploadTempDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s.Sweep(time.Now())
+
+	id := genToken()
+	if id == "" {
+		return nil, ErrTokenGen
+	}
+	f, err := os.OpenFile(uploadPath(id, ".part"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	now := time.Now()
+	t := &uploadTask{
+		info: *info,
+		h: sha256.New(),
+	}
+	t.info.ID = id
+	t.info.Name = filepath.Clean("/" + info.Name)[1:] // remove '../'
+	t.info.Offset = 0
+	t.info.Create = now
+	t.info.Update = now
+	err = t.save()
+	if err != nil {
+		os.Remove(uploadPath(id, ".part"))
+		return nil, err
+	}
+
+	s.mx.Lock()
+	s.list[id] = t
+	s.mx.Unlock()
+
+	out := t.info
+	return &out, nil
+}
+
+// load from memory or state file
+func (s *UploadStore) get(id string) *uploadTask {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	t, ok := s.list[id]
+	if ok {
+		return t
+	}
+	if id == "" || strings.ContainsAny(id, "/\\.") {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(uploadPath(id, ".json"))
+	if err != nil {
+		return nil
+	}
+	t = &uploadTask{
+		h: sha256.New(),
+	}
+	if json.Unmarshal(buf, &t.info) != nil || t.info.ID != id {
+		return nil
+	}
+	if len(t.info.HashState) > 0 {
+		err = t.h.(encoding.BinaryUnmarshaler).UnmarshalBinary(t.info.HashState)
+		if err != nil {
+			return nil
+		}
+	}
+	// drop data after last saved state, eg: crash when writing
+	err = os.Truncate(uploadPath(id, ".part"), t.info.Offset)
+	if err != nil {
+		return nil
+	}
+	s.list[id] = t
+	return t
+}
+
+func (s *UploadStore) Info(id string) *UploadInfo {
+	t := s.get(id)
+	if t == nil {
+		return nil
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.done {
+		return nil
+	}
+	out := t.info
+	return &out
+}
+
+// append chunk at offset, return new offset
+func (s *UploadStore) Write(id string, offset int64, rd io.Reader) (int64, error) {
+	t := s.get(id)
+	if t == nil {
+		return 0, ErrNotExist
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.done {
+		return 0, ErrNotExist
+	}
+	if offset != t.info.Offset {
+		return t.info.Offset, ErrUploadOffset
+	}
+
+	f, err := os.OpenFile(uploadPath(id, ".part"), os.O_WRONLY, 0644)
+	if err != nil {
+		return t.info.Offset, err
+	}
+	defer f.Close()
+	_, err = f.Seek(offset, 0)
+	if err != nil {
+		return t.info.Offset, err
+	}
+
+	limit := t.info.Length - offset
+	if limit > UploadChunkLimit {
+		limit = UploadChunkLimit
+	}
+	// write & hash only what really on disk, keep Offset & hash state match
+	buf := make([]byte, 32 * 1024)
+	rd = io.LimitReader(rd, limit)
+	for {
+		nr, er := rd.Read(buf)
+		if nr > 0 {
+			nw, ew := f.Write(buf[:nr])
+			t.h.Write(buf[:nw])
+			t.info.Offset += int64(nw)
+			if ew != nil {
+				err = ew
+				break
+			}
+		}
+		if er == io.EOF {
+			break
+		}
+		if er != nil {
+			err = er
+			break
+		}
+	}
+	t.info.Update = time.Now()
+	if err2 := t.save(); err2 != nil && err == nil {
+		err = err2
+	}
+	return t.info.Offset, err
+}
+
+// all data received, move out from UploadTempDir
+// return open file & sha256, caller should close & remove the file
+func (s *UploadStore) Finish(id string) (*UploadInfo, *os.File, string, error) {
+	t := s.get(id)
+	if t == nil {
+		return nil, nil, "", ErrNotExist
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.done {
+		return nil, nil, "", ErrNotExist
+	}
+	if t.info.Offset != t.info.Length {
+		return nil, nil, "", ErrUploadSize
+	}
+
+	f, err := os.Open(uploadPath(id, ".part"))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Size() != t.info.Length {
+		f.Close()
+		return nil, nil, "", ErrUploadSize
+	}
+
+	t.done = true
+	s.mx.Lock()
+	delete(s.list, id)
+	s.mx.Unlock()
+	os.Remove(uploadPath(id, ".json"))
+
+	info := t.info
+	return &info, f, hex.EncodeToString(t.h.Sum(nil)), nil
+}
+
+func (s *UploadStore) Remove(id string) error {
+	t := s.get(id)
+	if t == nil {
+		return ErrNotExist
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.done = true
+	s.mx.Lock()
+	delete(s.list, id)
+	s.mx.Unlock()
+	os.Remove(uploadPath(id, ".json"))
+	return os.Remove(uploadPath(id, ".part"))
+}
+
+// Bytes of unfinished upload by uid, include not loaded state file
+func (s *UploadStore) Pending(uid UserID) int64 {
+	files, err := ioutil.ReadDir(UploadTempDir)
+	if err != nil {
+		return 0
+	}
+	var n int64
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(UploadTempDir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		var info UploadInfo
+		if json.Unmarshal(buf, &info) != nil || info.UID != uid {
+			continue
+		}
+		n += info.Length
+	}
+	return n
+}
+
+// remove expired upload, include not loaded state file
+func (s *UploadStore) Sweep(now time.Time) {
+	files, err := ioutil.ReadDir(UploadTempDir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".part") {
+			continue
+		}
+		id := strings.TrimSuffix(name, ".part")
+		mt := fi.ModTime()
+		if st, err := os.Stat(uploadPath(id, ".json")); err == nil && st.ModTime().After(mt) {
+			mt = st.ModTime()
+		}
+		if now.Sub(mt) > UploadExpire {
+			Vln(4, "[upload]remove expired", id)
+			s.Remove(id)
+			os.Remove(uploadPath(id, ".part"))
+		}
+	}
+}
+
+// save state file, call with lock
+func (t *uploadTask) save() error {
+	st, err := t.h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	t.info.HashState = st
+	buf, err := json.Marshal(&t.info)
+	if err != nil {
+		return err
+	}
+	tmp := uploadPath(t.info.ID, ".json.tmp")
+	err = ioutil.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, uploadPath(t.info.ID, ".json"))
+}
@@ -0,0 +1,109 @@
+package webmap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestResumableUpload(t *testing.T) {
+	_, done := tempStorage(t, "upload")
+	defer done()
+
+	db := NewDataStore()
+	hid, _ := db.AddHook(&HookConfig{Name: "test"})
+	hook := db.GetHookByID(hid)
+
+	wb := NewWebAPI(db)
+	defer wb.Close()
+
+	do := func(method string, path string, hdr map[string]string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		for k, v := range hdr {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		wb.upload(w, r)
+		return w
+	}
+	patch := func(loc string, off int, chunk []byte) *httptest.ResponseRecorder {
+		return do("PATCH", loc, map[string]string{
+			"Content-Type": "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(off),
+		}, chunk)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	b64 := base64.StdEncoding.EncodeToString
+	w := do("POST", "/api/upload/", map[string]string{
+		"Upload-Length": strconv.Itoa(len(data)),
+		"Upload-Metadata": "filename " + b64([]byte("data.bin")) + ",target " + b64([]byte("hook")) + ",auth " + b64([]byte(hook.AuthToken)),
+	}, nil)
+	loc := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || loc == "" {
+		t.Fatal("create upload error", w.Code, w.Body.String())
+	}
+
+	if w := patch(loc, 0, data[:4000]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "4000" {
+		t.Fatal("patch error", w.Code, w.Header())
+	}
+	if w := patch(loc, 100, data[100:200]); w.Code != http.StatusConflict {
+		t.Fatal("wrong offset should conflict", w.Code)
+	}
+	if w := do("POST", loc + "/done", nil, nil); !bytes.Contains(w.Body.Bytes(), []byte(`"ok": false`)) {
+		t.Fatal("should not finish before complete", w.Body.String())
+	}
+
+	// server restart, resume from state file
+	wb.uploads = NewUploadStore()
+	w = do("HEAD", loc, nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "4000" || w.Header().Get("Upload-Length") != strconv.Itoa(len(data)) {
+		t.Fatal("head error", w.Code, w.Header())
+	}
+	if w := patch(loc, 4000, data[4000:]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != strconv.Itoa(len(data)) {
+		t.Fatal("patch error", w.Code, w.Header())
+	}
+	if w := do("POST", loc + "/done", nil, nil); w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"ok": true`)) {
+		t.Fatal("finish error", w.Code, w.Body.String())
+	}
+
+	hook = db.GetHookByID(hid)
+	hash, _ := sha256fd(bytes.NewReader(data))
+	if hook.Checksum != hash || hook.Size != int64(len(data)) || hook.ExtName != "data.bin" {
+		t.Fatal("hook data not match", hook)
+	}
+	if w := do("HEAD", loc, nil, nil); w.Code != http.StatusNotFound {
+		t.Fatal("finished upload should be removed", w.Code)
+	}
+	files, _ := ioutil.ReadDir(UploadTempDir)
+	if len(files) != 0 {
+		t.Fatal("temp file not clean up", len(files))
+	}
+
+	// attach need login
+	w = do("POST", "/api/upload/", map[string]string{
+		"Upload-Length": "10",
+	}, nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatal("attach upload without login should fail", w.Code)
+	}
+
+	// unfinished upload count for user quota
+	uid, _ := db.AddUser(&User{Acc: "a", Name: "a", Quota: 1})
+	hid2, _ := db.AddHook(&HookConfig{Name: "quota", OwnerUID: uid})
+	meta := "target " + b64([]byte("hook")) + ",auth " + b64([]byte(db.GetHookByID(hid2).AuthToken))
+	hdr := map[string]string{
+		"Upload-Length": strconv.Itoa(600 * 1024),
+		"Upload-Metadata": meta,
+	}
+	if w := do("POST", "/api/upload/", hdr, nil); w.Code != http.StatusCreated {
+		t.Fatal("create upload within quota", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/api/upload/", hdr, nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatal("pending upload not count for quota", w.Code)
+	}
+}
@@ -28,6 +28,8 @@ type User struct {
 	Super bool `json:"su,omitempty"` // can edit other user?
 
 	Freeze bool `json:"fz,omitempty"`
+
+	Quota int64 `json:"quota,omitempty"` // MB, 0 for TmplIndex.UserQuota
 }
 
 func (s *User) Clone() *User {
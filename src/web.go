@@ -31,6 +31,15 @@ type WebAPI struct {
 	db API
 	sess *Session
 	f2b *Fail2Ban
+	puller *HookPuller
+	monitor *HookMonitor
+	hub *EventHub
+	features *HookFeatureStore
+	scrubber *FileScrubber
+	uploads *UploadStore
+	gc *StorageGC
+	fetcher *AttachFetcher
+	search *SearchIndex
 
 	indexBuf atomic.Value // *WebCacheResp
 	swBuf atomic.Value // *WebCacheResp
@@ -43,24 +52,62 @@ func NewWebAPI(api API) *WebAPI { // http.Handler
 		db: api,
 		sess: NewSession(),
 		f2b: NewFail2Ban(),
+		puller: NewHookPuller(api),
+		monitor: NewHookMonitor(api),
+		hub: NewEventHub(api),
+		features: NewHookFeatureStore(api),
+		scrubber: NewFileScrubber(api),
+		uploads: NewUploadStore(),
+		gc: NewStorageGC(api),
+		fetcher: NewAttachFetcher(api),
+		search: NewSearchIndex(api),
 	}
 	web.initHandler()
 	web.updateTmpl()
+	web.puller.Start()
+	web.monitor.Start()
+	web.hub.Start()
+	web.scrubber.Start()
+	web.gc.Start()
+	web.fetcher.Start()
+	web.search.Start()
 
 	return web
 }
 
+// end all event stream, for http.Server.RegisterOnShutdown
+func (wb *WebAPI) CloseEvents() {
+	wb.hub.Close()
+}
+
+func (wb *WebAPI) Close() {
+	wb.puller.Close()
+	wb.monitor.Close()
+	wb.hub.Close()
+	wb.scrubber.Close()
+	wb.gc.Close()
+	wb.fetcher.Close()
+	deriveWg.Wait()
+	wb.search.Close()
+	wb.sess.Close()
+}
+
 func (wb *WebAPI) initHandler() {
 	// public api
 	wb.HandleFunc("/", ReqGzFn(wb.index))
 	wb.HandleFunc("/api/info", wb.info)
 	wb.HandleFunc("/api/stats", wb.stats)
+	wb.HandleFunc("/api/events", wb.events) // live update, no gzip
 	wb.HandleFunc("/sw.js", ReqGzFn(wb.swjs))
 	wb.HandleFunc("/manifest.json", ReqGzFn(wb.manifest))
-	wb.HandleFunc("/dl/", ReqCacheFn(ReqGzFn(reqG("/dl/", wb.sess, wb.download)), "public, max-age=31536000, immutable"))
+	wb.HandleFunc("/dl/", ReqCacheFn(ReqGzFn(reqG("/dl/", wb.sess, wb.download)), "public, no-cache, max-age=0, must-revalidate")) // content can be replaced, revalidate by ETag
 
+	wb.HandleFunc("/tiles/", ReqCacheFn(ReqGzFn(reqG("/tiles/", wb.sess, wb.tiles)), "public, no-cache, max-age=0, must-revalidate")) // vector tile of '/dl/' & '/hook/' GeoJSON
+	wb.HandleFunc("/api/search", ReqGzFn(wb.searchFeature)) // full-text search over public layer
+	wb.HandleFunc("/api/query/", ReqGzFn(reqG("/api/query/", wb.sess, wb.query))) // spatial & property query of '/dl/' & '/hook/' GeoJSON
 	wb.HandleFunc("/hook/", ReqCacheFn(ReqGzFn(reqG("/hook/", wb.sess, wb.hookDL)), "public, no-cache, max-age=0, must-revalidate"))
 	wb.HandleFunc("/api/push/", reqP("/api/push/", wb.sess, wb.hookUpdate)) // data input
+	wb.HandleFunc("/api/feature/", reqP("/api/feature/", wb.sess, wb.hookFeature)) // data input, single feature for 'geojson' hook
 
 	// user
 	wb.HandleFunc("/api/auth", wb.auth)
@@ -75,10 +122,13 @@ func (wb *WebAPI) initHandler() {
 	wb.HandleFunc("/api/tab/", reqAGP("/api/tab/", wb.sess, wb.tab)) // tab
 	wb.HandleFunc("/api/link/", reqAGP("/api/link/", wb.sess, wb.link)) // nesed links
 	wb.HandleFunc("/api/attach/", reqAGP("/api/attach/", wb.sess, wb.attach)) // attach
+	wb.HandleFunc("/api/upload/", wb.upload) // resumable upload for attach & hook data
 	wb.HandleFunc("/api/hook/", reqAGP("/api/hook/", wb.sess, wb.hook)) // hook
 
 	wb.HandleFunc("/api/config/", reqAGP("/api/config/", wb.sess, wb.config)) // config
 	wb.HandleFunc("/api/astats", reqAG("/api/astats", wb.sess, wb.astats))
+	wb.HandleFunc("/api/refs", reqAG("/api/refs", wb.sess, wb.refs)) // dangling reference report
+	wb.HandleFunc("/api/storage/", reqAGP("/api/storage/", wb.sess, wb.storage)) // disk usage & orphan file
 }
 
 func (wb *WebAPI) logIn(w http.ResponseWriter, r *http.Request) {
@@ -191,10 +241,14 @@ func (wb *WebAPI) user(base string, sd *SessionData, w http.ResponseWriter, r *h
 	case "GET": // get self info
 		u = u.Clone()
 		u.Hash = "" // remove password hash
+		out := struct {
+			*User
+			Usage *UserUsage `json:"usage"`
+		}{u, userUsage(wb.db, u.ID)}
 
 		w.Header().Set("Cache-Control", "private, max-age=0, must-revalidate") // has user info, not cache by other
 		enc := json.NewEncoder(w)
-		err := enc.Encode(u)
+		err := enc.Encode(out)
 		if err != nil {
 			// should not error, log it
 			Vln(2, "[web][panic]", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
@@ -304,13 +358,29 @@ func (wb *WebAPI) info(w http.ResponseWriter, r *http.Request) {
 		Tabs  []*TabData    `json:"tab,omitempty"`
 		Link  []*Link       `json:"link,omitempty"`
 		User  []*User       `json:"user,omitempty"`
+		Fresh map[string]*HookFresh `json:"fresh,omitempty"` // by layer token, for dynamic layer
 	}
 
 	out := &Info{}
 
 	layer := wb.db.GetPubLayer()
 	if layer != nil {
-		out.Layer = layer
+		out.Layer = resolveLayers(wb.db, layer)
+
+		now := time.Now()
+		for _, ly := range layer {
+			if !ly.Dynamic {
+				continue
+			}
+			hook := wb.db.GetHookByToken(ly.Token)
+			if hook == nil || hook.Disable {
+				continue
+			}
+			if out.Fresh == nil {
+				out.Fresh = make(map[string]*HookFresh)
+			}
+			out.Fresh[ly.Token] = hook.Fresh(now)
+		}
 	}
 
 	maps := wb.db.GetPubMap()
@@ -444,11 +514,24 @@ func (wb *WebAPI) astats(base string, sd *SessionData, w http.ResponseWriter, r
 	type Stats struct {
 		PageView uint64 `json:"pv"`
 		UserVisit uint64 `json:"uv,omitempty"`
+		*MemCacheStats
+		Corrupt int `json:"nbad"` // attachment & hook data
 	}
 
 	out := &Stats{}
 	out.PageView = wb.db.GetPageView()
 	out.UserVisit = wb.db.GetUserVisit()
+	out.MemCacheStats = memCache.Stats()
+	for _, a := range wb.db.ListAllAttach() {
+		if a.Corrupt {
+			out.Corrupt += 1
+		}
+	}
+	for _, hook := range wb.db.ListHook() {
+		if hook.Corrupt {
+			out.Corrupt += 1
+		}
+	}
 	w.Header().Set("Cache-Control", "public, no-cache, max-age=0, must-revalidate")
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
@@ -2,14 +2,16 @@ package webmap
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"mime/multipart"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 var (
-	UploadFileSizeLimit = int64(100 * 1024 * 1024) // Bytes (100 MB)
 	UploadFileDir = "./upload/"
 )
 
@@ -39,7 +41,9 @@ func (wb *WebAPI) download(base string, sd *SessionData, w http.ResponseWriter,
 	}
 
 DL:
-	attach.ServeContent(w, r, UploadFileDir)
+	if attach.ServeContent(w, r, UploadFileDir) {
+		wb.scrubber.Kick()
+	}
 	return
 
 ERR404:
@@ -65,10 +69,25 @@ func (wb *WebAPI) attach(base string, sd *SessionData, w http.ResponseWriter, r
 	}
 
 	switch r.Method {
-	case "GET": // get all attach info
-		list := wb.db.ListAttach() // TODO: limit & page
+	case "GET": // search attach info
+		q := parseAttachQuery(r.URL.Query())
+		out := q.Apply(wb.db.ListAllAttach())
+
+		users := make(map[UserID]string)
+		for _, u := range wb.db.ListUser() {
+			users[u.ID] = u.Name
+		}
+		refs := NewRefIndex(wb.db.GetAllLayer())
+		for _, a := range out.Data {
+			a.cleanUp() // remove not necessary info
+			if name, ok := users[a.UploadUID]; ok {
+				a.UploaderName = name
+			}
+			a.Used = refs.Attach(a.Token)
+		}
+
 		enc := json.NewEncoder(w)
-		err := enc.Encode(list)
+		err := enc.Encode(out)
 		if err != nil {
 			// should not error, log it
 			Vln(2, "[web][panic]", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
@@ -88,36 +107,84 @@ func (wb *WebAPI) attach(base string, sd *SessionData, w http.ResponseWriter, r
 		case "": // upload
 
 			// TODO: session timeout when uploading?
-			r.ParseMultipartForm(UploadFileSizeLimit)
+			r.ParseMultipartForm(wb.db.GetConfig().attachSizeLimit())
+			if r.MultipartForm == nil {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+				return
+			}
 
 			fhs := r.MultipartForm.File["attach"]
 			for _, fh := range fhs {
+				if err := checkUpload(wb.db, StorageAttach, u.ID, fh.Size, 0); err != nil { // saved one counted for next
+					Vln(3, "[web][upload]quota", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), fh.Filename, fh.Size, err)
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
 				file, err := fh.Open()
 				if err != nil {
 					Vln(3, "[web][upload]parse file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
 					continue
 				}
-				attach, erroeText, errCode := saveFile(file, fh, r)
+				attach, erroeText, errCode := saveFile(file, fh, r, wb.db.GetConfig().attachAllow())
 				if erroeText != "" && errCode != 0 {
 					http.Error(w, erroeText, errCode)
 					return
 				}
 				if attach != nil {
 					attach.UploadUID = u.ID
-					_, err = wb.db.AddAttach(attach)
+					attach.UploaderName = u.Name
+					_, err = addAttachFile(wb.db, attach)
 					if err != nil {
 						Vln(3, "[web][upload]api call error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
 						http.Error(w, "Internal server error", http.StatusInternalServerError)
 						return
 					}
+					deriveAsync(wb.db, attach.Token)
 				}
 			}
 
 			writeResp(w, true, "")
 
+		case "import": // server download from url
+			rawURL := strings.TrimSpace(r.Form.Get("url"))
+			cron := strings.TrimSpace(r.Form.Get("cron"))
+			if cron != "" {
+				if _, err := ParseCron(cron); err != nil {
+					writeResp(w, false, "bad cron: " + err.Error())
+					return
+				}
+			}
+			attach, err := wb.fetcher.Import(rawURL, cron, u)
+			switch {
+			case err == nil:
+			case err == ErrFileType || err == ErrArchiveBomb:
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			case isQuotaErr(err):
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			default: // remote error
+				Vln(3, "[web][attach]import error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), rawURL, err)
+				writeResp(w, false, err.Error())
+				return
+			}
+			Vln(3, "[web][attach]import", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), rawURL, attach.Token, attach.Size)
+			w.Write([]byte(`{"ok": true, "token": "` + attach.Token + `"}`))
 
 		default:
 			switch act {
+			case "fetch": // re-fetch source now
+				_, err := wb.fetcher.Fetch(token)
+				switch {
+				case err == ErrNotExist:
+					http.Error(w, "404 not found", http.StatusNotFound)
+					return
+				case err != nil:
+					writeResp(w, false, err.Error())
+					return
+				}
+				writeResp(w, true, "")
+				return
 			case "del":
 				attach := wb.db.GetAttachByToken(token)
 				if attach == nil {
@@ -128,13 +195,56 @@ func (wb *WebAPI) attach(base string, sd *SessionData, w http.ResponseWriter, r
 				//	http.Error(w, "Forbidden, no permission", http.StatusForbidden)
 				//	return
 				//}
-				wb.db.DelAttachByAID(attach.ID)
-				err := attach.DelFromFS(UploadFileDir)
+				used := NewRefIndex(wb.db.GetAllLayer()).Attach(token)
+				if len(used) > 0 && r.Form.Get("force") != "1" {
+					writeUsed(w, used)
+					return
+				}
+				err := delAttach(wb.db, attach)
 				if err != nil {
 					Vln(3, "[web][attach]remove error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
 					http.Error(w, "Internal server error", http.StatusInternalServerError)
 					return
 				}
+				// converted GeoJSON not used directly by any layer
+				if d := wb.db.GetAttachByToken(attach.Derived); d != nil && len(NewRefIndex(wb.db.GetAllLayer()).Attach(d.Token)) == 0 {
+					delAttach(wb.db, d)
+				}
+				writeResp(w, true, "")
+				return
+			case "convert": // GeoJSON from shapefile, run now
+				conf := parseTableConf(r.Form.Get) // point table setting
+				_, setCRS := r.Form["srccrs"]
+				if conf != nil || setCRS {
+					attach := wb.db.GetAttachByToken(token)
+					if attach == nil {
+						http.Error(w, "404 not found", http.StatusNotFound)
+						return
+					}
+					attach = attach.Clone()
+					if conf != nil {
+						attach.Table = conf
+					}
+					if setCRS {
+						crs, err := parseCRS(r.Form.Get("srccrs"))
+						if err != nil {
+							writeResp(w, false, "crs not supported")
+							return
+						}
+						attach.SrcCRS = crs
+					}
+					wb.db.UpdateAttachDerive(attach)
+				}
+				err := deriveAttach(wb.db, token)
+				switch err {
+				case nil:
+				case ErrNotExist:
+					http.Error(w, "404 not found", http.StatusNotFound)
+					return
+				default:
+					writeResp(w, false, err.Error())
+					return
+				}
 				writeResp(w, true, "")
 				return
 			case "hide":
@@ -143,6 +253,11 @@ func (wb *WebAPI) attach(base string, sd *SessionData, w http.ResponseWriter, r
 					http.Error(w, "404 not found", http.StatusNotFound)
 					return
 				}
+				used := NewRefIndex(wb.db.GetAllLayer()).Attach(token)
+				if len(used) > 0 && r.Form.Get("force") != "1" {
+					writeUsed(w, used)
+					return
+				}
 				attach.Hide = true
 
 				err := wb.db.UpdateAttach(attach)
@@ -169,6 +284,106 @@ func (wb *WebAPI) attach(base string, sd *SessionData, w http.ResponseWriter, r
 				}
 				writeResp(w, true, "")
 				return
+			case "replace": // new content, keep token
+				r.ParseMultipartForm(wb.db.GetConfig().attachSizeLimit())
+				if r.MultipartForm == nil || len(r.MultipartForm.File["attach"]) != 1 {
+					http.Error(w, "Bad request", http.StatusBadRequest)
+					return
+				}
+				fhs := r.MultipartForm.File["attach"]
+				if err := checkUpload(wb.db, StorageAttach, u.ID, fhs[0].Size, 0); err != nil { // old one kept as version
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				file, err := fhs[0].Open()
+				if err != nil {
+					Vln(3, "[web][attach]parse file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+					http.Error(w, "Bad request", http.StatusBadRequest)
+					return
+				}
+				newAttach, erroeText, errCode := saveFile(file, fhs[0], r, wb.db.GetConfig().attachAllow())
+				if erroeText != "" && errCode != 0 {
+					http.Error(w, erroeText, errCode)
+					return
+				}
+				newAttach.UploadUID = u.ID
+				newAttach.UploaderName = u.Name
+				attach, err := replaceAttachFile(wb.db, token, newAttach)
+				if err == ErrNotExist {
+					http.Error(w, "404 not found", http.StatusNotFound)
+					return
+				}
+				if err != nil {
+					Vln(3, "[web][attach]replace error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+				Vln(3, "[web][attach]replace", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), attach.Token, attach.OriginalName, attach.Checksum)
+				deriveAsync(wb.db, attach.Token)
+				writeResp(w, true, "")
+				return
+			case "rollback": // ?ver=index of Versions
+				idx, err := strconv.Atoi(r.Form.Get("ver"))
+				if err != nil {
+					http.Error(w, "Bad request", http.StatusBadRequest)
+					return
+				}
+				attach, err := rollbackAttach(wb.db, token, idx)
+				if err == ErrNotExist {
+					http.Error(w, "404 not found", http.StatusNotFound)
+					return
+				}
+				if err != nil {
+					Vln(3, "[web][attach]rollback error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+				Vln(3, "[web][attach]rollback", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), attach.Token, attach.OriginalName, attach.Checksum)
+				deriveAsync(wb.db, attach.Token)
+				writeResp(w, true, "")
+				return
+			case "edit": // metadata
+				attach := wb.db.GetAttachByToken(token)
+				if attach == nil {
+					http.Error(w, "404 not found", http.StatusNotFound)
+					return
+				}
+				attach = attach.Clone()
+				attach.Desc = r.Form.Get("desc")
+				attach.Tags = parseTags(r.Form.Get("tags"))
+				if name := strings.TrimSpace(r.Form.Get("on")); name != "" {
+					attach.OriginalName = filepath.Clean("/" + name)[1:] // remove '../'
+				}
+				if attach.SourceURL != "" {
+					cron := strings.TrimSpace(r.Form.Get("fcron"))
+					if _, err := ParseCron(cron); cron != "" && err != nil {
+						writeResp(w, false, "bad cron: " + err.Error())
+						return
+					}
+					attach.FetchCron = cron
+				}
+
+				err := wb.db.UpdateAttach(attach)
+				if err != nil {
+					Vln(3, "[web][attach]edit error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+				writeResp(w, true, "")
+				return
+			case "verify": // full check now
+				attach := wb.db.GetAttachByToken(token)
+				if attach == nil {
+					http.Error(w, "404 not found", http.StatusNotFound)
+					return
+				}
+				st := wb.scrubber.VerifyAttach(attach.Clone(), 0)
+				if st.Corrupt {
+					writeResp(w, false, st.CheckErr)
+					return
+				}
+				writeResp(w, true, "")
+				return
 			case "info":
 				attach := wb.db.GetAttachByToken(token)
 				if attach == nil || attach.Hide {
@@ -178,7 +393,7 @@ func (wb *WebAPI) attach(base string, sd *SessionData, w http.ResponseWriter, r
 
 				// remove not necessary info
 				attach = attach.Clone()
-				attach.SaveName = ""
+				attach.cleanUp()
 
 				enc := json.NewEncoder(w)
 				err = enc.Encode(attach)
@@ -195,16 +410,17 @@ func (wb *WebAPI) attach(base string, sd *SessionData, w http.ResponseWriter, r
 	}
 }
 
-func saveFile(file multipart.File, handler *multipart.FileHeader, r *http.Request) (attach *Attachment, erroeText string, errCode int) {
+func saveFile(file multipart.File, handler *multipart.FileHeader, r *http.Request, allow string) (attach *Attachment, erroeText string, errCode int) {
 	defer file.Close()
 
-	// TODO: check meta
 	// check file magic
-	if isExeFile(file) {
-		Vln(3, "[web][upload]try upload executable file!", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), handler.Filename, handler.Size, handler.Header)
-		return nil, "file type not allow", http.StatusForbidden
+	ft, err := checkFileType(file, handler.Filename, handler.Size, allow)
+	if err != nil {
+		Vln(3, "[web][upload]file type not allow", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), handler.Filename, handler.Size, handler.Header, ft.Kind, err)
+		return nil, err.Error(), http.StatusForbidden
 	}
 	attach = NewAttachment(handler.Filename, handler.Size)
+	attach.setFileType(ft)
 	//attach.UploadUID = u.ID
 
 	saveFp := filepath.Join(UploadFileDir, attach.SaveName)
@@ -218,10 +434,46 @@ func saveFile(file multipart.File, handler *multipart.FileHeader, r *http.Reques
 	hash, err := cpAndHashFd(f, file)
 	if err != nil {
 		Vln(3, "[web][upload]save and hash file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+		os.Remove(saveFp)
 		return nil, "Internal server error", http.StatusInternalServerError
 	}
 	attach.Checksum = hash
+
+	// verify what on disk once, then only check by scrubber
+	err = f.Sync()
+	st := verifyFile(saveFp, attach.Size, hash, 0)
+	if err != nil || st.Corrupt {
+		Vln(3, "[web][upload]verify saved file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err, st.CheckErr)
+		os.Remove(saveFp)
+		return nil, "Internal server error", http.StatusInternalServerError
+	}
+	attach.FileCheck = *st
 	return
 }
 
 
+
+// move finished resumable upload into UploadFileDir, same check as saveFile()
+func moveAttachFile(file *os.File, name string, size int64, hash string, allow string) (*Attachment, error) {
+	ft, err := checkFileType(file, name, size, allow)
+	if err != nil {
+		return nil, err
+	}
+	attach := NewAttachment(name, size)
+	attach.setFileType(ft)
+
+	saveFp := filepath.Join(UploadFileDir, attach.SaveName)
+	err = os.Rename(file.Name(), saveFp)
+	if err != nil {
+		return nil, err
+	}
+	attach.Checksum = hash
+
+	st := verifyFile(saveFp, attach.Size, hash, 0)
+	if st.Corrupt {
+		os.Remove(saveFp)
+		return nil, errors.New(st.CheckErr)
+	}
+	attach.FileCheck = *st
+	return attach, nil
+}
@@ -3,7 +3,9 @@ package webmap
 import (
 	"encoding/json"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	//"path"
 	//"path/filepath"
 )
@@ -56,6 +58,43 @@ func (wb *WebAPI) config(base string, sd *SessionData, w http.ResponseWriter, r
 			conf.Manifest = r.Form.Get("manifest")
 			conf.HtmlHead = r.Form.Get("head")
 
+			conf.NotifyType = ""
+			switch ntype := r.Form.Get("ntype"); ntype {
+			case "json", "slack":
+				conf.NotifyType = ntype
+			}
+			conf.NotifyURL = ""
+			nurl, err := url.Parse(strings.TrimSpace(r.Form.Get("nurl")))
+			if err == nil && (nurl.Scheme == "http" || nurl.Scheme == "https") && nurl.Host != "" {
+				conf.NotifyURL = nurl.String()
+			}
+			conf.AttachTypes = cleanTypeList(r.Form.Get("atypes"))
+			conf.HookTypes = cleanTypeList(r.Form.Get("htypes"))
+			conf.AttachQuota = 0
+			if val, err := strconv.ParseInt(r.Form.Get("aquota"), 10, 64); err == nil && val > 0 {
+				conf.AttachQuota = val
+			}
+			conf.HookQuota = 0
+			if val, err := strconv.ParseInt(r.Form.Get("hquota"), 10, 64); err == nil && val > 0 {
+				conf.HookQuota = val
+			}
+			conf.UserQuota = 0
+			if val, err := strconv.ParseInt(r.Form.Get("uquota"), 10, 64); err == nil && val > 0 {
+				conf.UserQuota = val
+			}
+			conf.AttachSizeLimit = 0
+			if val, err := strconv.ParseInt(r.Form.Get("asize"), 10, 64); err == nil && val > 0 {
+				conf.AttachSizeLimit = val
+			}
+			conf.HookSizeLimit = 0
+			if val, err := strconv.ParseInt(r.Form.Get("hsize"), 10, 64); err == nil && val > 0 {
+				conf.HookSizeLimit = val
+			}
+			conf.ConvertSimplify = 0
+			if val, err := strconv.ParseFloat(r.Form.Get("simplify"), 64); err == nil && val > 0 {
+				conf.ConvertSimplify = val
+			}
+
 			val, err := strconv.ParseInt(r.Form.Get("loadfs"), 10, 64)
 			if err == nil {
 				if val < 0 {
@@ -94,3 +133,16 @@ func (wb *WebAPI) config(base string, sd *SessionData, w http.ResponseWriter, r
 }
 
 
+
+// "image, pdf,,zip" -> "image,pdf,zip", drop 'exe'
+func cleanTypeList(s string) string {
+	out := make([]string, 0, 8)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" || v == "exe" {
+			continue
+		}
+		out = append(out, v)
+	}
+	return strings.Join(out, ",")
+}
@@ -0,0 +1,76 @@
+package webmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Server-Sent Events for map client, public
+func (wb *WebAPI) events(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Add("Allow", "GET, OPTIONS")
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+
+	case "GET":
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := wb.hub.Subscribe()
+	if ch == nil {
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer wb.hub.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // for nginx
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(EventHeartbeat)
+	defer heartbeat.Stop()
+
+	timeout := time.NewTimer(EventStreamMax)
+	defer timeout.Stop()
+
+	done := r.Context().Done()
+	for {
+		select {
+		case <-done:
+			return
+		case <-wb.hub.die: // server shutdown
+			return
+		case <-timeout.C: // client reconnect after 'retry'
+			return
+		case <-heartbeat.C:
+			_, err := fmt.Fprintf(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+		case ev := <-ch:
+			buf, err := json.Marshal(ev)
+			if err != nil {
+				Vln(2, "[web][panic]", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, buf)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -15,6 +15,7 @@ var (
 type GzipResponseWriter struct {
 	http.ResponseWriter
 	gzip *gzip.Writer
+	skip bool // already compressed, write to ResponseWriter directly
 }
 
 func (w *GzipResponseWriter) Write(p []byte) (int, error) {
@@ -22,9 +23,16 @@ func (w *GzipResponseWriter) Write(p []byte) (int, error) {
 }
 
 func (w *GzipResponseWriter) Close() (error) {
+	if w.skip {
+		return nil
+	}
 	return w.gzip.Close()
 }
 
+func (w *GzipResponseWriter) Skip() {
+	w.skip = true
+}
+
 func CanAcceptsGzip(r *http.Request) (bool) {
 	s := strings.ToLower(r.Header.Get("Accept-Encoding"))
 	for _, ss := range strings.Split(s, ",") {
@@ -47,6 +55,6 @@ func TryGzipResponse(w http.ResponseWriter, r *http.Request) (*GzipResponseWrite
 	w.Header().Set("Content-Encoding", "gzip")
 	w.Header().Del("Content-Length")
 
-	return &GzipResponseWriter{w, gw}, true
+	return &GzipResponseWriter{w, gw, false}, true
 }
 
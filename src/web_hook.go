@@ -1,9 +1,14 @@
 package webmap
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"strconv"
+	"strings"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 )
@@ -35,7 +40,29 @@ func (wb *WebAPI) hookDL(base string, sd *SessionData, w http.ResponseWriter, r
 	}
 
 DL:
-	hook.ServeContent(w, r, CacheFileDir)
+	if hook.RenderType == HookTypeGeoJSON {
+		w.Header().Set("X-Feature-Ver", strconv.FormatUint(hook.FeatureVer, 10))
+		since := r.URL.Query().Get("since")
+		if since != "" {
+			ver, err := strconv.ParseUint(since, 10, 64)
+			if err == nil {
+				diff := wb.features.Diff(hook.ID, ver)
+				if diff != nil { // nil for full data
+					w.Header().Set("Content-Type", "application/json")
+					w.Header().Set("X-Feature-Ver", strconv.FormatUint(diff.Ver, 10))
+					enc := json.NewEncoder(w)
+					err = enc.Encode(diff)
+					if err != nil {
+						Vln(3, "[web][hook]diff output error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+					}
+					return
+				}
+			}
+		}
+	}
+	if hook.ServeContent(w, r, CacheFileDir) {
+		wb.scrubber.Kick()
+	}
 	return
 
 ERR404:
@@ -67,6 +94,10 @@ func (wb *WebAPI) hook(base string, sd *SessionData, w http.ResponseWriter, r *h
 			Note: r.Form.Get("note"),
 
 			RenderType: r.Form.Get("type"),
+
+			PullURL: strings.TrimSpace(r.Form.Get("purl")),
+			PullCron: strings.TrimSpace(r.Form.Get("pcron")),
+			PullHeader: r.Form.Get("phdr"),
 		}
 
 		o.Disable = false
@@ -74,6 +105,41 @@ func (wb *WebAPI) hook(base string, sd *SessionData, w http.ResponseWriter, r *h
 			o.Disable = true
 		}
 
+		o.Table = parseTableConf(r.Form.Get)
+		crs, err := parseCRS(r.Form.Get("srccrs"))
+		if err != nil {
+			return nil, "crs not supported"
+		}
+		o.SrcCRS = crs
+
+		if o.PullURL != "" {
+			pu, err := url.Parse(o.PullURL)
+			if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+				return nil, "pull url not valid"
+			}
+			_, err = ParseCron(o.PullCron)
+			if err != nil {
+				return nil, "pull schedule not valid"
+			}
+		}
+
+		val, err := strconv.Atoi(r.Form.Get("intv"))
+		if err == nil && val > 0 {
+			o.Interval = val
+		}
+
+		val, err = strconv.Atoi(r.Form.Get("pto"))
+		if err == nil && val > 0 {
+			o.PullTimeout = val
+		}
+		val, err = strconv.Atoi(r.Form.Get("pretry"))
+		if err == nil && val > 0 {
+			if val > HookPullMaxRetry {
+				val = HookPullMaxRetry
+			}
+			o.PullRetry = val
+		}
+
 		return o, ""
 	}
 
@@ -104,7 +170,11 @@ func (wb *WebAPI) hook(base string, sd *SessionData, w http.ResponseWriter, r *h
 		}
 
 		// get all hook
-		list := wb.db.ListHook()
+		refs := NewRefIndex(wb.db.GetAllLayer())
+		list := make([]*HookItem, 0, 8)
+		for _, hook := range wb.db.ListHook() {
+			list = append(list, &HookItem{hook, refs.Hook(hook.Token)})
+		}
 		enc := json.NewEncoder(w)
 		err := enc.Encode(list)
 		if err != nil {
@@ -127,6 +197,7 @@ func (wb *WebAPI) hook(base string, sd *SessionData, w http.ResponseWriter, r *h
 				writeResp(w, false, msg)
 				return
 			}
+			hook.OwnerUID = u.ID
 			_, err = wb.db.AddHook(hook)
 			if err != nil {
 				Vln(2, "[web][panic]", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
@@ -151,12 +222,52 @@ func (wb *WebAPI) hook(base string, sd *SessionData, w http.ResponseWriter, r *h
 					return
 				}
 
+				used := NewRefIndex(wb.db.GetAllLayer()).Hook(hook.Token)
+				if len(used) > 0 && r.Form.Get("force") != "1" {
+					writeUsed(w, used)
+					return
+				}
 				wb.db.DelHookByID(HookID(id))
+				wb.features.Forget(HookID(id))
 				err = hook.DelFromFS(CacheFileDir)
 				if err != nil {
 					Vln(3, "[web][hook]remove cached data error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
 				}
 
+			case "verify": // full check now
+				hook := wb.db.GetHookByID(HookID(id))
+				if hook == nil {
+					http.Error(w, "404 not found", http.StatusNotFound)
+					return
+				}
+				if hook.SaveName == "" {
+					writeResp(w, false, "no data")
+					return
+				}
+				st := wb.scrubber.VerifyHook(hook.Clone(), 0)
+				if st.Corrupt {
+					writeResp(w, false, st.CheckErr)
+					return
+				}
+
+			case "pull": // pull now
+				hook := wb.db.GetHookByID(HookID(id))
+				if hook == nil {
+					http.Error(w, "404 not found", http.StatusNotFound)
+					return
+				}
+				if hook.PullURL == "" {
+					writeResp(w, false, "pull url not set")
+					return
+				}
+
+				err = wb.puller.Pull(hook.ID)
+				if err != nil {
+					Vln(3, "[web][hook]pull error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+					writeResp(w, false, err.Error())
+					return
+				}
+
 			default:
 				hook, msg := parseHook()
 				if msg != "" {
@@ -188,7 +299,7 @@ func (wb *WebAPI) hookUpdate(base string, sd *SessionData, w http.ResponseWriter
 		return
 	}
 
-	r.ParseMultipartForm(CacheFileSizeLimit)
+	r.ParseMultipartForm(wb.db.GetConfig().hookSizeLimit())
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
@@ -196,47 +307,171 @@ func (wb *WebAPI) hookUpdate(base string, sd *SessionData, w http.ResponseWriter
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	defer file.Close()
+
+	err = updateHookData(wb.db, hook0, handler.Filename, handler.Size, file)
+	switch err {
+	case nil:
+	case ErrFileType, ErrArchiveBomb:
+		Vln(3, "[web][hook]file type not allow", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), handler.Filename, handler.Size, handler.Header, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case ErrFileTooLarge, ErrQuota, ErrUserQuota:
+		Vln(3, "[web][hook]quota exceeded", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), handler.Filename, handler.Size)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case ErrTableColumn, ErrConvertCRS, ErrConvertType, ErrGeoJSON:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		Vln(3, "[web][hook]save data error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
-	// TODO: check meta
-	// check file magic
-	if isExeFile(file) {
-		Vln(3, "[web][hook]try upload executable file!", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), handler.Filename, handler.Size, handler.Header)
+	wb.search.Touch()
+	Vln(3, "[web][hook]update data", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent())
+}
+
+// upsert / patch / delete feature of 'geojson' hook
+func (wb *WebAPI) hookFeature(base string, sd *SessionData, w http.ResponseWriter, r *http.Request) {
+	authToken := filepath.Base(r.URL.Path) // TODO: check 'asd?foo=bar'
+	hook0 := wb.db.GetHookByAuthToken(authToken)
+	if hook0 == nil {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	ops := &FeatureOps{}
+	dec := json.NewDecoder(io.LimitReader(r.Body, wb.db.GetConfig().hookSizeLimit()))
+	err := dec.Decode(ops)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ver, err := wb.features.Apply(hook0.ID, ops)
+	switch err {
+	case nil:
+	case ErrNotGeoJSON:
+		http.Error(w, "hook type not geojson", http.StatusBadRequest)
+		return
+	case ErrFeatureID, ErrFeatureFmt:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case ErrNotExist:
+		http.Error(w, "feature not found", http.StatusNotFound)
+		return
+	case ErrFileType:
 		http.Error(w, "file type not allow", http.StatusForbidden)
 		return
+	case ErrFileTooLarge, ErrQuota, ErrUserQuota:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	default:
+		Vln(3, "[web][hook]update feature error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	wb.search.Touch()
+	Vln(3, "[web][hook]update feature", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), len(ops.Upsert), len(ops.Patch), len(ops.Delete), ver)
+	w.Write([]byte(`{"ok": true, "ver": ` + strconv.FormatUint(ver, 10) + `}`))
+}
+
+// save data into CacheFileDir & update db, shared by push (hookUpdate) and pull (HookPuller)
+func updateHookData(db API, hook0 *HookConfig, name string, size int64, file io.ReadSeeker) error {
+	// check file magic
+	ft, err := checkFileType(file, name, size, db.GetConfig().hookAllow())
+	if err != nil {
+		return err
+	}
+	var report *ConvReport
+	if hook0.Table != nil { // point table, save as GeoJSON
+		buf, rep, err := convertHookTable(hook0.Table, hook0.SrcCRS, ft, name, file)
+		if err != nil {
+			return err
+		}
+		report = rep
+		file = bytes.NewReader(buf)
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ".geojson"
+		size = int64(len(buf))
+		ft = &FileType{"json", "application/json"}
+	} else if hook0.SrcCRS != "" && ft.Kind == "json" { // projected GeoJSON
+		buf, err := reprojectHookGeoJSON(hook0.SrcCRS, file)
+		if err != nil {
+			return err
+		}
+		file = bytes.NewReader(buf)
+		size = int64(len(buf))
+	}
+	return saveHookData(db, hook0, name, size, file, ft, report)
+}
+
+// save already converted data, eg: write back by feature edit
+func saveHookData(db API, hook0 *HookConfig, name string, size int64, file io.ReadSeeker, ft *FileType, report *ConvReport) error {
+	err := checkUpload(db, StorageHook, hook0.OwnerUID, size, hook0.Size)
+	if err != nil {
+		return err
 	}
 	hook := hook0.Clone()
-	hook.SetData(handler.Filename, handler.Size)
+	hook.SetData(name, size)
+	hook.Kind = ft.Kind
+	hook.MIME = ft.MIME
+	hook.FeatureVer += 1
+	hook.TableReport = report
 
 	saveFp := filepath.Join(CacheFileDir, hook.SaveName)
 	f, err := os.OpenFile(saveFp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		Vln(3, "[web][hook]open save file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return err
 	}
 	defer f.Close()
 
-	// TODO: also save in-memory cache if size < CacheInMemorySizeLimit
-	hash, err := cpAndHashFd(f, file)
+	var out io.Writer = f
+	var buf *bytes.Buffer
+	if size > 0 && memCache.fit(size) { // also keep in RAM for small data
+		buf = bytes.NewBuffer(make([]byte, 0, size))
+		out = io.MultiWriter(f, buf)
+	}
+	hash, err := cpAndHashFd(out, file)
 	if err != nil {
-		Vln(3, "[web][hook]save and hash file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		os.Remove(saveFp)
+		return err
 	}
 	hook.Checksum = hash
 
-	err = wb.db.UpdateHook(hook)
+	// verify what on disk once, then only check by scrubber
+	err = f.Sync()
+	if err != nil {
+		os.Remove(saveFp)
+		return err
+	}
+	st := verifyFile(saveFp, hook.Size, hash, 0)
+	if st.Corrupt {
+		os.Remove(saveFp)
+		return errors.New(st.CheckErr)
+	}
+	hook.FileCheck = *st
+	hook.Stats = nil
+	if hook.Kind == "json" {
+		hook.Stats = geoStatsFile(saveFp)
+	}
+	hook.NoStats = hook.Kind == "json" && hook.Stats == nil
+
+	err = db.UpdateHook(hook)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		Vln(3, "[web][hook]open save file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+		os.Remove(saveFp)
+		return err
+	}
+	if buf != nil && int64(buf.Len()) == hook.Size {
+		memCache.put(hook.cacheKey(), hook.MIME, buf.Bytes())
 	}
 
 	// remove old data
 	err = hook0.DelFromFS(CacheFileDir)
 	if err != nil {
-		Vln(3, "[web][hook]remove old cached data error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+		Vln(3, "[hook]remove old cached data error", hook0.ID, hook0.SaveName, err)
 	}
-
-	Vln(3, "[web][hook]update data", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent())
+	return nil
 }
-
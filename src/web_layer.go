@@ -25,24 +25,6 @@ func (wb *WebAPI) layer(base string, sd *SessionData, w http.ResponseWriter, r *
 		return
 	}
 
-	parseColor := func(s string) (string, bool) { // only #000~#fff & #000000~#ffffff
-		if len(s[1:]) < 3 {
-			return "", false
-		}
-		if len(s[1:]) > 6 {
-			return "", false
-		}
-		if s[0] != '#' {
-			return "", false
-		}
-		for _, r := range s[1:] {
-			if (r < 'a' || r > 'f') && (r < 'A' || r > 'F')  && (r < '0' || r > '9') {
-				return "", false
-			}
-		}
-		return s, true
-	}
-
 	parseOpacity := func(input string) (float32, error) {
 		opac, err := strconv.ParseFloat(input, 32)
 		if err != nil {
@@ -80,19 +62,33 @@ func (wb *WebAPI) layer(base string, sd *SessionData, w http.ResponseWriter, r *
 		}
 
 
+		st := attachStyle(wb.db, o.Token) // default from KML
+		if st == nil {
+			st = &AttachStyle{}
+		}
+
 		o.FillColor = "#3388FF"
+		if st.FillColor != "" {
+			o.FillColor = st.FillColor
+		}
 		fillcolor, ok := parseColor(r.Form.Get("fillcolor"))
 		if ok {
 			o.FillColor = fillcolor
 		}
 
 		o.Color = "#3388FF"
+		if st.Color != "" {
+			o.Color = st.Color
+		}
 		color, ok := parseColor(r.Form.Get("color"))
 		if ok {
 			o.Color = color
 		}
 
 		o.Opacity = 0.5
+		if st.Opacity > 0 {
+			o.Opacity = st.Opacity
+		}
 		opac, err := parseOpacity(r.Form.Get("opacity"))
 		if err == nil {
 			o.Opacity = opac
@@ -108,6 +104,20 @@ func (wb *WebAPI) layer(base string, sd *SessionData, w http.ResponseWriter, r *
 			o.Dynamic = true
 		}
 
+		o.Derived = r.Form.Get("derived") == "1"
+
+		style, err := ParseStyleRule(r.Form.Get("style"))
+		if err != nil {
+			return nil, "bad style"
+		}
+		o.Style = style
+
+		popup, err := ParsePopupConfig(r.Form.Get("popup"))
+		if err != nil {
+			return nil, "bad popup"
+		}
+		o.Popup = popup
+
 		return o, ""
 	}
 
@@ -161,12 +171,17 @@ func (wb *WebAPI) layer(base string, sd *SessionData, w http.ResponseWriter, r *
 				writeResp(w, false, msg)
 				return
 			}
+			if checkLayerToken(wb.db, layer) != nil {
+				writeResp(w, false, "token not found")
+				return
+			}
 			_, err = wb.db.AddLayer(layer)
 			if err != nil {
 				Vln(2, "[web][panic]", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
 			}
+			wb.search.Touch()
 			writeResp(w, true, "")
 			return
 
@@ -182,6 +197,7 @@ func (wb *WebAPI) layer(base string, sd *SessionData, w http.ResponseWriter, r *
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
 			}
+			wb.search.Touch()
 			writeResp(w, true, "")
 			return
 
@@ -203,12 +219,19 @@ func (wb *WebAPI) layer(base string, sd *SessionData, w http.ResponseWriter, r *
 					return
 				}
 				layer.ID = LayerID(id)
+				layer0 := wb.db.GetLayerByID(layer.ID)
+				changed := layer0 == nil || layer0.Token != layer.Token || layer0.Dynamic != layer.Dynamic
+				if changed && checkLayerToken(wb.db, layer) != nil { // keep old dangling one editable
+					writeResp(w, false, "token not found")
+					return
+				}
 				err = wb.db.UpdateLayer(layer)
 			}
 			if err != nil {
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
 			}
+			wb.search.Touch()
 			// http return ok
 			Vln(3, "[web][layer]updated", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent())
 			writeResp(w, true, "")
@@ -218,3 +241,28 @@ func (wb *WebAPI) layer(base string, sd *SessionData, w http.ResponseWriter, r *
 
 }
 
+
+// layers point to missing or not servable data
+func (wb *WebAPI) refs(base string, sd *SessionData, w http.ResponseWriter, r *http.Request) {
+	uid, ok := sd.Get("acc")
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	u := wb.db.GetUserByUID(uid.(UserID))
+	if u == nil || u.Freeze {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	out := struct {
+		Dangling []*DanglingRef `json:"dangling"`
+	}{danglingRefs(wb.db)}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(out)
+	if err != nil {
+		// should not error, log it
+		Vln(2, "[web][panic]", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+	}
+}
@@ -0,0 +1,39 @@
+package webmap
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// '/api/query/{token}?bbox=&point=&radius=&where=&offset=&limit=', token of GeoJSON attachment or hook
+func (wb *WebAPI) query(base string, sd *SessionData, w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, base)
+	gd := findGeoData(wb.db, token)
+	if gd == nil || (gd.hide && !wb.activeUser(sd)) { // deleted one for admin only
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	q, err := parseFeatureQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, "400 bad request", http.StatusBadRequest)
+		return
+	}
+
+	idx, err := queryIndexes.get(gd.key, gd.fp)
+	if err != nil {
+		Vln(3, "[web][query]load error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	out := idx.(*queryIndex).Query(q)
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(out)
+	if err != nil {
+		// should not error, log it
+		Vln(2, "[web][panic]", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+	}
+}
@@ -0,0 +1,48 @@
+package webmap
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// '/api/search?q=&limit=', feature of public layer
+func (wb *WebAPI) searchFeature(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "400 bad request", http.StatusBadRequest)
+		return
+	}
+	limit := SearchLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > SearchLimitMax {
+		limit = SearchLimitMax
+	}
+
+	res, total := wb.search.Search(q, limit)
+	if res == nil {
+		res = []*SearchResult{}
+	}
+	out := struct {
+		Query string `json:"q"`
+		Total int `json:"total"`
+		Results []*SearchResult `json:"results"`
+	}{q, total, res}
+
+	w.Header().Set("Cache-Control", "public, no-cache, max-age=0, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(out)
+	if err != nil {
+		// should not error, log it
+		Vln(2, "[web][panic]", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+	}
+}
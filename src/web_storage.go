@@ -0,0 +1,57 @@
+package webmap
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+func (wb *WebAPI) storage(base string, sd *SessionData, w http.ResponseWriter, r *http.Request) {
+	uid, ok := sd.Get("acc")
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	u := wb.db.GetUserByUID(uid.(UserID))
+	if u == nil || u.Freeze {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var rp *StorageReport
+	switch r.Method {
+	case "GET": // last report, ?scan=1 for rescan
+		rp = wb.gc.Last()
+		if rp == nil || r.URL.Query().Get("scan") == "1" {
+			rp = wb.gc.Run(time.Now(), false)
+		}
+
+	case "POST":
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		act := getKey(r.URL.Path)
+		switch act {
+		case "gc": // remove orphan now, still keep new one
+			rp = wb.gc.Run(time.Now(), true)
+			Vln(3, "[web][storage]gc", r.RemoteAddr, u.Name, len(rp.Orphans))
+		default:
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(rp)
+	if err != nil {
+		// should not error, log it
+		Vln(2, "[web][panic]", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+	}
+}
@@ -1,11 +1,32 @@
 package webmap
 
 import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	//"reflect"
 	"time"
 )
 
+// temp dir as UploadFileDir & CacheFileDir, UploadTempDir under it
+// call done() to restore & remove, after worker using them stopped
+func tempStorage(t *testing.T, name string) (dir string, done func()) {
+	dir, err := ioutil.TempDir("", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UploadFileDir0, CacheFileDir0, UploadTempDir0 := UploadFileDir, CacheFileDir, UploadTempDir
+	UploadFileDir, CacheFileDir, UploadTempDir = dir, dir, filepath.Join(dir, "tmp")
+	return dir, func() {
+		deriveWg.Wait()
+		UploadFileDir, CacheFileDir, UploadTempDir = UploadFileDir0, CacheFileDir0, UploadTempDir0
+		os.RemoveAll(dir)
+	}
+}
+
 func TestWebLowPreciseTime(t *testing.T) {
 	t0 := now()
 	t1 := now()
@@ -183,3 +204,43 @@ func TestWebSession(t *testing.T) {
 	}
 }
 
+
+func TestWebEventsClose(t *testing.T) {
+	wb := NewWebAPI(NewDataStore())
+	defer wb.Close()
+
+	stream := func() chan *httptest.ResponseRecorder {
+		out := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			w := httptest.NewRecorder()
+			wb.events(w, httptest.NewRequest("GET", "/api/events", nil))
+			out <- w
+		}()
+		return out
+	}
+
+	// end by timeout, client reconnect
+	EventStreamMax0 := EventStreamMax
+	EventStreamMax = 100 * time.Millisecond
+	out := stream()
+	select {
+	case w := <-out:
+		if !strings.HasPrefix(w.Body.String(), "retry:") {
+			t.Fatal("stream body", w.Body.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream not end by EventStreamMax")
+	}
+	EventStreamMax = EventStreamMax0
+
+	// end by shutdown
+	out = stream()
+	time.Sleep(50 * time.Millisecond)
+	go wb.CloseEvents() // shutdown hook may race with Close
+	wb.CloseEvents()
+	select {
+	case <-out:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream not end by shutdown")
+	}
+}
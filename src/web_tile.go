@@ -0,0 +1,111 @@
+package webmap
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// '/tiles/{token}/{z}/{x}/{y}.pbf', token of GeoJSON attachment or hook
+func (wb *WebAPI) tiles(base string, sd *SessionData, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, base), "/")
+	if len(parts) != 4 || !strings.HasSuffix(parts[3], ".pbf") {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	z, err1 := strconv.Atoi(parts[1])
+	x, err2 := strconv.Atoi(parts[2])
+	y, err3 := strconv.Atoi(strings.TrimSuffix(parts[3], ".pbf"))
+	if err1 != nil || err2 != nil || err3 != nil {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	td := findGeoData(wb.db, parts[0])
+	if td == nil || (td.hide && !wb.activeUser(sd)) { // deleted one for admin only
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	tileKey := "tile/" + td.key + "/" + strings.Join(parts[1:], "/")
+	etag := td.key + "-" + strings.Join(parts[1:], "-")
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	if e := memCache.get(tileKey); e != nil {
+		memCache.serve(w, r, e, td.mod, etag)
+		return
+	}
+
+	src, err := tileSources.get(td.key, td.fp)
+	if err != nil {
+		Vln(3, "[web][tile]load error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	buf, err := src.(*tileSource).Tile(z, x, y)
+	if err != nil {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	e := memCache.put(tileKey, "application/vnd.mapbox-vector-tile", buf)
+	if e == nil {
+		w.Write(buf)
+		return
+	}
+	memCache.serve(w, r, e, td.mod, etag)
+}
+
+// GeoJSON file of attachment / hook, for tile, query & search
+type geoData struct {
+	key string // with content version
+	fp string
+	mod time.Time
+	hide bool
+}
+
+// converted one used if token is not GeoJSON
+func findGeoData(db API, token string) *geoData {
+	if a := db.GetAttachByToken(token); a != nil {
+		hide := a.Hide
+		if a.Kind != "json" && a.Derived != "" {
+			if d := db.GetAttachByToken(a.Derived); d != nil {
+				hide = hide || d.Hide
+				a = d
+			}
+		}
+		if a.Kind != "json" || a.Corrupt {
+			return nil
+		}
+		return &geoData{
+			key: "a" + a.Token + "-" + a.Checksum,
+			fp: filepath.Join(UploadFileDir, filepath.Clean("/" + a.SaveName)[1:]),
+			mod: a.UploadTime,
+			hide: hide,
+		}
+	}
+	if h := db.GetHookByToken(token); h != nil {
+		if h.Kind != "json" || h.SaveName == "" || h.Corrupt {
+			return nil
+		}
+		return &geoData{
+			key: "h" + h.Token + "-" + h.Checksum + "-" + strconv.FormatUint(h.FeatureVer, 10),
+			fp: filepath.Join(CacheFileDir, filepath.Clean("/" + h.SaveName)[1:]),
+			mod: h.UpdateTime,
+			hide: h.Disable,
+		}
+	}
+	return nil
+}
+
+func (wb *WebAPI) activeUser(sd *SessionData) bool {
+	if sd == nil {
+		return false
+	}
+	uid, ok := sd.Get("acc")
+	if !ok {
+		return false
+	}
+	u := wb.db.GetUserByUID(uid.(UserID))
+	return u != nil && !u.Freeze
+}
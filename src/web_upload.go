@@ -0,0 +1,307 @@
+package webmap
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const tusVersion = "1.0.0"
+
+// resumable upload, tus core protocol + creation & termination
+// POST /api/upload/ -> PATCH /api/upload/{id} -> POST /api/upload/{id}/done
+func (wb *WebAPI) upload(w http.ResponseWriter, r *http.Request) {
+	base := "/api/upload/"
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+
+	sd := getSess(wb.sess, w, r)
+	getUser := func() *User {
+		if sd == nil {
+			return nil
+		}
+		uid, ok := sd.Get("acc")
+		if !ok {
+			return nil
+		}
+		u := wb.db.GetUserByUID(uid.(UserID))
+		if u == nil || u.Freeze {
+			return nil
+		}
+		return u
+	}
+
+	id, act := getParm(r.URL.Path, base)
+
+	// check permission for exist upload
+	getInfo := func() *UploadInfo {
+		info := wb.uploads.Info(id)
+		if info == nil {
+			return nil
+		}
+		if info.Target == UploadToAttach {
+			u := getUser()
+			if u == nil || u.ID != info.UID {
+				return nil
+			}
+		}
+		return info
+	}
+
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(wb.db.GetConfig().attachSizeLimit(), 10))
+		w.Header().Add("Allow", "POST, HEAD, PATCH, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case "HEAD": // progress
+		info := getInfo()
+		if info == nil {
+			http.Error(w, "404 not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+
+	case "PATCH": // chunk
+		info := getInfo()
+		if info == nil {
+			http.Error(w, "404 not found", http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, "Unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		offset, err = wb.uploads.Write(id, offset, r.Body)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		switch err {
+		case nil:
+		case ErrUploadOffset:
+			http.Error(w, "Conflict", http.StatusConflict)
+			return
+		case ErrNotExist:
+			http.Error(w, "404 not found", http.StatusNotFound)
+			return
+		default: // broken connection, client should HEAD & resume
+			Vln(4, "[web][upload]write chunk error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case "DELETE": // abort
+		info := getInfo()
+		if info == nil {
+			http.Error(w, "404 not found", http.StatusNotFound)
+			return
+		}
+		wb.uploads.Remove(id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case "POST":
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case id == "": // create
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		meta := parseUploadMeta(r.Header.Get("Upload-Metadata"))
+
+		info := &UploadInfo{
+			Target: meta["target"],
+			Name: meta["filename"],
+			Length: length,
+		}
+		if info.Target == "" {
+			info.Target = UploadToAttach
+		}
+		if info.Name == "" {
+			info.Name = "data"
+		}
+
+		switch info.Target {
+		case UploadToAttach:
+			u := getUser()
+			if u == nil {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if err := checkUploadPending(wb.db, StorageAttach, u.ID, length, 0, wb.uploads.Pending(u.ID)); err != nil {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			info.UID = u.ID
+			if token := meta["replace"]; token != "" {
+				if wb.db.GetAttachByToken(token) == nil {
+					http.Error(w, "404 not found", http.StatusNotFound)
+					return
+				}
+				info.Replace = token
+			}
+
+		case UploadToHook:
+			hook := wb.db.GetHookByAuthToken(meta["auth"])
+			if hook == nil {
+				http.Error(w, "404 not found", http.StatusNotFound)
+				return
+			}
+			if err := checkUploadPending(wb.db, StorageHook, hook.OwnerUID, length, hook.Size, wb.uploads.Pending(hook.OwnerUID)); err != nil {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			info.UID = hook.OwnerUID
+			info.HookID = hook.ID
+
+		default:
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		info, err = wb.uploads.Create(info)
+		if err != nil {
+			Vln(3, "[web][upload]create error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		Vln(4, "[web][upload]create", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), info.ID, info.Target, info.Name, info.Length)
+		w.Header().Set("Location", base + info.ID)
+		w.Header().Set("Upload-Offset", "0")
+		w.WriteHeader(http.StatusCreated)
+		return
+
+	case act == "done": // finalize
+		info0 := getInfo()
+		if info0 == nil {
+			http.Error(w, "404 not found", http.StatusNotFound)
+			return
+		}
+		info, file, hash, err := wb.uploads.Finish(id)
+		switch err {
+		case nil:
+		case ErrUploadSize:
+			writeResp(w, false, "upload not complete")
+			return
+		case ErrNotExist:
+			http.Error(w, "404 not found", http.StatusNotFound)
+			return
+		default:
+			Vln(3, "[web][upload]finish error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(file.Name()) // not used if moved
+		defer file.Close()
+
+		switch info.Target {
+		case UploadToAttach:
+			if err := checkUpload(wb.db, StorageAttach, info.UID, info.Length, 0); err != nil { // other upload may finish first
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			attach, err := moveAttachFile(file, info.Name, info.Length, hash, wb.db.GetConfig().attachAllow())
+			if err == ErrFileType || err == ErrArchiveBomb {
+				Vln(3, "[web][upload]file type not allow", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), info.Name, info.Length, err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				Vln(3, "[web][upload]save file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			attach.UploadUID = info.UID
+			if u := wb.db.GetUserByUID(info.UID); u != nil {
+				attach.UploaderName = u.Name
+			}
+			if info.Replace != "" {
+				attach, err = replaceAttachFile(wb.db, info.Replace, attach)
+			} else {
+				_, err = addAttachFile(wb.db, attach)
+			}
+			if err == ErrNotExist {
+				http.Error(w, "404 not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				Vln(3, "[web][upload]api call error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			Vln(3, "[web][upload]attach done", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), attach.Token, attach.OriginalName, attach.Size)
+			deriveAsync(wb.db, attach.Token)
+			w.Write([]byte(`{"ok": true, "token": "` + attach.Token + `"}`))
+			return
+
+		case UploadToHook:
+			hook0 := wb.db.GetHookByID(info.HookID)
+			if hook0 == nil {
+				http.Error(w, "404 not found", http.StatusNotFound)
+				return
+			}
+			err = updateHookData(wb.db, hook0, info.Name, info.Length, file)
+			switch err {
+			case nil:
+			case ErrFileType, ErrArchiveBomb:
+				Vln(3, "[web][upload]file type not allow", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), info.Name, info.Length, err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			case ErrFileTooLarge, ErrQuota, ErrUserQuota:
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			default:
+				Vln(3, "[web][upload]save hook data error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			wb.search.Touch()
+			Vln(3, "[web][upload]hook done", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), hook0.ID, info.Name, info.Length)
+			writeResp(w, true, "")
+			return
+		}
+	}
+
+	http.Error(w, "Bad request", http.StatusBadRequest)
+}
+
+// "key base64,key2 base64"
+func parseUploadMeta(s string) map[string]string {
+	out := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		v := strings.Fields(kv)
+		if len(v) == 0 {
+			continue
+		}
+		if len(v) == 1 {
+			out[v[0]] = ""
+			continue
+		}
+		buf, err := base64.StdEncoding.DecodeString(v[1])
+		if err != nil {
+			continue
+		}
+		out[v[0]] = string(buf)
+	}
+	return out
+}
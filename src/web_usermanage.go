@@ -47,6 +47,10 @@ func (wb *WebAPI) usermanage(base string, sd *SessionData, w http.ResponseWriter
 			u.Super = true
 		}
 
+		if val, err := strconv.ParseInt(r.Form.Get("quota"), 10, 64); err == nil && val > 0 {
+			u.Quota = val
+		}
+
 		pwd := r.Form.Get("pwd")
 		if pwd != "" {
 			if len(pwd) < 3 {
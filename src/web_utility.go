@@ -162,6 +162,12 @@ func (lrw *logResponseWriter) Write(buf []byte) (int, error) {
 	return n, err
 }
 
+func (lrw *logResponseWriter) Flush() { // for streaming response
+	if f, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 
 func ReqGzFn(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -204,6 +204,9 @@ var user = {
 				var info = JSON.parse(data)
 				console.log("[profile]ok", info, textStatus, jqXHR)
 				$('.page[data-url="user"] input[name="name"]').val(info.name)
+				var usage = info.usage || {}
+				var used = byte2Size(usage.attach + usage.hook) + ' (檔案 ' + usage.an + ' / 動態資源 ' + usage.hn + ')'
+				$('.page[data-url="user"] input[name="usage"]').val(used + ' / ' + (usage.quota ? byte2Size(usage.quota) : '不限制'))
 				$('[do="userSave"]').off('click', user.editAjax).on('click', user.editAjax)
 			},
 			error: alertOrLogin,
@@ -295,6 +298,16 @@ var site = {
 			manifest: manifestE.val(),
 			head: headE.val(),
 			loadfs: parseInt(loadfsE.val()) || 0,
+			ntype: el.find('select[name="ntype"]').val(),
+			nurl: el.find('input[name="nurl"]').val(),
+			atypes: el.find('input[name="atypes"]').val(),
+			htypes: el.find('input[name="htypes"]').val(),
+			aquota: parseInt(el.find('input[name="aquota"]').val()) || 0,
+			hquota: parseInt(el.find('input[name="hquota"]').val()) || 0,
+			uquota: parseInt(el.find('input[name="uquota"]').val()) || 0,
+			asize: parseInt(el.find('input[name="asize"]').val()) || 0,
+			hsize: parseInt(el.find('input[name="hsize"]').val()) || 0,
+			simplify: parseFloat(el.find('input[name="simplify"]').val()) || 0,
 
 			cstats: (el.find('input[name="cstats"]').is(':checked')? '1' : ''),
 			stats: (el.find('input[name="stats"]').is(':checked')? '1' : ''),
@@ -330,12 +343,53 @@ page('/status', showPage, function(ctx, next){
 		cache: false,
 		success: function(data, textStatus, jqXHR){
 			console.log("[stats]get", data, textStatus, jqXHR)
+			var req = data.mch + data.mcm
+			data.mcr = (req)? (data.mch * 100 / req).toFixed(1) + '%' : '-'
+			data.mcs = data.mch + ' / ' + data.mcm + ' / ' + data.mcg
+			data.mcu = byte2Size(data.mcb) + ' / ' + byte2Size(data.mcl) + ' (' + data.mcn + ')'
 			setInput(el, data)
 		},
 		error: alertOrLogin,
 	})
+	$.ajax({
+		url: "/api/refs",
+		method: "GET",
+		cache: false,
+		success: function(data, textStatus, jqXHR){
+			console.log("[refs]get", data, textStatus, jqXHR)
+			el.find('.refs').html(doT.template($('#reflist').html())(data.dangling || []))
+		},
+		error: alertOrLogin,
+	})
+	storage.load(el, 'GET', '')
+	el.find('[do="storageScan"]').off('click').on('click', function(){
+		storage.load(el, 'GET', '?scan=1')
+	})
+	el.find('[do="storageGC"]').off('click').on('click', function(){
+		if (!confirm('刪除超過保留期限的孤兒檔案?')) return
+		storage.load(el, 'POST', 'gc')
+	})
 })
 
+var storage = {
+	load: function(el, method, q) {
+		nprogress.start()
+		$.ajax({
+			url: "/api/storage/" + q,
+			method: method,
+			cache: false,
+			success: function(data, textStatus, jqXHR){
+				console.log("[storage]" + method, data, textStatus, jqXHR)
+				el.find('.storage').html(doT.template($('#storagelist').html())(data))
+			},
+			error: alertOrLogin,
+			complete: function(){
+				nprogress.done()
+			},
+		})
+	},
+}
+
 function um2ajax(ele, isNew) {
 	var ret = {}
 
@@ -347,6 +401,7 @@ function um2ajax(ele, isNew) {
 	var noteE = ele.find('input[name="note"]')
 	var suE = ele.find('input[name="su"]')
 	var fzE = ele.find('input[name="fz"]')
+	var quotaE = ele.find('input[name="quota"]')
 
 	var data = {
 		acc: accE.val(),
@@ -355,6 +410,7 @@ function um2ajax(ele, isNew) {
 
 		su: (suE.is(':checked')? '1' : ''),
 		fz: (fzE.is(':checked')? '1' : ''),
+		quota: parseInt(quotaE.val()) || 0,
 	}
 
 	if (data.acc == '') {
@@ -418,8 +474,11 @@ function layer2ajax(ele, isNew) {
 	var hideE = ele.find('input[name="hide"]')
 	var typeE = ele.find('select[name="type"]')
 	var dynE = ele.find('input[name="dyn"]')
+	var derivedE = ele.find('input[name="derived"]')
 	var velocityScaleE = ele.find('input[name="velocityScale"]')
 	var colorScaleE = ele.find('input[name="colorScale"]')
+	var styleE = ele.find('textarea[name="style"]')
+	var popupE = ele.find('textarea[name="popup"]')
 	var data = {
 		name: nameE.val(),
 		note: noteE.val(),
@@ -435,8 +494,11 @@ function layer2ajax(ele, isNew) {
 		type: typeE.val(),
 		velocityScale: velocityScaleE.val(),
 		colorScale: colorScaleE.val(),
+		style: styleE.val().trim(),
+		popup: popupE.val().trim(),
 
 		dyn: (dynE.is(':checked')? '1' : ''),
+		derived: (derivedE.is(':checked')? '1' : ''),
 	}
 
 	if (data.name == '') {
@@ -451,12 +513,30 @@ function layer2ajax(ele, isNew) {
 		ret.err = '透明度超過範圍(0.0~1.0)!!'
 		return ret
 	}
+	if (data.style != '') {
+		try {
+			data.style = JSON.stringify(JSON.parse(data.style))
+		} catch (e) {
+			ret.err = '樣式規則不是正確的JSON!!'
+			return ret
+		}
+	}
+	if (data.popup != '') {
+		try {
+			data.popup = JSON.stringify(JSON.parse(data.popup))
+		} catch (e) {
+			ret.err = '彈出視窗設定不是正確的JSON!!'
+			return ret
+		}
+	}
 
 	ret.data = data
 	return ret
 }
 var layer = mkUI($("#layerlist").html(), 'layer', layer2ajax)
-layer.addCbFn = layer.editCbFn = function (el) {
+layer.editCbFn = function (el, ctx, did, ret) {
+	el.find('textarea[name="style"]').val((ret && ret.style)? JSON.stringify(ret.style, null, 2) : '')
+	el.find('textarea[name="popup"]').val((ret && ret.popup)? JSON.stringify(ret.popup, null, 2) : '')
 	var fillcolorE = el.find('input[name="fillcolor"]')
 	var colorE = el.find('input[name="color"]')
 	var opacityE = el.find('input[name="opacity"]')
@@ -466,6 +546,7 @@ layer.addCbFn = layer.editCbFn = function (el) {
 	colorE.off('change').on('change', update)
 	opacityE.off('change').on('change', update)
 	opacityVE.off('change').on('change', setE)
+	el.find('input[name="token"]').off('change')
 	update()
 	function setE() {
 		opacityE.val(opacityVE.val())
@@ -476,6 +557,29 @@ layer.addCbFn = layer.editCbFn = function (el) {
 		el.find('.legend').html(html)
 	}
 }
+layer.addCbFn = function (el) {
+	layer.editCbFn(el)
+	var styleFn = function(token){ // color from KML style, derived one use its source
+		$.ajax({
+			url: '/api/attach/' + token + '/info',
+			method: "POST",
+			cache: false,
+			success: function(data){
+				var ret = JSON.parse(data)
+				if (!ret.style && ret.from) return styleFn(ret.from)
+				var st = ret.style || {}
+				if (st.color) el.find('input[name="color"]').val(st.color)
+				if (st.fillcolor) el.find('input[name="fillcolor"]').val(st.fillcolor)
+				if (st.opacity) el.find('input[name="opacity"]').val(st.opacity)
+				el.find('input[name="opacity"]').trigger('change')
+			},
+		})
+	}
+	el.find('input[name="token"]').off('change').on('change', function(){
+		var token = $(this).val()
+		if (token) styleFn(token)
+	})
+}
 page('/layer', showPage, layer.list)
 page('/layer/new', layer.add)
 page('/layer/:id', layer.edit)
@@ -736,54 +840,231 @@ attach.upload = function (ctx, next) {
 		msgE.html(listFileFn(files))
 	})
 	$('[do="attachUpload"]').off('click').on('click', upload);
+	$('[do="attachImport"]').off('click').on('click', function(){
+		var data = {
+			url: ele.find('input[name="url"]').val(),
+			cron: ele.find('input[name="cron"]').val(),
+		}
+		if (!data.url) return
+		nprogress.start();
+		$.ajax({
+			url: '/api/attach/import',
+			method: "POST",
+			cache: false,
+			data: data,
+			success: function(data, textStatus, jqXHR){
+				var ret = JSON.parse(data)
+				console.log('[attach]import', ret, textStatus, jqXHR)
+				if (!ret.ok) {
+					// TODO: no alert
+					alert('匯入失敗: ' + ret.msg)
+					return
+				}
+				page('/attach/' + ret.token)
+			},
+			error: function(jqXHR, textStatus, errorThrown){
+				if (jqXHR.status == 403 || jqXHR.status == 413) {
+					alert('匯入失敗: ' + jqXHR.responseText)
+					return
+				}
+				alertOrLogin(jqXHR, textStatus, errorThrown)
+			},
+			complete: function(){
+				nprogress.done();
+			},
+		})
+	})
 
 	function upload(){
 		//console.log('[upload]', files, ele.find('input[type="file"]')[0].files);
-		var form = new FormData()
 		var f = files || ele.find('input[type="file"]')[0].files
+		var total = 0, doneSz = 0
 		for (var i=0; i<f.length; i++) {
-			form.append('attach', f[i])
+			total += f[i].size
 		}
 
 		nprogress.start();
-		$.ajax({
-			xhr: function() {
-				var xhr = new window.XMLHttpRequest();
-
-				xhr.upload.addEventListener("progress", function(evt) {
-					if (evt.lengthComputable) {
-						var percentComplete = evt.loaded / evt.total;
-						nprogress.set(percentComplete);
-						console.log('[upload]', percentComplete);
-						if (percentComplete == 1) {
-							nprogress.done();
-							console.log('[upload] end')
-						}
-					}
-				}, false);
-
-				return xhr;
-			},
-			url: '/api/attach/',
-			type: "POST",
-			processData: false,
-			contentType: false,
-			mimeType: 'multipart/form-data',
-			data: form,
-			success: function(result) {
-				console.log('[ajax][upload]', result);
+		var next = function(i) {
+			if (i >= f.length) {
+				nprogress.done();
 				// TODO: no alert
 				alert('上傳完成')
 				page('/attach')
-			},
-			error: function (jqXHR, textStatus, errorThrown){
-				console.log('[ajax][upload]err', textStatus, errorThrown, jqXHR, jqXHR.responseText);
+				return
 			}
-		});
+			resumableUpload(f[i], {}, function(loaded) {
+				if (total) nprogress.set((doneSz + loaded) / total);
+			}, function(ret) {
+				console.log('[upload]done', f[i].name, ret);
+				doneSz += f[i].size
+				next(i + 1)
+			}, function(msg) {
+				nprogress.done();
+				console.log('[upload]err', f[i].name, msg);
+				// TODO: no alert
+				alert('上傳失敗: ' + f[i].name + ' ' + msg)
+			})
+		}
+		next(0)
 	}
 }
+attach.verify = function (e) {
+	verifyFile('/api/attach/' + $(this).attr('data-id') + '/verify', '/attach')
+}
+attach.items = []
+attach.next = ''
+attach.list = function (ctx, next) {
+	attach.items = []
+	attach.next = ''
+	attach.load()
+}
+attach.load = function () { // search & cursor page
+	var el = $('.page[data-url="attach"]')
+	var sort = (el.find('select[name="sort"]').val() || 'time').split(':')
+	var q = {
+		q: el.find('input[name="q"]').val(),
+		tag: el.find('input[name="tag"]').val(),
+		sort: sort[0],
+		asc: sort[1] || '',
+		cursor: attach.next,
+	}
+	$.ajax({
+		url: '/api/attach/',
+		method: "GET",
+		cache: false,
+		data: q,
+		success: function(data, textStatus, jqXHR){
+			var info = JSON.parse(data)
+			console.log('[attach]list', info, textStatus, jqXHR)
+			attach.items = attach.items.concat(info.data || [])
+			attach.next = info.next || ''
+
+			var tb = el.find('div.rTable')
+			tb.html(attach.listTmpl(attach.items))
+			el.find('.search .total').text(attach.items.length + ' / ' + info.total)
+			el.find('[do="attachMore"]').toggleClass('hide', !attach.next)
+			$('[do="attachDel"]').off('click', attach.delAjax).on('click', attach.delAjax)
+			attach.listCbFn(tb, info)
+		},
+		error: alertOrLogin,
+	})
+}
+attach.listCbFn = function(el, info){
+	el.find('[do="attachVerify"]').off('click', attach.verify).on('click', attach.verify)
+	el.find('.tag').off('click').on('click', function(){
+		$('.page[data-url="attach"] input[name="tag"]').val($(this).attr('data-tag'))
+		attach.list()
+	})
+}
+attach.meta = function (ctx, next) {
+	var el = $('.page[data-url="attach/meta"]')
+	var token = ctx.params.id
+	$.ajax({
+		url: '/api/attach/' + token + '/info',
+		method: "POST",
+		cache: false,
+		success: function(data, textStatus, jqXHR){
+			var ret = JSON.parse(data)
+			console.log('[attach]info', ret, textStatus, jqXHR)
+			clrInput(el, attach)
+			setInput(el, ret)
+			el.find('input[name="tags"]').val((ret.tags || []).join(', '))
+			el.find('input[name="replace"]').val('')
+			el.find('.fetch').toggleClass('hide', !ret.surl)
+			el.find('input[name="derived"]').val(ret.derived || ret.converr || '')
+			setTableConf(el, ret.table, ret.report)
+			el.find('select[name="srccrs"]').val(ret.srccrs || '')
+			el.find('input[name="fstat"]').val(ret.ftime ? utc2localStr(ret.ftime) + (ret.ferr ? ' 錯誤: ' + ret.ferr : ' 成功') : '')
+			el.find('.versions').html(attach.versTmpl(ret.vers))
+			el.find('[do="attachRollback"]').off('click').on('click', function(){
+				// TODO: no alert / confirm
+				if (!confirm('確定要還原此版本?')) return
+				attach.post('/api/attach/' + token + '/rollback', {ver: $(this).attr('data-ver')}, ctx.path)
+			})
+			$('.page').hide()
+			el.show()
+		},
+		error: alertOrLogin,
+	})
+	$('[do="attachReplace"]').off('click').on('click', function(){
+		var f = el.find('input[name="replace"]')[0].files[0]
+		if (!f) return
+		nprogress.start();
+		resumableUpload(f, {replace: token}, function(loaded) {
+			nprogress.set(loaded / f.size);
+		}, function(ret) {
+			nprogress.done();
+			console.log('[attach]replace', ret);
+			page(ctx.path)
+		}, function(msg) {
+			nprogress.done();
+			// TODO: no alert
+			alert('上傳失敗: ' + f.name + ' ' + msg)
+		})
+	})
+	$('[do="attachConvert"]').off('click').on('click', function(){
+		attach.post('/api/attach/' + token + '/convert', {srccrs: el.find('select[name="srccrs"]').val()}, ctx.path)
+	})
+	$('[do="attachTable"]').off('click').on('click', function(){
+		attach.post('/api/attach/' + token + '/convert', tableConf2ajax(el, {table: '1', srccrs: el.find('select[name="srccrs"]').val()}), ctx.path)
+	})
+	$('[do="attachFetch"]').off('click').on('click', function(){
+		attach.post('/api/attach/' + token + '/fetch', {}, ctx.path)
+	})
+	$('[do="attachMetaSave"]').off('click').on('click', function(){
+		var data = {
+			on: el.find('input[name="on"]').val(),
+			desc: el.find('input[name="desc"]').val(),
+			tags: el.find('input[name="tags"]').val(),
+			fcron: el.find('input[name="fcron"]').val(),
+		}
+		$.ajax({
+			url: '/api/attach/' + token + '/edit',
+			method: "POST",
+			cache: false,
+			data: data,
+			success: function(data, textStatus, jqXHR){
+				var ret = JSON.parse(data)
+				console.log('[attach]edit', ret, textStatus, jqXHR)
+				if (!ret.ok) {
+					// TODO: no alert
+					alert('錯誤:' + ret.msg)
+					return
+				}
+				page('/attach')
+			},
+			error: alertOrLogin,
+		})
+	})
+}
+attach.versTmpl = doT.template($('#attachvers').html())
+attach.post = function (url, data, back) {
+	$.ajax({
+		url: url,
+		method: "POST",
+		cache: false,
+		data: data,
+		success: function(data, textStatus, jqXHR){
+			var ret = JSON.parse(data)
+			console.log('[attach]post', url, ret, textStatus, jqXHR)
+			if (!ret.ok) {
+				// TODO: no alert
+				alert('錯誤:' + ret.msg)
+				return
+			}
+			page(back)
+		},
+		error: alertOrLogin,
+	})
+}
+$('[do="attachSearch"]').on('click', function(){ attach.list() })
+$('.page[data-url="attach"] .search input').on('keydown', function(e){
+	if (e.keyCode == 13) attach.list()
+})
+$('[do="attachMore"]').on('click', function(){ attach.load() })
 page('/attach', showPage, attach.list)
 page('/attach/new', attach.upload)
+page('/attach/:id', attach.meta)
 
 function hook2ajax(ele, isNew) {
 	var ret = {}
@@ -798,6 +1079,17 @@ function hook2ajax(ele, isNew) {
 		type: typeE.val(),
 
 		disable: (disableE.is(':checked')? '1' : ''),
+
+		intv: ele.find('input[name="intv"]').val(),
+		purl: ele.find('input[name="purl"]').val(),
+		pcron: ele.find('input[name="pcron"]').val(),
+		pto: ele.find('input[name="pto"]').val(),
+		pretry: ele.find('input[name="pretry"]').val(),
+		phdr: ele.find('textarea[name="phdr"]').val(),
+		srccrs: ele.find('select[name="srccrs"]').val(),
+	}
+	if (ele.find('input[name="table"]').is(':checked')) {
+		tableConf2ajax(ele, data).table = '1'
 	}
 
 	if (data.name == '') {
@@ -809,6 +1101,45 @@ function hook2ajax(ele, isNew) {
 	return ret
 }
 var hook = mkUI($("#hooklist").html(), 'hook', hook2ajax)
+hook.pull = function (e) {
+	var id = $(this).attr('data-id')
+	nprogress.start();
+	$.ajax({
+		url: '/api/hook/' + id + '/pull',
+		method: "POST",
+		cache: false,
+		success: function(data, textStatus, jqXHR){
+			nprogress.done();
+			var ret = JSON.parse(data)
+			console.log('[hook]pull', ret, textStatus, jqXHR)
+			if (!ret.ok) {
+				// TODO: no alert
+				alert('錯誤:' + ret.msg)
+			}
+			page('/hook')
+		},
+		error: function(jqXHR, textStatus, errorThrown){
+			nprogress.done();
+			alertOrLogin(jqXHR, textStatus, errorThrown)
+		},
+	})
+}
+hook.verify = function (e) {
+	verifyFile('/api/hook/' + $(this).attr('data-id') + '/verify', '/hook')
+}
+hook.addCbFn = function(el){
+	setTableConf(el, null, null)
+	el.find('select[name="srccrs"]').val('')
+}
+hook.editCbFn = function(el, ctx, id, ret){
+	el.find('input[name="table"]').prop('checked', !!ret.table)
+	setTableConf(el, ret.table, ret.trep)
+	el.find('select[name="srccrs"]').val(ret.srccrs || '')
+}
+hook.listCbFn = function(el, info){
+	el.find('[do="hookPull"]').off('click', hook.pull).on('click', hook.pull)
+	el.find('[do="hookVerify"]').off('click', hook.verify).on('click', hook.verify)
+}
 page('/hook', showPage, hook.list)
 page('/hook/new', hook.add)
 page('/hook/:id', hook.edit)
@@ -909,11 +1240,172 @@ function clrInput(el, obj) {
 	el.find('input[type="checkbox"]').prop('checked', false)
 	el.find('input[type="range"]').val('')
 	el.find('input[type="color"]').val('')
+	el.find('textarea').val('')
 	el.find('select').val('')
 	if (obj && obj.quill) {
 		obj.quill.setText('')
 	}
 }
+// resumable upload by '/api/upload/', can continue after network broken or page reload
+// meta: {target: 'hook', auth: token} for hook data, default to attach
+var UPLOAD_CHUNK = 4 * 1024 * 1024
+var UPLOAD_RETRY = 10
+function resumableUpload(file, meta, progressFn, doneFn, failFn) {
+	var key = 'upload:' + file.name + ':' + file.size + ':' + file.lastModified + ':' + (meta.target || '') + ':' + (meta.replace || '')
+	var loc = null
+	var retry = 0
+
+	var b64 = function(str) {
+		return btoa(unescape(encodeURIComponent(str)))
+	}
+	var mkMeta = function() {
+		var out = ['filename ' + b64(file.name)]
+		for (var k in meta) {
+			out.push(k + ' ' + b64(meta[k]))
+		}
+		return out.join(',')
+	}
+	var fail = function(jqXHR) {
+		if (jqXHR && (jqXHR.status == 403 || jqXHR.status == 413)) {
+			localStorage.removeItem(key)
+			failFn(jqXHR.responseText)
+			return
+		}
+		if (++retry > UPLOAD_RETRY) {
+			failFn('retry too many times')
+			return
+		}
+		setTimeout(head, Math.min(1000 * retry * retry, 30000))
+	}
+	var create = function() {
+		$.ajax({
+			url: '/api/upload/',
+			method: 'POST',
+			cache: false,
+			headers: {
+				'Tus-Resumable': '1.0.0',
+				'Upload-Length': file.size,
+				'Upload-Metadata': mkMeta(),
+			},
+			success: function(data, textStatus, jqXHR){
+				loc = jqXHR.getResponseHeader('Location')
+				localStorage.setItem(key, loc)
+				send(0)
+			},
+			error: fail,
+		})
+	}
+	var head = function() {
+		if (!loc) return create()
+		$.ajax({
+			url: loc,
+			method: 'HEAD',
+			cache: false,
+			headers: { 'Tus-Resumable': '1.0.0' },
+			success: function(data, textStatus, jqXHR){
+				send(parseInt(jqXHR.getResponseHeader('Upload-Offset')) || 0)
+			},
+			error: function(jqXHR) {
+				if (jqXHR.status == 404) { // expired, start again
+					localStorage.removeItem(key)
+					loc = null
+					return create()
+				}
+				fail(jqXHR)
+			},
+		})
+	}
+	var send = function(off) {
+		progressFn(off)
+		if (off >= file.size) return finish()
+		$.ajax({
+			url: loc,
+			method: 'PATCH',
+			cache: false,
+			processData: false,
+			contentType: 'application/offset+octet-stream',
+			headers: {
+				'Tus-Resumable': '1.0.0',
+				'Upload-Offset': off,
+			},
+			data: file.slice(off, off + UPLOAD_CHUNK),
+			success: function(data, textStatus, jqXHR){
+				retry = 0
+				send(parseInt(jqXHR.getResponseHeader('Upload-Offset')))
+			},
+			error: fail,
+		})
+	}
+	var finish = function() {
+		$.ajax({
+			url: loc + '/done',
+			method: 'POST',
+			cache: false,
+			dataType: 'json',
+			success: function(ret, textStatus, jqXHR){
+				localStorage.removeItem(key)
+				if (!ret.ok) return failFn(ret.msg)
+				doneFn(ret)
+			},
+			error: function(jqXHR) {
+				localStorage.removeItem(key)
+				failFn(jqXHR.responseText)
+			},
+		})
+	}
+
+	loc = localStorage.getItem(key)
+	head()
+}
+
+// full checksum check, reload list after done
+// point table setting & convert report, for attach meta & hook
+function tableConf2ajax(el, data) {
+	data.tx = el.find('input[name="tx"]').val()
+	data.ty = el.find('input[name="ty"]').val()
+	data.tdelim = el.find('input[name="tdelim"]').val()
+	data.tenc = el.find('select[name="tenc"]').val()
+	return data
+}
+function setTableConf(el, conf, rep) {
+	conf = conf || {}
+	el.find('input[name="tx"]').val(conf.x || '')
+	el.find('input[name="ty"]').val(conf.y || '')
+	el.find('input[name="tdelim"]').val(conf.delim || '')
+	el.find('select[name="tenc"]').val(conf.enc || '')
+	el.find('input[name="treport"]').val(rep ? ('共 ' + rep.rows + ' 列, 成功 ' + rep.ok + ' 列, 失敗 ' + (rep.rows - rep.ok) + ' 列') : '')
+	var html = ''
+	var failed = (rep && rep.failed) || []
+	for (var i=0; i<failed.length; i++) {
+		html += '<div>第 ' + failed[i].row + ' 列: ' + $('<i>').text(failed[i].err).html() + '</div>'
+	}
+	if (rep && rep.more) html += '<div>...另有 ' + rep.more + ' 列</div>'
+	el.find('.table-failed').html(html)
+}
+
+function verifyFile(url, back) {
+	nprogress.start();
+	$.ajax({
+		url: url,
+		method: "POST",
+		cache: false,
+		success: function(data, textStatus, jqXHR){
+			nprogress.done();
+			var ret = JSON.parse(data)
+			console.log('[verify]', url, ret, textStatus, jqXHR)
+			if (!ret.ok) {
+				// TODO: no alert
+				alert('檔案損毀:' + ret.msg)
+			}
+			page(back)
+		},
+		error: function(jqXHR, textStatus, errorThrown){
+			nprogress.done();
+			alertOrLogin(jqXHR, textStatus, errorThrown)
+		},
+	})
+}
+
 function setInput(el, data) {
 	for(var k in data) {
 		var e = el.find('[name="' + k + '"]')
@@ -1072,23 +1564,33 @@ console.log('['+op+']edit', ctx)
 			var id = el.attr('data-id')
 			console.log('['+ op +']del', e, this, id, el)
 
-			$.ajax({
-				url: '/api/'+ op +'/' + id + '/del',
-				method: "POST",
-				cache: false,
-				success: function(data, textStatus, jqXHR){
-					var ret = JSON.parse(data)
-					console.log('['+ op +']del', ret, textStatus, jqXHR)
-					if (!ret.ok) {
-						// TODO: no alert
-						alert('錯誤:' + ret.msg)
-						return
-					}
-					page('/' + op)
-					infoUpdate() // update lookup table
-				},
-				error: alertOrLogin,
-			})
+			var del = function(force) {
+				$.ajax({
+					url: '/api/'+ op +'/' + id + '/del',
+					method: "POST",
+					cache: false,
+					data: {force: force},
+					success: function(data, textStatus, jqXHR){
+						var ret = JSON.parse(data)
+						console.log('['+ op +']del', ret, textStatus, jqXHR)
+						if (!ret.ok && ret.used) { // in use by layer
+							var names = ret.used.map(function(l){ return l.name }).join(', ')
+							// TODO: no alert / confirm
+							if (confirm('仍有圖層使用中: ' + names + '\n刪除後圖層將無法顯示, 確定要刪除?')) del('1')
+							return
+						}
+						if (!ret.ok) {
+							// TODO: no alert
+							alert('錯誤:' + ret.msg)
+							return
+						}
+						page('/' + op)
+						infoUpdate() // update lookup table
+					},
+					error: alertOrLogin,
+				})
+			}
+			del('')
 		},
 		postAjax: function (e, isNew) {
 			console.log('[postAjax]', e)
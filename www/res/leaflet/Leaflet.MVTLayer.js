@@ -0,0 +1,315 @@
+/*
+ * L.MVTLayer: Mapbox Vector Tile on canvas, for '/tiles/{token}/{z}/{x}/{y}.pbf'
+ * only what the server output: one layer, point / line / polygon, no style in tile
+ * click on feature call options.popup(properties) for popup html
+ * options.featureStyle(properties) for style per feature, options used for not returned
+ */
+(function () {
+
+// protobuf reader
+function Pbf(buf) {
+	this.buf = buf;
+	this.pos = 0;
+	this.len = buf.length;
+}
+Pbf.prototype.varint = function () {
+	var v = 0, mul = 1, b;
+	do {
+		b = this.buf[this.pos++];
+		v += (b & 0x7f) * mul;
+		mul *= 128;
+	} while (b & 0x80);
+	return v;
+};
+Pbf.prototype.bytes = function () {
+	var end = this.varint() + this.pos;
+	var out = this.buf.subarray(this.pos, end);
+	this.pos = end;
+	return out;
+};
+Pbf.prototype.skip = function (wire) {
+	switch (wire) {
+	case 0: this.varint(); break;
+	case 1: this.pos += 8; break;
+	case 2: this.pos = this.varint() + this.pos; break;
+	case 5: this.pos += 4; break;
+	}
+};
+// fn(field, wire, pbf) should read the value or return false for skip
+Pbf.prototype.each = function (fn) {
+	while (this.pos < this.len) {
+		var key = this.varint();
+		if (fn(key >> 3, key & 7, this) === false) this.skip(key & 7);
+	}
+};
+Pbf.prototype.packed = function () {
+	var p = new Pbf(this.bytes());
+	var out = [];
+	while (p.pos < p.len) out.push(p.varint());
+	return out;
+};
+
+var utf8 = (typeof TextDecoder !== 'undefined') ? new TextDecoder('utf-8') : null;
+function str(b) {
+	if (utf8) return utf8.decode(b);
+	var s = '';
+	for (var i = 0; i < b.length; i++) s += '%' + ('0' + b[i].toString(16)).slice(-2);
+	return decodeURIComponent(s);
+}
+function unzigzag(n) {
+	return (n % 2) ? -(n + 1) / 2 : n / 2;
+}
+
+function readValue(p) {
+	var v = null;
+	var dv = new DataView(p.buf.buffer, p.buf.byteOffset);
+	p.each(function (f, w, p) {
+		switch (f) {
+		case 1: v = str(p.bytes()); return;
+		case 2: v = dv.getFloat32(p.pos, true); p.pos += 4; return;
+		case 3: v = dv.getFloat64(p.pos, true); p.pos += 8; return;
+		case 4: case 5: v = p.varint(); return;
+		case 6: v = unzigzag(p.varint()); return;
+		case 7: v = !!p.varint(); return;
+		}
+		return false;
+	});
+	return v;
+}
+
+// [[x, y], ...] for each MoveTo
+function readGeom(cmds) {
+	var parts = [], cur = null, x = 0, y = 0;
+	for (var i = 0; i < cmds.length;) {
+		var id = cmds[i] & 7, n = cmds[i] >> 3;
+		i++;
+		if (id == 7) { // ClosePath
+			if (cur && cur.length) cur.push(cur[0]);
+			continue;
+		}
+		for (var j = 0; j < n; j++) {
+			x += unzigzag(cmds[i++]);
+			y += unzigzag(cmds[i++]);
+			if (id == 1) {
+				cur = [];
+				parts.push(cur);
+			}
+			cur.push([x, y]);
+		}
+	}
+	return parts;
+}
+
+function readLayer(p) {
+	var ly = {extent: 4096, keys: [], vals: [], feats: []};
+	p.each(function (f, w, p) {
+		switch (f) {
+		case 1: ly.name = str(p.bytes()); return;
+		case 2: ly.feats.push(p.bytes()); return;
+		case 3: ly.keys.push(str(p.bytes())); return;
+		case 4: ly.vals.push(readValue(new Pbf(p.bytes()))); return;
+		case 5: ly.extent = p.varint(); return;
+		}
+		return false;
+	});
+	ly.feats = ly.feats.map(function (b) {
+		var ft = {id: null, type: 0, properties: {}, parts: []};
+		new Pbf(b).each(function (f, w, p) {
+			switch (f) {
+			case 1: ft.id = p.varint(); return;
+			case 2:
+				var tags = p.packed();
+				for (var i = 0; i + 1 < tags.length; i += 2) ft.properties[ly.keys[tags[i]]] = ly.vals[tags[i + 1]];
+				return;
+			case 3: ft.type = p.varint(); return;
+			case 4: ft.parts = readGeom(p.packed()); return;
+			}
+			return false;
+		});
+		return ft;
+	});
+	return ly;
+}
+
+function decodeTile(buf) {
+	var layers = [];
+	new Pbf(new Uint8Array(buf)).each(function (f, w, p) {
+		if (f != 3) return false;
+		layers.push(readLayer(new Pbf(p.bytes())));
+	});
+	return layers;
+}
+
+function segDist2(p, a, b) {
+	var dx = b[0] - a[0], dy = b[1] - a[1];
+	var t = (dx || dy) ? ((p[0] - a[0]) * dx + (p[1] - a[1]) * dy) / (dx * dx + dy * dy) : 0;
+	t = Math.max(0, Math.min(1, t));
+	var x = a[0] + t * dx - p[0], y = a[1] + t * dy - p[1];
+	return x * x + y * y;
+}
+
+function inRing(p, ring) {
+	var c = false;
+	for (var i = 0, j = ring.length - 1; i < ring.length; j = i++) {
+		var a = ring[i], b = ring[j];
+		if ((a[1] > p[1]) != (b[1] > p[1]) && p[0] < (b[0] - a[0]) * (p[1] - a[1]) / (b[1] - a[1]) + a[0]) c = !c;
+	}
+	return c;
+}
+
+L.MVTLayer = L.GridLayer.extend({
+	options: {
+		color: '#3388ff',
+		fillColor: '#3388ff',
+		fillOpacity: 0.2,
+		opacity: 1,
+		weight: 3,
+		radius: 5,
+		popup: null, // function(properties) return html
+		featureStyle: null, // function(properties) return {color, fillColor, fillOpacity, weight, dashArray}
+	},
+
+	initialize: function (url, options) {
+		this._url = url;
+		L.GridLayer.prototype.initialize.call(this, options);
+	},
+
+	onAdd: function (map) {
+		L.GridLayer.prototype.onAdd.call(this, map);
+		map.on('click', this._click, this);
+	},
+
+	onRemove: function (map) {
+		map.off('click', this._click, this);
+		L.GridLayer.prototype.onRemove.call(this, map);
+	},
+
+	setStyle: function (opts) {
+		L.Util.setOptions(this, opts);
+		for (var k in this._tiles) {
+			var el = this._tiles[k].el;
+			if (el._mvt) this._draw(el);
+		}
+		return this;
+	},
+
+	createTile: function (coords, done) {
+		var size = this.getTileSize();
+		var ratio = window.devicePixelRatio || 1;
+		var el = L.DomUtil.create('canvas', 'leaflet-tile');
+		el.width = size.x * ratio;
+		el.height = size.y * ratio;
+		el._ratio = ratio;
+
+		var self = this;
+		var xhr = new XMLHttpRequest();
+		xhr.open('GET', L.Util.template(this._url, coords), true);
+		xhr.responseType = 'arraybuffer';
+		xhr.onload = function () {
+			if (xhr.status != 200) return done(null, el); // empty
+			try {
+				el._mvt = decodeTile(xhr.response);
+				self._draw(el);
+			} catch (e) {
+				return done(e, el);
+			}
+			done(null, el);
+		};
+		xhr.onerror = function () { done(new Error('tile load error'), el); };
+		xhr.send();
+		return el;
+	},
+
+	_draw: function (el) {
+		var o = this.options;
+		var ctx = el.getContext('2d');
+		ctx.clearRect(0, 0, el.width, el.height);
+		ctx.lineJoin = ctx.lineCap = 'round';
+		for (var i = 0; i < el._mvt.length; i++) {
+			var ly = el._mvt[i];
+			var s = el.width / ly.extent;
+			for (var j = 0; j < ly.feats.length; j++) {
+				var ft = ly.feats[j];
+				var st = (o.featureStyle && o.featureStyle(ft.properties)) || {};
+				ctx.beginPath();
+				for (var k = 0; k < ft.parts.length; k++) {
+					var part = ft.parts[k];
+					if (ft.type == 1) {
+						ctx.moveTo(part[0][0] * s + o.radius * el._ratio, part[0][1] * s);
+						ctx.arc(part[0][0] * s, part[0][1] * s, o.radius * el._ratio, 0, Math.PI * 2);
+						continue;
+					}
+					for (var m = 0; m < part.length; m++) {
+						if (m == 0) ctx.moveTo(part[m][0] * s, part[m][1] * s);
+						else ctx.lineTo(part[m][0] * s, part[m][1] * s);
+					}
+				}
+				if (ft.type != 2) {
+					ctx.globalAlpha = (st.fillOpacity != null) ? st.fillOpacity : o.fillOpacity;
+					ctx.fillStyle = st.fillColor || o.fillColor;
+					ctx.fill('evenodd');
+				}
+				ctx.globalAlpha = o.opacity;
+				ctx.strokeStyle = st.color || o.color;
+				ctx.lineWidth = ((ft.type == 1) ? 1 : (st.weight || o.weight)) * el._ratio;
+				ctx.setLineDash((ft.type != 1 && st.dashArray) ? st.dashArray.split(/[ ,]+/).map(function (v) { return v * el._ratio; }) : []);
+				ctx.stroke();
+			}
+		}
+	},
+
+	// feature under the point, top most first
+	_hit: function (latlng) {
+		var map = this._map;
+		var z = this._tileZoom;
+		if (z == null) return null;
+		var size = this.getTileSize();
+		var pt = map.project(latlng, z);
+		var coords = L.point(Math.floor(pt.x / size.x), Math.floor(pt.y / size.y));
+		coords.z = z;
+		var t = this._tiles[this._tileCoordsToKey(coords)];
+		if (!t || !t.el._mvt) return null;
+		var px = [pt.x - coords.x * size.x, pt.y - coords.y * size.y];
+		var o = this.options;
+
+		for (var i = t.el._mvt.length - 1; i >= 0; i--) {
+			var ly = t.el._mvt[i];
+			var s = ly.extent / size.x;
+			var p = [px[0] * s, px[1] * s];
+			var tol = Math.max(o.radius, o.weight, 4) * s;
+			for (var j = ly.feats.length - 1; j >= 0; j--) {
+				var ft = ly.feats[j];
+				var hit = false;
+				if (ft.type == 3) { // even-odd over all ring
+					for (var k = 0; k < ft.parts.length; k++) {
+						if (inRing(p, ft.parts[k])) hit = !hit;
+					}
+				}
+				for (var k = 0; k < ft.parts.length && !hit && ft.type != 3; k++) {
+					var part = ft.parts[k];
+					for (var m = 0; m < part.length && !hit; m++) {
+						var b = part[(ft.type == 1) ? m : Math.min(m + 1, part.length - 1)];
+						if (segDist2(p, part[m], b) <= tol * tol) hit = true;
+					}
+				}
+				if (hit) return ft;
+			}
+		}
+		return null;
+	},
+
+	_click: function (e) {
+		if (!this.options.popup) return;
+		var ft = this._hit(e.latlng);
+		if (!ft) return;
+		L.popup({autoPan: false, maxHeight: 300}).setLatLng(e.latlng).setContent(this.options.popup(ft.properties, ft)).openOn(this._map);
+	},
+});
+
+L.mvtLayer = function (url, options) {
+	return new L.MVTLayer(url, options);
+};
+
+L.MVTLayer.decode = decodeTile;
+
+})();